@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"github.com/akamensky/argparse"
+	"github.com/bhutch29/sclipi/internal/middleware"
 	"github.com/bhutch29/sclipi/internal/utils"
 	"github.com/c-bata/go-prompt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
@@ -24,6 +27,9 @@ type arguments struct {
 	Quiet             *bool
 	Simulate          *bool
 	Version           *bool
+	Events            *bool
+	StatusModel       utils.StatusModel
+	Options           utils.InstrumentOptions
 	TextColor         prompt.Color
 	PromptColor       prompt.Color
 	PreviewColor      prompt.Color
@@ -38,12 +44,13 @@ func parseArgs() arguments {
 	parser := argparse.NewParser("Sclipi",
 		`A SCPI cli!
 Features an autocomplete-enabled interactive shell for sending SCPI commands.
-Arguments allow sending single commands or scripts from files non-interactively.`)
+Arguments allow sending single commands or scripts from files non-interactively.
+sclipi sim-learn <transcript> learns a simulator profile from a recorded session, see sclipi sim-learn -h.`)
 	args.Address = parser.String("a", "address", &argparse.Options{
-		Help: "The network address of the instrument. If not provided, Sclipi will use your network information and auto-completion to assist you"})
+		Help: "The VISA resource string of the instrument, e.g. TCPIP0::host::5025::SOCKET, TCPIP0::host::inst0::INSTR, TCPIP0::host::hislip0::INSTR, ASRL/dev/ttyUSB0::INSTR or SIM::SCPI.txt. A bare hostname or IP address connects to its SCPI socket. If not provided, Sclipi will use your network information and auto-completion to assist you"})
 	args.Port = parser.String("p", "port", &argparse.Options{
 		Default: "5025",
-		Help:    "The SCPI port of the instrument"})
+		Help:    "The SCPI socket port, used when the address is a bare hostname or IP address"})
 	args.Timeout = parser.Int("t", "timeout", &argparse.Options{
 		Default: 10,
 		Help: "Time in seconds to wait for SCPI commands or initial connection to complete"})
@@ -51,6 +58,65 @@ Arguments allow sending single commands or scripts from files non-interactively.
 		Help: "A single SCPI command to send non-interactively. Must set address if using this feature"})
 	args.ScriptFile = parser.String("f", "file", &argparse.Options{
 		Help: "The path to a newline-delimited list of commands to be run non-interactively. Must set address if using this feature"})
+	baudFlag := parser.Int("", "baud", &argparse.Options{
+		Default: 9600,
+		Help:    "Serial baud rate, used with ASRL resources"})
+	dataBitsFlag := parser.Int("", "data-bits", &argparse.Options{
+		Default: 8,
+		Help:    "Serial data bits (5-8), used with ASRL resources"})
+	parityFlag := parser.Selector("", "parity", []string{"none", "odd", "even", "mark", "space"}, &argparse.Options{
+		Default: "none",
+		Help:    "Serial parity, used with ASRL resources"})
+	stopBitsFlag := parser.Int("", "stop-bits", &argparse.Options{
+		Default: 1,
+		Help:    "Serial stop bits (1 or 2), used with ASRL resources"})
+	flowControlFlag := parser.Selector("", "flow-control", []string{"none", "xonxoff", "rtscts"}, &argparse.Options{
+		Default: "none",
+		Help:    "Serial flow control, used with ASRL resources"})
+	writeTerminationFlag := parser.Selector("", "write-termination", []string{"LF", "CR", "CRLF", "NONE"}, &argparse.Options{
+		Help: "Characters appended to each command (default LF). NONE relies on the END signal of VXI-11 and HiSLIP"})
+	readTerminationFlag := parser.Selector("", "read-termination", []string{"LF", "CR", "CRLF", "NONE"}, &argparse.Options{
+		Help: "Characters marking the end of each response (default LF). NONE relies on the END signal of VXI-11 and HiSLIP"})
+	maxResponseSizeFlag := parser.Int("", "max-response-size", &argparse.Options{
+		Help: fmt.Sprintf("Largest response in bytes accepted from the instrument (default %d)", utils.DefaultMaxResponseSize)})
+	profileFlag := parser.String("", "profile", &argparse.Options{
+		Help: "JSON instrument profile with writeTermination, readTermination and maxResponseSize settings. Arguments override it"})
+	errorQueryFlag := parser.String("", "error-query", &argparse.Options{
+		Default: "SYST:ERR?",
+		Help:    "Query used to read the instrument's error queue after each command, e.g. :SYST:ERR:NEXT? or SYST:ERR:ALL?"})
+	maxErrorsFlag := parser.Int("", "max-errors", &argparse.Options{
+		Default: utils.DefaultMaxErrors,
+		Help:    "Maximum number of error queue entries read after each command"})
+	syncFlag := parser.Selector("", "sync", []string{"none", "opc", "esr", "oper"}, &argparse.Options{
+		Default: "none",
+		Help:    "Wait for each command to complete by appending *OPC? (opc), polling *ESR? (esr) or polling :STAT:OPER:COND? (oper)"})
+	syncTimeoutFlag := parser.Int("", "sync-timeout", &argparse.Options{
+		Default: int(utils.DefaultSyncTimeout / time.Second),
+		Help:    "Time in seconds to wait for a command to complete when --sync is set"})
+	statusModelFlag := parser.String("", "status-model", &argparse.Options{
+		Help: "JSON file describing the instrument's status registers for -status, replacing or extending the standard ones"})
+	traceFlag := parser.Flag("", "trace-io", &argparse.Options{
+		Help: "Log every call on the instrument with the data sent and received to stderr"})
+	metricsFlag := parser.Flag("", "metrics", &argparse.Options{
+		Help: "Print call counts and latencies to stderr on exit"})
+	rateLimitFlag := parser.Float("", "rate-limit", &argparse.Options{
+		Default: 0.0,
+		Help:    "Most calls started on the instrument per second, 0 for no limit"})
+	rateBurstFlag := parser.Int("", "rate-burst", &argparse.Options{
+		Default: 1,
+		Help:    "Calls allowed at once on an idle instrument before --rate-limit applies"})
+	faultDropAfterFlag := parser.Int("", "fault-drop-after", &argparse.Options{
+		Help: "Testing: drop the connection after this many calls"})
+	faultDelayFlag := parser.Int("", "fault-delay", &argparse.Options{
+		Help: "Testing: delay every call on the instrument by this many milliseconds"})
+	faultCorruptEveryFlag := parser.Int("", "fault-corrupt-every", &argparse.Options{
+		Help: "Testing: corrupt every nth query response"})
+	recordFlag := parser.String("", "record", &argparse.Options{
+		Help: "Record every command, query and response to this file, to be replayed with --replay"})
+	replayFlag := parser.String("", "replay", &argparse.Options{
+		Help: "Answer from a session recorded with --record instead of an instrument, failing when a different command is sent. Same as -a REPLAY::<file>"})
+	replayTimingFlag := parser.Flag("", "replay-timing", &argparse.Options{
+		Help: "Make --replay take as long to answer as the recorded instrument did"})
 	args.Delay = parser.Int("d", "delay", &argparse.Options{
 		Default: 0,
 		Help:    "Delay in milliseconds between each command when running from a file"})
@@ -58,6 +124,8 @@ Arguments allow sending single commands or scripts from files non-interactively.
 		Help: "Suppresses unnecessary output"})
 	args.Simulate = parser.Flag("s", "simulate", &argparse.Options{
 		Help: "Runs in simulated mode. Requires SCPI.txt file in working directory"})
+	args.Events = parser.Flag("", "events", &argparse.Options{
+		Help: "Print service requests and status byte changes while the shell is idle. Raw sockets poll *STB? to detect them"})
 	args.Version = parser.Flag("", "version", &argparse.Options{
 		Help: "Print version information"})
 	textColorFlag := parser.Selector("", "text-color", colors, &argparse.Options{
@@ -96,23 +164,93 @@ Arguments allow sending single commands or scripts from files non-interactively.
 	args.SelectedBgColor = colorFromString(*selectedBgColorFlag)
 	args.PreviewColor = colorFromString(*previewColorFlag)
 
+	parity, _ := utils.ParseParity(*parityFlag)
+	flowControl, _ := utils.ParseFlowControl(*flowControlFlag)
+	syncMode, _ := utils.ParseSyncMode(*syncFlag)
+
+	var profile utils.InstrumentProfile
+	if *profileFlag != "" {
+		var err error
+		if profile, err = utils.LoadInstrumentProfile(*profileFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *writeTerminationFlag != "" {
+		profile.WriteTermination = *writeTerminationFlag
+	}
+	if *readTerminationFlag != "" {
+		profile.ReadTermination = *readTerminationFlag
+	}
+	if *maxResponseSizeFlag != 0 {
+		profile.MaxResponseSize = *maxResponseSizeFlag
+	}
+	framing, err := profile.Framing()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	args.Options = utils.InstrumentOptions{
+		Timeout:     time.Duration(*args.Timeout) * time.Second,
+		Interactive: true,
+		Serial:      utils.SerialConfig{BaudRate: *baudFlag, DataBits: *dataBitsFlag, Parity: parity, StopBits: *stopBitsFlag, FlowControl: flowControl},
+		Framing:     framing,
+		ErrorQueue:  utils.ErrorQueueOptions{Query: *errorQueryFlag, MaxErrors: *maxErrorsFlag},
+		Sync:        utils.SyncOptions{Mode: syncMode, Timeout: time.Duration(*syncTimeoutFlag) * time.Second},
+	}
+
+	ioMiddleware = middleware.Config{
+		RateLimit: *rateLimitFlag,
+		RateBurst: *rateBurstFlag,
+		Faults: middleware.Faults{
+			DropAfter:    *faultDropAfterFlag,
+			Delay:        time.Duration(*faultDelayFlag) * time.Millisecond,
+			CorruptEvery: *faultCorruptEveryFlag,
+		},
+	}
+	if *traceFlag {
+		ioMiddleware.Trace = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	}
+	if *recordFlag != "" {
+		ioMiddleware.Record = func(string) (io.WriteCloser, error) { return os.Create(*recordFlag) }
+	}
+	if *metricsFlag {
+		ioMiddleware.Metrics = middleware.NewMetrics()
+	}
+	args.Options.ReplayTiming = *replayTimingFlag
+	if *replayFlag != "" {
+		*args.Address = "REPLAY::" + *replayFlag
+	}
+
+	args.StatusModel = utils.DefaultStatusModel()
+	if *statusModelFlag != "" {
+		model, err := utils.LoadStatusModel(*statusModelFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args.StatusModel = model
+	}
+
 	if *args.Version {
 		fmt.Println(version)
 		os.Exit(0)
 	}
 
 	if *args.Command != "" {
-		runCommand(*args.Command, *args.Address, *args.Port, time.Duration(*args.Timeout) * time.Second)
-		os.Exit(0)
+		exit(runCommand(*args.Command, *args.Address, *args.Port, args.Options))
 	}
 
 	if *args.ScriptFile != "" {
-		runScriptFile(*args.ScriptFile, *args.Address, *args.Port, time.Duration(*args.Timeout)*time.Second, time.Duration(*args.Delay)*time.Millisecond)
-		os.Exit(0)
+		exit(runScriptFile(*args.ScriptFile, *args.Address, *args.Port, args.Options, time.Duration(*args.Delay)*time.Millisecond))
 	}
 
-	attemptingSim := *args.Address == "simulated" || *args.Simulate
-	if attemptingSim && !utils.SimFileExists() {
+	if *args.Simulate && !utils.SimFileExists() {
+		log.Fatal("Error: Simulated instrument requires SCPI.txt file in working directory")
+	}
+	if resource, err := utils.ParseResource(*args.Address); err == nil && resource.Kind == utils.ResourceSim {
+		if _, err := os.Stat(resource.Profile); err != nil {
+			log.Fatalf("Error: Simulated instrument requires %s file", resource.Profile)
+		}
+	} else if *args.Address == "simulated" && !utils.SimFileExists() {
 		log.Fatal("Error: Simulated instrument requires SCPI.txt file in working directory")
 	}
 
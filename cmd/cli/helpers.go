@@ -1,40 +1,96 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/bhutch29/sclipi/internal/middleware"
+	"github.com/bhutch29/sclipi/internal/utils"
 	"log"
+	"os"
+	"os/signal"
 	"time"
 )
 
-func runCommand(command string, ip string, port string, timeout time.Duration) {
+// Exit codes of the non-interactive modes, so automation can tell a slow instrument from a dead one
+const (
+	exitOk              = 0
+	exitFailure         = 1
+	exitTimeout         = 2
+	exitConnectionLost  = 3
+	exitProtocolError   = 4
+	exitInstrumentError = 5
+	exitLocked          = 6
+	exitInterrupted     = 130
+)
+
+// Wraps the connection to the instrument as selected by the diagnostic arguments, such as --trace-io
+var ioMiddleware middleware.Config
+
+// Prints the metrics, if collected, and exits with code
+func exit(code int) {
+	printMetrics()
+	os.Exit(code)
+}
+
+func printMetrics() {
+	if ioMiddleware.Metrics != nil {
+		ioMiddleware.Metrics.WriteSummary(os.Stderr)
+	}
+}
+
+func exitCode(err error) int {
+	switch utils.KindOf(err) {
+	case utils.ErrorKindNone:
+		return exitOk
+	case utils.ErrorKindTimeout:
+		return exitTimeout
+	case utils.ErrorKindConnection:
+		return exitConnectionLost
+	case utils.ErrorKindProtocol:
+		return exitProtocolError
+	case utils.ErrorKindInstrument:
+		return exitInstrumentError
+	case utils.ErrorKindLocked:
+		return exitLocked
+	case utils.ErrorKindCanceled:
+		return exitInterrupted
+	}
+	return exitFailure
+}
+
+func runCommand(command string, ip string, port string, opts utils.InstrumentOptions) int {
 	if ip == "" {
 		log.Fatal("Error: Address flag must be set when using Command flag")
 	}
-	inst, err := buildAndConnectInstrument(ip, port, timeout, &progress{})
+	inst, err := buildAndConnectInstrument(ip, port, opts, &progress{})
 	if err != nil {
 		fmt.Println()
 		fmt.Println(err)
-		log.Fatal()
+		return exitCode(err)
 	}
 	defer inst.Close()
 
-	sm := newScpiManager(inst)
-	sm.handleScpi(command)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	sm := newScpiManager(inst, opts)
+	return exitCode(sm.handleScpi(ctx, command))
 }
 
-func runScriptFile(file string, ip string, port string, timeout time.Duration, delay time.Duration) {
+func runScriptFile(file string, ip string, port string, opts utils.InstrumentOptions, delay time.Duration) int {
 	if ip == "" {
 		log.Fatal("Error: Address flag must be set when using File flag")
 	}
-	inst, err := buildAndConnectInstrument(ip, port, timeout, &progress{})
+	inst, err := buildAndConnectInstrument(ip, port, opts, &progress{})
 	if err != nil {
 		fmt.Println()
 		fmt.Println(err)
-		log.Fatal()
+		return exitCode(err)
 	}
 	defer inst.Close()
 
-	sm := newScpiManager(inst)
-	sm.runScript(file, delay)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	sm := newScpiManager(inst, opts)
+	return exitCode(sm.runScript(ctx, file, delay))
 }
 
@@ -25,7 +25,7 @@ func (ip *ipCompleter) completer(d prompt.Document) []prompt.Suggest {
 
 	var o []prompt.Suggest
 	if ip.simSupported {
-		o = []prompt.Suggest{{Text: "simulated", Description: "Simulate SCPI instrument using SCPI.txt file in Sclipi directory"}}
+		o = []prompt.Suggest{{Text: "SIM", Description: "Simulate SCPI instrument using SCPI.txt file in Sclipi directory"}}
 	}
 	o = append(o, []prompt.Suggest{{Text: "localhost", Description: "Connect to local machine"}, {Text: "?", Description: "Help"}}...)
 	otherSuggests := prompt.FilterHasPrefix(o, d.GetWordBeforeCursor(), false)
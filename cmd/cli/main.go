@@ -5,38 +5,47 @@ import (
 	"github.com/bhutch29/sclipi/internal/utils"
 	"github.com/c-bata/go-prompt"
 	"github.com/schollz/progressbar"
-	"time"
 	"os"
+	"time"
+	"strconv"
 )
 
 var version = "undefined"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sim-learn" {
+		os.Exit(runSimLearn(os.Args[1:]))
+	}
 	args := parseArgs()
 	commonPromptOptions := getPromptOptions(args)
 
 	printIntroText(*args.Quiet)
 	defer fmt.Println("Goodbye!")
+	defer printMetrics()
 	address := getAddress(args, commonPromptOptions)
 
 	bar := progress{Silent: *args.Quiet}
 	bar.forward(0)
 
-	inst, err := buildAndConnectInstrument(address, *args.Port, time.Duration(*args.Timeout) * time.Second, &bar)
+	inst, err := buildAndConnectInstrument(address, *args.Port, args.Options, &bar)
 	if err != nil {
 		fmt.Println()
 		fmt.Println(err.Error())
-		os.Exit(1)
+		exit(exitCode(err))
 	}
 	defer inst.Close()
 
 	bar.forward(30)
-	sm := newScpiManager(inst)
+	sm := newScpiManager(inst, args.Options)
+	sm.status = args.StatusModel
 	bar.forward(30)
 
 	if !*args.Quiet {
 		bar.clear()
 	}
+	if *args.Events {
+		sm.startEvents()
+	}
 
 	history, _ := utils.GetHistoryFromFile()
 
@@ -93,6 +102,9 @@ Just because a completion doesn't appear doesn't mean your command won't work! S
 Sclipi tracks the history of all commands you have ever sent.
 Up and Down arrow keys cycle through your command history.
 
+# Interrupting:
+Press Ctrl-C while a command or script is running to abandon it and return to the prompt.
+
 # Exiting:
 There are 3 ways to exit the application.
 1. Type 'quit' and hit Enter
@@ -103,7 +115,7 @@ There are 3 ways to exit the application.
 
 func getAddress(args arguments, commonOptions []prompt.Option) string {
 	if *args.Simulate {
-		return "simulated"
+		return "SIM"
 	}
 	if *args.Address != "" {
 		return *args.Address
@@ -125,19 +137,14 @@ func getAddress(args arguments, commonOptions []prompt.Option) string {
 	return result
 }
 
-func buildAndConnectInstrument(address string, port string, timeout time.Duration, bar *progress) (utils.Instrument, error) {
-	var inst utils.Instrument
-	if address == "simulated" {
-		inst = utils.NewSimInstrument(timeout, true)
-	} else {
-		inst = utils.NewScpiInstrument(timeout, true)
-	}
-
-	if err := inst.Connect(address+":"+port, bar.forward); err != nil {
-		return inst, err
+func buildAndConnectInstrument(address string, port string, opts utils.InstrumentOptions, bar *progress) (utils.Instrument, error) {
+	portNumber, _ := strconv.Atoi(port)
+	resource, err := utils.ResolveAddress(address, portNumber)
+	if err != nil {
+		return nil, err
 	}
-
-	return inst, nil
+	opts.Middleware = ioMiddleware.Middleware(resource.String())
+	return utils.OpenResource(resource, opts, bar.forward)
 }
 
 type progress struct {
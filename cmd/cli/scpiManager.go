@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/atotto/clipboard"
 	"github.com/bhutch29/sclipi/internal/utils"
@@ -9,21 +11,34 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 )
 
 type scpiManager struct {
-	inst      utils.Instrument
-	history   history
-	colonTree utils.ScpiNode
-	starTree  utils.ScpiNode
+	inst       utils.Instrument
+	history    history
+	colonTree  utils.ScpiNode
+	starTree   utils.ScpiNode
+	errorQueue utils.ErrorQueueOptions
+	sync       utils.SyncOptions
+	status     utils.StatusModel
+	// Held while the executor runs, so status events are printed only while the prompt is idle
+	busy       *sync.Mutex
+	stopEvents context.CancelFunc
 }
 
-func newScpiManager(i utils.Instrument) scpiManager {
+func newScpiManager(i utils.Instrument, opts utils.InstrumentOptions) scpiManager {
 	sm := scpiManager{}
 	sm.inst = i
+	sm.errorQueue = opts.ErrorQueue
+	sm.sync = opts.Sync
+	sm.status = utils.DefaultStatusModel()
+	sm.busy = &sync.Mutex{}
 	sm.getTree(i)
 	return sm
 }
@@ -34,14 +49,21 @@ func (sm *scpiManager) executor(s string) {
 		return
 	} else if s == "quit" || s == "exit" {
 		fmt.Println("Bye!")
-		os.Exit(0)
+		exit(0)
 	}
 
+	sm.busy.Lock()
+	defer sm.busy.Unlock()
+
+	// go-prompt restores the terminal while the executor runs, so Ctrl-C arrives as SIGINT and abandons the running command
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	switch string(s[0]) {
 	case ":", "*":
-		sm.handleScpi(s)
+		sm.handleScpi(ctx, s)
 	case "-":
-		sm.handleDashCommands(s)
+		sm.handleDashCommands(ctx, s)
 	case "$":
 		sm.handlePassThrough(s)
 	case "?":
@@ -62,7 +84,7 @@ func (sm *scpiManager) handlePassThrough(s string) {
 	}
 }
 
-func (sm *scpiManager) handleDashCommands(s string) {
+func (sm *scpiManager) handleDashCommands(ctx context.Context, s string) {
 	if s == "-history" {
 		sm.printCommandHistory()
 	} else if s == "-copy" {
@@ -71,19 +93,147 @@ func (sm *scpiManager) handleDashCommands(s string) {
 		sm.copyAllToClipboard()
 	} else if strings.HasPrefix(s, "-save_script") {
 		sm.saveCommandsToFile(strings.TrimPrefix(s, "-save_script"))
+	} else if strings.HasPrefix(s, "-save_session") {
+		sm.saveSessionToFile(strings.TrimPrefix(s, "-save_session"))
 	} else if strings.HasPrefix(s, "-run_script") {
-		sm.runScript(strings.TrimPrefix(s, "-run_script"), 0)
+		sm.runScript(ctx, strings.TrimPrefix(s, "-run_script"), 0)
 	} else if strings.HasPrefix(s, "-set_timeout") {
 		timeout, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(s, "-set_timeout")))
 		if err != nil {
 			fmt.Println("Supplied timeout must be an integer")
 		}
 		sm.inst.SetTimeout(time.Duration(timeout) * time.Second)
+	} else if strings.HasPrefix(s, "-events") {
+		switch strings.TrimSpace(strings.TrimPrefix(s, "-events")) {
+		case "on":
+			sm.startEvents()
+		case "off":
+			sm.stopEventsIfRunning()
+		default:
+			fmt.Println("Usage: -events on|off")
+		}
+	} else if s == "-status" {
+		sm.printStatus(ctx)
+	} else if strings.HasPrefix(s, "-set_status_enable") {
+		sm.setStatusEnable(ctx, strings.Fields(strings.TrimPrefix(s, "-set_status_enable")))
+	} else if strings.HasPrefix(s, "-set_sync") {
+		mode, err := utils.ParseSyncMode(strings.TrimSpace(strings.TrimPrefix(s, "-set_sync")))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		sm.sync.Mode = mode
+		fmt.Printf("Commands now wait for completion using: %s\n", mode)
 	} else {
 		fmt.Println(s + ": command not found")
 	}
 }
 
+// Prints each register of the status model as a table of its bits. Reading the event registers clears them.
+func (sm *scpiManager) printStatus(ctx context.Context) {
+	statuses, err := utils.ReadStatus(ctx, sm.inst, sm.status)
+	for _, status := range statuses {
+		printRegisterStatus(status, "")
+	}
+	if err != nil {
+		fmt.Printf("Failed to read status registers: %s\n", err)
+	}
+}
+
+func printRegisterStatus(status utils.RegisterStatus, indent string) {
+	header := indent + status.Name
+	for _, value := range []struct {
+		name  string
+		value *int
+	}{{"condition", status.Condition}, {"event", status.Event}, {"enable", status.Enable}} {
+		if value.value != nil {
+			header += fmt.Sprintf(", %s %d (0x%X)", value.name, *value.value, *value.value)
+		}
+	}
+	fmt.Println(header)
+
+	mark := func(value *int, set bool) string {
+		if value == nil {
+			return ""
+		} else if set {
+			return "x"
+		}
+		return "."
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s  BIT\tNAME\tCOND\tEVENT\tENABLE\tDESCRIPTION\n", indent)
+	for _, flag := range status.Flags {
+		fmt.Fprintf(w, "%s  %d\t%s\t%s\t%s\t%s\t%s\n", indent, flag.Bit, flag.Name,
+			mark(status.Condition, flag.Condition), mark(status.Event, flag.Event), mark(status.Enable, flag.Enabled), flag.Description)
+	}
+	w.Flush()
+
+	for _, child := range status.Children {
+		printRegisterStatus(child, indent+"  ")
+	}
+}
+
+func (sm *scpiManager) setStatusEnable(ctx context.Context, fields []string) {
+	if len(fields) != 2 {
+		fmt.Println("Usage: -set_status_enable <register> <mask>")
+		return
+	}
+	reg, ok := sm.status.Find(fields[0])
+	if !ok {
+		fmt.Printf("Unknown status register '%s'\n", fields[0])
+		return
+	}
+	mask, err := strconv.ParseInt(fields[1], 0, 32)
+	if err != nil {
+		fmt.Println("Supplied mask must be an integer, e.g. 32 or 0x20")
+		return
+	}
+	if err := utils.SetStatusEnable(ctx, sm.inst, reg, int(mask)); err != nil {
+		fmt.Printf("Failed to set enable mask: %s\n", err)
+		return
+	}
+	fmt.Printf("%s enable mask set to %d (%s)\n", reg.Name, mask, strings.Join(reg.Decode(int(mask)), " "))
+}
+
+// Prints status events in the background. Polling and printing wait for the executor, so they never interrupt a command.
+func (sm *scpiManager) startEvents() {
+	if sm.stopEvents != nil {
+		fmt.Println("Already printing status events")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := utils.SubscribeEvents(ctx, sm.inst, utils.EventOptions{Guard: sm.busy})
+	if err != nil {
+		cancel()
+		fmt.Printf("Failed to subscribe to status events: %s\n", err)
+		return
+	}
+	sm.stopEvents = cancel
+	fmt.Println("Printing status events")
+
+	go func() {
+		for event := range events {
+			sm.busy.Lock()
+			if event.ServiceRequest {
+				fmt.Printf("\nService request, status byte: %d (0x%02X)\n", event.StatusByte, event.StatusByte)
+			} else {
+				fmt.Printf("\nStatus byte: %d (0x%02X)\n", event.StatusByte, event.StatusByte)
+			}
+			sm.busy.Unlock()
+		}
+	}()
+}
+
+func (sm *scpiManager) stopEventsIfRunning() {
+	if sm.stopEvents == nil {
+		fmt.Println("Not printing status events")
+		return
+	}
+	sm.stopEvents()
+	sm.stopEvents = nil
+	fmt.Println("Stopped printing status events")
+}
+
 func (sm *scpiManager) saveCommandsToFile(fileName string) {
 	file := strings.TrimSpace(fileName)
 	if file == "" {
@@ -99,6 +249,22 @@ func (sm *scpiManager) saveCommandsToFile(fileName string) {
 	}
 }
 
+// Saves the commands and responses of the session, which sclipi sim-learn turns into a simulator profile
+func (sm *scpiManager) saveSessionToFile(fileName string) {
+	file := strings.TrimSpace(fileName)
+	if file == "" {
+		file = "ScpiSession.log"
+	}
+	session := sm.history.String()
+	if len(session) < 1 {
+		fmt.Println("You have not run any commands this session")
+		return
+	}
+	if err := ioutil.WriteFile(file, []byte(session), 0644); err != nil {
+		fmt.Println(err)
+	}
+}
+
 func (sm *scpiManager) copyPreviousToClipboard() {
 	if err := clipboard.WriteAll(sm.history.latestResponse()); err != nil {
 		fmt.Println("Copy to clipboard failed: " + err.Error())
@@ -115,39 +281,45 @@ func (sm *scpiManager) printCommandHistory() {
 	fmt.Print(sm.history.CommandsString())
 }
 
-func (sm *scpiManager) handleScpi(s string) {
-	if strings.Contains(s, "?") {
-		r, err := sm.inst.Query(s)
-		if err != nil {
-			fmt.Println(err)
-			sm.history.addResponse(err.Error())
-		}
-		fmt.Print(r)
-		sm.history.addCommand(s)
-		sm.history.addResponse(r)
+// Sends the program message s one unit at a time, printing each response and the errors each unit caused. Returns the first failure, for the exit code of non-interactive runs.
+func (sm *scpiManager) handleScpi(ctx context.Context, s string) error {
+	msg, err := utils.ParseProgramMessage(s)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+	sm.history.addCommand(s)
 
-		errors, err := sm.inst.QueryError([]string{})
-		if err != nil {
-			fmt.Printf("failed to query errors: %s\n", err)
-		}
-		for _, error := range errors {
-			fmt.Println("Error: " + error)
+	opts := utils.ProgramOptions{CheckErrors: true, ErrorQueue: sm.errorQueue, Sync: sm.sync}
+	results, err := utils.ExecuteProgramMessage(ctx, sm.inst, msg, opts)
+	for _, result := range results {
+		if result.Query {
+			fmt.Print(result.Response)
+			sm.history.addResponse(result.Response)
 		}
-	} else {
-		err := sm.inst.Command(s)
-		if err != nil {
-			fmt.Println(err)
+		for _, e := range result.Errors {
+			var attribution string
+			if len(msg.Units) > 1 {
+				attribution = fmt.Sprintf(" [%s]", result.Text)
+			}
+			if e.Info != "" {
+				fmt.Printf("Error %d: %s (%s)%s\n", e.Code, e.Message, e.Info, attribution)
+			} else {
+				fmt.Printf("Error %d: %s%s\n", e.Code, e.Message, attribution)
+			}
 		}
-		sm.history.addCommand(s)
+	}
 
-		errors, err := sm.inst.QueryError([]string{})
-		if err != nil {
-			fmt.Printf("failed to query errors: %s\n", err)
-		}
-		for _, error := range errors {
-			fmt.Println("Error: " + error)
-		}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		fmt.Println("Interrupted")
+		return ctx.Err()
+	}
+	if err != nil {
+		fmt.Println(err)
+		sm.history.addResponse(err.Error() + "\n")
+		return err
 	}
+	return utils.FirstInstrumentError(results)
 }
 
 func (sm *scpiManager) completer(d prompt.Document) []prompt.Suggest {
@@ -179,8 +351,13 @@ func (sm *scpiManager) completer(d prompt.Document) []prompt.Suggest {
 		suggests := []prompt.Suggest{
 			{Text: "-history", Description: "Show all commands sent this session"},
 			{Text: "-save_script", Description: "Save command history to provided filename. Default: ScpiCommands.txt"},
+			{Text: "-save_session", Description: "Save commands and responses to provided filename, for sclipi sim-learn. Default: ScpiSession.log"},
 			{Text: "-run_script", Description: "Run script from provided filename. Default: ScpiCommands.txt"},
 			{Text: "-set_timeout", Description: "Set timeout to provided number of seconds"},
+			{Text: "-events", Description: "Print service requests and status byte changes while idle: on or off"},
+			{Text: "-status", Description: "Read the status byte, standard event, operation and questionable registers and list their bits"},
+			{Text: "-set_status_enable", Description: "Program a register's enable mask, e.g. -set_status_enable esr 60. Registers: stb, esr, oper, ques or a name or path from the status model"},
+			{Text: "-set_sync", Description: "Wait for commands to complete using none, opc (*OPC?), esr (*ESR? polling) or oper (:STAT:OPER:COND? polling)"},
 			{Text: "-copy", Description: "Copy most recent SCPI response to clipboard"},
 			{Text: "-copy_all", Description: "Copy entire session to clipboard"},
 			{Text: "quit", Description: "Exit Sclipi"},
@@ -201,6 +378,11 @@ func (sm *scpiManager) getTree(i utils.Instrument) {
 			sm.colonTree = colonTree
 			sm.starTree = starTree
 		}
+		if d, ok := utils.As[utils.HeaderDiagnoser](i); ok {
+			for _, diagnostic := range d.HeaderDiagnostics() {
+				fmt.Printf("Warning: skipped SYST:HELP:HEAD? %s\n", diagnostic)
+			}
+		}
 	}
 }
 
@@ -274,7 +456,8 @@ func (sm *scpiManager) getNodeChildByContent(parent utils.ScpiNode, input string
 	return false, utils.ScpiNode{}
 }
 
-func (sm *scpiManager) runScript(file string, delay time.Duration) {
+// Runs each line of file, continuing past failures. Returns the first failure, or the interruption if it was stopped.
+func (sm *scpiManager) runScript(ctx context.Context, file string, delay time.Duration) error {
 	file = strings.TrimSpace(file)
 	if file == "" {
 		file = "ScpiCommands.txt"
@@ -286,12 +469,24 @@ func (sm *scpiManager) runScript(file string, delay time.Duration) {
 		} else {
 			fmt.Printf("Could not run script file with name '%s'. Check to make sure it exists\n", file)
 		}
+		return err
 	}
+	var result error
 	for i, line := range lines {
 		if i > 0 && delay > 0 {
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			fmt.Println("Script stopped")
+			return ctx.Err()
 		}
 		fmt.Println("> " + line)
-		sm.handleScpi(line)
+		if err := sm.handleScpi(ctx, line); err != nil && result == nil {
+			result = err
+		}
 	}
+	return result
 }
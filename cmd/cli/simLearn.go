@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/akamensky/argparse"
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Runs `sclipi sim-learn <transcript> -o <profile>`, writing the simulator profile learned from a transcript.
+// osArgs starts with sim-learn.
+func runSimLearn(osArgs []string) int {
+	parser := argparse.NewParser("sclipi sim-learn <transcript>",
+		"Learns a simulator profile, used with -a SIM::<profile>, from a session recorded with --record or saved with -save_session")
+	output := parser.String("o", "output", &argparse.Options{
+		Default: "profile.yaml",
+		Help:    "The profile to write, as JSON if it ends in .json and YAML otherwise"})
+	headers := parser.String("", "headers", &argparse.Options{
+		Help: "The SYST:HELP:HEAD? file of the instrument, so every spelling of a header is learned as one"})
+	timing := parser.Flag("", "timing", &argparse.Options{
+		Help: "Learn how long the queries of a recorded session took as their delays"})
+
+	// The transcript comes first, as argparse names positional arguments after their index in its help
+	var transcript string
+	args := osArgs
+	if len(osArgs) > 1 && !strings.HasPrefix(osArgs[1], "-") {
+		transcript = osArgs[1]
+		args = append(osArgs[:1:1], osArgs[2:]...)
+	}
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		return exitFailure
+	}
+	if transcript == "" {
+		fmt.Print(parser.Usage("a transcript is required"))
+		return exitFailure
+	}
+
+	file, err := os.Open(transcript)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	defer file.Close()
+	profile, err := utils.LearnSimProfile(file, utils.SimLearnOptions{Headers: *headers, Timing: *timing, Profile: *output})
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+
+	format := "yaml"
+	if strings.EqualFold(filepath.Ext(*output), ".json") {
+		format = "json"
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	defer out.Close()
+	if err := profile.Encode(out, format); err != nil {
+		fmt.Println(err)
+		return exitFailure
+	}
+	fmt.Printf("Learned %d headers into %s\n", len(profile.Commands), *output)
+	return exitOk
+}
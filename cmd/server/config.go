@@ -2,9 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/bhutch29/sclipi/internal/middleware"
+	"github.com/bhutch29/sclipi/internal/utils"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -15,6 +23,21 @@ type Config struct {
 	DefaultScpiSocketAddress string
 	PreferencesFilePath      string
   ConnectionMode           string
+	StatusModelFilePath      string
+	// Profiles are the instrument profiles that requests select with the profile parameter, keyed by lowercase name
+	Profiles map[string]utils.InstrumentProfile
+	// SimProfiles are the simulator profiles that simulated requests select with the simProfile parameter, mapping
+	// lowercase names to the path of a utils.SimProfile or :SYST:HELP:HEAD? file
+	SimProfiles map[string]string
+	// KeepAlive is the TCP keepalive period of instrument connections, see utils.InstrumentOptions
+	KeepAlive        time.Duration
+	ConnectionPolicy connectionPolicy
+	// Cached connections unused for CacheIdleTimeout are closed, zero keeps them open
+	CacheIdleTimeout time.Duration
+	// CacheMaxEntries bounds the cached connections, closing the least recently used first. Zero is unbounded.
+	CacheMaxEntries int
+	// Middleware wraps instrument connections to trace their I/O, collect metrics, limit their rate or inject faults
+	Middleware middleware.Config
 }
 
 func loadConfig() (*Config, error) {
@@ -23,6 +46,23 @@ func loadConfig() (*Config, error) {
 	pflag.String("scpi-address", "localhost", "Default SCPI socket address")
 	pflag.String("preferences-file", "$HOME/.scpir/preferences.json", "Preferences file path")
 	pflag.String("connection-mode", "per-client", "Connection mode (per-client or server-default)")
+	pflag.String("status-model", "", "JSON file describing the instrument status registers served by /status")
+	pflag.Duration("keepalive", 15*time.Second, "Idle time before TCP keepalive probes on instrument connections, 0 or less disables them")
+	pflag.Duration("heartbeat-interval", 0, "Check idle instrument connections this often, 0 disables the heartbeat")
+	pflag.String("heartbeat-query", defaultConnectionPolicy.HeartbeatQuery, "Query sent by the heartbeat")
+	pflag.Duration("reconnect-min-backoff", defaultConnectionPolicy.MinBackoff, "Wait before the first retry of a failed connection")
+	pflag.Duration("reconnect-max-backoff", defaultConnectionPolicy.MaxBackoff, "Longest wait between retries of a failed connection")
+	pflag.Int("reconnect-max-attempts", defaultConnectionPolicy.MaxAttempts, "Retries of a lost connection before it is down, 0 retries forever")
+	pflag.Duration("cache-idle-timeout", 10*time.Minute, "Close instrument connections unused for this long, 0 keeps them open")
+	pflag.Int("cache-max-entries", 32, "Most instrument connections kept open, closing the least recently used first, 0 for no limit")
+	pflag.Bool("trace-io", false, "Log every call on an instrument with the data sent and received")
+	pflag.Bool("metrics", false, "Collect call counts and latencies of each instrument, served by /metrics")
+	pflag.Float64("rate-limit", 0, "Most calls started on each instrument per second, 0 for no limit")
+	pflag.Int("rate-burst", 1, "Calls allowed at once on an idle instrument before rate-limit applies")
+	pflag.Int("fault-drop-after", 0, "Testing: drop each instrument connection after this many calls, 0 never drops")
+	pflag.Duration("fault-delay", 0, "Testing: delay every call on an instrument this long")
+	pflag.Int("fault-corrupt-every", 0, "Testing: corrupt every nth query response, 0 never corrupts")
+	pflag.String("record-dir", "", "Record the session of every instrument connection to a file in this directory, to be replayed with a REPLAY::<file> address")
 	pflag.Parse()
 
 	viper.BindPFlags(pflag.CommandLine)
@@ -64,9 +104,99 @@ func loadConfig() (*Config, error) {
 		DefaultScpiSocketAddress: defaultAddress,
 		PreferencesFilePath:      os.ExpandEnv(viper.GetString("preferences-file")),
 		ConnectionMode:           connectionMode,
+		StatusModelFilePath:      os.ExpandEnv(viper.GetString("status-model")),
+		KeepAlive:                viper.GetDuration("keepalive"),
+		ConnectionPolicy: connectionPolicy{
+			HeartbeatInterval: viper.GetDuration("heartbeat-interval"),
+			HeartbeatQuery:    viper.GetString("heartbeat-query"),
+			MinBackoff:        viper.GetDuration("reconnect-min-backoff"),
+			MaxBackoff:        viper.GetDuration("reconnect-max-backoff"),
+			MaxAttempts:       viper.GetInt("reconnect-max-attempts"),
+		},
+		CacheIdleTimeout: viper.GetDuration("cache-idle-timeout"),
+		CacheMaxEntries:  viper.GetInt("cache-max-entries"),
+		Middleware: middleware.Config{
+			RateLimit: viper.GetFloat64("rate-limit"),
+			RateBurst: viper.GetInt("rate-burst"),
+			Faults: middleware.Faults{
+				DropAfter:    viper.GetInt("fault-drop-after"),
+				Delay:        viper.GetDuration("fault-delay"),
+				CorruptEvery: viper.GetInt("fault-corrupt-every"),
+			},
+		},
+	}
+	if viper.GetBool("trace-io") {
+		config.Middleware.Trace = slog.Default()
+	}
+	if dir := os.ExpandEnv(viper.GetString("record-dir")); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create record-dir: %w", err)
+		}
+		config.Middleware.Record = func(name string) (io.WriteCloser, error) {
+			return os.Create(filepath.Join(dir, sessionFileName(name, time.Now())))
+		}
+	}
+	if viper.GetBool("metrics") {
+		config.Middleware.Metrics = middleware.NewMetrics()
+	}
+	if config.Middleware.Faults.Enabled() {
+		log.Printf("Injecting instrument faults: %+v", config.Middleware.Faults)
+	}
+	if config.KeepAlive == 0 {
+		// The flag documents zero as disabled, which utils spells as a negative period
+		config.KeepAlive = -1
+	}
+	if policy := config.ConnectionPolicy; policy.MinBackoff <= 0 || policy.MaxBackoff < policy.MinBackoff {
+		return nil, fmt.Errorf("reconnect-min-backoff must be positive and no longer than reconnect-max-backoff")
+	}
+	if config.ConnectionPolicy.HeartbeatInterval > 0 && config.ConnectionPolicy.HeartbeatQuery == "" {
+		return nil, fmt.Errorf("heartbeat-query cannot be empty while the heartbeat is enabled")
+	}
+	if config.CacheIdleTimeout < 0 || config.CacheMaxEntries < 0 {
+		return nil, fmt.Errorf("cache-idle-timeout and cache-max-entries cannot be negative")
+	}
+	if config.Middleware.RateLimit < 0 {
+		return nil, fmt.Errorf("rate-limit cannot be negative")
+	}
+
+	if err := viper.UnmarshalKey("profiles", &config.Profiles); err != nil {
+		return nil, fmt.Errorf("invalid instrument profiles: %w", err)
+	}
+	for name, profile := range config.Profiles {
+		if _, err := profile.Framing(); err != nil {
+			return nil, fmt.Errorf("invalid instrument profile %s: %w", name, err)
+		}
+	}
+
+	if err := viper.UnmarshalKey("simProfiles", &config.SimProfiles); err != nil {
+		return nil, fmt.Errorf("invalid simulator profiles: %w", err)
+	}
+	for name, path := range config.SimProfiles {
+		path = os.ExpandEnv(path)
+		config.SimProfiles[name] = path
+		if err := checkSimProfile(path); err != nil {
+			return nil, fmt.Errorf("invalid simulator profile %s: %w", name, err)
+		}
 	}
 
 	log.Printf("Config: %+v", config)
 
 	return config, nil
 }
+
+// Checks that the simulator profile at path loads, or that the :SYST:HELP:HEAD? file exists
+func checkSimProfile(path string) error {
+	if utils.IsSimProfile(path) {
+		_, err := utils.LoadSimProfile(path)
+		return err
+	}
+	_, err := os.Stat(path)
+	return err
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Names the recording of the session with the instrument at resource started at start, e.g. TCPIP_dmm_5025_SOCKET-20240102-150405.000.jsonl
+func sessionFileName(resource string, start time.Time) string {
+	return fmt.Sprintf("%s-%s.jsonl", strings.Trim(unsafeFileNameChars.ReplaceAllString(resource, "_"), "_"), start.Format("20060102-150405.000"))
+}
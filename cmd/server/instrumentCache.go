@@ -1,77 +1,559 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
-	"strconv"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/bhutch29/sclipi/internal/middleware"
 	"github.com/bhutch29/sclipi/internal/utils"
 )
 
+// connectionState is what the cache knows about the connection to an instrument
+type connectionState string
+
+const (
+	// Never connected, or no longer cached
+	stateDisconnected connectionState = "disconnected"
+	stateConnected    connectionState = "connected"
+	// The connection was lost and is being restored in the background
+	stateReconnecting connectionState = "reconnecting"
+	// Connecting failed, or reconnecting gave up. The next request tries again once the backoff has passed.
+	stateDown connectionState = "down"
+)
+
+// connectionPolicy is how the cache keeps connections alive and restores lost ones
+type connectionPolicy struct {
+	// HeartbeatInterval is how often an idle connection is checked with HeartbeatQuery. Zero disables the heartbeat.
+	HeartbeatInterval time.Duration
+	HeartbeatQuery    string
+	// The wait before each reconnect attempt doubles from MinBackoff up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is how many times a lost connection is retried before it is down. Zero retries until it is back.
+	MaxAttempts int
+}
+
+var defaultConnectionPolicy = connectionPolicy{
+	HeartbeatQuery: "*OPC?",
+	MinBackoff:     time.Second,
+	MaxBackoff:     30 * time.Second,
+	MaxAttempts:    10,
+}
+
+// Returns the wait before the attempt following the given number of consecutive failures
+func (p connectionPolicy) backoff(failures int) time.Duration {
+	wait := p.MinBackoff
+	for range failures - 1 {
+		if wait >= p.MaxBackoff/2 {
+			return p.MaxBackoff
+		}
+		wait *= 2
+	}
+	return min(wait, p.MaxBackoff)
+}
+
+// connectionStatus is the state of the connection to one instrument, as served by /health and /isConnected
+type connectionStatus struct {
+	Resource  string          `json:"resource"`
+	Connected bool            `json:"connected"`
+	State     connectionState `json:"state"`
+	Since     time.Time       `json:"since,omitzero"`
+	LastError string          `json:"lastError,omitempty"`
+	// Failures is the number of consecutive failed connection attempts
+	Failures    int       `json:"failures,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt,omitzero"`
+}
+
+// cacheEntryInfo describes a cache entry for /dumpInstCache
+type cacheEntryInfo struct {
+	connectionStatus
+	// Owner is the client that opened the connection
+	Owner    string    `json:"owner,omitempty"`
+	LastUsed time.Time `json:"lastUsed,omitzero"`
+	// Holds counts the long running requests, such as event streams, keeping the connection from eviction
+	Holds int `json:"holds,omitempty"`
+}
+
+type cacheEntry struct {
+	resource  utils.Resource
+	opts      utils.InstrumentOptions
+	inst      utils.Instrument
+	state     connectionState
+	since     time.Time
+	lastError error
+	failures  int
+	retryAt   time.Time
+	lastUsed  time.Time
+	owner     string
+	holds     int
+	// Closed when the connection attempt in progress finishes, nil if there is none
+	connecting chan struct{}
+}
+
 type instrumentCache struct {
-	mu    sync.RWMutex
-	cache map[string]utils.Instrument
+	mu      sync.RWMutex
+	entries map[string]*cacheEntry
+	guards  map[string]*sync.Mutex
+	policy  connectionPolicy
+	// Connections taken out of the cache, closed by unlock once mu is released since closing can take a full timeout
+	closing []utils.Instrument
+	// Connections unused for idleTimeout are closed by sweep. Zero keeps them open.
+	idleTimeout time.Duration
+	// maxEntries bounds the cache, evicting the least recently used entry first. Zero is unbounded.
+	maxEntries int
+	// inUse reports instruments that must not be evicted even though idle, e.g. because a client holds their lock
+	inUse func(utils.Resource) bool
+	// middleware wraps each new connection, e.g. to trace its I/O
+	middleware middleware.Config
 }
 
 func newInstrumentCache() *instrumentCache {
 	return &instrumentCache{
-		cache: make(map[string]utils.Instrument),
+		entries: make(map[string]*cacheEntry),
+		guards:  make(map[string]*sync.Mutex),
+		policy:  defaultConnectionPolicy,
 	}
 }
 
-func (ic *instrumentCache) get(address string, port int, timeout time.Duration, progressFn func(int)) (utils.Instrument, error) {
-	fullAddress := address + ":" + strconv.Itoa(port)
+// Returns the mutex that serializes calls to the instrument at resource, so event polling does not interleave with requests
+func (ic *instrumentCache) guard(resource utils.Resource) *sync.Mutex {
+	key := resource.String()
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	guard, exists := ic.guards[key]
+	if !exists {
+		guard = &sync.Mutex{}
+		ic.guards[key] = guard
+	}
+	return guard
+}
+
+// Returns the cached connection to resource, connecting on behalf of owner if there is none. While the instrument is
+// reconnecting, or down and waiting out its backoff, it fails right away instead of trying to connect.
+func (ic *instrumentCache) get(resource utils.Resource, opts utils.InstrumentOptions, owner string, progressFn func(int)) (utils.Instrument, error) {
+	key := resource.String()
 
 	ic.mu.RLock()
-	inst, exists := ic.cache[fullAddress]
+	entry, exists := ic.entries[key]
+	if exists && entry.inst != nil {
+		inst := entry.inst
+		ic.mu.RUnlock()
+		ic.touch(key, inst)
+		return inst, nil
+	}
 	ic.mu.RUnlock()
 
-  if inst == nil {
-    ic.invalidate(address, port);
-  }
+	ic.mu.Lock()
+	defer ic.unlock()
 
-	if exists && inst != nil {
-		return inst, nil
+	for {
+		entry, exists = ic.entries[key]
+		if !exists {
+			entry = &cacheEntry{resource: resource, state: stateDisconnected}
+			ic.entries[key] = entry
+		}
+		// Failed attempts count as use too, so an address that never connects is evicted once clients stop trying it
+		entry.lastUsed = time.Now()
+		if entry.inst != nil {
+			return entry.inst, nil
+		}
+		connecting := entry.connecting
+		if connecting == nil {
+			break
+		}
+		// Another request is connecting, so its outcome is shared rather than dialing again
+		ic.mu.Unlock()
+		<-connecting
+		ic.mu.Lock()
+	}
+	if wait := time.Until(entry.retryAt); entry.state != stateDisconnected && wait > 0 {
+		return nil, fmt.Errorf("%w: instrument is %s, next attempt in %s: %v", utils.ErrConnectionClosed, entry.state, wait.Round(time.Second), entry.lastError)
+	}
+	entry.opts = opts
+	entry.owner = owner
+	err := ic.connect(entry, progressFn)
+	ic.evictOverflow(key)
+	if err != nil {
+		return nil, err
 	}
+	return entry.inst, nil
+}
 
+func (ic *instrumentCache) touch(key string, inst utils.Instrument) {
 	ic.mu.Lock()
 	defer ic.mu.Unlock()
+	if entry, exists := ic.entries[key]; exists && entry.inst == inst {
+		entry.lastUsed = time.Now()
+	}
+}
+
+// Connects entry and records the outcome. Must be called with mu held, which is released while dialing so that an
+// unreachable instrument does not hold up the rest of the cache. The entry is marked as connecting meanwhile.
+func (ic *instrumentCache) connect(entry *cacheEntry, progressFn func(int)) error {
+	key := entry.resource.String()
+	opts := entry.opts
+	opts.Middleware = ic.middleware.Middleware(key)
+	connecting := make(chan struct{})
+	entry.connecting = connecting
+	ic.mu.Unlock()
+	inst, err := connectInstrument(entry.resource, opts, progressFn)
+	ic.mu.Lock()
+	entry.connecting = nil
+	close(connecting)
 
-	inst, err := connectInstrument(address, port, timeout, progressFn)
+	if ic.entries[key] != entry {
+		// Evicted or disconnected while dialing
+		if inst != nil {
+			ic.closing = append(ic.closing, inst)
+		}
+		return fmt.Errorf("%w: connection to %s was removed while connecting", utils.ErrConnectionClosed, key)
+	}
 	if err != nil {
-		return nil, err
+		entry.failures++
+		entry.lastError = err
+		entry.retryAt = time.Now().Add(ic.policy.backoff(entry.failures))
+		if entry.state != stateReconnecting || (ic.policy.MaxAttempts > 0 && entry.failures >= ic.policy.MaxAttempts) {
+			ic.setState(entry, stateDown)
+		}
+		return err
+	}
+	entry.inst = inst
+	entry.failures = 0
+	entry.lastError = nil
+	entry.retryAt = time.Time{}
+	ic.setState(entry, stateConnected)
+	if ic.policy.HeartbeatInterval > 0 {
+		go ic.heartbeat(entry.resource, inst)
+	}
+	return nil
+}
+
+// Must be called with mu held
+func (ic *instrumentCache) setState(entry *cacheEntry, state connectionState) {
+	if entry.state != state {
+		log.Printf("Connection to %s is %s", entry.resource, state)
+		entry.state = state
+		entry.since = time.Now()
+	}
+}
+
+// Closes the cached connection to resource after it failed with err and starts restoring it in the background.
+// The first attempt is immediate, so a request that found the connection lost can retry right away.
+func (ic *instrumentCache) invalidate(resource utils.Resource, err error) {
+	ic.mu.RLock()
+	entry, exists := ic.entries[resource.String()]
+	var inst utils.Instrument
+	if exists {
+		inst = entry.inst
+	}
+	ic.mu.RUnlock()
+	if inst != nil {
+		ic.lost(resource, inst, err)
+	}
+}
+
+// Like invalidate, but only if inst is still the cached connection
+func (ic *instrumentCache) lost(resource utils.Resource, inst utils.Instrument, err error) {
+	key := resource.String()
+
+	ic.mu.Lock()
+	defer ic.unlock()
+
+	entry, exists := ic.entries[key]
+	if !exists || entry.inst != inst {
+		return
+	}
+	ic.closing = append(ic.closing, inst)
+	entry.inst = nil
+	entry.lastError = err
+	entry.failures = 0
+	entry.retryAt = time.Now()
+	ic.setState(entry, stateReconnecting)
+	log.Printf("Invalidated cached connection to %s: %v", key, err)
+	go ic.reconnect(key)
+}
+
+// Retries a lost connection with backoff until it is back, or down after policy.MaxAttempts
+func (ic *instrumentCache) reconnect(key string) {
+	for {
+		ic.mu.RLock()
+		entry, exists := ic.entries[key]
+		if !exists || entry.state != stateReconnecting {
+			ic.mu.RUnlock()
+			return
+		}
+		wait := time.Until(entry.retryAt)
+		ic.mu.RUnlock()
+		time.Sleep(wait)
+
+		ic.mu.Lock()
+		if ic.entries[key] != entry {
+			// Evicted or disconnected while waiting
+			ic.mu.Unlock()
+			return
+		}
+		if entry.state == stateReconnecting && entry.inst == nil && entry.connecting == nil && !time.Now().Before(entry.retryAt) {
+			_ = ic.connect(entry, nil)
+		}
+		ic.unlock()
+	}
+}
+
+// Checks the connection with policy.HeartbeatQuery whenever it has been idle for a heartbeat interval, so a lost
+// connection is found and restored before the next request needs it. Stops once inst is no longer the cached connection.
+func (ic *instrumentCache) heartbeat(resource utils.Resource, inst utils.Instrument) {
+	key := resource.String()
+	ticker := time.NewTicker(ic.policy.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ic.mu.RLock()
+		entry, exists := ic.entries[key]
+		current := exists && entry.inst == inst
+		var idle time.Duration
+		var timeout time.Duration
+		if current {
+			idle = time.Since(entry.lastUsed)
+			timeout = entry.opts.Timeout
+		}
+		ic.mu.RUnlock()
+		if !current {
+			return
+		}
+		if idle < ic.policy.HeartbeatInterval {
+			continue
+		}
+
+		// A request in progress shows the connection is in use, so the heartbeat waits for the next tick
+		guard := ic.guard(resource)
+		if !guard.TryLock() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := inst.QueryContext(ctx, ic.policy.HeartbeatQuery)
+		cancel()
+		guard.Unlock()
+		if errors.Is(err, utils.ErrConnectionClosed) {
+			ic.lost(resource, inst, err)
+			return
+		}
+	}
+}
+
+// Returns the cached connection to resource without connecting if there is none
+func (ic *instrumentCache) lookup(resource utils.Resource) (utils.Instrument, bool) {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	entry, exists := ic.entries[resource.String()]
+	if !exists || entry.inst == nil {
+		return nil, false
 	}
+	return entry.inst, true
+}
 
-	ic.cache[fullAddress] = inst
-	return inst, nil
+func (ic *instrumentCache) status(resource utils.Resource) connectionStatus {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	entry, exists := ic.entries[resource.String()]
+	if !exists {
+		return connectionStatus{Resource: resource.String(), State: stateDisconnected}
+	}
+	return entry.status()
 }
 
-func (ic *instrumentCache) invalidate(address string, port int) {
-	fullAddress := address + ":" + strconv.Itoa(port)
+// Returns the status of every instrument the cache has seen
+func (ic *instrumentCache) statuses() []connectionStatus {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	statuses := make([]connectionStatus, 0, len(ic.entries))
+	for _, entry := range ic.entries {
+		statuses = append(statuses, entry.status())
+	}
+	slices.SortFunc(statuses, func(a, b connectionStatus) int { return strings.Compare(a.Resource, b.Resource) })
+	return statuses
+}
 
+// Returns every entry of the cache with its owner and last use
+func (ic *instrumentCache) dump() []cacheEntryInfo {
+	ic.mu.RLock()
+	defer ic.mu.RUnlock()
+
+	infos := make([]cacheEntryInfo, 0, len(ic.entries))
+	for _, entry := range ic.entries {
+		infos = append(infos, cacheEntryInfo{connectionStatus: entry.status(), Owner: entry.owner, LastUsed: entry.lastUsed, Holds: entry.holds})
+	}
+	slices.SortFunc(infos, func(a, b cacheEntryInfo) int { return strings.Compare(a.Resource, b.Resource) })
+	return infos
+}
+
+// Keeps the connection to resource from eviction until the returned function is called. Used by requests that hold
+// the connection for longer than a single call, such as event streams.
+func (ic *instrumentCache) hold(resource utils.Resource) func() {
 	ic.mu.Lock()
 	defer ic.mu.Unlock()
 
-	if inst, exists := ic.cache[fullAddress]; exists {
-		inst.Close()
-		delete(ic.cache, fullAddress)
-		log.Printf("Invalidated cached connection to %s", fullAddress)
+	entry, exists := ic.entries[resource.String()]
+	if !exists {
+		return func() {}
+	}
+	entry.holds++
+	return func() {
+		ic.mu.Lock()
+		defer ic.mu.Unlock()
+		entry.holds--
+		entry.lastUsed = time.Now()
 	}
 }
 
-func connectInstrument(address string, port int, timeout time.Duration, progressFn func(int)) (utils.Instrument, error) {
-	log.Printf("Connecting to instrument at address '%s'\n", address)
-	var inst utils.Instrument
-	if address == "simulated" {
-		inst = utils.NewSimInstrument(timeout, false)
-	} else {
-		inst = utils.NewScpiInstrument(timeout, false)
+// Closes the connection to resource and forgets it, waiting for a request in progress to finish first.
+// Returns false if there was no entry for resource.
+func (ic *instrumentCache) disconnect(resource utils.Resource) bool {
+	guard := ic.guard(resource)
+	guard.Lock()
+	defer guard.Unlock()
+
+	ic.mu.Lock()
+	defer ic.unlock()
+
+	key := resource.String()
+	entry, exists := ic.entries[key]
+	if !exists {
+		return false
+	}
+	ic.remove(key, entry, "disconnected")
+	return true
+}
+
+// Closes every cached connection, e.g. on shutdown
+func (ic *instrumentCache) closeAll() {
+	ic.mu.Lock()
+	defer ic.unlock()
+
+	for key, entry := range ic.entries {
+		ic.remove(key, entry, "closed on shutdown")
 	}
+}
+
+// Closes the connections that have not been used for idleTimeout every so often until ctx is done
+func (ic *instrumentCache) sweep(ctx context.Context) {
+	if ic.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(max(ic.idleTimeout/2, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ic.evictIdle(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ic *instrumentCache) evictIdle(now time.Time) {
+	ic.mu.Lock()
+	defer ic.unlock()
 
-	if err := inst.Connect(address+":"+strconv.Itoa(port), progressFn); err != nil {
-		return inst, err
+	for key, entry := range ic.entries {
+		if now.Sub(entry.lastUsed) >= ic.idleTimeout {
+			ic.evict(key, entry, "idle")
+		}
 	}
+}
+
+// Evicts the least recently used entries other than keep until the cache is within maxEntries. Must be called with mu held.
+func (ic *instrumentCache) evictOverflow(keep string) {
+	if ic.maxEntries <= 0 {
+		return
+	}
+	candidates := make([]string, 0, len(ic.entries))
+	for key := range ic.entries {
+		if key != keep {
+			candidates = append(candidates, key)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b string) int { return ic.entries[a].lastUsed.Compare(ic.entries[b].lastUsed) })
+	for _, key := range candidates {
+		if len(ic.entries) <= ic.maxEntries {
+			return
+		}
+		ic.evict(key, ic.entries[key], "least recently used")
+	}
+	if len(ic.entries) > ic.maxEntries {
+		log.Printf("Instrument cache holds %d entries, more than %d, because the rest are in use", len(ic.entries), ic.maxEntries)
+	}
+}
+
+// Removes entry unless it is in use. Must be called with mu held.
+func (ic *instrumentCache) evict(key string, entry *cacheEntry, reason string) bool {
+	if entry.holds > 0 || (ic.inUse != nil && ic.inUse(entry.resource)) {
+		return false
+	}
+	// A request in progress shows the connection is in use. Not waiting for it also keeps mu from being held for long.
+	if guard, exists := ic.guards[key]; exists {
+		if !guard.TryLock() {
+			return false
+		}
+		defer guard.Unlock()
+	}
+	ic.remove(key, entry, reason)
+	return true
+}
+
+// Forgets entry and its guard, leaving its connection to be closed by unlock. Anyone still holding the old guard is
+// using the old connection, which is closed, so a new guard can serve the next connection. Must be called with mu held.
+func (ic *instrumentCache) remove(key string, entry *cacheEntry, reason string) {
+	if entry.inst != nil {
+		ic.closing = append(ic.closing, entry.inst)
+		entry.inst = nil
+	}
+	delete(ic.entries, key)
+	delete(ic.guards, key)
+	log.Printf("Removed cached connection to %s: %s", key, reason)
+}
+
+// Releases mu, then closes the connections removed while it was held
+func (ic *instrumentCache) unlock() {
+	closing := ic.closing
+	ic.closing = nil
+	ic.mu.Unlock()
+	for _, inst := range closing {
+		inst.Close()
+	}
+}
+
+// Must be called with mu held
+func (e *cacheEntry) status() connectionStatus {
+	status := connectionStatus{
+		Resource:  e.resource.String(),
+		Connected: e.state == stateConnected,
+		State:     e.state,
+		Since:     e.since,
+		Failures:  e.failures,
+	}
+	if e.lastError != nil {
+		status.LastError = e.lastError.Error()
+	}
+	if e.state != stateConnected {
+		status.NextAttempt = e.retryAt
+	}
+	return status
+}
 
-	return inst, nil
+func connectInstrument(resource utils.Resource, opts utils.InstrumentOptions, progressFn func(int)) (utils.Instrument, error) {
+	log.Printf("Connecting to instrument at resource '%s'\n", resource)
+	return utils.OpenResource(resource, opts, progressFn)
 }
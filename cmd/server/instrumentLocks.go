@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+const defaultLockLease = 60 * time.Second
+
+// instrumentLock is a client's exclusive claim on an instrument. It expires at the end of its lease unless renewed.
+type instrumentLock struct {
+	Owner string `json:"owner,omitempty"`
+	// Token identifies the holder and is only sent to it
+	Token    string    `json:"token,omitempty"`
+	Acquired time.Time `json:"acquired,omitzero"`
+	Expires  time.Time `json:"expires,omitzero"`
+	// Native is set while the instrument's own VXI-11 or HiSLIP lock is also held, which keeps other controllers out
+	Native   bool `json:"native"`
+	resource utils.Resource
+	expiry   *time.Timer
+}
+
+// Returns a copy of the lock that is safe to show to other clients
+func (l instrumentLock) public() instrumentLock {
+	l.Token = ""
+	l.expiry = nil
+	return l
+}
+
+// lockedError reports that a client without the lock's token tried to use a locked instrument
+type lockedError struct {
+	lock instrumentLock
+}
+
+func (e *lockedError) Error() string {
+	return fmt.Sprintf("instrument locked by %s until %s", e.lock.Owner, e.lock.Expires.Format(time.RFC3339))
+}
+
+func (e *lockedError) Unwrap() error {
+	return utils.ErrLocked
+}
+
+// The token does not belong to the lock currently held, e.g. because its lease expired
+var errLockNotHeld = errors.New("lock is not held by this token")
+
+type lockTable struct {
+	mu    sync.Mutex
+	locks map[string]*instrumentLock
+	// Closed when the lock of an instrument is released, waking the clients waiting for it
+	released map[string]chan struct{}
+	// Called with each lock whose lease ran out, after it has been removed
+	onExpire func(instrumentLock)
+}
+
+func newLockTable(onExpire func(instrumentLock)) *lockTable {
+	return &lockTable{
+		locks:    make(map[string]*instrumentLock),
+		released: make(map[string]chan struct{}),
+		onExpire: onExpire,
+	}
+}
+
+// Takes the lock of resource for lease, waiting up to wait for its holder to release it. Fails with a lockedError
+// naming the holder if it is still locked after that.
+func (lt *lockTable) acquire(ctx context.Context, resource utils.Resource, owner string, lease time.Duration, wait time.Duration) (instrumentLock, error) {
+	key := resource.String()
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		lt.mu.Lock()
+		holder, held := lt.locks[key]
+		if !held {
+			now := time.Now()
+			lock := &instrumentLock{Owner: owner, Token: newLockToken(), Acquired: now, Expires: now.Add(lease), resource: resource}
+			token := lock.Token
+			lock.expiry = time.AfterFunc(lease, func() { lt.expire(key, token) })
+			lt.locks[key] = lock
+			lt.mu.Unlock()
+			log.Printf("Instrument %s locked by %s", key, owner)
+			return *lock, nil
+		}
+		current := holder.public()
+		released, exists := lt.released[key]
+		if !exists {
+			released = make(chan struct{})
+			lt.released[key] = released
+		}
+		lt.mu.Unlock()
+
+		if wait <= 0 {
+			return instrumentLock{}, &lockedError{current}
+		}
+		select {
+		case <-released:
+		case <-deadline.C:
+			return instrumentLock{}, &lockedError{current}
+		case <-ctx.Done():
+			return instrumentLock{}, ctx.Err()
+		}
+	}
+}
+
+// Extends the lease of the lock held with token to lease from now
+func (lt *lockTable) renew(resource utils.Resource, token string, lease time.Duration) (instrumentLock, error) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lock, held := lt.locks[resource.String()]
+	if !held || lock.Token != token {
+		return instrumentLock{}, errLockNotHeld
+	}
+	lock.Expires = time.Now().Add(lease)
+	lock.expiry.Reset(lease)
+	return *lock, nil
+}
+
+func (lt *lockTable) setNative(resource utils.Resource, token string, native bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if lock, held := lt.locks[resource.String()]; held && lock.Token == token {
+		lock.Native = native
+	}
+}
+
+// Releases the lock held with token and returns it
+func (lt *lockTable) release(resource utils.Resource, token string) (instrumentLock, error) {
+	key := resource.String()
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lock, held := lt.locks[key]
+	if !held || lock.Token != token {
+		return instrumentLock{}, errLockNotHeld
+	}
+	lock.expiry.Stop()
+	lt.remove(key)
+	log.Printf("Instrument %s unlocked by %s", key, lock.Owner)
+	return *lock, nil
+}
+
+func (lt *lockTable) expire(key string, token string) {
+	lt.mu.Lock()
+	lock, held := lt.locks[key]
+	if !held || lock.Token != token || time.Now().Before(lock.Expires) {
+		// Released or renewed while the timer fired
+		lt.mu.Unlock()
+		return
+	}
+	lt.remove(key)
+	lt.mu.Unlock()
+
+	log.Printf("Lock of instrument %s held by %s expired", key, lock.Owner)
+	if lt.onExpire != nil {
+		lt.onExpire(*lock)
+	}
+}
+
+// Must be called with mu held
+func (lt *lockTable) remove(key string) {
+	delete(lt.locks, key)
+	if released, exists := lt.released[key]; exists {
+		close(released)
+		delete(lt.released, key)
+	}
+}
+
+// Returns a lockedError if resource is locked with a token other than token
+func (lt *lockTable) check(resource utils.Resource, token string) error {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	if lock, held := lt.locks[resource.String()]; held && lock.Token != token {
+		return &lockedError{lock.public()}
+	}
+	return nil
+}
+
+func (lt *lockTable) current(resource utils.Resource) (instrumentLock, bool) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	lock, held := lt.locks[resource.String()]
+	if !held {
+		return instrumentLock{}, false
+	}
+	return lock.public(), true
+}
+
+func newLockToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
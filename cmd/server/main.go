@@ -9,7 +9,9 @@ import (
 	"io"
 	"log"
   "log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -22,19 +24,27 @@ import (
 
 var version = "unknown"
 var instCache = newInstrumentCache()
+var instLocks = newLockTable(releaseNativeLock)
 var config *Config
 var preferences *Preferences
+var statusModel = utils.DefaultStatusModel()
 
 type scpiResponse struct {
-	Response    string   `json:"response"`
-	Errors      []string `json:"errors"`
-	ServerError string   `json:"serverError"`
+	Response    string                  `json:"response"`
+	Data        any                     `json:"data,omitempty"`
+	Errors      []utils.InstrumentError `json:"errors"`
+	ServerError string                  `json:"serverError"`
+	ErrorKind   string                  `json:"errorKind,omitempty"`
+	// Units holds the response and errors of each unit of a compound program message
+	Units []utils.UnitResult `json:"units,omitempty"`
 }
 
 type healthResponse struct {
   Healthy        bool   `json:"healthy"`
   ConnectionMode string `json:"connectionMode"`
   Version        string `json:"version"`
+	// Connections is the state of every instrument connection the server has made or tried to make
+	Connections []connectionStatus `json:"connections"`
 }
 
 func main() {
@@ -50,6 +60,23 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	instCache.policy = config.ConnectionPolicy
+	instCache.idleTimeout = config.CacheIdleTimeout
+	instCache.maxEntries = config.CacheMaxEntries
+	instCache.middleware = config.Middleware
+	// Evicting a locked instrument would drop its native lock
+	instCache.inUse = func(resource utils.Resource) bool {
+		_, locked := instLocks.current(resource)
+		return locked
+	}
+
+	if config.StatusModelFilePath != "" {
+		statusModel, err = utils.LoadStatusModel(config.StatusModelFilePath)
+		if err != nil {
+			log.Fatalf("Failed to load status model: %v", err)
+		}
+	}
+
 	preferences, err = loadPreferences()
 	if err != nil {
 		log.Fatalf("Failed to load preferences: %v", err)
@@ -61,9 +88,14 @@ func main() {
 		log.Printf("Loaded preferences: %+v", preferences)
   }
 
+	// Cancelled on shutdown so in-flight instrument I/O is abandoned instead of holding up the exit
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
 	addr := fmt.Sprintf(":%d", config.ServerPort)
 	server := &http.Server{
-		Addr: addr,
+		Addr:        addr,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
 
 	http.HandleFunc("/health", handleHealth)
@@ -73,8 +105,15 @@ func main() {
 	http.HandleFunc("/commands", handleCommandsRequest)
 	http.HandleFunc("/preferences", handlePreferences)
 	http.HandleFunc("/isConnected", handleIsConnected)
+	http.HandleFunc("/events", handleEvents)
+	http.HandleFunc("/status", handleStatus)
+	http.HandleFunc("/lock", handleLock)
+	http.HandleFunc("/disconnect", handleDisconnect)
+	http.HandleFunc("/metrics", handleMetrics)
 	http.HandleFunc("/dumpInstCache", handleDumpInstCache)
 
+	go instCache.sweep(baseCtx)
+
 	go func() {
 		log.Printf("Serving on port %d", config.ServerPort)
 		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
@@ -86,6 +125,7 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+	cancelBase()
 
 	shutdownCtx, shutdownRelease := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownRelease()
@@ -93,6 +133,8 @@ func main() {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("HTTP shutdown error: %v", err)
 	}
+	// Instruments often accept a single socket client, so leave none of them open for the next one
+	instCache.closeAll()
 	log.Println("Shutdown complete.")
 }
 
@@ -113,7 +155,7 @@ func getClientIP(r *http.Request) string {
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Handling request", "route", "/health", "clientIP", getClientIP(r))
-  healthResponse := healthResponse{Healthy: true, Version: version, ConnectionMode: config.ConnectionMode}
+  healthResponse := healthResponse{Healthy: true, Version: version, ConnectionMode: config.ConnectionMode, Connections: instCache.statuses()}
 	slog.Debug("Request info", "route", "/health", "clientIP", getClientIP(r), "response", healthResponse)
 	w.WriteHeader(http.StatusOK)
 	responseData, _ := json.Marshal(healthResponse)
@@ -211,29 +253,122 @@ func handlePreferences(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Preferences cleared")
 }
 
-func executeWithRetry(address string, port int, timeout time.Duration, operation func(utils.Instrument) error) error {
-	inst, err := instCache.get(address, port, timeout, nil)
-	if err != nil {
-		return err
-	}
-
-	inst.SetTimeout(timeout)
-	err = operation(inst)
-
-	if err != nil && errors.Is(err, utils.ErrConnectionClosed) {
-		slog.Warn("Connection closed, attempting reconnect", "error", err)
-		instCache.invalidate(address, port)
-		inst, err = instCache.get(address, port, timeout, nil)
+// Runs operation on the cached instrument, opened on behalf of client, reconnecting once if the connection was lost.
+// Each attempt gets its own opts.Timeout and is abandoned early if ctx is cancelled, e.g. by a client disconnect.
+// Fails with a lockedError if another client holds the instrument's lock and lockToken is not its token.
+func executeWithRetry(ctx context.Context, resource utils.Resource, client string, lockToken string, opts utils.InstrumentOptions, operation func(context.Context, utils.Instrument) error) error {
+	attempt := func() error {
+		inst, err := instCache.get(resource, opts, client, nil)
 		if err != nil {
 			return err
 		}
-		inst.SetTimeout(timeout)
-		return operation(inst)
+		guard := instCache.guard(resource)
+		guard.Lock()
+		defer guard.Unlock()
+		// Checked while holding the guard, so nothing runs on the instrument between taking a lock and using it
+		if err := instLocks.check(resource, lockToken); err != nil {
+			return err
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+		return operation(attemptCtx, inst)
+	}
+
+	err := attempt()
+	if err != nil && errors.Is(err, utils.ErrConnectionClosed) && ctx.Err() == nil {
+		slog.Warn("Connection closed, attempting reconnect", "error", err)
+		instCache.invalidate(resource, err)
+		return attempt()
 	}
 
 	return err
 }
 
+// Maps the kind of an instrument error to the status of the response, so clients can tell a slow instrument from a dead one
+func errorStatus(kind utils.ErrorKind) int {
+	switch kind {
+	case utils.ErrorKindNone, utils.ErrorKindInstrument:
+		return http.StatusOK
+	case utils.ErrorKindTimeout:
+		return http.StatusGatewayTimeout
+	case utils.ErrorKindConnection, utils.ErrorKindCanceled:
+		return http.StatusServiceUnavailable
+	case utils.ErrorKindProtocol:
+		return http.StatusBadGateway
+	case utils.ErrorKindLocked:
+		return http.StatusLocked
+	}
+	return http.StatusInternalServerError
+}
+
+// Reads the optional serial line settings, framing, error queue and sync settings shared by the instrument routes
+func instrumentOptionsFromQuery(query url.Values, timeout time.Duration) (utils.InstrumentOptions, error) {
+	opts := utils.InstrumentOptions{Timeout: timeout, KeepAlive: config.KeepAlive}
+
+	intParams := map[string]*int{
+		"baud":      &opts.Serial.BaudRate,
+		"dataBits":  &opts.Serial.DataBits,
+		"stopBits":  &opts.Serial.StopBits,
+		"maxErrors": &opts.ErrorQueue.MaxErrors,
+	}
+	for name, value := range intParams {
+		if s := query.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return opts, fmt.Errorf("parameter %s must be a number", name)
+			}
+			*value = n
+		}
+	}
+
+	opts.ErrorQueue.Query = query.Get("errorQuery")
+
+	var err error
+	if opts.Sync.Mode, err = utils.ParseSyncMode(query.Get("sync")); err != nil {
+		return opts, err
+	}
+	opts.Sync.Timeout = utils.DefaultSyncTimeout
+	if s := query.Get("syncTimeoutSeconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			return opts, fmt.Errorf("parameter syncTimeoutSeconds must be a positive number")
+		}
+		opts.Sync.Timeout = time.Duration(seconds) * time.Second
+	}
+	if opts.Serial.Parity, err = utils.ParseParity(query.Get("parity")); err != nil {
+		return opts, err
+	}
+	if opts.Serial.FlowControl, err = utils.ParseFlowControl(query.Get("flowControl")); err != nil {
+		return opts, err
+	}
+
+	// A named profile from the config file supplies the framing, which the explicit parameters override
+	var profile utils.InstrumentProfile
+	if name := query.Get("profile"); name != "" {
+		var ok bool
+		if profile, ok = config.Profiles[strings.ToLower(name)]; !ok {
+			return opts, fmt.Errorf("unknown instrument profile '%s'", name)
+		}
+	}
+	if s := query.Get("writeTermination"); s != "" {
+		profile.WriteTermination = s
+	}
+	if s := query.Get("readTermination"); s != "" {
+		profile.ReadTermination = s
+	}
+	if s := query.Get("maxResponseSize"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("parameter maxResponseSize must be a positive number")
+		}
+		profile.MaxResponseSize = n
+	}
+	if opts.Framing, err = profile.Framing(); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
 func handleCommandsRequest(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Handling request", "route", "/commands", "clientIP", getClientIP(r))
 	if r.Method != http.MethodGet {
@@ -253,45 +388,74 @@ func handleCommandsRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if portString == "" {
+	if portString == "" && !utils.IsResourceString(address) {
 		w.WriteHeader(http.StatusBadRequest)
     slog.Error("Missing required parameter: port", "route", "/commands")
 		fmt.Fprintln(w, "Missing required parameter: port")
 		return
 	}
 
-  port, err := strconv.Atoi(portString);
+  var port int
+  if portString != "" {
+    var err error
+    port, err = strconv.Atoi(portString);
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      slog.Error("Required parameter port must be a number", "route", "/commands")
+      fmt.Fprintln(w, "Required parameter port must be a number")
+      return
+    }
+  }
+
+  resource, err := utils.ResolveAddress(address, port)
   if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-    slog.Error("Required parameter port must be a number", "route", "/commands")
-		fmt.Fprintln(w, "Required parameter port must be a number")
+    slog.Error("Invalid instrument address", "route", "/commands", "error", err)
+		fmt.Fprintf(w, "Invalid instrument address: %v\n", err)
 		return
   }
 
-	slog.Debug("Request info", "route", "/commands", "clientIP", getClientIP(r), "address", address, "port", port)
+  opts, err := instrumentOptionsFromQuery(r.URL.Query(), 10 * time.Second)
+  if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Invalid connection settings", "route", "/commands", "error", err)
+		fmt.Fprintf(w, "Invalid connection settings: %v\n", err)
+		return
+  }
 
-	inst, err := instCache.get(address, port, 10 * time.Second, nil)
-	if err != nil {
-	  w.WriteHeader(http.StatusInternalServerError)
-    slog.Error("Failed to get instrument", "route", "/commands", "error", err)
-    fmt.Fprintf(w, "Failed to get instrument: %v", err)
-    return
-	}
+	slog.Debug("Request info", "route", "/commands", "clientIP", getClientIP(r), "resource", resource)
 
-  starTree, colonTree, err := inst.GetSupportedCommandsTree()
+  // The tree is cached by the instrument, so it is read under the guard like any other call
+  var starTree, colonTree utils.ScpiNode
+  var diagnostics []utils.ParseDiagnostic
+  err = executeWithRetry(r.Context(), resource, getClientIP(r), r.URL.Query().Get("lockToken"), opts, func(ctx context.Context, inst utils.Instrument) error {
+    var err error
+    starTree, colonTree, err = inst.GetSupportedCommandsTree()
+    if err != nil {
+      return err
+    }
+    if d, ok := utils.As[utils.HeaderDiagnoser](inst); ok {
+      diagnostics = d.HeaderDiagnostics()
+    }
+    return nil
+  })
   if err != nil {
-	  w.WriteHeader(http.StatusInternalServerError)
+	  w.WriteHeader(errorStatus(utils.KindOf(err)))
     slog.Error("Failed to get commands", "route", "/commands", "error", err)
     fmt.Fprintf(w, "Failed to get commands: %v", err)
     return
   }
+  for _, diagnostic := range diagnostics {
+    slog.Warn("Skipped unparseable header", "route", "/commands", "resource", resource, "line", diagnostic.Line, "text", diagnostic.Text, "reason", diagnostic.Reason)
+  }
 
   type result struct {
     StarTree utils.ScpiNode `json:"starTree"`
     ColonTree utils.ScpiNode `json:"colonTree"`
+    Diagnostics []utils.ParseDiagnostic `json:"diagnostics,omitempty"`
   }
 
-  responseData, err := json.Marshal(result{StarTree: starTree, ColonTree: colonTree})
+  responseData, err := json.Marshal(result{StarTree: starTree, ColonTree: colonTree, Diagnostics: diagnostics})
   if err != nil {
 	  w.WriteHeader(http.StatusInternalServerError)
     slog.Error("Failed to read commands", "route", "/commands", "error", err)
@@ -344,8 +508,11 @@ func handleScpiRequest(w http.ResponseWriter, r *http.Request) {
 	autoSystErrorString := r.URL.Query().Get("autoSystErr")
 	timeoutSecondsString := r.URL.Query().Get("timeoutSeconds")
 	scriptSource := r.URL.Query().Get("scriptSource")
+	format := r.URL.Query().Get("format")
+	byteOrderString := r.URL.Query().Get("byteOrder")
+	lockToken := r.URL.Query().Get("lockToken")
 
-	slog.Debug("Request info", "route", "/scpi", "clientIP", getClientIP(r), "scpi", scpi, "address", address, "port", portString, "simulated", simulatedString, "autoSystErr", autoSystErrorString, "timeoutSeconds", timeoutSecondsString, "scriptSource", scriptSource)
+	slog.Debug("Request info", "route", "/scpi", "clientIP", getClientIP(r), "scpi", scpi, "address", address, "port", portString, "simulated", simulatedString, "autoSystErr", autoSystErrorString, "timeoutSeconds", timeoutSecondsString, "scriptSource", scriptSource, "format", format, "byteOrder", byteOrderString)
 
 	if address == "" {
 		address = preferences.ScpiAddress
@@ -385,20 +552,67 @@ func handleScpiRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if simulated {
-		address = "simulated"
+		var err error
+		if address, err = simAddress(r.URL.Query()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Invalid simulator profile", "route", "/scpi", "error", err)
+			fmt.Fprintf(w, "Invalid simulator profile: %v\n", err)
+			return
+		}
+	}
+
+	resource, err := utils.ResolveAddress(address, port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Invalid instrument address", "route", "/scpi", "error", err)
+		fmt.Fprintf(w, "Invalid instrument address: %v\n", err)
+		return
 	}
 
-	timeout := time.Duration(timeoutSeconds) * time.Second
+	opts, err := instrumentOptionsFromQuery(r.URL.Query(), time.Duration(timeoutSeconds) * time.Second)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Invalid connection settings", "route", "/scpi", "error", err)
+		fmt.Fprintf(w, "Invalid connection settings: %v\n", err)
+		return
+	}
+
+	decode, err := responseDecoder(format, byteOrderString)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Invalid response format", "route", "/scpi", "error", err)
+		fmt.Fprintf(w, "Invalid response format: %v\n", err)
+		return
+	}
+	msg, err := utils.ParseProgramMessage(scpi)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.Error("Invalid program message", "route", "/scpi", "error", err)
+		fmt.Fprintf(w, "Invalid program message: %v\n", err)
+		return
+	}
+	if decode != nil && (len(msg.Units) != 1 || !msg.Units[0].Query) {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Parameter format requires a single query", "route", "/scpi", "format", format)
+		fmt.Fprintln(w, "Parameter format requires a single query")
+		return
+	}
+	if opts.Sync.Mode != utils.SyncNone && msg.Queries() > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Parameter sync requires commands only", "route", "/scpi", "sync", opts.Sync.Mode)
+		fmt.Fprintln(w, "Parameter sync requires commands only")
+		return
+	}
 
   var executeError error
 	scpiResponse := scpiResponse{}
 
   if (scpi == ":_ERR") {
     scpiResponse.ServerError = fmt.Sprint("This is a fake server error for testing purposes.")
-    var errors []string
+    var errors []utils.InstrumentError
     if (autoSystError) {
-      errors = append(errors, "First fake :SYST:ERR? response")
-      errors = append(errors, "Another fake :SYST:ERR? response for testing")
+      errors = append(errors, utils.InstrumentError{Code: -100, Message: "First fake :SYST:ERR? response"})
+      errors = append(errors, utils.InstrumentError{Code: -200, Message: "Another fake :SYST:ERR? response for testing", Info: "with device-specific info"})
     }
     scpiResponse.Errors = errors;
 
@@ -418,34 +632,65 @@ func handleScpiRequest(w http.ResponseWriter, r *http.Request) {
     return
   }
 
-	if strings.Contains(scpi, "?") {
-		var queryResponse string
-		executeError = executeWithRetry(address, port, timeout, func(inst utils.Instrument) error {
+	if decode != nil {
+		var data any
+		executeError = executeWithRetry(r.Context(), resource, getClientIP(r), lockToken, opts, func(ctx context.Context, inst utils.Instrument) error {
 			var err error
-			queryResponse, err = inst.Query(scpi)
+			data, err = decode(ctx, inst, scpi)
 			return err
 		})
 		if executeError != nil {
 			slog.Error("Error sending query", "route", "/scpi", "error", executeError)
 			scpiResponse.ServerError = fmt.Sprintf("%v", executeError)
 		} else {
-			scpiResponse.Response = queryResponse
+			scpiResponse.Data = data
 		}
 	} else {
-		executeError = executeWithRetry(address, port, timeout, func(inst utils.Instrument) error {
-			return inst.Command(scpi)
+		// The sync timeout bounds the wait for completion, on top of the timeout for sending the commands
+		messageOpts := opts
+		if opts.Sync.Mode != utils.SyncNone {
+			messageOpts.Timeout += opts.Sync.Timeout
+		}
+		var results []utils.UnitResult
+		executeError = executeWithRetry(r.Context(), resource, getClientIP(r), lockToken, messageOpts, func(ctx context.Context, inst utils.Instrument) error {
+			var err error
+			results, err = utils.ExecuteProgramMessage(ctx, inst, msg, utils.ProgramOptions{CheckErrors: autoSystError, ErrorQueue: opts.ErrorQueue, Sync: opts.Sync})
+			return err
 		})
 		if executeError != nil {
-			slog.Error("Error sending command", "route", "/scpi", "error", executeError)
+			slog.Error("Error sending program message", "route", "/scpi", "error", executeError)
 			scpiResponse.ServerError = fmt.Sprintf("%v", executeError)
 		}
+
+		// A unit that timed out used up the request's time before its errors were read, so they are read afresh
+		if last := len(results) - 1; autoSystError && executeError != nil && last >= 0 && len(results[last].Errors) == 0 &&
+			!errors.Is(executeError, utils.ErrConnectionClosed) && r.Context().Err() == nil {
+			err := executeWithRetry(r.Context(), resource, getClientIP(r), lockToken, opts, func(ctx context.Context, inst utils.Instrument) error {
+				var err error
+				results[last].Errors, err = inst.QueryErrorContext(ctx, opts.ErrorQueue)
+				return err
+			})
+			if err != nil {
+				slog.Error("Error doing auto :syst:err?", "route", "/scpi", "error", err)
+				scpiResponse.ServerError = fmt.Sprintf("Error querying system errors: %v", err)
+			}
+		}
+
+		for _, result := range results {
+			scpiResponse.Response += result.Response
+			scpiResponse.Errors = append(scpiResponse.Errors, result.Errors...)
+		}
+		if len(msg.Units) > 1 {
+			scpiResponse.Units = results
+		}
 	}
 
-	if autoSystError && !errors.Is(executeError, utils.ErrConnectionClosed) {
-		var systErrors []string
-		err := executeWithRetry(address, port, timeout, func(inst utils.Instrument) error {
+	// Decoded queries read the error queue once they are done
+	if decode != nil && autoSystError && !errors.Is(executeError, utils.ErrConnectionClosed) && r.Context().Err() == nil {
+		var systErrors []utils.InstrumentError
+		err := executeWithRetry(r.Context(), resource, getClientIP(r), lockToken, opts, func(ctx context.Context, inst utils.Instrument) error {
 			var err error
-			systErrors, err = inst.QueryError([]string{})
+			systErrors, err = inst.QueryErrorContext(ctx, opts.ErrorQueue)
 			return err
 		})
 		if err != nil {
@@ -456,11 +701,49 @@ func handleScpiRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
+	kind := utils.KindOf(executeError)
+	if kind == utils.ErrorKindNone && len(scpiResponse.Errors) > 0 {
+		kind = utils.ErrorKindInstrument
+	}
+	scpiResponse.ErrorKind = string(kind)
+	w.WriteHeader(errorStatus(kind))
 	responseData, _ := json.Marshal(scpiResponse)
 	fmt.Fprintf(w, "%s\n", responseData)
 }
 
+// Returns the function that queries and decodes numeric responses for the format parameter, or nil for plain text.
+// The format is either ascii, for comma separated lists, or the element type of a binary block.
+func responseDecoder(format string, byteOrder string) (func(context.Context, utils.Instrument, string) (any, error), error) {
+	if format == "" || format == "text" {
+		return nil, nil
+	}
+	if format == "ascii" {
+		return func(ctx context.Context, inst utils.Instrument, scpi string) (any, error) {
+			return utils.QueryAscii(ctx, inst, scpi)
+		}, nil
+	}
+	dtype, err := utils.ParseDataType(format)
+	if err != nil {
+		return nil, err
+	}
+	order, err := utils.ParseByteOrder(byteOrder)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, inst utils.Instrument, scpi string) (any, error) {
+		values, err := utils.QueryBinary(ctx, inst, scpi, dtype, order)
+		// encoding/json writes byte slices as base64, so unsigned bytes are widened to keep the response a JSON array
+		if raw, ok := values.([]uint8); ok {
+			ints := make([]int, len(raw))
+			for idx, b := range raw {
+				ints[idx] = int(b)
+			}
+			return ints, err
+		}
+		return values, err
+	}, nil
+}
+
 func handleIsConnected(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Handling request", "route", "/isConnected", "clientIP", getClientIP(r))
 
@@ -483,19 +766,23 @@ func handleIsConnected(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if portString == "" {
+	if portString == "" && !utils.IsResourceString(address) {
 		w.WriteHeader(http.StatusBadRequest)
     slog.Error("Missing required parameter: port", "route", "/isConnected")
 		fmt.Fprintln(w, "Missing required parameter: port")
 		return
 	}
 
-  port, err := strconv.Atoi(portString);
-  if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-    slog.Error("Required parameter port must be a number", "route", "/isConnected")
-		fmt.Fprintln(w, "Required parameter port must be a number")
-		return
+  var port int
+  if portString != "" {
+    var err error
+    port, err = strconv.Atoi(portString);
+    if err != nil {
+      w.WriteHeader(http.StatusBadRequest)
+      slog.Error("Required parameter port must be a number", "route", "/isConnected")
+      fmt.Fprintln(w, "Required parameter port must be a number")
+      return
+    }
   }
 
 	timeoutSeconds := 10
@@ -512,29 +799,489 @@ func handleIsConnected(w http.ResponseWriter, r *http.Request) {
 
   simulated := simulatedString == "true"
 	if simulated {
-		address = "simulated"
+		var err error
+		if address, err = simAddress(r.URL.Query()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Invalid simulator profile", "route", "/isConnected", "error", err)
+			fmt.Fprintf(w, "Invalid simulator profile: %v\n", err)
+			return
+		}
+	}
+
+	resource, err := utils.ResolveAddress(address, port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Invalid instrument address", "route", "/isConnected", "error", err)
+		fmt.Fprintf(w, "Invalid instrument address: %v\n", err)
+		return
+	}
+
+	opts, err := instrumentOptionsFromQuery(r.URL.Query(), time.Duration(timeoutSeconds) * time.Second)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+    slog.Error("Invalid connection settings", "route", "/isConnected", "error", err)
+		fmt.Fprintf(w, "Invalid connection settings: %v\n", err)
+		return
+	}
+
+	// The tracked state answers without a test *IDN? while the connection is being restored, or is kept checked by the heartbeat
+	status := instCache.status(resource)
+	switch {
+	case status.State == stateReconnecting:
+	case status.State == stateConnected && instCache.policy.HeartbeatInterval > 0:
+	default:
+		executeError := executeWithRetry(r.Context(), resource, getClientIP(r), r.URL.Query().Get("lockToken"), opts, func(ctx context.Context, inst utils.Instrument) error {
+			_, err := inst.QueryContext(ctx, "*IDN?")
+			return err
+		})
+		if executeError != nil {
+			slog.Error("Error sending test *IDN?", "route", "/isConnected", "error", executeError)
+		}
+		status = instCache.status(resource)
+		// Someone else holding the lock means the instrument is there
+		status.Connected = executeError == nil || errors.Is(executeError, utils.ErrLocked)
+	}
+
+	if r.URL.Query().Get("detail") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(status)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, status.Connected)
+}
 
-	timeout := time.Duration(timeoutSeconds) * time.Second
+// Streams the instrument's status events as server-sent events until the client disconnects or the connection is lost
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling request", "route", "/events", "clientIP", getClientIP(r))
 
-  executeError := executeWithRetry(address, port, timeout, func(inst utils.Instrument) error {
-    _, err := inst.Query("*IDN?")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		slog.Error("Received request with unsupported method", "route", "/events", "method", r.Method)
+		fmt.Fprintln(w, "/events only supports GET")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		slog.Error("Response writer does not support streaming", "route", "/events")
+		fmt.Fprintln(w, "Streaming is not supported")
+		return
+	}
+
+	pollInterval := utils.DefaultEventPollInterval
+	if pollIntervalString := r.URL.Query().Get("pollIntervalMs"); pollIntervalString != "" {
+		ms, err := strconv.Atoi(pollIntervalString)
+		if err != nil || ms <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Parameter pollIntervalMs must be a positive number", "route", "/events", "pollIntervalMs", pollIntervalString)
+			fmt.Fprintln(w, "Parameter pollIntervalMs must be a positive number")
+			return
+		}
+		pollInterval = time.Duration(ms) * time.Millisecond
+	}
+
+	resource, ok := resourceFromQuery(w, r, "/events")
+	if !ok {
+		return
+	}
+	opts, err := instrumentOptionsFromQuery(r.URL.Query(), 10*time.Second)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.Error("Invalid connection settings", "route", "/events", "error", err)
+		fmt.Fprintf(w, "Invalid connection settings: %v\n", err)
+		return
+	}
+
+	if err := instLocks.check(resource, r.URL.Query().Get("lockToken")); err != nil {
+		w.WriteHeader(http.StatusLocked)
+		slog.Error("Instrument is locked", "route", "/events", "error", err)
+		fmt.Fprintf(w, "Failed to subscribe to events: %v\n", err)
+		return
+	}
+	inst, err := instCache.get(resource, opts, getClientIP(r), nil)
+	if err != nil {
+		w.WriteHeader(errorStatus(utils.KindOf(err)))
+		slog.Error("Failed to get instrument", "route", "/events", "error", err)
+		fmt.Fprintf(w, "Failed to get instrument: %v\n", err)
+		return
+	}
+	// The stream keeps using the connection without further requests, so it must not be evicted as idle
+	defer instCache.hold(resource)()
+	events, err := utils.SubscribeEvents(r.Context(), inst, utils.EventOptions{PollInterval: pollInterval, Guard: instCache.guard(resource)})
+	if err != nil {
+		w.WriteHeader(errorStatus(utils.KindOf(err)))
+		slog.Error("Failed to subscribe to events", "route", "/events", "error", err)
+		fmt.Fprintf(w, "Failed to subscribe to events: %v\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for event := range events {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	slog.Debug("Event stream ended", "route", "/events", "resource", resource)
+}
+
+// GET reads and decodes the status registers, or only the one named by the register parameter. POST programs the
+// enable mask of register to mask and returns the register's new state.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling request", "route", "/status", "clientIP", getClientIP(r))
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		slog.Error("Received request with unsupported method", "route", "/status", "method", r.Method)
+		fmt.Fprintln(w, "/status only supports GET and POST")
+		return
+	}
+
+	registers := statusModel.Registers
+	registerName := r.URL.Query().Get("register")
+	if registerName != "" {
+		reg, ok := statusModel.Find(registerName)
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Unknown status register", "route", "/status", "register", registerName)
+			fmt.Fprintf(w, "Unknown status register: %s\n", registerName)
+			return
+		}
+		registers = []utils.StatusRegister{reg}
+	} else if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.Error("Missing required parameter: register", "route", "/status")
+		fmt.Fprintln(w, "Missing required parameter: register")
+		return
+	}
+	mask := -1
+	if r.Method == http.MethodPost {
+		maskString := r.URL.Query().Get("mask")
+		value, err := strconv.ParseInt(maskString, 0, 32)
+		if err != nil || value < 0 || value > 0xFFFF {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Parameter mask must be a number between 0 and 65535", "route", "/status", "mask", maskString)
+			fmt.Fprintln(w, "Parameter mask must be a number between 0 and 65535")
+			return
+		}
+		mask = int(value)
+	}
+
+	resource, ok := resourceFromQuery(w, r, "/status")
+	if !ok {
+		return
+	}
+	opts, err := instrumentOptionsFromQuery(r.URL.Query(), 10*time.Second)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.Error("Invalid connection settings", "route", "/status", "error", err)
+		fmt.Fprintf(w, "Invalid connection settings: %v\n", err)
+		return
+	}
+
+	var statuses []utils.RegisterStatus
+	err = executeWithRetry(r.Context(), resource, getClientIP(r), r.URL.Query().Get("lockToken"), opts, func(ctx context.Context, inst utils.Instrument) error {
+		if mask >= 0 {
+			if err := utils.SetStatusEnable(ctx, inst, registers[0], mask); err != nil {
+				return err
+			}
+		}
+		var err error
+		statuses, err = utils.ReadStatus(ctx, inst, utils.StatusModel{Registers: registers})
 		return err
 	})
+	if err != nil {
+		w.WriteHeader(errorStatus(utils.KindOf(err)))
+		slog.Error("Failed to read status registers", "route", "/status", "error", err)
+		fmt.Fprintf(w, "Failed to read status registers: %v\n", err)
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statuses)
+}
+
+type lockResponse struct {
+	Locked bool `json:"locked"`
+	instrumentLock
+}
+
+// GET shows who holds the instrument's lock. POST takes the lock for leaseSeconds (default 60), waiting up to waitSeconds
+// (default 0) for its holder to release it, or renews the lease of the lock held with token. DELETE releases the lock
+// held with token. The instrument's own lock is also taken when its transport has one.
+func handleLock(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling request", "route", "/lock", "clientIP", getClientIP(r))
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		slog.Error("Received request with unsupported method", "route", "/lock", "method", r.Method)
+		fmt.Fprintln(w, "/lock only supports GET, POST and DELETE")
+		return
+	}
+
+	resource, ok := resourceFromQuery(w, r, "/lock")
+	if !ok {
+		return
+	}
+	token := r.URL.Query().Get("token")
+
+	switch r.Method {
+	case http.MethodGet:
+		lock, held := instLocks.current(resource)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(lockResponse{Locked: held, instrumentLock: lock})
+		return
 
-	if executeError != nil {
-		slog.Error("Error sending test *IDN?", "route", "/isConnected", "error", executeError)
-	  fmt.Fprintln(w, "false")
+	case http.MethodDelete:
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Missing required parameter: token", "route", "/lock")
+			fmt.Fprintln(w, "Missing required parameter: token")
+			return
+		}
+		lock, err := instLocks.release(resource, token)
+		if err != nil {
+			writeLockError(w, err)
+			return
+		}
+		releaseNativeLock(lock)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "Lock released")
+		return
+	}
+
+	lease := defaultLockLease
+	if s := r.URL.Query().Get("leaseSeconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Parameter leaseSeconds must be a positive number", "route", "/lock", "leaseSeconds", s)
+			fmt.Fprintln(w, "Parameter leaseSeconds must be a positive number")
+			return
+		}
+		lease = time.Duration(seconds) * time.Second
+	}
+
+	var lock instrumentLock
+	var err error
+	if token != "" {
+		lock, err = instLocks.renew(resource, token, lease)
 	} else {
-	  fmt.Fprintln(w, "true")
+		lock, err = acquireLock(r, resource, lease)
+	}
+	if err != nil {
+		writeLockError(w, err)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lockResponse{Locked: true, instrumentLock: lock})
+}
+
+// Takes the server's lock of resource for the client of r, then the instrument's own lock if its transport has one
+func acquireLock(r *http.Request, resource utils.Resource, lease time.Duration) (instrumentLock, error) {
+	var wait time.Duration
+	if s := r.URL.Query().Get("waitSeconds"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 0 {
+			return instrumentLock{}, fmt.Errorf("parameter waitSeconds must be a positive number")
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	opts, err := instrumentOptionsFromQuery(r.URL.Query(), 10*time.Second)
+	if err != nil {
+		return instrumentLock{}, fmt.Errorf("invalid connection settings: %w", err)
+	}
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		owner = getClientIP(r)
+	}
+
+	lock, err := instLocks.acquire(r.Context(), resource, owner, lease, wait)
+	if err != nil {
+		return instrumentLock{}, err
+	}
+	err = executeWithRetry(r.Context(), resource, getClientIP(r), lock.Token, opts, func(ctx context.Context, inst utils.Instrument) error {
+		locker, ok := utils.As[utils.Locker](inst)
+		if !ok {
+			return nil
+		}
+		if err := locker.Lock(wait); err != nil {
+			return err
+		}
+		lock.Native = true
+		return nil
+	})
+	if kind := utils.KindOf(err); kind == utils.ErrorKindOther || kind == utils.ErrorKindProtocol {
+		// e.g. an instrument that does not implement the lock of its transport, which the server's lock still covers
+		slog.Warn("Failed to take the instrument's own lock", "route", "/lock", "resource", resource, "error", err)
+	} else if err != nil {
+		instLocks.release(resource, lock.Token)
+		return instrumentLock{}, err
+	}
+	instLocks.setNative(resource, lock.Token, lock.Native)
+	return lock, nil
+}
+
+// Lock conflicts are 423 with the holder, or 409 for a token that does not hold the lock
+func writeLockError(w http.ResponseWriter, err error) {
+	var locked *lockedError
+	switch {
+	case errors.As(err, &locked):
+		slog.Info("Instrument is locked", "route", "/lock", "owner", locked.lock.Owner)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusLocked)
+		json.NewEncoder(w).Encode(lockResponse{Locked: true, instrumentLock: locked.lock})
+	case errors.Is(err, errLockNotHeld):
+		w.WriteHeader(http.StatusConflict)
+		slog.Error("Lock is not held", "route", "/lock", "error", err)
+		fmt.Fprintf(w, "Lock is not held: %v\n", err)
+	case utils.KindOf(err) != utils.ErrorKindOther:
+		w.WriteHeader(errorStatus(utils.KindOf(err)))
+		slog.Error("Failed to lock instrument", "route", "/lock", "error", err)
+		fmt.Fprintf(w, "Failed to lock instrument: %v\n", err)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		slog.Error("Invalid lock request", "route", "/lock", "error", err)
+		fmt.Fprintf(w, "Invalid lock request: %v\n", err)
+	}
+}
+
+// Releases the instrument's own lock taken along with lock. It is already gone if the connection was lost since.
+func releaseNativeLock(lock instrumentLock) {
+	if !lock.Native {
+		return
+	}
+	inst, ok := instCache.lookup(lock.resource)
+	if !ok {
+		return
+	}
+	locker, ok := utils.As[utils.Locker](inst)
+	if !ok {
+		return
+	}
+	guard := instCache.guard(lock.resource)
+	guard.Lock()
+	defer guard.Unlock()
+	if err := locker.Unlock(); err != nil {
+		slog.Warn("Failed to release the instrument's own lock", "resource", lock.resource, "error", err)
+	}
+}
+
+// Returns the address of the simulated instrument selected by the simProfile parameter, a name from the config file, or
+// of the default simulated instrument without one
+func simAddress(query url.Values) (string, error) {
+	name := query.Get("simProfile")
+	if name == "" {
+		return "SIM", nil
+	}
+	path, ok := config.SimProfiles[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("unknown simulator profile '%s'", name)
+	}
+	return "SIM::" + path, nil
+}
+
+// Resolves the instrument of an instrument route from its address, port and simulated parameters, falling back to the preferred
+// address and port. Writes a 400 response and returns false if they are invalid.
+func resourceFromQuery(w http.ResponseWriter, r *http.Request, route string) (utils.Resource, bool) {
+	address := r.URL.Query().Get("address")
+	if r.URL.Query().Get("simulated") == "true" {
+		var err error
+		if address, err = simAddress(r.URL.Query()); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Invalid simulator profile", "route", route, "error", err)
+			fmt.Fprintf(w, "Invalid simulator profile: %v\n", err)
+			return utils.Resource{}, false
+		}
+	} else if address == "" {
+		address = preferences.ScpiAddress
+	}
+	port := preferences.ScpiPort
+	if portString := r.URL.Query().Get("port"); portString != "" {
+		var err error
+		port, err = strconv.Atoi(portString)
+		if err != nil || port < 1 || port > 65535 {
+			w.WriteHeader(http.StatusBadRequest)
+			slog.Error("Port must be a number between 1 and 65535", "route", route, "port", portString)
+			fmt.Fprintln(w, "Port must be a number between 1 and 65535")
+			return utils.Resource{}, false
+		}
+	}
+
+	resource, err := utils.ResolveAddress(address, port)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		slog.Error("Invalid instrument address", "route", route, "error", err)
+		fmt.Fprintf(w, "Invalid instrument address: %v\n", err)
+		return utils.Resource{}, false
+	}
+	return resource, true
 }
 
 func handleDumpInstCache(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Handling request", "route", "/dumpInstCache", "clientIP", getClientIP(r))
-  slog.Info("Dumping instCache", "cache", instCache.cache)
-  fmt.Fprintf(w, "%v\n", instCache.cache)
+	entries := instCache.dump()
+	slog.Info("Dumping instCache", "cache", entries)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
+
+// Serves the call counts and latencies of each instrument, keyed by resource and kind of call
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling request", "route", "/metrics", "clientIP", getClientIP(r))
+
+	if config.Middleware.Metrics == nil {
+		w.WriteHeader(http.StatusNotFound)
+		slog.Error("Metrics are disabled", "route", "/metrics")
+		fmt.Fprintln(w, "Metrics are disabled, start the server with --metrics")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(config.Middleware.Metrics.Snapshot())
+}
+
+// Closes the server's connection to an instrument, so other tools can connect to instruments that allow a single client.
+// The next request to the instrument connects again.
+func handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling request", "route", "/disconnect", "clientIP", getClientIP(r))
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		slog.Error("Received request with unsupported method", "route", "/disconnect", "method", r.Method)
+		fmt.Fprintf(w, "/disconnect supports the POST method\n")
+		return
+	}
+
+	resource, ok := resourceFromQuery(w, r, "/disconnect")
+	if !ok {
+		return
+	}
+	if err := instLocks.check(resource, r.URL.Query().Get("lockToken")); err != nil {
+		w.WriteHeader(http.StatusLocked)
+		slog.Error("Instrument is locked", "route", "/disconnect", "error", err)
+		fmt.Fprintf(w, "Failed to disconnect: %v\n", err)
+		return
+	}
+
+	if !instCache.disconnect(resource) {
+		w.WriteHeader(http.StatusNotFound)
+		slog.Info("Instrument not connected", "route", "/disconnect", "resource", resource)
+		fmt.Fprintln(w, "Instrument not connected")
+		return
+	}
+	slog.Info("Disconnected instrument", "route", "/disconnect", "resource", resource)
 	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "Disconnected")
 }
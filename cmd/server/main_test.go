@@ -1,12 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/middleware"
+	"github.com/bhutch29/sclipi/internal/utils"
 )
 
 func TestHandleScpiRequestQuery(t *testing.T) {
@@ -20,8 +32,8 @@ func TestHandleScpiRequestQuery(t *testing.T) {
 	if status != http.StatusOK {
 		t.Errorf("expected status OK, got %s", http.StatusText(status))
 	}
-	if strings.TrimSpace(response.Response) != "*IDN?" {
-		t.Errorf("expected echo of *IDN? got %v", response)
+	if !strings.HasPrefix(response.Response, "Sclipi,Simulated Instrument,") {
+		t.Errorf("expected the simulated identity, got %v", response)
 	}
 }
 
@@ -48,6 +60,23 @@ func TestHandleScpiRequestMustBePost(t *testing.T) {
 	}
 }
 
+func TestHandleScpiRequestCompound(t *testing.T) {
+	response, status, err := postScpi(`:SOUR:FREQ 1GHz;FREQ?;:DISP:TEXT "Ready?"`)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("postScpi failed: %s %v", http.StatusText(status), err)
+	}
+	if response.Response != "1GHz\n" {
+		t.Errorf("expected only the query to be answered, got %q", response.Response)
+	}
+	if len(response.Units) != 3 || !response.Units[1].Query || response.Units[1].Response != response.Response {
+		t.Errorf("unexpected units %+v", response.Units)
+	}
+
+	if _, status, _ := postScpi(`:DISP:TEXT "Ready`); status != http.StatusBadRequest {
+		t.Errorf("expected an unterminated string to be rejected, got %s", http.StatusText(status))
+	}
+}
+
 func postScpi(scpi string) (scpiResponse, int, error) {
 	req := httptest.NewRequest(http.MethodPost, "/scpi?simulated=true", strings.NewReader(scpi))
 	w := httptest.NewRecorder()
@@ -64,3 +93,695 @@ func postScpi(scpi string) (scpiResponse, int, error) {
   }
   return response, res.StatusCode, nil
 }
+
+func TestHandleScpiRequestFormat(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&format=complex128", strings.NewReader("TRAC:DATA?"))
+	w := httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected unknown format to be rejected, got %s", w.Result().Status)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&format=float32", strings.NewReader("FORM REAL,32"))
+	w = httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected format on a command to be rejected, got %s", w.Result().Status)
+	}
+
+	// The simulated instrument answers with the value last set, which is not a numeric list
+	if _, status, err := postScpi("TRAC:DATA ABC"); err != nil || status != http.StatusOK {
+		t.Fatalf("postScpi failed: %s %v", http.StatusText(status), err)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&format=ascii", strings.NewReader("TRAC:DATA?"))
+	w = httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	var response scpiResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.ServerError == "" || response.Data != nil {
+		t.Errorf("expected non-numeric response to fail, got %+v", response)
+	}
+}
+
+func TestHandleScpiRequestErrorKind(t *testing.T) {
+	// Nothing listens on the port once the listener is closed, so the connection is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/scpi?address="+address+"&port="+port, strings.NewReader("*IDN?"))
+	w := httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status Service Unavailable, got %s", w.Result().Status)
+	}
+	var response scpiResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.ErrorKind != string(utils.ErrorKindConnection) || response.ServerError == "" {
+		t.Errorf("expected connection lost error, got %+v", response)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := map[utils.ErrorKind]int{
+		utils.ErrorKindNone:       http.StatusOK,
+		utils.ErrorKindInstrument: http.StatusOK,
+		utils.ErrorKindTimeout:    http.StatusGatewayTimeout,
+		utils.ErrorKindConnection: http.StatusServiceUnavailable,
+		utils.ErrorKindProtocol:   http.StatusBadGateway,
+		utils.ErrorKindLocked:     http.StatusLocked,
+		utils.ErrorKindOther:      http.StatusInternalServerError,
+	}
+	for kind, expected := range tests {
+		if status := errorStatus(kind); status != expected {
+			t.Errorf("errorStatus(%q) = %d, expected %d", kind, status, expected)
+		}
+	}
+}
+
+func TestHandleScpiRequestSync(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&sync=later", strings.NewReader(":INIT:IMM"))
+	w := httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected unknown sync mode to be rejected, got %s", w.Result().Status)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&sync=opc", strings.NewReader(":TRAC:DATA?"))
+	w = httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected sync on a query to be rejected, got %s", w.Result().Status)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&sync=opc&syncTimeoutSeconds=0", strings.NewReader(":INIT:IMM"))
+	w = httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected zero sync timeout to be rejected, got %s", w.Result().Status)
+	}
+}
+
+func TestHandleEventsValidation(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/events?simulated=true", nil)
+	w := httptest.NewRecorder()
+	handleEvents(w, req)
+	if w.Result().StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status Method Not Allowed, got %s", w.Result().Status)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/events?simulated=true&pollIntervalMs=soon", nil)
+	w = httptest.NewRecorder()
+	handleEvents(w, req)
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected invalid poll interval to be rejected, got %s", w.Result().Status)
+	}
+}
+
+func TestHandleEventsStreamsUntilClientDisconnects(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/events?simulated=true&pollIntervalMs=10", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handleEvents(w, req)
+	if w.Result().StatusCode != http.StatusOK || w.Result().Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected an event stream, got %s %q", w.Result().Status, w.Result().Header.Get("Content-Type"))
+	}
+}
+
+func TestHandleStatusValidation(t *testing.T) {
+	tests := map[string]int{
+		http.MethodDelete + " /status?simulated=true":                     http.StatusMethodNotAllowed,
+		http.MethodPost + " /status?simulated=true&mask=32":               http.StatusBadRequest,
+		http.MethodPost + " /status?simulated=true&register=esr&mask=big": http.StatusBadRequest,
+		http.MethodGet + " /status?simulated=true&register=voltage":       http.StatusBadRequest,
+	}
+	for request, expected := range tests {
+		method, target, _ := strings.Cut(request, " ")
+		w := httptest.NewRecorder()
+		handleStatus(w, httptest.NewRequest(method, target, nil))
+		if w.Result().StatusCode != expected {
+			t.Errorf("%s: expected status %d, got %s", request, expected, w.Result().Status)
+		}
+	}
+}
+
+func TestHandleStatusRegister(t *testing.T) {
+	// Answers every query with +32, i.e. only bit 5 set
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			for range strings.Count(string(buf[:n]), "?") {
+				conn.Write([]byte("+32\n"))
+			}
+		}
+	}()
+	address, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	req := httptest.NewRequest(http.MethodPost, "/status?register=esr&mask=32&address="+address+"&port="+port, nil)
+	w := httptest.NewRecorder()
+	handleStatus(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected status OK, got %s", w.Result().Status)
+	}
+	var statuses []utils.RegisterStatus
+	if err := json.NewDecoder(w.Result().Body).Decode(&statuses); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Event == nil || *statuses[0].Event != 32 || statuses[0].Condition != nil {
+		t.Fatalf("unexpected standard event status %+v", statuses)
+	}
+	for _, flag := range statuses[0].Flags {
+		if (flag.Name == "CME") != flag.Event || (flag.Name == "CME") != flag.Enabled {
+			t.Errorf("expected only CME to be set and enabled, got %+v", flag)
+		}
+	}
+}
+
+func TestInstrumentOptionsFromQueryFraming(t *testing.T) {
+	previous := config
+	config = &Config{Profiles: map[string]utils.InstrumentProfile{"dmm": {WriteTermination: "CRLF", ReadTermination: "CRLF", MaxResponseSize: 1024}}}
+	defer func() { config = previous }()
+
+	query, _ := url.ParseQuery("profile=DMM&readTermination=NONE")
+	opts, err := instrumentOptionsFromQuery(query, time.Second)
+	if err != nil {
+		t.Fatalf("instrumentOptionsFromQuery failed: %v", err)
+	}
+	if opts.Framing != (utils.Framing{WriteTermination: "\r\n", ReadTermination: utils.TerminationEoi, MaxResponseSize: 1024}) {
+		t.Errorf("expected the profile with the read termination overridden, got %+v", opts.Framing)
+	}
+
+	for _, raw := range []string{"profile=scope", "maxResponseSize=0", "writeTermination=TAB"} {
+		query, _ := url.ParseQuery(raw)
+		if _, err := instrumentOptionsFromQuery(query, time.Second); err == nil {
+			t.Errorf("expected %s to be rejected", raw)
+		}
+	}
+}
+
+func TestHandleScpiRequestSimProfile(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "siggen.json")
+	if err := os.WriteFile(profile, []byte(`{"idn": "Acme,Signal Generator,0,1.0", "commands": [{"header": ":VOLTage", "max": 10}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	previous := config
+	config = &Config{SimProfiles: map[string]string{"siggen": profile}}
+	defer func() { config = previous }()
+
+	post := func(query string, scpi string) (*http.Response, scpiResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&autoSystErr=true&"+query, strings.NewReader(scpi))
+		w := httptest.NewRecorder()
+		handleScpiRequest(w, req)
+		var response scpiResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Result(), response
+	}
+	if _, response := post("simProfile=SigGen", "*IDN?"); response.Response != "Acme,Signal Generator,0,1.0\n" {
+		t.Errorf("expected the profile's identity, got %+v", response)
+	}
+	if _, response := post("simProfile=siggen", ":VOLT 11"); len(response.Errors) != 1 || response.Errors[0].Code != -222 {
+		t.Errorf("expected the profile to refuse the value, got %+v", response)
+	}
+	if res, _ := post("simProfile=scope", "*IDN?"); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an unknown profile to be rejected, got %s", res.Status)
+	}
+}
+
+func TestHandleCommandsRequestDiagnostics(t *testing.T) {
+	headers := filepath.Join(t.TempDir(), "SCPI.txt")
+	if err := os.WriteFile(headers, []byte("*RST/nquery/\n:MEASure:VOLTage?/qonly/\n:SENSe:RANGe <value>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/commands?address="+url.QueryEscape("SIM::"+headers), nil)
+	w := httptest.NewRecorder()
+	handleCommandsRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the other headers to be served, got %d %s", w.Code, w.Body.String())
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		StarTree    utils.ScpiNode          `json:"starTree"`
+		ColonTree   utils.ScpiNode          `json:"colonTree"`
+		Diagnostics []utils.ParseDiagnostic `json:"diagnostics"`
+	}
+	if err := json.NewDecoder(reader).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.StarTree.Children) != 1 || len(response.ColonTree.Children) != 1 {
+		t.Errorf("expected *RST and MEASure, got %+v %+v", response.StarTree, response.ColonTree)
+	}
+	if len(response.Diagnostics) != 1 || response.Diagnostics[0].Line != 3 || response.Diagnostics[0].Text != ":SENSe:RANGe <value>" {
+		t.Errorf("expected the third line to be reported, got %+v", response.Diagnostics)
+	}
+}
+
+func lockRequest(method string, query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/lock?simulated=true&"+query, nil)
+	w := httptest.NewRecorder()
+	handleLock(w, req)
+	return w
+}
+
+func TestHandleLock(t *testing.T) {
+	w := lockRequest(http.MethodPost, "owner=bench&leaseSeconds=30")
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("expected the lock to be taken, got %s", w.Result().Status)
+	}
+	var lock lockResponse
+	if err := json.NewDecoder(w.Result().Body).Decode(&lock); err != nil || !lock.Locked || lock.Token == "" || lock.Owner != "bench" {
+		t.Fatalf("unexpected lock %+v %v", lock, err)
+	}
+	defer lockRequest(http.MethodDelete, "token="+lock.Token)
+
+	if w := lockRequest(http.MethodPost, "owner=other"); w.Result().StatusCode != http.StatusLocked {
+		t.Errorf("expected a second client to be refused, got %s", w.Result().Status)
+	}
+	var current lockResponse
+	json.NewDecoder(lockRequest(http.MethodGet, "").Result().Body).Decode(&current)
+	if !current.Locked || current.Owner != "bench" || current.Token != "" {
+		t.Errorf("expected the lock to be shown without its token, got %+v", current)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/scpi?simulated=true", strings.NewReader("*IDN?"))
+	w = httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusLocked {
+		t.Errorf("expected a request without the token to be refused, got %s", w.Result().Status)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/scpi?simulated=true&lockToken="+lock.Token, strings.NewReader("*IDN?"))
+	w = httptest.NewRecorder()
+	handleScpiRequest(w, req)
+	if w.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected the holder's request to succeed, got %s", w.Result().Status)
+	}
+	commands := "/commands?address=" + url.QueryEscape(utils.Resource{Kind: utils.ResourceSim}.String())
+	w = httptest.NewRecorder()
+	handleCommandsRequest(w, httptest.NewRequest(http.MethodGet, commands, nil))
+	if w.Result().StatusCode != http.StatusLocked {
+		t.Errorf("expected /commands without the token to be refused, got %s", w.Result().Status)
+	}
+	w = httptest.NewRecorder()
+	handleCommandsRequest(w, httptest.NewRequest(http.MethodGet, commands+"&lockToken="+lock.Token, nil))
+	// The simulator has no SCPI.txt here, so getting past the lock is all that is checked
+	if w.Result().StatusCode == http.StatusLocked {
+		t.Errorf("expected the holder's /commands request to get past the lock, got %s", w.Result().Status)
+	}
+
+	if w := lockRequest(http.MethodPost, "token=stale"); w.Result().StatusCode != http.StatusConflict {
+		t.Errorf("expected renewing with the wrong token to conflict, got %s", w.Result().Status)
+	}
+	if w := lockRequest(http.MethodDelete, "token="+lock.Token); w.Result().StatusCode != http.StatusOK {
+		t.Errorf("expected the lock to be released, got %s", w.Result().Status)
+	}
+	if w := lockRequest(http.MethodDelete, "token="+lock.Token); w.Result().StatusCode != http.StatusConflict {
+		t.Errorf("expected releasing twice to conflict, got %s", w.Result().Status)
+	}
+}
+
+func TestLockTableQueuesAndExpires(t *testing.T) {
+	expired := make(chan instrumentLock, 1)
+	locks := newLockTable(func(lock instrumentLock) { expired <- lock })
+	resource := utils.Resource{Kind: utils.ResourceSim}
+
+	first, err := locks.acquire(context.Background(), resource, "first", 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if _, err := locks.acquire(context.Background(), resource, "second", time.Second, 0); !errors.Is(err, utils.ErrLocked) {
+		t.Errorf("expected the held lock to be refused, got %v", err)
+	}
+
+	// The second client waits in line until the first lease runs out
+	second, err := locks.acquire(context.Background(), resource, "second", time.Second, time.Second)
+	if err != nil || second.Owner != "second" {
+		t.Fatalf("expected the lock after the lease expired, got %+v %v", second, err)
+	}
+	if lock := <-expired; lock.Token != first.Token {
+		t.Errorf("expected the first lock to expire, got %+v", lock)
+	}
+	if err := locks.check(resource, first.Token); !errors.Is(err, utils.ErrLocked) {
+		t.Errorf("expected the expired token to be refused, got %v", err)
+	}
+	if _, err := locks.renew(resource, first.Token, time.Second); !errors.Is(err, errLockNotHeld) {
+		t.Errorf("expected the expired token not to renew, got %v", err)
+	}
+}
+
+func TestConnectionPolicyBackoff(t *testing.T) {
+	policy := connectionPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for failures, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 40: 5 * time.Second} {
+		if wait := policy.backoff(failures); wait != expected {
+			t.Errorf("backoff(%d) = %s, expected %s", failures, wait, expected)
+		}
+	}
+}
+
+// Waits until the cache reports state for resource
+func waitForState(t *testing.T, ic *instrumentCache, resource utils.Resource, state connectionState) connectionStatus {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := ic.status(resource)
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %s, got %+v", state, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestInstrumentCacheHeartbeatReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if first {
+				// The instrument reboots, dropping the first connection
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					for range strings.Count(string(buf[:n]), "?") {
+						conn.Write([]byte("1\n"))
+					}
+				}
+			}()
+		}
+	}()
+	address, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	resource := utils.Resource{Kind: utils.ResourceSocket, Host: address, Port: portNumber}
+
+	ic := newInstrumentCache()
+	ic.policy = connectionPolicy{HeartbeatInterval: 20 * time.Millisecond, HeartbeatQuery: "*OPC?", MinBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, MaxAttempts: 3}
+	first, err := ic.get(resource, utils.InstrumentOptions{Timeout: time.Second, Framing: utils.Framing{}}, "test", nil)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+
+	// The heartbeat finds the dropped connection and restores it without a request
+	waitForState(t, ic, resource, stateConnected)
+	deadline := time.Now().Add(2 * time.Second)
+	for inst, _ := ic.lookup(resource); inst == first || inst == nil; inst, _ = ic.lookup(resource) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the heartbeat to replace the dropped connection")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Without an instrument to reconnect to, the cache gives up after MaxAttempts and fails fast
+	listener.Close()
+	ic.invalidate(resource, errors.New("instrument switched off"))
+	status := waitForState(t, ic, resource, stateDown)
+	if status.Connected || status.Failures != 3 || status.LastError == "" {
+		t.Errorf("unexpected status after giving up %+v", status)
+	}
+	if _, err := ic.get(resource, utils.InstrumentOptions{Timeout: time.Second}, "test", nil); !errors.Is(err, utils.ErrConnectionClosed) {
+		t.Errorf("expected a down instrument to fail fast, got %v", err)
+	}
+}
+
+func TestHandleIsConnectedDetail(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/isConnected?simulated=true&address=SIM&port=1&detail=true", nil)
+	w := httptest.NewRecorder()
+	handleIsConnected(w, req)
+	var status connectionStatus
+	if err := json.NewDecoder(w.Result().Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if !status.Connected || status.State != stateConnected {
+		t.Errorf("expected the simulator to be connected, got %+v", status)
+	}
+}
+
+func TestInstrumentCacheConnectsWithoutBlocking(t *testing.T) {
+	// A HiSLIP server that accepts the connection but never answers the initialization
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	address, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	unreachable := utils.Resource{Kind: utils.ResourceHislip, Host: address, Port: portNumber, Device: "hislip0"}
+
+	ic := newInstrumentCache()
+	opts := utils.InstrumentOptions{Timeout: 500 * time.Millisecond}
+	results := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := ic.get(unreachable, opts, "test", nil)
+			results <- err
+		}()
+	}
+	conn := <-accepted
+	defer conn.Close()
+
+	start := time.Now()
+	ic.statuses()
+	if _, err := ic.get(utils.Resource{Kind: utils.ResourceSim}, opts, "test", nil); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected the cache to stay usable while dialing, took %s", elapsed)
+	}
+	for range 2 {
+		if err := <-results; err == nil {
+			t.Error("expected connecting to the silent instrument to fail")
+		}
+	}
+	select {
+	case <-accepted:
+		t.Error("expected the waiting request to share the connection attempt")
+	default:
+	}
+	ic.closeAll()
+}
+
+func TestInstrumentCacheEviction(t *testing.T) {
+	ic := newInstrumentCache()
+	ic.maxEntries = 2
+	ic.idleTimeout = time.Minute
+	locked := map[string]bool{}
+	ic.inUse = func(resource utils.Resource) bool { return locked[resource.String()] }
+
+	instruments := make([]utils.Resource, 4)
+	for i := range instruments {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		instruments[i] = utils.Resource{Kind: utils.ResourceSocket, Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port}
+	}
+	get := func(resource utils.Resource) {
+		t.Helper()
+		if _, err := ic.get(resource, utils.InstrumentOptions{Timeout: time.Second}, "client-a", nil); err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+	}
+
+	get(instruments[0])
+	get(instruments[1])
+	get(instruments[0])
+	get(instruments[2])
+	if _, ok := ic.lookup(instruments[1]); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if _, ok := ic.lookup(instruments[0]); !ok {
+		t.Error("expected the recently used entry to be kept")
+	}
+
+	// Entries in use are kept even over the limit
+	release := ic.hold(instruments[0])
+	locked[instruments[2].String()] = true
+	get(instruments[3])
+	if len(ic.dump()) != 3 {
+		t.Errorf("expected the held and locked entries to be kept, got %+v", ic.dump())
+	}
+
+	ic.evictIdle(time.Now().Add(2 * time.Minute))
+	if entries := ic.dump(); len(entries) != 2 || entries[0].Holds+entries[1].Holds != 1 || entries[0].Owner != "client-a" {
+		t.Errorf("expected only the held and locked entries to survive idling, got %+v", entries)
+	}
+	release()
+	delete(locked, instruments[2].String())
+	ic.guard(instruments[0])
+	ic.evictIdle(time.Now().Add(2 * time.Minute))
+	if entries := ic.dump(); len(entries) != 0 {
+		t.Errorf("expected every idle entry to be evicted, got %+v", entries)
+	}
+	if len(ic.guards) != 0 {
+		t.Errorf("expected the guards of evicted entries to be forgotten, got %d", len(ic.guards))
+	}
+
+	get(instruments[0])
+	ic.closeAll()
+	if _, ok := ic.lookup(instruments[0]); ok {
+		t.Error("expected closeAll to close every connection")
+	}
+}
+
+func TestHandleDisconnect(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/scpi?simulated=true", strings.NewReader("*IDN?"))
+	w := httptest.NewRecorder()
+	handleScpiRequest(w, req)
+
+	req = httptest.NewRequest(http.MethodGet, "/dumpInstCache", nil)
+	w = httptest.NewRecorder()
+	handleDumpInstCache(w, req)
+	var entries []cacheEntryInfo
+	if err := json.NewDecoder(w.Result().Body).Decode(&entries); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.State == stateConnected && entry.Owner != "" && !entry.LastUsed.IsZero() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the simulator in the cache dump, got %+v", entries)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/disconnect?simulated=true", nil)
+	w = httptest.NewRecorder()
+	handleDisconnect(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/disconnect?simulated=true", nil)
+	w = httptest.NewRecorder()
+	handleDisconnect(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 once disconnected, got %d", w.Code)
+	}
+}
+
+func TestExecuteWithRetryReconnects(t *testing.T) {
+	resource, _ := utils.ResolveAddress("SIM", 0)
+	metrics := middleware.NewMetrics()
+	instCache.disconnect(resource)
+	instCache.middleware = middleware.Config{Metrics: metrics, Faults: middleware.Faults{DropAfter: 1}}
+	defer func() {
+		instCache.middleware = middleware.Config{}
+		instCache.disconnect(resource)
+	}()
+
+	if _, status, err := postScpi("*IDN?"); err != nil || status != http.StatusOK {
+		t.Fatalf("first request failed with %d: %v", status, err)
+	}
+	first, _ := instCache.lookup(resource)
+
+	// The connection drops on the second call, which is retried once on a new connection
+	response, status, err := postScpi("*IDN?")
+	if err != nil || status != http.StatusOK || response.Response == "" {
+		t.Fatalf("expected the request to succeed after reconnecting, got %d %+v: %v", status, response, err)
+	}
+	if second, _ := instCache.lookup(resource); second == first {
+		t.Error("expected a new connection")
+	}
+	if stats := metrics.Snapshot()[resource.String()][middleware.OpQuery]; stats.Count != 3 || stats.Errors != 1 {
+		t.Errorf("expected 3 queries with 1 dropped, got %+v", stats)
+	}
+	if status := instCache.status(resource); status.State != stateConnected {
+		t.Errorf("expected the instrument to be connected again, got %+v", status)
+	}
+}
+
+func TestRecordAndReplaySession(t *testing.T) {
+	resource, _ := utils.ResolveAddress("SIM", 0)
+	dir := t.TempDir()
+	instCache.disconnect(resource)
+	instCache.middleware = middleware.Config{Record: func(name string) (io.WriteCloser, error) {
+		return os.Create(filepath.Join(dir, sessionFileName(name, time.Now())))
+	}}
+	defer func() { instCache.middleware = middleware.Config{} }()
+
+	recorded, status, err := postScpi("*IDN?")
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("request failed with %d: %v", status, err)
+	}
+	// Closing the connection finishes the recording
+	instCache.disconnect(resource)
+	instCache.middleware = middleware.Config{}
+
+	sessions, _ := filepath.Glob(filepath.Join(dir, "SIM_SCPI.txt-*.jsonl"))
+	if len(sessions) != 1 {
+		t.Fatalf("expected one recorded session, got %v", sessions)
+	}
+	replay := func(scpi string) (scpiResponse, int) {
+		req := httptest.NewRequest(http.MethodPost, "/scpi?address="+url.QueryEscape("REPLAY::"+sessions[0]), strings.NewReader(scpi))
+		w := httptest.NewRecorder()
+		handleScpiRequest(w, req)
+		var response scpiResponse
+		json.NewDecoder(w.Result().Body).Decode(&response)
+		return response, w.Code
+	}
+	if response, status := replay("*RST"); status == http.StatusOK || !strings.Contains(response.ServerError, "replay diverged") {
+		t.Errorf("expected a divergence, got %d %+v", status, response)
+	}
+	if response, status := replay("*IDN?"); status != http.StatusOK || response.Response != recorded.Response {
+		t.Errorf("expected the recorded response %q, got %d %+v", recorded.Response, status, response)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	// Host is the address every instrument listens on, empty for all interfaces
+	Host        string
+	Instruments []instrumentConfig
+}
+
+// instrumentConfig is a simulated instrument and the ports it is served on. A zero port disables that transport.
+type instrumentConfig struct {
+	// Headers is the simulator profile or :SYSTem:HELP:HEADers? style file listing the simulated commands
+	Headers string
+	// Idn is the *IDN? response, empty for the simulator's default
+	Idn     string
+	Latency time.Duration
+	Port    int
+	// HislipPort is usually 4880
+	HislipPort int
+	// Vxi11Port is the portmapper port, which clients expect to be 111
+	Vxi11Port int
+}
+
+func loadConfig() (*Config, error) {
+	pflag.String("host", "", "Address to listen on, empty for all interfaces")
+	pflag.String("headers", "SCPI.txt", "SYST:HELP:HEAD? style file or YAML or JSON simulator profile listing the simulated commands")
+	pflag.String("idn", "", "Response to *IDN?, empty for the simulator's default")
+	pflag.Duration("latency", 0, "Delay the handling of every message this long")
+	pflag.Int("port", 5025, "Raw socket port, 0 disables it")
+	pflag.Int("hislip-port", 0, "HiSLIP port, usually 4880, 0 disables it")
+	pflag.Int("vxi11-port", 0, "VXI-11 portmapper port, which clients expect to be 111, 0 disables it")
+	pflag.String("config", "", "YAML or JSON file listing several simulated instruments, replacing the single one set by the other flags")
+	pflag.Parse()
+
+	flags := pflag.CommandLine
+	config := &Config{}
+	config.Host, _ = flags.GetString("host")
+	if path, _ := flags.GetString("config"); path != "" {
+		instruments, err := readInstruments(path)
+		if err != nil {
+			return nil, err
+		}
+		config.Instruments = instruments
+	} else {
+		inst := instrumentConfig{}
+		inst.Headers, _ = flags.GetString("headers")
+		inst.Idn, _ = flags.GetString("idn")
+		inst.Latency, _ = flags.GetDuration("latency")
+		inst.Port, _ = flags.GetInt("port")
+		inst.HislipPort, _ = flags.GetInt("hislip-port")
+		inst.Vxi11Port, _ = flags.GetInt("vxi11-port")
+		config.Instruments = []instrumentConfig{inst}
+	}
+
+	for i, inst := range config.Instruments {
+		if err := inst.validate(); err != nil {
+			return nil, fmt.Errorf("invalid instrument %d: %w", i+1, err)
+		}
+	}
+	return config, nil
+}
+
+// Reads the instruments list of a config file such as
+//
+//	instruments:
+//	  - headers: SCPI.txt
+//	    idn: Keysight Technologies,N5182B,US00000001,B.01.00
+//	    port: 5025
+//	    hislipPort: 4880
+//	  - headers: dmm.txt
+//	    port: 5026
+//	    latency: 20ms
+func readInstruments(path string) ([]instrumentConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	var instruments []instrumentConfig
+	if err := v.UnmarshalKey("instruments", &instruments); err != nil {
+		return nil, fmt.Errorf("invalid instruments in %s: %w", path, err)
+	}
+	if len(instruments) == 0 {
+		return nil, fmt.Errorf("%s lists no instruments", path)
+	}
+	return instruments, nil
+}
+
+func (c instrumentConfig) validate() error {
+	if c.Headers == "" {
+		return fmt.Errorf("headers cannot be empty")
+	}
+	if c.Latency < 0 {
+		return fmt.Errorf("latency cannot be negative")
+	}
+	for _, port := range []int{c.Port, c.HislipPort, c.Vxi11Port} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("port must be between 0 and 65535, got %d", port)
+		}
+	}
+	if c.Port == 0 && c.HislipPort == 0 && c.Vxi11Port == 0 {
+		return fmt.Errorf("at least one of port, hislipPort and vxi11Port must be set")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadInstruments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sim.yaml")
+	yaml := `instruments:
+  - headers: SCPI.txt
+    idn: Acme,Model 1,42,2.0
+    port: 5025
+    hislipPort: 4880
+  - headers: dmm.txt
+    port: 5026
+    latency: 20ms
+`
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	instruments, err := readInstruments(path)
+	if err != nil {
+		t.Fatalf("readInstruments failed: %v", err)
+	}
+	expected := []instrumentConfig{
+		{Headers: "SCPI.txt", Idn: "Acme,Model 1,42,2.0", Port: 5025, HislipPort: 4880},
+		{Headers: "dmm.txt", Port: 5026, Latency: 20 * time.Millisecond},
+	}
+	if len(instruments) != len(expected) || instruments[0] != expected[0] || instruments[1] != expected[1] {
+		t.Errorf("expected %+v, got %+v", expected, instruments)
+	}
+}
+
+func TestInstrumentConfigValidate(t *testing.T) {
+	invalid := []instrumentConfig{
+		{Headers: "SCPI.txt"},
+		{Port: 5025},
+		{Headers: "SCPI.txt", Port: 70000},
+		{Headers: "SCPI.txt", Port: 5025, Latency: -time.Second},
+	}
+	for _, inst := range invalid {
+		if err := inst.validate(); err == nil {
+			t.Errorf("expected %+v to be rejected", inst)
+		}
+	}
+	if err := (instrumentConfig{Headers: "SCPI.txt", Vxi11Port: 111}).validate(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+var version = "unknown"
+
+// A transport an instrument is served on
+type transport struct {
+	port     int
+	resource utils.Resource
+	serve    func(net.Listener) error
+}
+
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	log.Printf("Starting simulator %s", version)
+
+	host := config.Host
+	if host == "" {
+		host = "localhost"
+	}
+	var listeners []net.Listener
+	for _, inst := range config.Instruments {
+		server, err := utils.NewSimServer(utils.SimServerOptions{Profile: inst.Headers, Identity: inst.Idn, Latency: inst.Latency})
+		if err != nil {
+			log.Fatalf("Failed to load simulated instrument: %v", err)
+		}
+		transports := []transport{
+			{inst.Port, utils.Resource{Kind: utils.ResourceSocket, Host: host, Port: inst.Port}, server.ServeSocket},
+			{inst.HislipPort, utils.Resource{Kind: utils.ResourceHislip, Host: host, Device: "hislip0", Port: inst.HislipPort}, server.ServeHislip},
+			{inst.Vxi11Port, utils.Resource{Kind: utils.ResourceVxi11, Host: host, Device: "inst0"}, server.ServeVxi11},
+		}
+		for _, t := range transports {
+			if t.port == 0 {
+				continue
+			}
+			listener, err := net.Listen("tcp", net.JoinHostPort(config.Host, strconv.Itoa(t.port)))
+			if err != nil {
+				log.Fatalf("Failed to listen: %v", err)
+			}
+			listeners = append(listeners, listener)
+			log.Printf("Simulating %s at %s on port %d", inst.Headers, t.resource, t.port)
+			go func() {
+				if err := t.serve(listener); !errors.Is(err, net.ErrClosed) {
+					log.Fatalf("Failed to serve %s: %v", t.resource, err)
+				}
+			}()
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	log.Println("Shutting down simulator...")
+	for _, listener := range listeners {
+		listener.Close()
+	}
+}
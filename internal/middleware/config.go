@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"log/slog"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Config selects the middleware applied to instruments, e.g. from command line arguments
+type Config struct {
+	// Trace logs every call to this logger. Nil disables tracing.
+	Trace *slog.Logger
+	// Metrics records every call. Nil disables metrics.
+	Metrics *Metrics
+	// RateLimit is the most calls started per second, with bursts of up to RateBurst. Zero disables the limit.
+	RateLimit float64
+	RateBurst int
+	Faults    Faults
+	// Record opens the file the session of the instrument called name is recorded to. Nil disables recording.
+	Record func(name string) (io.WriteCloser, error)
+}
+
+// Middleware returns the middleware selected by c for the instrument called name, innermost first. Recording is
+// innermost so only the instrument's own behaviour is replayed, faults come next so the trace shows them as if they
+// came from the instrument, and metrics are outermost so they include the time spent waiting for the rate limit.
+func (c Config) Middleware(name string) []utils.Middleware {
+	var middleware []utils.Middleware
+	if c.Record != nil {
+		middleware = append(middleware, c.record(name))
+	}
+	if c.Faults.Enabled() {
+		middleware = append(middleware, Inject(c.Faults))
+	}
+	if c.Trace != nil {
+		middleware = append(middleware, Trace(c.Trace.With("instrument", name)))
+	}
+	if c.RateLimit > 0 {
+		middleware = append(middleware, RateLimit(c.RateLimit, c.RateBurst))
+	}
+	if c.Metrics != nil {
+		middleware = append(middleware, c.Metrics.Middleware(name))
+	}
+	return middleware
+}
+
+// Opens the recording once the instrument is connected, so failed connection attempts leave no files behind.
+// The instrument is used without recording if the recording cannot be opened.
+func (c Config) record(name string) utils.Middleware {
+	return func(inst utils.Instrument) utils.Instrument {
+		file, err := c.Record(name)
+		if err != nil {
+			log.Printf("Not recording %s: %v", name, err)
+			return inst
+		}
+		session, err := utils.NewSessionWriter(file, name)
+		if err != nil {
+			file.Close()
+			log.Printf("Not recording %s: %v", name, err)
+			return inst
+		}
+		return Record(session, file)(inst)
+	}
+}
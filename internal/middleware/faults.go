@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Faults selects the failures injected by Inject, for testing how clients cope with misbehaving instruments
+type Faults struct {
+	// DropAfter closes the connection once this many calls have been made, failing the next call and every later one
+	// with utils.ErrConnectionClosed. Zero never drops it.
+	DropAfter int
+	// Delay holds back each call this long before making it
+	Delay time.Duration
+	// CorruptEvery corrupts the response of every CorruptEvery-th query, inverting its first byte and dropping its
+	// last, e.g. to break the length of a block. Zero never corrupts.
+	CorruptEvery int
+}
+
+func (f Faults) Enabled() bool {
+	return f.DropAfter > 0 || f.Delay > 0 || f.CorruptEvery > 0
+}
+
+// Inject returns a Middleware that makes the calls on an instrument fail as faults describes. Each instrument it wraps
+// counts its calls separately, so a reconnected instrument starts afresh.
+func Inject(faults Faults) utils.Middleware {
+	return func(inst utils.Instrument) utils.Instrument {
+		var mu sync.Mutex
+		calls, queries := 0, 0
+		dropped := false
+		return Wrap(func(ctx context.Context, call *Call, next func(context.Context) error) error {
+			if call.Op == OpClose {
+				return next(ctx)
+			}
+
+			mu.Lock()
+			calls++
+			drop := faults.DropAfter > 0 && calls > faults.DropAfter
+			closeNow := drop && !dropped
+			dropped = dropped || drop
+			mu.Unlock()
+			if drop {
+				if closeNow {
+					inst.Close()
+				}
+				return fmt.Errorf("%w: injected fault after %d calls", utils.ErrConnectionClosed, faults.DropAfter)
+			}
+
+			if faults.Delay > 0 {
+				timer := time.NewTimer(faults.Delay)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return fmt.Errorf("injected delay: %w", ctx.Err())
+				}
+			}
+
+			err := next(ctx)
+			if err != nil || (call.Op != OpQuery && call.Op != OpQueryBytes) || faults.CorruptEvery <= 0 {
+				return err
+			}
+			mu.Lock()
+			queries++
+			corrupt := queries%faults.CorruptEvery == 0
+			mu.Unlock()
+			if corrupt && len(call.Output) > 0 {
+				output := append([]byte{}, call.Output[:max(len(call.Output)-1, 1)]...)
+				output[0] ^= 0xff
+				call.Output = output
+			}
+			return nil
+		})(inst)
+	}
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Metrics collects call counts, sizes and latencies of instruments, keyed by the name each instrument was wrapped with
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[string]map[Op]*opStats
+}
+
+type opStats struct {
+	count    int
+	errors   int
+	sent     int
+	received int
+	total    time.Duration
+	min      time.Duration
+	max      time.Duration
+}
+
+// OpStats summarizes the calls of one kind on an instrument
+type OpStats struct {
+	Count  int `json:"count"`
+	Errors int `json:"errors"`
+	// BytesSent and BytesReceived count the commands and queries sent and the responses received
+	BytesSent     int     `json:"bytesSent"`
+	BytesReceived int     `json:"bytesReceived"`
+	MinMs         float64 `json:"minMs"`
+	MeanMs        float64 `json:"meanMs"`
+	MaxMs         float64 `json:"maxMs"`
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[string]map[Op]*opStats)}
+}
+
+// Middleware returns a Middleware that records each call of the instrument under name
+func (m *Metrics) Middleware(name string) utils.Middleware {
+	return Wrap(func(ctx context.Context, call *Call, next func(context.Context) error) error {
+		start := time.Now()
+		err := next(ctx)
+		m.record(name, call, time.Since(start), err)
+		return err
+	})
+}
+
+func (m *Metrics) record(name string, call *Call, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops, exists := m.stats[name]
+	if !exists {
+		ops = make(map[Op]*opStats)
+		m.stats[name] = ops
+	}
+	stats, exists := ops[call.Op]
+	if !exists {
+		stats = &opStats{min: elapsed}
+		ops[call.Op] = stats
+	}
+	stats.count++
+	if err != nil {
+		stats.errors++
+	}
+	stats.sent += len(call.Input)
+	stats.received += len(call.Output)
+	stats.total += elapsed
+	stats.min = min(stats.min, elapsed)
+	stats.max = max(stats.max, elapsed)
+}
+
+// Snapshot returns the statistics recorded so far of each instrument and kind of call
+func (m *Metrics) Snapshot() map[string]map[Op]OpStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := make(map[string]map[Op]OpStats, len(m.stats))
+	for name, ops := range m.stats {
+		snapshot[name] = make(map[Op]OpStats, len(ops))
+		for op, stats := range ops {
+			snapshot[name][op] = OpStats{
+				Count:         stats.count,
+				Errors:        stats.errors,
+				BytesSent:     stats.sent,
+				BytesReceived: stats.received,
+				MinMs:         milliseconds(stats.min),
+				MeanMs:        milliseconds(stats.total / time.Duration(stats.count)),
+				MaxMs:         milliseconds(stats.max),
+			}
+		}
+	}
+	return snapshot
+}
+
+// WriteSummary writes a line with the statistics of each instrument and kind of call to w
+func (m *Metrics) WriteSummary(w io.Writer) {
+	snapshot := m.Snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		ops := make([]Op, 0, len(snapshot[name]))
+		for op := range snapshot[name] {
+			ops = append(ops, op)
+		}
+		slices.Sort(ops)
+		for _, op := range ops {
+			s := snapshot[name][op]
+			fmt.Fprintf(w, "%s %s: %d calls, %d errors, %d bytes sent, %d bytes received, latency min %.2fms mean %.2fms max %.2fms\n",
+				name, op, s.Count, s.Errors, s.BytesSent, s.BytesReceived, s.MinMs, s.MeanMs, s.MaxMs)
+		}
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
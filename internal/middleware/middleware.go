@@ -0,0 +1,160 @@
+// Package middleware wraps instruments to trace their I/O, measure their latency, limit their call rate, record
+// sessions for replay and inject faults for testing. Each wrapper is a utils.Middleware, so they compose in utils.InstrumentOptions.Middleware.
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Op names the kind of a call on an instrument
+type Op string
+
+const (
+	OpCommand    Op = "command"
+	OpQuery      Op = "query"
+	OpQueryBytes Op = "queryBytes"
+	OpQueryError Op = "queryError"
+	// OpCommands reads the instrument's supported commands
+	OpCommands Op = "commands"
+	OpClose    Op = "close"
+)
+
+// Call is a single call on an instrument, as seen by an Interceptor
+type Call struct {
+	Op Op
+	// Input is the command or query sent, or the error query for OpQueryError
+	Input string
+	// Output is the response of a query once the call has returned. Interceptors may replace it.
+	Output []byte
+	// Errors are the error queue entries read by OpQueryError
+	Errors []utils.InstrumentError
+	// StarTree and ColonTree are the command trees read by OpCommands
+	StarTree  utils.ScpiNode
+	ColonTree utils.ScpiNode
+}
+
+// Interceptor runs around each call on an instrument. It makes the call by calling next, or fails it without calling next.
+type Interceptor func(ctx context.Context, call *Call, next func(context.Context) error) error
+
+// Wrap returns a Middleware that runs intercept around each call on the instrument
+func Wrap(intercept Interceptor) utils.Middleware {
+	return func(inst utils.Instrument) utils.Instrument {
+		return &instrument{inner: inst, intercept: intercept}
+	}
+}
+
+// Chain wraps inst in middleware in order, so the last one is outermost
+func Chain(inst utils.Instrument, middleware ...utils.Middleware) utils.Instrument {
+	for _, m := range middleware {
+		inst = m(inst)
+	}
+	return inst
+}
+
+type instrument struct {
+	inner     utils.Instrument
+	intercept Interceptor
+}
+
+func (i *instrument) Unwrap() utils.Instrument {
+	return i.inner
+}
+
+func (i *instrument) Connect(address string, progress func(int)) error {
+	return i.inner.Connect(address, progress)
+}
+
+func (i *instrument) Command(command string) error {
+	return i.intercept(context.Background(), &Call{Op: OpCommand, Input: command}, func(context.Context) error {
+		return i.inner.Command(command)
+	})
+}
+
+func (i *instrument) CommandContext(ctx context.Context, command string) error {
+	return i.intercept(ctx, &Call{Op: OpCommand, Input: command}, func(ctx context.Context) error {
+		return i.inner.CommandContext(ctx, command)
+	})
+}
+
+func (i *instrument) Query(query string) (string, error) {
+	call := &Call{Op: OpQuery, Input: query}
+	err := i.intercept(context.Background(), call, func(context.Context) error {
+		res, err := i.inner.Query(query)
+		call.Output = []byte(res)
+		return err
+	})
+	return string(call.Output), err
+}
+
+func (i *instrument) QueryContext(ctx context.Context, query string) (string, error) {
+	call := &Call{Op: OpQuery, Input: query}
+	err := i.intercept(ctx, call, func(ctx context.Context) error {
+		res, err := i.inner.QueryContext(ctx, query)
+		call.Output = []byte(res)
+		return err
+	})
+	return string(call.Output), err
+}
+
+func (i *instrument) QueryBytes(query string) ([]byte, error) {
+	call := &Call{Op: OpQueryBytes, Input: query}
+	err := i.intercept(context.Background(), call, func(context.Context) error {
+		res, err := i.inner.QueryBytes(query)
+		call.Output = res
+		return err
+	})
+	return call.Output, err
+}
+
+func (i *instrument) QueryBytesContext(ctx context.Context, query string) ([]byte, error) {
+	call := &Call{Op: OpQueryBytes, Input: query}
+	err := i.intercept(ctx, call, func(ctx context.Context) error {
+		res, err := i.inner.QueryBytesContext(ctx, query)
+		call.Output = res
+		return err
+	})
+	return call.Output, err
+}
+
+func (i *instrument) QueryError(opts utils.ErrorQueueOptions) ([]utils.InstrumentError, error) {
+	call := &Call{Op: OpQueryError, Input: opts.Query}
+	err := i.intercept(context.Background(), call, func(context.Context) error {
+		errs, err := i.inner.QueryError(opts)
+		call.Errors = errs
+		return err
+	})
+	return call.Errors, err
+}
+
+func (i *instrument) QueryErrorContext(ctx context.Context, opts utils.ErrorQueueOptions) ([]utils.InstrumentError, error) {
+	call := &Call{Op: OpQueryError, Input: opts.Query}
+	err := i.intercept(ctx, call, func(ctx context.Context) error {
+		errs, err := i.inner.QueryErrorContext(ctx, opts)
+		call.Errors = errs
+		return err
+	})
+	return call.Errors, err
+}
+
+func (i *instrument) GetSupportedCommandsTree() (utils.ScpiNode, utils.ScpiNode, error) {
+	call := &Call{Op: OpCommands}
+	err := i.intercept(context.Background(), call, func(context.Context) error {
+		var err error
+		call.StarTree, call.ColonTree, err = i.inner.GetSupportedCommandsTree()
+		return err
+	})
+	return call.StarTree, call.ColonTree, err
+}
+
+func (i *instrument) SetTimeout(timeout time.Duration) {
+	i.inner.SetTimeout(timeout)
+}
+
+func (i *instrument) Close() error {
+	return i.intercept(context.Background(), &Call{Op: OpClose}, func(context.Context) error {
+		return i.inner.Close()
+	})
+}
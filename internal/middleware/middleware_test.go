@@ -0,0 +1,206 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Echoes each query back as its response
+type fakeInstrument struct {
+	sent   []string
+	closed bool
+}
+
+func (f *fakeInstrument) Connect(string, func(int)) error { return nil }
+func (f *fakeInstrument) Command(command string) error {
+	return f.CommandContext(context.Background(), command)
+}
+func (f *fakeInstrument) CommandContext(ctx context.Context, command string) error {
+	if f.closed {
+		return utils.ErrConnectionClosed
+	}
+	f.sent = append(f.sent, command)
+	return nil
+}
+func (f *fakeInstrument) Query(query string) (string, error) {
+	return f.QueryContext(context.Background(), query)
+}
+func (f *fakeInstrument) QueryContext(ctx context.Context, query string) (string, error) {
+	res, err := f.QueryBytesContext(ctx, query)
+	return string(res), err
+}
+func (f *fakeInstrument) QueryBytes(query string) ([]byte, error) {
+	return f.QueryBytesContext(context.Background(), query)
+}
+func (f *fakeInstrument) QueryBytesContext(ctx context.Context, query string) ([]byte, error) {
+	if f.closed {
+		return nil, utils.ErrConnectionClosed
+	}
+	f.sent = append(f.sent, query)
+	return []byte(query), nil
+}
+func (f *fakeInstrument) QueryError(opts utils.ErrorQueueOptions) ([]utils.InstrumentError, error) {
+	return nil, nil
+}
+func (f *fakeInstrument) QueryErrorContext(ctx context.Context, opts utils.ErrorQueueOptions) ([]utils.InstrumentError, error) {
+	return nil, nil
+}
+func (f *fakeInstrument) GetSupportedCommandsTree() (utils.ScpiNode, utils.ScpiNode, error) {
+	return utils.ScpiNode{}, utils.ScpiNode{}, nil
+}
+func (f *fakeInstrument) SetTimeout(time.Duration) {}
+func (f *fakeInstrument) Close() error {
+	f.closed = true
+	return nil
+}
+
+// Implements utils.Locker, to check that it is found through the wrappers
+type fakeLocker struct {
+	fakeInstrument
+}
+
+func (f *fakeLocker) Lock(time.Duration) error { return nil }
+func (f *fakeLocker) Unlock() error            { return nil }
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	record := func(name string) utils.Middleware {
+		return Wrap(func(ctx context.Context, call *Call, next func(context.Context) error) error {
+			order = append(order, name)
+			return next(ctx)
+		})
+	}
+	inst := Chain(&fakeLocker{}, record("inner"), record("outer"))
+	if _, err := inst.Query("*IDN?"); err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	if strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("expected the last middleware to be outermost, got %v", order)
+	}
+	if _, ok := utils.As[utils.Locker](inst); !ok {
+		t.Error("expected the wrapped instrument's Locker to be found")
+	}
+	if _, ok := utils.As[utils.EventSource](inst); ok {
+		t.Error("expected no EventSource")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	inst := Chain(&fakeInstrument{}, Trace(slog.New(slog.NewTextHandler(&buf, nil))))
+	inst.QueryContext(context.Background(), "MEAS:VOLT?")
+	out := buf.String()
+	for _, expected := range []string{"direction=out", "direction=in", "op=query", "bytes=10", "data=MEAS:VOLT?", "elapsed="} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in trace %q", expected, out)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	inst := Chain(&fakeInstrument{}, Inject(Faults{DropAfter: 2}), metrics.Middleware("dmm"))
+	inst.Command("*RST")
+	inst.Query("*IDN?")
+	inst.Query("*IDN?")
+
+	stats := metrics.Snapshot()["dmm"]
+	if stats[OpCommand].Count != 1 || stats[OpCommand].BytesSent != 4 {
+		t.Errorf("unexpected command stats %+v", stats[OpCommand])
+	}
+	if q := stats[OpQuery]; q.Count != 2 || q.Errors != 1 || q.BytesReceived != 5 || q.MaxMs < q.MinMs {
+		t.Errorf("unexpected query stats %+v", q)
+	}
+	var buf bytes.Buffer
+	metrics.WriteSummary(&buf)
+	if !strings.Contains(buf.String(), "dmm query: 2 calls, 1 errors") {
+		t.Errorf("unexpected summary %q", buf.String())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	inst := Chain(&fakeInstrument{}, RateLimit(50, 2))
+	start := time.Now()
+	for range 4 {
+		inst.Command("*CLS")
+	}
+	// The burst of 2 goes through at once, the other 2 wait 20ms each
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("expected calls to be limited, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := inst.CommandContext(ctx, "*CLS"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled wait to fail, got %v", err)
+	}
+}
+
+func TestInjectFaults(t *testing.T) {
+	fake := &fakeInstrument{}
+	inst := Chain(fake, Inject(Faults{DropAfter: 3, CorruptEvery: 2}))
+
+	if res, _ := inst.Query("ABCD"); res != "ABCD" {
+		t.Errorf("expected the first response untouched, got %q", res)
+	}
+	if res, _ := inst.QueryBytes("ABCD"); !bytes.Equal(res, []byte{'A' ^ 0xff, 'B', 'C'}) {
+		t.Errorf("expected the second response corrupted, got %q", res)
+	}
+	if err := inst.Command("*CLS"); err != nil {
+		t.Errorf("expected the third call to succeed, got %v", err)
+	}
+	if _, err := inst.Query("*IDN?"); !errors.Is(err, utils.ErrConnectionClosed) {
+		t.Errorf("expected the connection dropped after 3 calls, got %v", err)
+	}
+	if !fake.closed {
+		t.Error("expected the dropped connection to be closed")
+	}
+
+	delayed := Chain(&fakeInstrument{}, Inject(Faults{Delay: time.Second}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := delayed.QueryContext(ctx, "*IDN?"); utils.KindOf(err) != utils.ErrorKindTimeout {
+		t.Errorf("expected the delay to time out, got %v", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	config := Config{Record: func(name string) (io.WriteCloser, error) { return os.Create(path) }}
+	inst := Chain(&fakeInstrument{}, config.Middleware("TCPIP::dmm::5025::SOCKET")...)
+	inst.GetSupportedCommandsTree()
+	inst.Command("*RST")
+	inst.QueryBytes("\x00\xff")
+	inst.Query("*IDN?")
+	inst.Close()
+
+	replay, err := utils.OpenResource(utils.Resource{Kind: utils.ResourceReplay, Session: path}, utils.InstrumentOptions{Timeout: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("failed to replay the recording: %v", err)
+	}
+	if _, _, err := replay.GetSupportedCommandsTree(); err != nil {
+		t.Errorf("expected the recorded command trees, got %v", err)
+	}
+	if err := replay.Command("*RST"); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if res, err := replay.QueryBytes("\x00\xff"); err != nil || !bytes.Equal(res, []byte("\x00\xff")) {
+		t.Errorf("expected the recorded binary response, got %q: %v", res, err)
+	}
+	if _, err := replay.Query("MEAS:VOLT?"); !errors.Is(err, utils.ErrReplayDiverged) {
+		t.Errorf("expected a divergence, got %v", err)
+	}
+	if res, err := replay.Query("*IDN?"); err != nil || res != "*IDN?" {
+		t.Errorf("expected the recorded response, got %q: %v", res, err)
+	}
+}
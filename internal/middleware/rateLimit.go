@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// RateLimit delays calls so that no more than perSecond of them start each second on average, allowing bursts of up to
+// burst calls after the instrument has been idle. Closing the instrument is never delayed.
+func RateLimit(perSecond float64, burst int) utils.Middleware {
+	limiter := &tokenBucket{rate: perSecond, burst: float64(max(burst, 1)), tokens: float64(max(burst, 1)), last: time.Now()}
+	return Wrap(func(ctx context.Context, call *Call, next func(context.Context) error) error {
+		if call.Op != OpClose {
+			if err := limiter.wait(ctx); err != nil {
+				return err
+			}
+		}
+		return next(ctx)
+	})
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Takes a token, waiting until one is available or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// Taking the token up front reserves it, so concurrent callers queue behind each other
+	b.tokens--
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Record writes every call on the instrument and its outcome to session, so it can be replayed with a REPLAY
+// resource. The command trees are recorded the first time they are read. closer, if not nil, is closed along with
+// the instrument.
+func Record(session *utils.SessionWriter, closer io.Closer) utils.Middleware {
+	var mu sync.Mutex
+	treesRecorded := false
+	return Wrap(func(ctx context.Context, call *Call, next func(context.Context) error) error {
+		start := time.Now()
+		err := next(ctx)
+		entry := utils.SessionEntry{Elapsed: time.Since(start), Op: string(call.Op), Errors: call.Errors}
+		entry.SetInput(call.Input)
+
+		switch call.Op {
+		case OpClose:
+			if closer != nil {
+				closer.Close()
+			}
+			return err
+		case OpCommands:
+			mu.Lock()
+			record := err == nil && !treesRecorded
+			treesRecorded = treesRecorded || record
+			mu.Unlock()
+			if !record {
+				return err
+			}
+			entry.StarTree, entry.ColonTree = &call.StarTree, &call.ColonTree
+		case OpQuery, OpQueryBytes:
+			entry.SetOutput(call.Output)
+		}
+		entry.SetError(err)
+		if writeErr := session.Write(start, entry); writeErr != nil {
+			log.Printf("Failed to record %s: %v", call.Op, writeErr)
+		}
+		return err
+	})
+}
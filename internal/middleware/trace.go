@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bhutch29/sclipi/internal/utils"
+)
+
+// Longest data logged by Trace for each direction of a call, so large blocks do not flood the log
+const maxTracedBytes = 256
+
+// Trace logs each call with what was sent, what was received, their sizes and how long the call took
+func Trace(logger *slog.Logger) utils.Middleware {
+	return Wrap(func(ctx context.Context, call *Call, next func(context.Context) error) error {
+		if call.Input != "" {
+			logger.Info("Instrument I/O", "direction", "out", "op", call.Op, "bytes", len(call.Input), "data", truncate([]byte(call.Input)))
+		}
+		start := time.Now()
+		err := next(ctx)
+		elapsed := time.Since(start)
+
+		attrs := []any{"direction", "in", "op", call.Op, "elapsed", elapsed}
+		switch {
+		case call.Output != nil:
+			attrs = append(attrs, "bytes", len(call.Output), "data", truncate(call.Output))
+		case len(call.Errors) > 0:
+			attrs = append(attrs, "errors", call.Errors)
+		}
+		if err != nil {
+			logger.Warn("Instrument I/O failed", append(attrs, "error", err)...)
+		} else {
+			logger.Info("Instrument I/O", attrs...)
+		}
+		return err
+	})
+}
+
+func truncate(data []byte) string {
+	if len(data) > maxTracedBytes {
+		return string(data[:maxTracedBytes]) + "..."
+	}
+	return string(data)
+}
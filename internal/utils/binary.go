@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DataType is the element type of a binary block, matching the instrument's FORM setting
+type DataType int
+
+const (
+	Int8 DataType = iota
+	Uint8
+	Int16
+	Uint16
+	Int32
+	Uint32
+	Int64
+	Float32
+	Float64
+)
+
+var dataTypeNames = map[string]DataType{
+	"int8":    Int8,
+	"uint8":   Uint8,
+	"int16":   Int16,
+	"uint16":  Uint16,
+	"int32":   Int32,
+	"uint32":  Uint32,
+	"int64":   Int64,
+	"float32": Float32,
+	"real32":  Float32,
+	"float64": Float64,
+	"real64":  Float64,
+}
+
+func ParseDataType(s string) (DataType, error) {
+	if dtype, ok := dataTypeNames[strings.ToLower(s)]; ok {
+		return dtype, nil
+	}
+	return 0, fmt.Errorf("unknown data type '%s', expected int8, uint8, int16, uint16, int32, uint32, int64, float32 or float64", s)
+}
+
+// Converts a FORM:BORD style name into a byte order. NORMAL is big-endian and SWAPPED is little-endian.
+func ParseByteOrder(s string) (binary.ByteOrder, error) {
+	switch strings.ToLower(s) {
+	case "", "norm", "normal", "big":
+		return binary.BigEndian, nil
+	case "swap", "swapped", "little":
+		return binary.LittleEndian, nil
+	}
+	return nil, fmt.Errorf("unknown byte order '%s', expected normal or swapped", s)
+}
+
+func (d DataType) size() int {
+	switch d {
+	case Int8, Uint8:
+		return 1
+	case Int16, Uint16:
+		return 2
+	case Int32, Uint32, Float32:
+		return 4
+	}
+	return 8
+}
+
+func (d DataType) makeSlice(n int) any {
+	switch d {
+	case Int8:
+		return make([]int8, n)
+	case Uint8:
+		return make([]uint8, n)
+	case Int16:
+		return make([]int16, n)
+	case Uint16:
+		return make([]uint16, n)
+	case Int32:
+		return make([]int32, n)
+	case Uint32:
+		return make([]uint32, n)
+	case Int64:
+		return make([]int64, n)
+	case Float32:
+		return make([]float32, n)
+	}
+	return make([]float64, n)
+}
+
+// Decodes a block payload into a slice of the given type, e.g. []float32 for Float32
+func DecodeBinary(payload []byte, dtype DataType, order binary.ByteOrder) (any, error) {
+	if len(payload)%dtype.size() != 0 {
+		return nil, fmt.Errorf("%d byte block is not a whole number of %d byte values", len(payload), dtype.size())
+	}
+	values := dtype.makeSlice(len(payload) / dtype.size())
+	if err := binary.Read(bytes.NewReader(payload), order, values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Sends a query whose response is a definite length block, e.g. TRAC:DATA? after FORM REAL,32, and decodes its payload
+func QueryBinary(ctx context.Context, inst Instrument, cmd string, dtype DataType, order binary.ByteOrder) (any, error) {
+	payload, err := inst.QueryBytesContext(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeBinary(payload, dtype, order)
+}
+
+// Parses a comma separated list of numbers, e.g. the response to TRAC:DATA? after FORM ASC
+func ParseAsciiList(response string) ([]float64, error) {
+	response = strings.TrimSpace(response)
+	if response == "" {
+		return []float64{}, nil
+	}
+	fields := strings.Split(response, ",")
+	values := make([]float64, len(fields))
+	for idx, field := range fields {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("value %d of the response is not a number: '%s'", idx+1, strings.TrimSpace(field))
+		}
+		values[idx] = value
+	}
+	return values, nil
+}
+
+func QueryAscii(ctx context.Context, inst Instrument, cmd string) ([]float64, error) {
+	response, err := inst.QueryContext(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAsciiList(response)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecodeBinary(t *testing.T) {
+	var buf bytes.Buffer
+	floats := []float32{1.5, -2.25, float32(math.Pi)}
+	binary.Write(&buf, binary.LittleEndian, floats)
+
+	values, err := DecodeBinary(buf.Bytes(), Float32, binary.LittleEndian)
+	if err != nil {
+		t.Fatalf("DecodeBinary failed: %v", err)
+	}
+	if !reflect.DeepEqual(values, floats) {
+		t.Errorf("expected %v, got %v", floats, values)
+	}
+
+	values, err = DecodeBinary([]byte{0x01, 0x02, 0xff, 0xfe}, Int16, binary.BigEndian)
+	if err != nil || !reflect.DeepEqual(values, []int16{0x0102, -2}) {
+		t.Errorf("expected big-endian int16 values, got %v %v", values, err)
+	}
+
+	if _, err := DecodeBinary([]byte{1, 2, 3}, Float64, binary.BigEndian); err == nil {
+		t.Error("expected partial value to fail")
+	}
+}
+
+func TestQueryBinary(t *testing.T) {
+	var buf bytes.Buffer
+	doubles := []float64{1e9, -0.5, 0}
+	binary.Write(&buf, binary.BigEndian, doubles)
+	block := []byte(fmt.Sprintf("#2%d%s\n", buf.Len(), buf.Bytes()))
+	address := newFakeSocketServer(t, block)
+
+	inst := NewScpiInstrument(Framing{}, time.Second, false)
+	if err := inst.Connect(address, nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	values, err := QueryBinary(context.Background(), inst, "TRAC:DATA?", Float64, binary.BigEndian)
+	if err != nil {
+		t.Fatalf("QueryBinary failed: %v", err)
+	}
+	if !reflect.DeepEqual(values, doubles) {
+		t.Errorf("expected %v, got %v", doubles, values)
+	}
+}
+
+func TestParseAsciiList(t *testing.T) {
+	values, err := ParseAsciiList("+1.00000E+09, -2.5,3\n")
+	if err != nil || !reflect.DeepEqual(values, []float64{1e9, -2.5, 3}) {
+		t.Errorf("unexpected values %v %v", values, err)
+	}
+	values, err = ParseAsciiList("\n")
+	if err != nil || len(values) != 0 {
+		t.Errorf("expected empty list, got %v %v", values, err)
+	}
+	if _, err := ParseAsciiList("1,abc,3"); err == nil {
+		t.Error("expected non-numeric value to fail")
+	}
+}
+
+func TestParseByteOrder(t *testing.T) {
+	if order, err := ParseByteOrder("SWAP"); err != nil || order != binary.LittleEndian {
+		t.Errorf("expected SWAP to be little-endian, got %v %v", order, err)
+	}
+	if order, err := ParseByteOrder("NORM"); err != nil || order != binary.BigEndian {
+		t.Errorf("expected NORM to be big-endian, got %v %v", order, err)
+	}
+	if _, err := ParseByteOrder("middle"); err == nil {
+		t.Error("expected unknown byte order to fail")
+	}
+}
@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// Reads one response message from a byte stream, however many reads it takes to arrive. Arbitrary block responses
+// (IEEE 488.2 section 8.7.9 and 8.7.10) are returned as their payload without the header, any other response is returned
+// without its termination. Responses longer than maxSize fail with a protocol error.
+func readResponse(r *bufio.Reader, termination string, maxSize int) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == '#' {
+		// A short peek leaves the error to readUntil
+		if header, _ := r.Peek(2); isBlockHeader(header) {
+			return readBlock(r, termination, maxSize)
+		}
+	}
+	return readUntil(r, termination, maxSize)
+}
+
+// Reports whether b starts with the header of a block. Anything else starting with #, such as the non-decimal number
+// #H1F, is a plain response.
+func isBlockHeader(b []byte) bool {
+	return len(b) >= 2 && b[0] == '#' && b[1] >= '0' && b[1] <= '9'
+}
+
+func readUntil(r *bufio.Reader, termination string, maxSize int) ([]byte, error) {
+	last := termination[len(termination)-1]
+	var result []byte
+	for {
+		b, err := r.ReadSlice(last)
+		result = append(result, b...)
+		if len(result)-len(termination) > maxSize {
+			return nil, responseTooLarge(maxSize)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasSuffix(result, []byte(termination)) {
+			return result[:len(result)-len(termination)], nil
+		}
+	}
+}
+
+func readBlock(r *bufio.Reader, termination string, maxSize int) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	numDigits, err := blockHeaderDigits(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Indefinite length blocks run until the newline that terminates the response
+	if numDigits == 0 {
+		return readUntil(r, "\n", maxSize)
+	}
+
+	digits := make([]byte, numDigits)
+	if _, err := io.ReadFull(r, digits); err != nil {
+		return nil, err
+	}
+	length, err := blockLength(digits)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxSize {
+		return nil, responseTooLarge(maxSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, len(termination))
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return nil, err
+	}
+	if string(trailer) != termination {
+		return nil, protocolError("expected response termination after %d byte block, got %q", length, trailer)
+	}
+	return payload, nil
+}
+
+// Decodes a complete response message from a message-based transport such as VXI-11 or HiSLIP, where the end of the
+// message is already known. Block responses are returned as their payload, other responses without their termination.
+func decodeResponse(message []byte, termination string) ([]byte, error) {
+	if !isBlockHeader(message) {
+		return bytes.TrimSuffix(message, []byte(termination)), nil
+	}
+	numDigits, err := blockHeaderDigits(message[:2])
+	if err != nil {
+		return nil, err
+	}
+	if numDigits == 0 {
+		return bytes.TrimSuffix(message[2:], []byte("\n")), nil
+	}
+	if len(message) < 2+numDigits {
+		return nil, protocolError("truncated block header %q", message)
+	}
+	length, err := blockLength(message[2 : 2+numDigits])
+	if err != nil {
+		return nil, err
+	}
+	start := 2 + numDigits
+	if len(message)-start < length {
+		return nil, protocolError("block header announced %d bytes but only %d were received", length, len(message)-start)
+	}
+	rest := bytes.TrimSuffix(message[start+length:], []byte(termination))
+	if termination == "" {
+		// Instruments usually still end a block with a newline when END marks the end of the message
+		rest = bytes.TrimSuffix(rest, []byte("\n"))
+	}
+	if len(rest) > 0 {
+		return nil, protocolError("unexpected %d bytes after %d byte block", len(rest), length)
+	}
+	return message[start : start+length], nil
+}
+
+func blockHeaderDigits(header []byte) (int, error) {
+	if header[0] != '#' || header[1] < '0' || header[1] > '9' {
+		return 0, protocolError("invalid block header %q", header)
+	}
+	return int(header[1] - '0'), nil
+}
+
+func blockLength(digits []byte) (int, error) {
+	for _, d := range digits {
+		if d < '0' || d > '9' {
+			return 0, protocolError("invalid block length %q", digits)
+		}
+	}
+	return strconv.Atoi(string(digits))
+}
+
+// Formats payload as a definite length arbitrary block, e.g. #15hello
+func formatBlock(payload []byte) string {
+	length := strconv.Itoa(len(payload))
+	return "#" + strconv.Itoa(len(length)) + length + string(payload)
+}
+
+// Queries use the textual form of the response, which always ends in a single newline
+func responseString(b []byte) string {
+	if bytes.HasSuffix(b, []byte("\n")) {
+		return string(b)
+	}
+	return string(b) + "\n"
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadResponseDefiniteBlock(t *testing.T) {
+	payload := []byte("binary\n\x00data#with\nnewlines")
+	stream := fmt.Sprintf("#2%d%s\n+1\n", len(payload), payload)
+	r := bufio.NewReader(strings.NewReader(stream))
+
+	b, err := readResponse(r, "\n", DefaultMaxResponseSize)
+	if err != nil {
+		t.Fatalf("readResponse failed: %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Errorf("expected payload %q, got %q", payload, b)
+	}
+
+	// The terminator after the block must be consumed so the next response is intact
+	next, err := readResponse(r, "\n", DefaultMaxResponseSize)
+	if err != nil || string(next) != "+1" {
+		t.Errorf("expected next response +1, got %q %v", next, err)
+	}
+}
+
+func TestReadResponseLargeBlock(t *testing.T) {
+	payload := bytes.Repeat([]byte{0xff, '\n', '#', '4'}, 5000)
+	stream := fmt.Sprintf("#5%05d%s\n", len(payload), payload)
+	r := bufio.NewReaderSize(strings.NewReader(stream), 16)
+
+	b, err := readResponse(r, "\n", DefaultMaxResponseSize)
+	if err != nil {
+		t.Fatalf("readResponse failed: %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Errorf("expected %d byte payload, got %d bytes", len(payload), len(b))
+	}
+}
+
+func TestReadResponseIndefiniteBlock(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("#0abc,def\n"))
+	b, err := readResponse(r, "\n", DefaultMaxResponseSize)
+	if err != nil || string(b) != "abc,def" {
+		t.Errorf("expected indefinite block payload abc,def, got %q %v", b, err)
+	}
+}
+
+func TestReadResponseCrLfTermination(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("#15ab\rcd\r\n+0,\"No error\"\r\n"))
+	b, err := readResponse(r, "\r\n", DefaultMaxResponseSize)
+	if err != nil || string(b) != "ab\rcd" {
+		t.Errorf("expected block payload, got %q %v", b, err)
+	}
+	b, err = readResponse(r, "\r\n", DefaultMaxResponseSize)
+	if err != nil || string(b) != "+0,\"No error\"" {
+		t.Errorf("expected text response, got %q %v", b, err)
+	}
+}
+
+func TestReadResponseMalformedBlocks(t *testing.T) {
+	for _, stream := range []string{
+		"#2a1\n",
+		"#3100abc\n",
+		"#13abcX",
+	} {
+		r := bufio.NewReader(strings.NewReader(stream))
+		if b, err := readResponse(r, "\n", DefaultMaxResponseSize); err == nil {
+			t.Errorf("expected %q to fail, got %q", stream, b)
+		}
+	}
+}
+
+func TestReadResponseNonDecimalNumbers(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("#H1F\n#Q17\n+1\n"))
+	for _, expected := range []string{"#H1F", "#Q17", "+1"} {
+		if b, err := readResponse(r, "\n", DefaultMaxResponseSize); err != nil || string(b) != expected {
+			t.Errorf("expected %s, got %q %v", expected, b, err)
+		}
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected string
+	}{
+		{"+1.00000E+09\n", "+1.00000E+09"},
+		{"#14ab\ncd\n", "ab\nc"},
+		{"#14ab\nc\n", "ab\nc"},
+		{"#14ab\nc", "ab\nc"},
+		{"#0raw\ndata\n", "raw\ndata"},
+		{"#H1F\n", "#H1F"},
+		{"#\n", "#"},
+	}
+	for _, test := range tests {
+		b, err := decodeResponse([]byte(test.message), "\n")
+		if test.message == "#14ab\ncd\n" {
+			if err == nil {
+				t.Errorf("expected trailing data after block to fail, got %q", b)
+			}
+			continue
+		}
+		if err != nil || string(b) != test.expected {
+			t.Errorf("decodeResponse(%q) = %q %v, expected %q", test.message, b, err, test.expected)
+		}
+	}
+	if _, err := decodeResponse([]byte("#3100abc"), "\n"); err == nil {
+		t.Error("expected truncated block to fail")
+	}
+}
+
+func TestReadResponseMaxSize(t *testing.T) {
+	for _, stream := range []string{
+		strings.Repeat("1,", 40) + "1\n",
+		"#3100" + strings.Repeat("x", 100) + "\n",
+	} {
+		r := bufio.NewReaderSize(strings.NewReader(stream), 16)
+		if b, err := readResponse(r, "\n", 64); !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected %d byte response to exceed the maximum size, got %q %v", len(stream), b, err)
+		}
+	}
+
+	r := bufio.NewReader(strings.NewReader(strings.Repeat("x", 64) + "\n"))
+	if b, err := readResponse(r, "\n", 64); err != nil || len(b) != 64 {
+		t.Errorf("expected response of exactly the maximum size to be read, got %d bytes %v", len(b), err)
+	}
+}
+
+func TestDecodeResponseEoi(t *testing.T) {
+	for message, expected := range map[string]string{
+		"+1.5E+00\n": "+1.5E+00\n",
+		"#13abc":     "abc",
+		"#13abc\n":   "abc",
+	} {
+		b, err := decodeResponse([]byte(message), "")
+		if err != nil || string(b) != expected {
+			t.Errorf("decodeResponse(%q) = %q %v, expected %q", message, b, err, expected)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+const defaultErrorQuery = "SYST:ERR?"
+
+// DefaultMaxErrors bounds how many entries QueryError reads, so an instrument that never reports 0,"No error" cannot stall it
+const DefaultMaxErrors = 100
+
+// ErrorQueueOptions controls how QueryError drains the instrument's error queue
+type ErrorQueueOptions struct {
+	// Query reads the next entry, e.g. :SYST:ERR:NEXT?. A query ending in ALL?, e.g. SYST:ERR:ALL?, reads every entry
+	// at once as a comma separated list. Empty means SYST:ERR?.
+	Query string
+	// MaxErrors is the most entries read, the rest are left in the queue. Zero means DefaultMaxErrors.
+	MaxErrors int
+}
+
+func queryErrorQueue(ctx context.Context, query func(context.Context, string) (string, error), opts ErrorQueueOptions) ([]InstrumentError, error) {
+	cmd := opts.Query
+	if cmd == "" {
+		cmd = defaultErrorQuery
+	}
+	maxErrors := opts.MaxErrors
+	if maxErrors <= 0 {
+		maxErrors = DefaultMaxErrors
+	}
+	all := strings.HasSuffix(strings.ToUpper(cmd), "ALL?")
+
+	var errs []InstrumentError
+	for len(errs) < maxErrors {
+		res, err := query(ctx, cmd)
+		if err != nil {
+			return errs, err
+		}
+		entries, err := ParseInstrumentErrors(res)
+		if err != nil {
+			return errs, err
+		}
+		for _, entry := range entries {
+			if entry.Code == 0 || len(errs) == maxErrors {
+				return errs, nil
+			}
+			errs = append(errs, entry)
+		}
+		if all || len(entries) == 0 {
+			return errs, nil
+		}
+	}
+	return errs, nil
+}
+
+// Parses a single error queue entry such as -113,"Undefined header" or +0,"No error"
+func ParseInstrumentError(response string) (InstrumentError, error) {
+	entries, err := ParseInstrumentErrors(response)
+	if err != nil {
+		return InstrumentError{}, err
+	}
+	if len(entries) != 1 {
+		return InstrumentError{}, protocolError("expected one error queue entry, got %d in %q", len(entries), response)
+	}
+	return entries[0], nil
+}
+
+// Parses a comma separated list of error queue entries, as returned by SYST:ERR:ALL?. Messages are quoted strings, in
+// which a doubled quote stands for a literal one.
+func ParseInstrumentErrors(response string) ([]InstrumentError, error) {
+	rest := strings.TrimSpace(response)
+	var entries []InstrumentError
+	for rest != "" {
+		codeText, message, found := strings.Cut(rest, ",")
+		if !found {
+			return nil, protocolError("missing message in error queue entry %q", rest)
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(codeText))
+		if err != nil {
+			return nil, protocolError("invalid error code in error queue entry %q", rest)
+		}
+		text, remainder, err := cutQuotedString(strings.TrimLeft(message, " "))
+		if err != nil {
+			return nil, err
+		}
+		entry := InstrumentError{Code: code, Message: text}
+		if message, info, found := strings.Cut(text, ";"); found {
+			entry.Message, entry.Info = message, info
+		}
+		entries = append(entries, entry)
+
+		rest = strings.TrimSpace(remainder)
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, protocolError("unexpected %q after error queue entry", rest)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	return entries, nil
+}
+
+// Splits a leading SCPI string, quoted with " or ', from s. Instruments that leave the message unquoted get the whole of s.
+func cutQuotedString(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		return s, "", nil
+	}
+	quote := s[0]
+	var text strings.Builder
+	for idx := 1; idx < len(s); idx++ {
+		if s[idx] != quote {
+			text.WriteByte(s[idx])
+			continue
+		}
+		if idx+1 < len(s) && s[idx+1] == quote {
+			text.WriteByte(quote)
+			idx++
+			continue
+		}
+		return text.String(), s[idx+1:], nil
+	}
+	return "", "", protocolError("unterminated string in error queue entry %q", s)
+}
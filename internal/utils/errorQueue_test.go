@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseInstrumentErrors(t *testing.T) {
+	tests := []struct {
+		response string
+		expected []InstrumentError
+	}{
+		{"+0,\"No error\"\n", []InstrumentError{{Code: 0, Message: "No error"}}},
+		{"0,\"No error\"", []InstrumentError{{Code: 0, Message: "No error"}}},
+		{"-113,\"Undefined header\"\n", []InstrumentError{{Code: -113, Message: "Undefined header"}}},
+		{"-222,\"Data out of range;Frequency clipped to 6 GHz\"", []InstrumentError{{Code: -222, Message: "Data out of range", Info: "Frequency clipped to 6 GHz"}}},
+		{"-113,\"Undefined header\",-350,\"Queue overflow\"\n", []InstrumentError{{Code: -113, Message: "Undefined header"}, {Code: -350, Message: "Queue overflow"}}},
+		{"-100,\"Command error, \"\"bad\"\" name\"", []InstrumentError{{Code: -100, Message: "Command error, \"bad\" name"}}},
+		{"-100,Command error", []InstrumentError{{Code: -100, Message: "Command error"}}},
+	}
+	for _, test := range tests {
+		entries, err := ParseInstrumentErrors(test.response)
+		if err != nil || !reflect.DeepEqual(entries, test.expected) {
+			t.Errorf("ParseInstrumentErrors(%q) = %+v %v, expected %+v", test.response, entries, err, test.expected)
+		}
+	}
+
+	for _, response := range []string{"garbage", "abc,\"message\"", "-100,\"unterminated", "-100,\"a\" -200,\"b\""} {
+		if entries, err := ParseInstrumentErrors(response); !errors.Is(err, ErrProtocol) {
+			t.Errorf("expected %q to be a protocol error, got %+v %v", response, entries, err)
+		}
+	}
+}
+
+func TestInstrumentErrorString(t *testing.T) {
+	entry, err := ParseInstrumentError("-222,\"Data out of range;Frequency clipped\"")
+	if err != nil {
+		t.Fatalf("ParseInstrumentError failed: %v", err)
+	}
+	if entry.Error() != "-222,\"Data out of range;Frequency clipped\"" {
+		t.Errorf("unexpected error string %s", entry.Error())
+	}
+}
+
+// Answers each query with the next canned response and records what was sent
+type fakeErrorQueue struct {
+	responses []string
+	queries   []string
+}
+
+func (q *fakeErrorQueue) query(ctx context.Context, cmd string) (string, error) {
+	q.queries = append(q.queries, cmd)
+	if len(q.responses) == 0 {
+		return "+0,\"No error\"\n", nil
+	}
+	res := q.responses[0]
+	q.responses = q.responses[1:]
+	return res, nil
+}
+
+func TestQueryErrorQueue(t *testing.T) {
+	q := &fakeErrorQueue{responses: []string{"-113,\"Undefined header\"\n", "-222,\"Data out of range\"\n", "0,\"No error\"\n"}}
+	errs, err := queryErrorQueue(context.Background(), q.query, ErrorQueueOptions{})
+	if err != nil || len(errs) != 2 || errs[0].Code != -113 || errs[1].Code != -222 {
+		t.Errorf("unexpected errors %+v %v", errs, err)
+	}
+	if len(q.queries) != 3 || q.queries[0] != "SYST:ERR?" {
+		t.Errorf("expected three SYST:ERR? queries, got %v", q.queries)
+	}
+}
+
+func TestQueryErrorQueueMaxErrors(t *testing.T) {
+	// An instrument that never reports an empty queue must not be queried forever
+	q := &fakeErrorQueue{}
+	for range 10 {
+		q.responses = append(q.responses, "-310,\"System error\"\n")
+	}
+	errs, err := queryErrorQueue(context.Background(), q.query, ErrorQueueOptions{Query: ":SYST:ERR:NEXT?", MaxErrors: 3})
+	if err != nil || len(errs) != 3 {
+		t.Errorf("expected to stop after 3 errors, got %+v %v", errs, err)
+	}
+	if len(q.queries) != 3 || q.queries[0] != ":SYST:ERR:NEXT?" {
+		t.Errorf("expected three :SYST:ERR:NEXT? queries, got %v", q.queries)
+	}
+}
+
+func TestQueryErrorQueueAll(t *testing.T) {
+	q := &fakeErrorQueue{responses: []string{"-113,\"Undefined header\",-350,\"Queue overflow\"\n"}}
+	errs, err := queryErrorQueue(context.Background(), q.query, ErrorQueueOptions{Query: "SYST:ERR:ALL?"})
+	if err != nil || len(errs) != 2 || errs[1].Code != -350 {
+		t.Errorf("unexpected errors %+v %v", errs, err)
+	}
+	if len(q.queries) != 1 {
+		t.Errorf("expected a single SYST:ERR:ALL? query, got %v", q.queries)
+	}
+
+	q = &fakeErrorQueue{responses: []string{"0,\"No error\"\n"}}
+	if errs, err := queryErrorQueue(context.Background(), q.query, ErrorQueueOptions{Query: "SYST:ERR:ALL?"}); err != nil || len(errs) != 0 {
+		t.Errorf("expected empty queue, got %+v %v", errs, err)
+	}
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Transport failures are reported by wrapping one of these, so callers can tell them apart with errors.Is
+var (
+	// The connection to the instrument is gone and must be reopened
+	ErrConnectionClosed = errors.New("connection closed")
+	// The instrument did not respond in time. The connection is still usable.
+	ErrTimeout = errors.New("timeout")
+	// The instrument or transport sent something that does not follow the protocol
+	ErrProtocol = errors.New("protocol error")
+	// Another client or controller holds the instrument's exclusive lock
+	ErrLocked = errors.New("instrument locked")
+)
+
+// InstrumentError is an entry of the instrument's error queue, e.g. -222,"Data out of range;Frequency clipped to 6 GHz"
+type InstrumentError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Info is the device-specific text following a semicolon in the message, if any
+	Info string `json:"info,omitempty"`
+}
+
+func (e *InstrumentError) Error() string {
+	if e.Info != "" {
+		return fmt.Sprintf("%d,\"%s;%s\"", e.Code, e.Message, e.Info)
+	}
+	return fmt.Sprintf("%d,\"%s\"", e.Code, e.Message)
+}
+
+// ErrorKind names the class of an error for clients that react to them differently
+type ErrorKind string
+
+const (
+	ErrorKindNone       ErrorKind = ""
+	ErrorKindTimeout    ErrorKind = "timeout"
+	ErrorKindConnection ErrorKind = "connectionLost"
+	ErrorKindProtocol   ErrorKind = "protocol"
+	ErrorKindInstrument ErrorKind = "instrument"
+	ErrorKindCanceled   ErrorKind = "canceled"
+	ErrorKindLocked     ErrorKind = "locked"
+	ErrorKindOther      ErrorKind = "other"
+)
+
+// Classifies err, including unwrapped I/O errors such as a refused connection from Connect
+func KindOf(err error) ErrorKind {
+	var instrumentErr *InstrumentError
+	err = transportError(err)
+	switch {
+	case err == nil:
+		return ErrorKindNone
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.Is(err, ErrConnectionClosed):
+		return ErrorKindConnection
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return ErrorKindTimeout
+	case errors.Is(err, ErrProtocol):
+		return ErrorKindProtocol
+	case errors.Is(err, ErrLocked):
+		return ErrorKindLocked
+	case errors.As(err, &instrumentErr):
+		return ErrorKindInstrument
+	}
+	return ErrorKindOther
+}
+
+// Wraps an I/O error from a connection in ErrConnectionClosed or ErrTimeout when it is one
+func transportError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, ErrConnectionClosed) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrProtocol) {
+		return err
+	}
+	if isConnectionError(err) {
+		return fmt.Errorf("%w: %v", ErrConnectionClosed, err)
+	}
+	var netErr net.Error
+	if errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %v", ErrTimeout, err)
+	}
+	return err
+}
+
+func isConnectionError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ENOTCONN) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EIO)
+}
+
+func protocolError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrProtocol, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected ErrorKind
+	}{
+		{nil, ErrorKindNone},
+		{transportError(io.EOF), ErrorKindConnection},
+		{transportError(fmt.Errorf("write: %w", syscall.ECONNRESET)), ErrorKindConnection},
+		{transportError(os.ErrDeadlineExceeded), ErrorKindTimeout},
+		{fmt.Errorf("%w: %v", context.DeadlineExceeded, os.ErrDeadlineExceeded), ErrorKindTimeout},
+		{fmt.Errorf("%w: read interrupted", context.Canceled), ErrorKindCanceled},
+		{protocolError("unexpected message type %d", 3), ErrorKindProtocol},
+		{fmt.Errorf("failed to lock inst0: %w", vxi11Error(11)), ErrorKindLocked},
+		{fmt.Errorf("query failed: %w", &InstrumentError{Code: -113, Message: "Undefined header"}), ErrorKindInstrument},
+		{errors.New("something else"), ErrorKindOther},
+	}
+	for _, test := range tests {
+		if kind := KindOf(test.err); kind != test.expected {
+			t.Errorf("KindOf(%v) = %q, expected %q", test.err, kind, test.expected)
+		}
+	}
+}
+
+func TestReadResponseMalformedBlockIsProtocolError(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("#2a1\n"))
+	if _, err := readResponse(r, "\n", DefaultMaxResponseSize); !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected protocol error, got %v", err)
+	}
+}
+
+func TestScpiQueryTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Accepts the connection but never answers
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	inst := NewScpiInstrument(Framing{}, 20*time.Millisecond, false)
+	if err := inst.Connect(listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	_, err = inst.Query("*OPC?")
+	if !errors.Is(err, ErrTimeout) || errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestScpiQueryConnectionLost(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Hangs up as soon as the first command arrives
+		conn, err := listener.Accept()
+		if err == nil {
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+
+	inst := NewScpiInstrument(Framing{}, time.Second, false)
+	if err := inst.Connect(listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	if _, err := inst.Query("*IDN?"); KindOf(err) != ErrorKindConnection {
+		t.Errorf("expected connection lost, got %v", err)
+	}
+}
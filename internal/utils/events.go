@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Request Service bit of the status byte, set while the instrument asserts SRQ
+const stbRequestService = 1 << 6
+
+// StatusEvent reports the instrument's status byte (IEEE 488.2 section 11.2) after a service request or a change
+type StatusEvent struct {
+	Time       time.Time `json:"time"`
+	StatusByte byte      `json:"statusByte"`
+	// ServiceRequest is true when the instrument requested service, either through an interrupt channel or the RQS bit
+	ServiceRequest bool `json:"serviceRequest"`
+}
+
+// EventSource is implemented by instruments whose transport delivers service requests without polling
+type EventSource interface {
+	// Events delivers a StatusEvent for each service request until ctx is done or the connection is lost, then closes the channel
+	Events(ctx context.Context) (<-chan StatusEvent, error)
+}
+
+const DefaultEventPollInterval = time.Second
+
+type EventOptions struct {
+	// PollInterval is how often *STB? is queried when the instrument is not an EventSource. Zero means DefaultEventPollInterval.
+	PollInterval time.Duration
+	// Guard, if set, is held during each poll and a poll is skipped while someone else holds it, so polls never interleave
+	// with other calls on the instrument
+	Guard *sync.Mutex
+}
+
+// Delivers status events until ctx is done or the connection is lost. Instruments that are an EventSource report service
+// requests through their interrupt channel, any other instrument is polled with *STB? and reports each change of the
+// status byte, starting with its current value.
+func SubscribeEvents(ctx context.Context, inst Instrument, opts EventOptions) (<-chan StatusEvent, error) {
+	if source, ok := As[EventSource](inst); ok {
+		if events, err := source.Events(ctx); err == nil {
+			return events, nil
+		}
+		// e.g. a VXI-11 instrument that cannot reach back to an IPv6 address, polling still works
+	}
+
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultEventPollInterval
+	}
+	events := make(chan StatusEvent, 16)
+	go func() {
+		defer close(events)
+		last := -1
+		for {
+			value, err := pollStatusByte(ctx, inst, opts.Guard)
+			if errors.Is(err, ErrConnectionClosed) || ctx.Err() != nil {
+				return
+			}
+			if err == nil && value >= 0 && value != last {
+				last = value
+				event := StatusEvent{Time: time.Now(), StatusByte: byte(value), ServiceRequest: value&stbRequestService != 0}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Returns -1 without querying if guard is held by someone else
+func pollStatusByte(ctx context.Context, inst Instrument, guard *sync.Mutex) (int, error) {
+	if guard != nil {
+		if !guard.TryLock() {
+			return -1, nil
+		}
+		defer guard.Unlock()
+	}
+	res, err := inst.QueryContext(ctx, "*STB?")
+	if err != nil {
+		return -1, err
+	}
+	return parseRegister(res)
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribeEventsPolling(t *testing.T) {
+	inst := connectFakeSocket(t, []byte("+0\n"), []byte("+0\n"), []byte("+80\n"))
+	var guard sync.Mutex
+	guard.Lock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := SubscribeEvents(ctx, inst, EventOptions{PollInterval: 5 * time.Millisecond, Guard: &guard})
+	if err != nil {
+		t.Fatalf("SubscribeEvents failed: %v", err)
+	}
+
+	// No polls while someone else holds the guard
+	select {
+	case event := <-events:
+		t.Fatalf("expected no event while the guard is held, got %+v", event)
+	case <-time.After(30 * time.Millisecond):
+	}
+	guard.Unlock()
+
+	expected := []StatusEvent{{StatusByte: 0}, {StatusByte: 80, ServiceRequest: true}}
+	for _, want := range expected {
+		select {
+		case event := <-events:
+			if event.StatusByte != want.StatusByte || event.ServiceRequest != want.ServiceRequest {
+				t.Errorf("expected %+v, got %+v", want, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %+v", want)
+		}
+	}
+
+	// The fake server hangs up after its last response, which ends the subscription
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected no more events")
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("expected the events channel to close when the connection is lost")
+	}
+}
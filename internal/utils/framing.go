@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TerminationEoi stands for no termination characters: commands are sent as is and a response ends with the transport's
+// end-of-message signal, the END bit of VXI-11 and HiSLIP. Raw sockets and serial ports have no such signal.
+const TerminationEoi = "EOI"
+
+// DefaultMaxResponseSize bounds a single response, so a runaway instrument or a corrupt block header cannot exhaust memory
+const DefaultMaxResponseSize = 64 << 20
+
+// Framing is how messages are delimited on the wire
+type Framing struct {
+	// WriteTermination is appended to every command. Empty means LF.
+	WriteTermination string
+	// ReadTermination ends every response. Empty means LF.
+	ReadTermination string
+	// MaxResponseSize is the most bytes read for one response, including block payloads. Zero means DefaultMaxResponseSize.
+	MaxResponseSize int
+}
+
+// Converts a termination name (LF, CR, CRLF, or NONE and EOI for TerminationEoi) into the characters it represents
+func ParseTermination(s string) (string, error) {
+	switch strings.ToUpper(s) {
+	case "", "LF":
+		return "\n", nil
+	case "CR":
+		return "\r", nil
+	case "CRLF":
+		return "\r\n", nil
+	case "NONE", "EOI":
+		return TerminationEoi, nil
+	}
+	return "", fmt.Errorf("unknown termination '%s', expected LF, CR, CRLF or NONE", s)
+}
+
+func (f Framing) writeTermination() string {
+	return terminationChars(f.WriteTermination)
+}
+
+func (f Framing) readTermination() string {
+	return terminationChars(f.ReadTermination)
+}
+
+func terminationChars(termination string) string {
+	switch termination {
+	case "":
+		return "\n"
+	case TerminationEoi:
+		return ""
+	}
+	return termination
+}
+
+func (f Framing) maxResponseSize() int {
+	if f.MaxResponseSize <= 0 {
+		return DefaultMaxResponseSize
+	}
+	return f.MaxResponseSize
+}
+
+// Stream transports find the end of a message by its termination alone, so they cannot use TerminationEoi
+func (f Framing) requireTerminations(transport string) error {
+	if f.WriteTermination == TerminationEoi || f.ReadTermination == TerminationEoi {
+		return fmt.Errorf("%s has no end-of-message signal, so it needs LF, CR or CRLF terminations", transport)
+	}
+	return nil
+}
+
+func responseTooLarge(maxSize int) error {
+	return protocolError("response exceeds the maximum size of %d bytes", maxSize)
+}
+
+// InstrumentProfile holds the framing an instrument model needs, so it can be kept in a file instead of being repeated
+// for each connection. Terminations are names as accepted by ParseTermination, empty fields keep the default.
+type InstrumentProfile struct {
+	WriteTermination string `json:"writeTermination,omitempty"`
+	ReadTermination  string `json:"readTermination,omitempty"`
+	MaxResponseSize  int    `json:"maxResponseSize,omitempty"`
+}
+
+func LoadInstrumentProfile(path string) (InstrumentProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return InstrumentProfile{}, err
+	}
+	var profile InstrumentProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return InstrumentProfile{}, fmt.Errorf("invalid instrument profile %s: %w", path, err)
+	}
+	if _, err := profile.Framing(); err != nil {
+		return InstrumentProfile{}, fmt.Errorf("invalid instrument profile %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+func (p InstrumentProfile) Framing() (Framing, error) {
+	writeTermination, err := ParseTermination(p.WriteTermination)
+	if err != nil {
+		return Framing{}, err
+	}
+	readTermination, err := ParseTermination(p.ReadTermination)
+	if err != nil {
+		return Framing{}, err
+	}
+	if p.MaxResponseSize < 0 {
+		return Framing{}, fmt.Errorf("maximum response size must not be negative")
+	}
+	return Framing{WriteTermination: writeTermination, ReadTermination: readTermination, MaxResponseSize: p.MaxResponseSize}, nil
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTermination(t *testing.T) {
+	for name, expected := range map[string]string{"": "\n", "lf": "\n", "CR": "\r", "CRLF": "\r\n", "none": TerminationEoi} {
+		if termination, err := ParseTermination(name); err != nil || termination != expected {
+			t.Errorf("ParseTermination(%q) = %q %v, expected %q", name, termination, err, expected)
+		}
+	}
+	if _, err := ParseTermination("TAB"); err == nil {
+		t.Error("expected unknown termination to fail")
+	}
+}
+
+func TestFramingDefaults(t *testing.T) {
+	var framing Framing
+	if framing.writeTermination() != "\n" || framing.readTermination() != "\n" || framing.maxResponseSize() != DefaultMaxResponseSize {
+		t.Errorf("expected LF terminations and the default maximum size, got %+v", framing)
+	}
+	framing = Framing{WriteTermination: TerminationEoi, ReadTermination: TerminationEoi}
+	if framing.writeTermination() != "" || framing.readTermination() != "" {
+		t.Errorf("expected no termination characters, got %+v", framing)
+	}
+	if err := framing.requireTerminations("a raw socket"); err == nil {
+		t.Error("expected stream transports to reject EOI framing")
+	}
+}
+
+func TestLoadInstrumentProfile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profile.json")
+	if err := os.WriteFile(path, []byte(`{"writeTermination": "CRLF", "readTermination": "NONE", "maxResponseSize": 1024}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	profile, err := LoadInstrumentProfile(path)
+	if err != nil {
+		t.Fatalf("LoadInstrumentProfile failed: %v", err)
+	}
+	framing, err := profile.Framing()
+	if err != nil || framing != (Framing{WriteTermination: "\r\n", ReadTermination: TerminationEoi, MaxResponseSize: 1024}) {
+		t.Errorf("unexpected framing %+v %v", framing, err)
+	}
+
+	path = filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(path, []byte(`{"readTermination": "ETX"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadInstrumentProfile(path); err == nil {
+		t.Error("expected profile with unknown termination to fail")
+	}
+}
@@ -0,0 +1,671 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HiSLIP (IVI-6.1) message types
+const (
+	hislipInitialize                      = 0
+	hislipInitializeResponse              = 1
+	hislipFatalError                      = 2
+	hislipError                           = 3
+	hislipAsyncLock                       = 4
+	hislipAsyncLockResponse               = 5
+	hislipData                            = 6
+	hislipDataEnd                         = 7
+	hislipDeviceClearComplete             = 8
+	hislipDeviceClearAcknowledge          = 9
+	hislipAsyncMaximumMessageSize         = 15
+	hislipAsyncMaximumMessageSizeResponse = 16
+	hislipAsyncInitialize                 = 17
+	hislipAsyncInitializeResponse         = 18
+	hislipAsyncDeviceClear                = 19
+	hislipAsyncServiceRequest             = 20
+	hislipAsyncStatusQuery                = 21
+	hislipAsyncStatusResponse             = 22
+	hislipAsyncDeviceClearAcknowledge     = 23
+)
+
+const (
+	hislipPort             = 4880
+	hislipProtocolVersion  = 0x0200
+	hislipVendorId         = 'S'<<8 | 'C'
+	hislipInitialMessageId = 0xffffff00
+	hislipHeaderLength     = 16
+	hislipMaxPayload       = 1 << 24
+
+	hislipControlOverlapped   = 0x01
+	hislipControlRmtDelivered = 0x01
+	hislipControlEncryption   = 0x02
+)
+
+var hislipFatalErrorMessages = map[byte]string{
+	0: "unidentified error",
+	1: "poorly formed message header",
+	2: "attempt to use connection without both channels established",
+	3: "invalid initialization sequence",
+	4: "server refused connection due to maximum number of clients exceeded",
+	5: "secure connection failed",
+}
+
+var hislipErrorMessages = map[byte]string{
+	0: "unidentified error",
+	1: "unrecognized message type",
+	2: "unrecognized control code",
+	3: "unrecognized vendor defined message",
+	4: "message too large",
+	5: "authentication failed",
+}
+
+type hislipMessage struct {
+	messageType byte
+	control     byte
+	parameter   uint32
+	payload     []byte
+}
+
+// HislipMode selects between synchronized and overlapped HiSLIP operation
+type HislipMode int
+
+const (
+	// Use whichever mode the instrument prefers
+	HislipModeDefault HislipMode = iota
+	HislipModeSynchronized
+	HislipModeOverlapped
+)
+
+type hislipInstrument struct {
+	subAddress string
+	mode       HislipMode
+	framing    Framing
+	overlapped bool
+	sync       net.Conn
+	// Held while using the sync channel, for the whole of a command, query or device clear
+	syncMu  sync.Mutex
+	async   net.Conn
+	asyncMu sync.Mutex
+	// Set while Events reads the async channel, which then hands the replies to asyncTransaction through it
+	asyncReplies   chan hislipMessage
+	sessionId      uint16
+	messageId      uint32
+	rmtDelivered   bool
+	maxMessageSize uint64
+	timeout        timeoutSetting
+	interrupted    bool
+	interactive    bool
+	headersHash    uint32
+	starTree       ScpiNode
+	colonTree      ScpiNode
+	diagnostics    []ParseDiagnostic
+}
+
+// SubAddress is the HiSLIP device name, e.g. hislip0. An empty subAddress uses hislip0.
+// The instrument chooses the mode at connection time. If it differs from the requested mode it is renegotiated with a device clear.
+func NewHislipInstrument(subAddress string, mode HislipMode, framing Framing, timeout time.Duration, interactive bool) Instrument {
+	if subAddress == "" {
+		subAddress = "hislip0"
+	}
+	i := &hislipInstrument{subAddress: subAddress, mode: mode, framing: framing, interactive: interactive}
+	i.timeout.set(timeout)
+	return i
+}
+
+// Address is the instrument host, optionally followed by the HiSLIP port (default 4880)
+func (i *hislipInstrument) Connect(address string, progress func(int)) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, fmt.Sprint(hislipPort))
+	}
+	d := net.Dialer{Timeout: i.timeout.get()}
+
+	syncConn, err := d.Dial("tcp", address)
+	if err != nil {
+		return err
+	}
+	if err := i.initialize(syncConn); err != nil {
+		syncConn.Close()
+		return err
+	}
+	if progress != nil {
+		progress(20)
+	}
+
+	asyncConn, err := d.Dial("tcp", address)
+	if err != nil {
+		syncConn.Close()
+		return err
+	}
+	if err := i.asyncInitialize(asyncConn); err != nil {
+		syncConn.Close()
+		asyncConn.Close()
+		return err
+	}
+	i.sync = syncConn
+	i.async = asyncConn
+
+	if err := i.negotiateMaximumMessageSize(); err != nil {
+		i.Close()
+		return err
+	}
+	if i.mode != HislipModeDefault && i.overlapped != (i.mode == HislipModeOverlapped) {
+		if err := i.Clear(); err != nil {
+			i.Close()
+			return err
+		}
+	}
+	if progress != nil {
+		progress(20)
+	}
+	return nil
+}
+
+func (i *hislipInstrument) initialize(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(i.timeout.get()))
+	err := writeHislipMessage(conn, hislipMessage{
+		messageType: hislipInitialize,
+		parameter:   hislipProtocolVersion<<16 | hislipVendorId,
+		payload:     []byte(i.subAddress),
+	})
+	if err != nil {
+		return err
+	}
+	res, err := expectHislipMessage(conn, hislipInitializeResponse)
+	if err != nil {
+		return fmt.Errorf("hislip initialize failed: %w", err)
+	}
+	if res.control&hislipControlEncryption != 0 {
+		return fmt.Errorf("hislip initialize failed: instrument requires an encrypted connection, which is not supported")
+	}
+	i.overlapped = res.control&hislipControlOverlapped != 0
+	i.sessionId = uint16(res.parameter)
+	i.messageId = hislipInitialMessageId
+	return nil
+}
+
+func (i *hislipInstrument) asyncInitialize(conn net.Conn) error {
+	_ = conn.SetDeadline(time.Now().Add(i.timeout.get()))
+	if err := writeHislipMessage(conn, hislipMessage{messageType: hislipAsyncInitialize, parameter: uint32(i.sessionId)}); err != nil {
+		return err
+	}
+	if _, err := expectHislipMessage(conn, hislipAsyncInitializeResponse); err != nil {
+		return fmt.Errorf("hislip async initialize failed: %w", err)
+	}
+	return nil
+}
+
+func (i *hislipInstrument) negotiateMaximumMessageSize() error {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, hislipMaxPayload)
+	res, err := i.asyncTransaction(hislipMessage{messageType: hislipAsyncMaximumMessageSize, payload: payload}, hislipAsyncMaximumMessageSizeResponse)
+	if err != nil {
+		return err
+	}
+	if len(res.payload) != 8 {
+		return protocolError("hislip: malformed maximum message size response")
+	}
+	i.maxMessageSize = binary.BigEndian.Uint64(res.payload)
+	return nil
+}
+
+func (i *hislipInstrument) asyncTransaction(msg hislipMessage, responseType byte) (hislipMessage, error) {
+	return i.asyncTransactionTimeout(msg, responseType, i.timeout.get())
+}
+
+// Like asyncTransaction, for replies the instrument may take longer than the default timeout to send
+func (i *hislipInstrument) asyncTransactionTimeout(msg hislipMessage, responseType byte, timeout time.Duration) (hislipMessage, error) {
+	i.asyncMu.Lock()
+	defer i.asyncMu.Unlock()
+	if i.asyncReplies != nil {
+		return i.listenerTransaction(msg, responseType, timeout)
+	}
+	_ = i.async.SetDeadline(time.Now().Add(timeout))
+	if err := writeHislipMessage(i.async, msg); err != nil {
+		return hislipMessage{}, i.wrapError(err)
+	}
+	res, err := expectHislipMessage(i.async, responseType)
+	if err != nil {
+		return hislipMessage{}, i.wrapError(err)
+	}
+	return res, nil
+}
+
+// Like asyncTransaction, but the reply is read by the Events listener. Must be called with asyncMu held.
+func (i *hislipInstrument) listenerTransaction(msg hislipMessage, responseType byte, timeout time.Duration) (hislipMessage, error) {
+	_ = i.async.SetWriteDeadline(time.Now().Add(i.timeout.get()))
+	if err := writeHislipMessage(i.async, msg); err != nil {
+		return hislipMessage{}, i.wrapError(err)
+	}
+	expired := time.After(timeout)
+	for {
+		select {
+		case res, ok := <-i.asyncReplies:
+			if !ok {
+				return hislipMessage{}, fmt.Errorf("%w: hislip async channel closed while waiting for a reply", ErrConnectionClosed)
+			}
+			if err := hislipErrorFromMessage(res); err != nil {
+				return hislipMessage{}, err
+			}
+			if res.messageType == responseType {
+				return res, nil
+			}
+		case <-expired:
+			return hislipMessage{}, fmt.Errorf("%w: no hislip async reply of type %d", ErrTimeout, responseType)
+		}
+	}
+}
+
+// Events reads the async channel for service requests, and answers each with the status byte from an AsyncStatusQuery.
+// Other async transactions keep working while it runs.
+func (i *hislipInstrument) Events(ctx context.Context) (<-chan StatusEvent, error) {
+	replies := make(chan hislipMessage, 1)
+	i.asyncMu.Lock()
+	if i.asyncReplies != nil {
+		i.asyncMu.Unlock()
+		return nil, errors.New("hislip: events are already being delivered")
+	}
+	i.asyncReplies = replies
+	_ = i.async.SetReadDeadline(time.Time{})
+	i.asyncMu.Unlock()
+
+	events := make(chan StatusEvent, 16)
+	requests := make(chan struct{}, 1)
+	stop := context.AfterFunc(ctx, func() { _ = i.async.SetReadDeadline(time.Now()) })
+	listenerDone := make(chan struct{})
+
+	go func() {
+		defer close(listenerDone)
+		for {
+			msg, err := readHislipMessage(i.async)
+			if err != nil {
+				return
+			}
+			if msg.messageType == hislipAsyncServiceRequest {
+				select {
+				case requests <- struct{}{}:
+				default: // a status query is already pending
+				}
+				continue
+			}
+			select {
+			case replies <- msg:
+			default: // nobody is waiting for it
+			}
+		}
+	}()
+
+	go func() {
+		defer close(events)
+		defer func() {
+			stop()
+			_ = i.async.SetReadDeadline(time.Now())
+			<-listenerDone
+			close(replies)
+			i.asyncMu.Lock()
+			i.asyncReplies = nil
+			i.asyncMu.Unlock()
+		}()
+		for {
+			select {
+			case <-requests:
+			case <-listenerDone:
+				return
+			case <-ctx.Done():
+				return
+			}
+			// RMT-delivered and the message ID are left at zero, so the query does not affect the Message Available bit
+			res, err := i.asyncTransaction(hislipMessage{messageType: hislipAsyncStatusQuery}, hislipAsyncStatusResponse)
+			if err != nil {
+				if errors.Is(err, ErrConnectionClosed) {
+					return
+				}
+				continue
+			}
+			select {
+			case events <- StatusEvent{Time: time.Now(), StatusByte: res.control, ServiceRequest: true}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Clear performs a HiSLIP device clear, discarding any pending input and output and resetting the message sequence.
+// The device clear also requests the configured synchronized or overlapped mode.
+func (i *hislipInstrument) Clear() error {
+	i.syncMu.Lock()
+	defer i.syncMu.Unlock()
+	return i.clear()
+}
+
+func (i *hislipInstrument) clear() error {
+	if _, err := i.asyncTransaction(hislipMessage{messageType: hislipAsyncDeviceClear}, hislipAsyncDeviceClearAcknowledge); err != nil {
+		return fmt.Errorf("hislip device clear failed: %w", err)
+	}
+	// An interrupted read may have stopped halfway through a message, so the sync channel is drained regardless of message boundaries
+	if i.interrupted {
+		if err := flushInput(i.sync, i.sync, i.timeout.get()); err != nil {
+			return i.wrapError(err)
+		}
+	}
+
+	var features byte
+	if i.mode == HislipModeOverlapped || (i.mode == HislipModeDefault && i.overlapped) {
+		features = hislipControlOverlapped
+	}
+	_ = i.sync.SetDeadline(time.Now().Add(i.timeout.get()))
+	if err := writeHislipMessage(i.sync, hislipMessage{messageType: hislipDeviceClearComplete, control: features}); err != nil {
+		return i.wrapError(err)
+	}
+	for {
+		// Data still in flight from before the clear is discarded
+		res, err := readHislipMessage(i.sync)
+		if err != nil {
+			return i.wrapError(err)
+		}
+		if res.messageType == hislipDeviceClearAcknowledge {
+			i.overlapped = res.control&hislipControlOverlapped != 0
+			break
+		}
+		if err := hislipErrorFromMessage(res); err != nil {
+			return err
+		}
+	}
+	i.messageId = hislipInitialMessageId
+	i.rmtDelivered = false
+	i.interrupted = false
+	return nil
+}
+
+// Lock requests the exclusive lock with AsyncLock, waiting up to timeout for other clients to release it
+func (i *hislipInstrument) Lock(timeout time.Duration) error {
+	msg := hislipMessage{messageType: hislipAsyncLock, control: 1, parameter: uint32(timeout.Milliseconds())}
+	res, err := i.asyncTransactionTimeout(msg, hislipAsyncLockResponse, timeout+i.timeout.get())
+	if err != nil {
+		return fmt.Errorf("hislip lock failed: %w", err)
+	}
+	switch res.control {
+	case 1:
+		return nil
+	case 0:
+		return fmt.Errorf("%w: hislip lock was not released by its holder in time", ErrLocked)
+	}
+	return fmt.Errorf("hislip lock failed: the instrument rejected the request")
+}
+
+// Unlock releases the lock after the instrument has processed the last message sent
+func (i *hislipInstrument) Unlock() error {
+	// The id of the last message sent, read once the sync channel is free so it is not changing meanwhile
+	i.syncMu.Lock()
+	lastMessageId := i.messageId - 2
+	i.syncMu.Unlock()
+	msg := hislipMessage{messageType: hislipAsyncLock, parameter: lastMessageId}
+	res, err := i.asyncTransaction(msg, hislipAsyncLockResponse)
+	if err != nil {
+		return fmt.Errorf("hislip unlock failed: %w", err)
+	}
+	if res.control != 1 && res.control != 2 {
+		return fmt.Errorf("hislip unlock failed: no lock is held")
+	}
+	return nil
+}
+
+func (i *hislipInstrument) Command(command string) error {
+	return i.CommandContext(context.Background(), command)
+}
+
+func (i *hislipInstrument) CommandContext(ctx context.Context, command string) error {
+	i.syncMu.Lock()
+	defer i.syncMu.Unlock()
+	if err := i.write(ctx, command+i.framing.writeTermination()); err != nil {
+		return fmt.Errorf("failed to execute the command '%s': %w", command, err)
+	}
+	return nil
+}
+
+func (i *hislipInstrument) write(ctx context.Context, data string) error {
+	// A device clear discards whatever an interrupted call left behind
+	if i.interrupted {
+		if err := i.clear(); err != nil {
+			return err
+		}
+	}
+
+	b := []byte(data)
+	stop := bindContext(ctx, i.sync, i.timeout.get())
+	defer stop()
+	for {
+		chunk := b
+		messageType := byte(hislipDataEnd)
+		if i.maxMessageSize > hislipHeaderLength && uint64(len(chunk)) > i.maxMessageSize-hislipHeaderLength {
+			chunk = chunk[:i.maxMessageSize-hislipHeaderLength]
+			messageType = hislipData
+		}
+
+		var control byte
+		if i.rmtDelivered {
+			control = hislipControlRmtDelivered
+			i.rmtDelivered = false
+		}
+		err := writeHislipMessage(i.sync, hislipMessage{messageType: messageType, control: control, parameter: i.messageId, payload: chunk})
+		if err != nil {
+			return contextError(ctx, i.wrapError(err))
+		}
+		i.messageId += 2
+		b = b[len(chunk):]
+		if messageType == hislipDataEnd {
+			return nil
+		}
+	}
+}
+
+func (i *hislipInstrument) read(ctx context.Context) ([]byte, error) {
+	// The message ID of the DataEnd that carried the query
+	queryId := i.messageId - 2
+	var result []byte
+	stop := bindContext(ctx, i.sync, i.timeout.get())
+	defer stop()
+	for {
+		msg, err := readHislipMessage(i.sync)
+		if err != nil {
+			return nil, contextError(ctx, i.wrapError(err))
+		}
+		if err := hislipErrorFromMessage(msg); err != nil {
+			return nil, err
+		}
+		if msg.messageType != hislipData && msg.messageType != hislipDataEnd {
+			return nil, protocolError("hislip: unexpected message type %d while reading response", msg.messageType)
+		}
+		if i.overlapped && msg.parameter != queryId {
+			continue // response to an earlier, abandoned query
+		}
+		result = append(result, msg.payload...)
+		if maxSize := i.framing.maxResponseSize(); len(result) > maxSize {
+			// The rest of the response is discarded by the device clear before the next call
+			i.interrupted = true
+			return nil, responseTooLarge(maxSize)
+		}
+		if msg.messageType == hislipDataEnd {
+			i.rmtDelivered = true
+			return result, nil
+		}
+	}
+}
+
+func (i *hislipInstrument) wrapError(err error) error {
+	if err = transportError(err); errors.Is(err, ErrConnectionClosed) {
+		return err
+	}
+	i.interrupted = true
+	return err
+}
+
+func (i *hislipInstrument) Query(cmd string) (string, error) {
+	return i.QueryContext(context.Background(), cmd)
+}
+
+func (i *hislipInstrument) QueryContext(ctx context.Context, cmd string) (string, error) {
+	b, err := i.QueryBytesContext(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return responseString(b), nil
+}
+
+func (i *hislipInstrument) QueryBytes(cmd string) ([]byte, error) {
+	return i.QueryBytesContext(context.Background(), cmd)
+}
+
+func (i *hislipInstrument) QueryBytesContext(ctx context.Context, cmd string) ([]byte, error) {
+	i.syncMu.Lock()
+	defer i.syncMu.Unlock()
+	return i.query(ctx, cmd)
+}
+
+// Must be called with syncMu held
+func (i *hislipInstrument) query(ctx context.Context, cmd string) ([]byte, error) {
+	if err := i.write(ctx, cmd+i.framing.writeTermination()); err != nil {
+		return nil, err
+	}
+
+	finish := trackQueryProgress(callTimeout(ctx, i.timeout.get()), i.interactive)
+	b, err := i.read(ctx)
+	finish(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(b, i.framing.readTermination())
+}
+
+func (i *hislipInstrument) QueryError(opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return i.QueryErrorContext(context.Background(), opts)
+}
+
+// The queue is drained holding syncMu, so no other call runs between its queries
+func (i *hislipInstrument) QueryErrorContext(ctx context.Context, opts ErrorQueueOptions) ([]InstrumentError, error) {
+	i.syncMu.Lock()
+	defer i.syncMu.Unlock()
+	return queryErrorQueue(ctx, func(ctx context.Context, cmd string) (string, error) {
+		b, err := i.query(ctx, cmd)
+		if err != nil {
+			return "", err
+		}
+		return responseString(b), nil
+	}, opts)
+}
+
+func (i *hislipInstrument) GetSupportedCommandsTree() (ScpiNode, ScpiNode, error) {
+	r, err := i.Query(":SYST:HELP:HEAD?")
+	if err != nil {
+		return ScpiNode{}, ScpiNode{}, err
+	}
+	if hash := hash(r); hash != i.headersHash {
+		i.starTree, i.colonTree, i.diagnostics = parseHeaders(strings.Split(r, "\n"))
+		i.headersHash = hash
+	}
+	return i.starTree, i.colonTree, nil
+}
+
+func (i *hislipInstrument) HeaderDiagnostics() []ParseDiagnostic {
+	return i.diagnostics
+}
+
+func (i *hislipInstrument) SetTimeout(timeout time.Duration) {
+	i.timeout.set(timeout)
+}
+
+func (i *hislipInstrument) conns() []net.Conn {
+	return []net.Conn{i.sync, i.async}
+}
+
+func (i *hislipInstrument) Close() error {
+	var errs []error
+	if i.async != nil {
+		errs = append(errs, i.async.Close())
+	}
+	if i.sync != nil {
+		errs = append(errs, i.sync.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func writeHislipMessage(w io.Writer, msg hislipMessage) error {
+	b := make([]byte, hislipHeaderLength+len(msg.payload))
+	b[0] = 'H'
+	b[1] = 'S'
+	b[2] = msg.messageType
+	b[3] = msg.control
+	binary.BigEndian.PutUint32(b[4:], msg.parameter)
+	binary.BigEndian.PutUint64(b[8:], uint64(len(msg.payload)))
+	copy(b[hislipHeaderLength:], msg.payload)
+	_, err := w.Write(b)
+	return err
+}
+
+func readHislipMessage(r io.Reader) (hislipMessage, error) {
+	header := make([]byte, hislipHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return hislipMessage{}, err
+	}
+	if header[0] != 'H' || header[1] != 'S' {
+		return hislipMessage{}, protocolError("hislip: invalid message prologue %q", header[:2])
+	}
+	length := binary.BigEndian.Uint64(header[8:])
+	if length > hislipMaxPayload {
+		return hislipMessage{}, protocolError("hislip: message payload of %d bytes exceeds maximum of %d", length, hislipMaxPayload)
+	}
+	msg := hislipMessage{
+		messageType: header[2],
+		control:     header[3],
+		parameter:   binary.BigEndian.Uint32(header[4:]),
+		payload:     make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, msg.payload); err != nil {
+		return hislipMessage{}, err
+	}
+	return msg, nil
+}
+
+func expectHislipMessage(r io.Reader, messageType byte) (hislipMessage, error) {
+	msg, err := readHislipMessage(r)
+	if err != nil {
+		return msg, err
+	}
+	if err := hislipErrorFromMessage(msg); err != nil {
+		return msg, err
+	}
+	if msg.messageType != messageType {
+		return msg, protocolError("hislip: expected message type %d, got %d", messageType, msg.messageType)
+	}
+	return msg, nil
+}
+
+func hislipErrorFromMessage(msg hislipMessage) error {
+	var description string
+	switch msg.messageType {
+	case hislipFatalError:
+		description = hislipFatalErrorMessages[msg.control]
+	case hislipError:
+		description = hislipErrorMessages[msg.control]
+	default:
+		return nil
+	}
+	if description == "" {
+		description = fmt.Sprintf("error code %d", msg.control)
+	}
+	if len(msg.payload) > 0 {
+		description += ": " + string(msg.payload)
+	}
+	if msg.messageType == hislipFatalError {
+		return fmt.Errorf("%w: hislip fatal error: %s", ErrConnectionClosed, description)
+	}
+	return protocolError("hislip error: %s", description)
+}
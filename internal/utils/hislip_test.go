@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHislipServer implements the server side of the HiSLIP handshake, data transfer and device clear for a single session
+type fakeHislipServer struct {
+	listener       net.Listener
+	overlapped     bool
+	maxMessageSize uint64
+	mu             sync.Mutex
+	received       []string
+	dataMessages   int
+	clears         int
+	subAddress     string
+	statusByte     byte
+	asyncConn      net.Conn
+	writeMu        sync.Mutex
+	// Set while a client holds the lock
+	locked bool
+}
+
+func newFakeHislipServer(t *testing.T, overlapped bool) *fakeHislipServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeHislipServer{listener: listener, overlapped: overlapped, maxMessageSize: 48}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeHislipServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeHislipServer) handle(conn net.Conn) {
+	defer conn.Close()
+	var pending string
+	for {
+		msg, err := readHislipMessage(conn)
+		if err != nil {
+			return
+		}
+		var res hislipMessage
+		switch msg.messageType {
+		case hislipInitialize:
+			s.mu.Lock()
+			s.subAddress = string(msg.payload)
+			s.mu.Unlock()
+			res = hislipMessage{messageType: hislipInitializeResponse, parameter: hislipProtocolVersion<<16 | 42}
+			if s.overlapped {
+				res.control = hislipControlOverlapped
+			}
+		case hislipAsyncInitialize:
+			if msg.parameter != 42 {
+				res = hislipMessage{messageType: hislipFatalError, control: 3}
+				break
+			}
+			s.mu.Lock()
+			s.asyncConn = conn
+			s.mu.Unlock()
+			res = hislipMessage{messageType: hislipAsyncInitializeResponse, parameter: 'F'<<8 | 'K'}
+		case hislipAsyncMaximumMessageSize:
+			payload := make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, s.maxMessageSize)
+			res = hislipMessage{messageType: hislipAsyncMaximumMessageSizeResponse, payload: payload}
+		case hislipAsyncDeviceClear:
+			res = hislipMessage{messageType: hislipAsyncDeviceClearAcknowledge}
+		case hislipAsyncLock:
+			s.mu.Lock()
+			res = hislipMessage{messageType: hislipAsyncLockResponse}
+			switch {
+			case msg.control == 1 && !s.locked:
+				s.locked = true
+				res.control = 1
+			case msg.control == 0 && s.locked:
+				s.locked = false
+				res.control = 1
+			case msg.control == 0:
+				res.control = 3
+			}
+			s.mu.Unlock()
+		case hislipAsyncStatusQuery:
+			s.mu.Lock()
+			res = hislipMessage{messageType: hislipAsyncStatusResponse, control: s.statusByte}
+			s.mu.Unlock()
+		case hislipDeviceClearComplete:
+			s.mu.Lock()
+			s.clears++
+			s.overlapped = msg.control&hislipControlOverlapped != 0
+			s.mu.Unlock()
+			pending = ""
+			res = hislipMessage{messageType: hislipDeviceClearAcknowledge, control: msg.control}
+		case hislipData:
+			s.mu.Lock()
+			s.dataMessages++
+			s.mu.Unlock()
+			pending += string(msg.payload)
+			continue
+		case hislipDataEnd:
+			message := pending + string(msg.payload)
+			pending = ""
+			s.mu.Lock()
+			s.received = append(s.received, message)
+			s.mu.Unlock()
+			response := s.respond(strings.TrimSuffix(message, "\n"))
+			if response == "" {
+				continue
+			}
+			res = hislipMessage{messageType: hislipDataEnd, parameter: msg.parameter, payload: []byte(response)}
+		default:
+			res = hislipMessage{messageType: hislipError, control: 1}
+		}
+		s.writeMu.Lock()
+		err = writeHislipMessage(conn, res)
+		s.writeMu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Sets the status byte and asserts SRQ on the async channel
+func (s *fakeHislipServer) requestService(statusByte byte) error {
+	s.mu.Lock()
+	s.statusByte = statusByte
+	conn := s.asyncConn
+	s.mu.Unlock()
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeHislipMessage(conn, hislipMessage{messageType: hislipAsyncServiceRequest})
+}
+
+func (s *fakeHislipServer) respond(message string) string {
+	if strings.HasPrefix(message, ":ECHO") {
+		return message + "\n"
+	}
+	switch message {
+	case "*IDN?":
+		return "Fake,HiSLIP Instrument,0001,1.0\n"
+	case "SYST:ERR?":
+		return "+0,\"No error\"\n"
+	}
+	return ""
+}
+
+func connectFakeHislip(t *testing.T, serverOverlapped bool, mode HislipMode) (*fakeHislipServer, Instrument) {
+	s := newFakeHislipServer(t, serverOverlapped)
+	inst := NewHislipInstrument("", mode, Framing{}, time.Second, false)
+	if err := inst.Connect(s.listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { inst.Close() })
+	return s, inst
+}
+
+func TestHislipQuery(t *testing.T) {
+	s, inst := connectFakeHislip(t, false, HislipModeDefault)
+	res, err := inst.Query("*IDN?")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if res != "Fake,HiSLIP Instrument,0001,1.0\n" {
+		t.Errorf("unexpected *IDN? response %q", res)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subAddress != "hislip0" {
+		t.Errorf("expected default sub-address hislip0, got %q", s.subAddress)
+	}
+	if s.clears != 0 {
+		t.Errorf("expected no device clear when mode matches, got %d", s.clears)
+	}
+}
+
+func TestHislipConcurrentQueries(t *testing.T) {
+	_, inst := connectFakeHislip(t, false, HislipModeDefault)
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 10 {
+				query := fmt.Sprintf(":ECHO%d:VALue%d?", g, n)
+				if res, err := inst.Query(query); err != nil || res != query+"\n" {
+					t.Errorf("expected %s to get its own response, got %q %v", query, res, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHislipCommandSplitsLargeMessages(t *testing.T) {
+	s, inst := connectFakeHislip(t, false, HislipModeDefault)
+	command := ":DISPlay:WINDow:TEXT:DATA \"a message longer than the maximum message size\""
+	if err := inst.Command(command); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	if _, err := inst.Query("*IDN?"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.received[0] != command+"\n" {
+		t.Errorf("expected server to reassemble %q, got %q", command, s.received[0])
+	}
+	if s.dataMessages == 0 {
+		t.Error("expected command to be split into Data messages")
+	}
+}
+
+func TestHislipNegotiatesOverlappedMode(t *testing.T) {
+	s, inst := connectFakeHislip(t, false, HislipModeOverlapped)
+	s.mu.Lock()
+	if s.clears != 1 || !s.overlapped {
+		t.Errorf("expected device clear requesting overlapped mode, got %d clears, overlapped %v", s.clears, s.overlapped)
+	}
+	s.mu.Unlock()
+	if _, err := inst.Query("*IDN?"); err != nil {
+		t.Fatalf("Query in overlapped mode failed: %v", err)
+	}
+}
+
+func TestHislipClear(t *testing.T) {
+	s, inst := connectFakeHislip(t, true, HislipModeDefault)
+	clearer, ok := inst.(Clearer)
+	if !ok {
+		t.Fatal("expected HiSLIP instrument to support device clear")
+	}
+	if err := clearer.Clear(); err != nil {
+		t.Fatalf("Clear failed: %v", err)
+	}
+	s.mu.Lock()
+	if s.clears != 1 || !s.overlapped {
+		t.Errorf("expected device clear keeping overlapped mode, got %d clears, overlapped %v", s.clears, s.overlapped)
+	}
+	s.mu.Unlock()
+	errors, err := inst.QueryError(ErrorQueueOptions{})
+	if err != nil || len(errors) != 0 {
+		t.Errorf("expected empty error queue after clear, got %v %v", errors, err)
+	}
+}
+
+func TestHislipEvents(t *testing.T) {
+	s, inst := connectFakeHislip(t, false, HislipModeDefault)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := inst.(EventSource).Events(ctx)
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+
+	if err := s.requestService(0x44); err != nil {
+		t.Fatalf("requestService failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		if event.StatusByte != 0x44 || !event.ServiceRequest {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an event for the service request")
+	}
+
+	// Async transactions still get their replies while the listener owns the async channel
+	if err := inst.(Clearer).Clear(); err != nil {
+		t.Errorf("Clear failed while listening for events: %v", err)
+	}
+	if res, err := inst.Query("*IDN?"); err != nil || res != "Fake,HiSLIP Instrument,0001,1.0\n" {
+		t.Errorf("unexpected *IDN? response %q %v", res, err)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("expected no more events after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the events channel to close after cancel")
+	}
+	if err := inst.(Clearer).Clear(); err != nil {
+		t.Errorf("Clear failed after events stopped: %v", err)
+	}
+}
+
+func TestHislipEoiFramingAndMaxResponseSize(t *testing.T) {
+	s := newFakeHislipServer(t, false)
+	inst := NewHislipInstrument("", HislipModeDefault, Framing{WriteTermination: TerminationEoi, ReadTermination: TerminationEoi, MaxResponseSize: 16}, time.Second, false)
+	if err := inst.Connect(s.listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	if _, err := inst.Query("*IDN?"); !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected the 32 byte response to exceed the maximum size, got %v", err)
+	}
+	res, err := inst.Query("SYST:ERR?")
+	if err != nil || res != "+0,\"No error\"\n" {
+		t.Errorf("expected the next query to succeed, got %q %v", res, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.received) != 2 || s.received[0] != "*IDN?" {
+		t.Errorf("expected commands without a termination, got %q", s.received)
+	}
+	if s.clears == 0 {
+		t.Error("expected a device clear to discard the rest of the oversized response")
+	}
+}
+
+func TestHislipLock(t *testing.T) {
+	s := newFakeHislipServer(t, false)
+	inst := NewHislipInstrument("", HislipModeDefault, Framing{}, time.Second, false)
+	if err := inst.Connect(s.listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	locker := inst.(Locker)
+	if err := locker.Lock(time.Second); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	// The fake has a single lock, so a second request behaves as if another client held it
+	if err := locker.Lock(time.Second); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the held lock to be refused, got %v", err)
+	}
+	if err := locker.Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := locker.Unlock(); err == nil {
+		t.Error("expected unlocking without holding the lock to fail")
+	}
+}
@@ -2,47 +2,113 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
   "hash/fnv"
+	"io"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/schollz/progressbar"
 )
 
-var ErrConnectionClosed = errors.New("connection closed")
-
 type Instrument interface {
 	Connect(string, func(int)) error
 	Command(string) error
 	Query(string) (string, error)
+	// QueryBytes returns the raw response, without its termination. Arbitrary block responses are returned as their payload.
+	QueryBytes(string) ([]byte, error)
+	// The Context variants give up as soon as ctx is done. A ctx deadline replaces the default timeout for that call.
+	CommandContext(context.Context, string) error
+	QueryContext(context.Context, string) (string, error)
+	QueryBytesContext(context.Context, string) ([]byte, error)
+	QueryErrorContext(context.Context, ErrorQueueOptions) ([]InstrumentError, error)
 	GetSupportedCommandsTree() (ScpiNode, ScpiNode, error)
+	// SetTimeout sets the default timeout used by calls without a ctx deadline
 	SetTimeout(time.Duration)
-	QueryError([]string) ([]string, error)
+	// QueryError drains the instrument's error queue, returning its entries in order
+	QueryError(ErrorQueueOptions) ([]InstrumentError, error)
 	Close() error
 }
 
+// Clearer is implemented by instruments whose transport supports a device clear, which aborts pending operations and discards buffered input and output
+type Clearer interface {
+	Clear() error
+}
+
+// Locker is implemented by instruments whose transport has an exclusive lock, which also keeps other controllers out
+type Locker interface {
+	// Lock waits up to timeout for the lock, failing with ErrLocked if another controller still holds it
+	Lock(timeout time.Duration) error
+	// Unlock releases the lock taken by Lock
+	Unlock() error
+}
+
+// HeaderDiagnoser is implemented by instruments that parse :SYST:HELP:HEAD? for GetSupportedCommandsTree
+type HeaderDiagnoser interface {
+	// HeaderDiagnostics returns the header lines the last GetSupportedCommandsTree could not parse and left out
+	HeaderDiagnostics() []ParseDiagnostic
+}
+
+// Middleware wraps an instrument to add behaviour around its calls, such as logging or fault injection
+type Middleware func(Instrument) Instrument
+
+// Wrapper is implemented by instruments that wrap another instrument, such as those returned by a Middleware
+type Wrapper interface {
+	Unwrap() Instrument
+}
+
+// As returns the first instrument in the chain of wrappers around inst, starting with inst itself, that implements T.
+// Use it instead of a type assertion to find optional interfaces such as Locker.
+func As[T any](inst Instrument) (T, bool) {
+	for inst != nil {
+		if t, ok := inst.(T); ok {
+			return t, true
+		}
+		wrapper, ok := inst.(Wrapper)
+		if !ok {
+			break
+		}
+		inst = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
 type scpiInstrument struct {
 	address     string
+	framing     Framing
 	connection  *net.TCPConn
-	timeout     time.Duration
-  mu          sync.RWMutex
+	reader      *bufio.Reader
+	timeout     timeoutSetting
+	interrupted bool
+	// Transactions queued for the worker goroutine, the only one that touches the connection
+	requests  chan scpiRequest
+	closed    chan struct{}
+	closeOnce sync.Once
   interactive bool
   headersHash uint32
   starTree    ScpiNode
   colonTree   ScpiNode
+  diagnostics []ParseDiagnostic
 }
 
-func NewScpiInstrument(timeout time.Duration, interactive bool) Instrument {
-  return &scpiInstrument{timeout: timeout, interactive: interactive}
+// Raw sockets have no end-of-message signal, so framing cannot use TerminationEoi
+func NewScpiInstrument(framing Framing, timeout time.Duration, interactive bool) Instrument {
+  i := &scpiInstrument{framing: framing, interactive: interactive}
+  i.timeout.set(timeout)
+  return i
 }
 
 func (i *scpiInstrument) Connect(address string, progress func(int)) error {
+	if err := i.framing.requireTerminations("a raw socket"); err != nil {
+		return err
+	}
 	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
 		return err
@@ -51,7 +117,7 @@ func (i *scpiInstrument) Connect(address string, progress func(int)) error {
 		progress(20)
 	}
 
-	d := net.Dialer{Timeout: i.timeout}
+	d := net.Dialer{Timeout: i.timeout.get()}
 
 	conn, err := d.Dial("tcp", tcpAddr.String())
 	if err != nil {
@@ -63,152 +129,253 @@ func (i *scpiInstrument) Connect(address string, progress func(int)) error {
 
 	i.address = address
 	i.connection = conn.(*net.TCPConn)
+	i.reader = bufio.NewReader(i.connection)
+	i.requests = make(chan scpiRequest)
+	i.closed = make(chan struct{})
+	go i.serve()
 	return nil
 }
 
+// scpiRequest is a transaction: everything run does on the connection happens without any other call in between
+type scpiRequest struct {
+	ctx  context.Context
+	run  func(context.Context) error
+	done chan error
+}
+
+// Runs the queued transactions one at a time, in the order they were queued, until the instrument is closed
+func (i *scpiInstrument) serve() {
+	for {
+		select {
+		case req := <-i.requests:
+			if err := req.ctx.Err(); err != nil {
+				// Abandoned while waiting in the queue
+				req.done <- err
+				continue
+			}
+			req.done <- req.run(req.ctx)
+		case <-i.closed:
+			return
+		}
+	}
+}
+
+// Queues run and waits for the worker to finish it. A transaction that has started runs to completion or until ctx
+// interrupts its I/O.
+func (i *scpiInstrument) transaction(ctx context.Context, run func(context.Context) error) error {
+	req := scpiRequest{ctx: ctx, run: run, done: make(chan error, 1)}
+	select {
+	case i.requests <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-i.closed:
+		return fmt.Errorf("%w: instrument was closed", ErrConnectionClosed)
+	}
+	return <-req.done
+}
+
 func (i *scpiInstrument) Command(command string) error {
-	if err := i.exec(command); err != nil {
-		return fmt.Errorf("failed to execute the command '%s': %s", command, err)
+	return i.CommandContext(context.Background(), command)
+}
+
+func (i *scpiInstrument) CommandContext(ctx context.Context, command string) error {
+	err := i.transaction(ctx, func(ctx context.Context) error {
+		return i.exec(ctx, command)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute the command '%s': %w", command, err)
 	}
 	return nil
 }
 
-func (i *scpiInstrument) exec(cmd string) error {
-  i.mu.Lock()
-  defer i.mu.Unlock()
-	b := []byte(cmd + "\n")
-	_ = i.connection.SetWriteDeadline(time.Now().Add(i.timeout))
-	if _, err := i.connection.Write(b); err != nil {
-		if isConnectionError(err) {
-			return fmt.Errorf("%w: %v", ErrConnectionClosed, err)
+// Must only be called by the worker, as must read
+func (i *scpiInstrument) exec(ctx context.Context, cmd string) error {
+	if i.interrupted {
+		if err := flushInput(i.reader, i.connection, i.timeout.get()); err != nil {
+			return i.wrapError(ctx, err)
 		}
-		return err
+		i.interrupted = false
+	}
+
+	stop := bindContext(ctx, i.connection, i.timeout.get())
+	defer stop()
+	if _, err := i.connection.Write([]byte(cmd + i.framing.writeTermination())); err != nil {
+		return i.wrapError(ctx, err)
 	}
 	return nil
 }
 
-func isConnectionError(err error) bool {
-	if err == nil {
-		return false
+func (i *scpiInstrument) wrapError(ctx context.Context, err error) error {
+	if err = transportError(err); errors.Is(err, ErrConnectionClosed) {
+		return err
 	}
-	errStr := err.Error()
-	return strings.Contains(errStr, "broken pipe") ||
-		strings.Contains(errStr, "connection reset") ||
-		strings.Contains(errStr, "use of closed network connection") ||
-		strings.TrimSpace(errStr) == "EOF" ||
-		errors.Is(err, net.ErrClosed)
+	// Whatever part of the response was not read yet is discarded before the next call
+	i.interrupted = true
+	return contextError(ctx, err)
 }
 
-func (i *scpiInstrument) QueryError(errors []string) ([]string, error) {
-	res, err := i.Query("SYST:ERR?")
-	if err != nil {
-		return errors, err
-	}
-	if !strings.HasPrefix(res, "+0") {
-		errors = append(errors, strings.TrimRight(res, "\n"))
-		return i.QueryError(errors)
-	}
-	return errors, nil
+func (i *scpiInstrument) QueryError(opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return i.QueryErrorContext(context.Background(), opts)
+}
+
+// The whole drain is one transaction, so no other call can add to or read from the error queue halfway through
+func (i *scpiInstrument) QueryErrorContext(ctx context.Context, opts ErrorQueueOptions) ([]InstrumentError, error) {
+	var errs []InstrumentError
+	err := i.transaction(ctx, func(ctx context.Context) error {
+		var err error
+		errs, err = queryErrorQueue(ctx, func(ctx context.Context, cmd string) (string, error) {
+			b, err := i.query(ctx, cmd)
+			return responseString(b), err
+		}, opts)
+		return err
+	})
+	return errs, err
 }
 
 func (i *scpiInstrument) Query(cmd string) (res string, err error) {
+	return i.QueryContext(context.Background(), cmd)
+}
+
+func (i *scpiInstrument) QueryContext(ctx context.Context, cmd string) (res string, err error) {
   if (cmd == ":SARA?") {
     return "Sara is cute!", nil;
   }
 
-	if err := i.exec(cmd); err != nil {
+	b, err := i.QueryBytesContext(ctx, cmd)
+	if err != nil {
 		return "", err
 	}
+	return responseString(b), nil
+}
 
-	queryCompleted := make(chan bool, 1)
-	queryFailed := make(chan bool, 1)
-	done := make(chan bool)
-	go queryProgress(queryCompleted, queryFailed, done, i.timeout, i.interactive)
+func (i *scpiInstrument) QueryBytes(cmd string) ([]byte, error) {
+	return i.QueryBytesContext(context.Background(), cmd)
+}
 
-  i.mu.Lock()
-  defer i.mu.Unlock()
-	_ = i.connection.SetReadDeadline(time.Now().Add(i.timeout))
+func (i *scpiInstrument) QueryBytesContext(ctx context.Context, cmd string) ([]byte, error) {
+	var b []byte
+	err := i.transaction(ctx, func(ctx context.Context) error {
+		var err error
+		b, err = i.query(ctx, cmd)
+		return err
+	})
+	return b, err
+}
 
-	b := bufio.NewReader(i.connection)
-	buf := make([]byte, 4096)
+// Writes cmd and reads its response. Must only be called by the worker.
+func (i *scpiInstrument) query(ctx context.Context, cmd string) ([]byte, error) {
+	if err := i.exec(ctx, cmd); err != nil {
+		return nil, err
+	}
 
-	l, err := b.Read(buf)
+	finish := trackQueryProgress(callTimeout(ctx, i.timeout.get()), i.interactive)
+
+	stop := bindContext(ctx, i.connection, i.timeout.get())
+	defer stop()
+
+	b, err := readResponse(i.reader, i.framing.readTermination(), i.framing.maxResponseSize())
+	finish(err == nil)
 	if err != nil {
-		queryFailed <- true
-		<-done
-		if isConnectionError(err) {
-			return "", fmt.Errorf("%w: %v", ErrConnectionClosed, err)
-		}
-		return "", err
+		return nil, i.wrapError(ctx, err)
 	}
+	return b, nil
+}
 
-	firstRead := string(buf[:l])
+func (i *scpiInstrument) SetTimeout(timeout time.Duration) {
+	i.timeout.set(timeout)
+}
 
-	result := firstRead
-	if strings.HasPrefix(firstRead, "#") {
-		firstLineIndex := strings.IndexByte(firstRead, '\n')
-		result = result[firstLineIndex:]
-		responseSize, err := i.parseBlockInfo(firstRead[:firstLineIndex])
-		if err != nil {
-			queryFailed <- true
-			<-done
-			return "", err
-		}
+type deadliner interface {
+	SetDeadline(time.Time) error
+	SetReadDeadline(time.Time) error
+}
 
-		numBytesRead := l
-		for {
-			n, err := b.Read(buf)
-			if err != nil {
-				queryFailed <- true
-				<-done
-				if isConnectionError(err) {
-					return "", fmt.Errorf("%w: %v", ErrConnectionClosed, err)
-				}
-				return "", err
-			}
+// The default timeout of an instrument, which SetTimeout may change while another goroutine is making a call
+type timeoutSetting struct {
+	nanoseconds atomic.Int64
+}
 
-			numBytesRead += n
-			result += string(buf[:n])
+func (t *timeoutSetting) get() time.Duration {
+	return time.Duration(t.nanoseconds.Load())
+}
 
-			if numBytesRead >= responseSize {
-				break
-			}
-		}
-	}
-	queryCompleted <- true
-	<-done
-	return result, nil
+func (t *timeoutSetting) set(timeout time.Duration) {
+	t.nanoseconds.Store(int64(timeout))
 }
 
-func (i *scpiInstrument) parseBlockInfo(blockInfo string) (int, error) {
-	blockInfo = strings.TrimSuffix(blockInfo, "\n")
-	if !strings.HasPrefix(blockInfo, "#") || len(blockInfo) == 0 {
-		return -1, fmt.Errorf("unrecognized response header found: %s", blockInfo)
+// Returns how long a call may take: until the ctx deadline if there is one, otherwise the default timeout
+func callTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
 	}
+	return timeout
+}
 
-	blockInfo = strings.TrimPrefix(blockInfo, "#")
-	characters := strings.Split(blockInfo, "")
-
-	numChars, err := strconv.Atoi(characters[0])
-	if err != nil {
-		return -1, err
+// Applies the call deadline to conn and interrupts any blocked I/O as soon as ctx is cancelled.
+// The returned function must be called once the call finishes.
+func bindContext(ctx context.Context, conn deadliner, timeout time.Duration) func() {
+	_ = conn.SetDeadline(time.Now().Add(callTimeout(ctx, timeout)))
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+		close(interrupted)
+	})
+	return func() {
+		if !stop() {
+			// Wait for the interruption so it cannot leak into the next call
+			<-interrupted
+		}
 	}
+}
 
-	resultString := ""
-	for _, char := range characters[1 : numChars+1] {
-		resultString += char
+// Reports a ctx cancellation or deadline instead of the I/O error it caused
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%w: %v", ctxErr, err)
 	}
-
-	result, err := strconv.Atoi(resultString)
-	if err != nil {
-		return -1, err
+	// A read deadline taken from ctx can pass a moment before ctx reports it
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return fmt.Errorf("%w: %v", context.DeadlineExceeded, err)
 	}
+	return err
+}
 
-	return result, nil
+const flushQuietPeriod = 50 * time.Millisecond
+
+// Discards input until none has arrived for flushQuietPeriod, so the remains of an interrupted response are not mistaken
+// for the next one. Gives up after limit if the instrument keeps sending.
+func flushInput(r io.Reader, conn deadliner, limit time.Duration) error {
+	if br, ok := r.(*bufio.Reader); ok {
+		_, _ = br.Discard(br.Buffered())
+	}
+	end := time.Now().Add(limit)
+	buf := make([]byte, 4096)
+	for time.Now().Before(end) {
+		_ = conn.SetReadDeadline(time.Now().Add(flushQuietPeriod))
+		if _, err := r.Read(buf); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+	}
+	return fmt.Errorf("instrument kept sending data for %s after an interrupted call", limit)
 }
 
-func (i *scpiInstrument) SetTimeout(timeout time.Duration) {
-	i.timeout = timeout
+// Starts a progress bar for a pending query. The returned function must be called once the query finishes.
+func trackQueryProgress(timeout time.Duration, interactive bool) func(success bool) {
+	queryCompleted := make(chan bool, 1)
+	queryFailed := make(chan bool, 1)
+	done := make(chan bool)
+	go queryProgress(queryCompleted, queryFailed, done, timeout, interactive)
+	return func(success bool) {
+		if success {
+			queryCompleted <- true
+		} else {
+			queryFailed <- true
+		}
+		<-done
+	}
 }
 
 func queryProgress(queryCompleted chan bool, queryFailed chan bool, done chan bool, timeout time.Duration, interactive bool) {
@@ -241,7 +408,7 @@ loop:
 			break loop
 		case <-queryFailed:
 			break loop
-		case <-time.After(timeout / 10):
+		case <-time.After(max(timeout/10, 10*time.Millisecond)):
 			if interactive && percent < 90 {
 				_ = bar.Add(10)
 				percent += 10
@@ -253,54 +420,67 @@ loop:
 	done <- true
 }
 
-func (i *scpiInstrument) getSupportedCommands() ([]string, []string, uint32, error) {
+func (i *scpiInstrument) getSupportedCommands() ([]string, uint32, error) {
 	r, err := i.Query(":SYST:HELP:HEAD?")
-	commands := strings.Split(r, "\n")
-
-	var colonCommands []string
-	var starCommands []string
-	for _, command := range commands {
-		if command != "" {
-			if strings.HasPrefix(command, "*") {
-				starCommands = append(starCommands, command)
-			} else {
-				colonCommands = append(colonCommands, command)
-			}
-		}
-	}
-
   hash := hash(r);
 
-	return starCommands, colonCommands, hash, err
+	return strings.Split(r, "\n"), hash, err
 }
 
 func (i *scpiInstrument) GetSupportedCommandsTree() (ScpiNode, ScpiNode, error) {
-  starCommands, colonCommands, hash, err := i.getSupportedCommands()
+  commands, hash, err := i.getSupportedCommands()
   if err != nil {
     return ScpiNode{}, ScpiNode{}, err
   }
   if (hash != i.headersHash) {
-    i.starTree = parseScpi(starCommands)
-    i.colonTree = parseScpi(colonCommands)
+    i.starTree, i.colonTree, i.diagnostics = parseHeaders(commands)
     i.headersHash = hash
   }
   return i.starTree, i.colonTree, nil
 }
 
+func (i *scpiInstrument) HeaderDiagnostics() []ParseDiagnostic {
+  return i.diagnostics
+}
+
+func (i *scpiInstrument) conns() []net.Conn {
+	return []net.Conn{i.connection}
+}
+
 func (i *scpiInstrument) Close() error {
+	i.closeOnce.Do(func() { close(i.closed) })
 	return i.connection.Close()
 }
 
+// simInstrument remembers the settings made by commands and answers queries from them, see simState
 type simInstrument struct {
-	timeout time.Duration
+	timeout timeoutSetting
   interactive bool
+  profile string
+  state *simState
+  diagnostics []ParseDiagnostic
 }
 
-func NewSimInstrument(timeout time.Duration, interactive bool) Instrument {
-  return &simInstrument{timeout: timeout, interactive: interactive}
+// Profile is the path of a SimProfile or of a :SYST:HELP:HEAD? style file describing the simulated commands, empty for
+// SCPI.txt. Any header is accepted if that file does not exist.
+func NewSimInstrument(profile string, timeout time.Duration, interactive bool) Instrument {
+  if profile == "" {
+    profile = defaultSimProfile
+  }
+  i := &simInstrument{interactive: interactive, profile: profile, state: newSimState(nil)}
+  i.timeout.set(timeout)
+  return i
 }
 
+// Loads the profile given to NewSimInstrument, the address is unused
 func (i *simInstrument) Connect(address string, progress func(int)) error {
+  state, err := loadSimState(i.profile)
+  if errors.Is(err, os.ErrNotExist) && !IsSimProfile(i.profile) {
+    state = newSimState(nil)
+  } else if err != nil {
+    return err
+  }
+  i.state = state
 	if progress != nil {
 		progress(40)
 	}
@@ -308,15 +488,35 @@ func (i *simInstrument) Connect(address string, progress func(int)) error {
 }
 
 func (i *simInstrument) Command(command string) error {
-	return nil
+	return i.CommandContext(context.Background(), command)
 }
 
-func (i *simInstrument) Query(query string) (string, error) {
+func (i *simInstrument) CommandContext(ctx context.Context, command string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, _, err := i.state.execute(ctx, command)
+	return err
+}
+
+func (i *simInstrument) QueryContext(ctx context.Context, query string) (string, error) {
+	b, err := i.QueryBytesContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	return responseString(b), nil
+}
+
+// Block responses are decoded to their payload as the other transports do, so the simulator answers like hardware
+func (i *simInstrument) QueryBytesContext(ctx context.Context, query string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if query == "*ESR?" || query == "*ID?" {
 		queryCompleted := make(chan bool, 1)
 		queryFailed := make(chan bool, 1)
 		done := make(chan bool)
-		go queryProgress(queryCompleted, queryFailed, done, i.timeout, i.interactive)
+		go queryProgress(queryCompleted, queryFailed, done, i.timeout.get(), i.interactive)
 		if query == "*ID?" {
 			queryFailed <- true
 		} else {
@@ -324,47 +524,55 @@ func (i *simInstrument) Query(query string) (string, error) {
 		}
 		<-done
 	}
-	return query + "\n", nil
-}
-
-func (i *simInstrument) getSupportedCommands() ([]string, []string, uint32, error) {
-	commands, err := readLinesFromPath("SCPI.txt")
+	res, _, err := i.state.execute(ctx, query)
 	if err != nil {
-		return []string{}, []string{}, 0, err
+		return nil, err
 	}
+	return decodeResponse([]byte(res+"\n"), "\n")
+}
 
-	var colonCommands []string
-	var starCommands []string
-	for _, command := range commands {
-		if command != "" {
-			if strings.HasPrefix(command, "*") {
-				starCommands = append(starCommands, command)
-			} else {
-				colonCommands = append(colonCommands, command)
-			}
-		}
+func (i *simInstrument) Query(query string) (string, error) {
+	return i.QueryContext(context.Background(), query)
+}
+
+func (i *simInstrument) QueryBytes(query string) ([]byte, error) {
+	return i.QueryBytesContext(context.Background(), query)
+}
+
+func (i *simInstrument) getSupportedCommands() ([]string, uint32, error) {
+	commands := i.state.headers
+	if commands == nil {
+		return []string{}, 0, fmt.Errorf("simulated instrument has no commands: %s not found", i.profile)
 	}
 
   fakeHash := uint32(1234)
-	return starCommands, colonCommands, fakeHash, nil
+	return commands, fakeHash, nil
 }
 
 func (i *simInstrument) GetSupportedCommandsTree() (ScpiNode, ScpiNode, error) {
-  starCommands, colonCommands, _, err := i.getSupportedCommands()
+  commands, _, err := i.getSupportedCommands()
   if err != nil {
     return ScpiNode{}, ScpiNode{}, err
   }
-  starTree := parseScpi(starCommands);
-  colonTree := parseScpi(colonCommands);
+  starTree, colonTree, diagnostics := parseHeaders(commands);
+  i.diagnostics = diagnostics
   return starTree, colonTree, nil
 }
 
+func (i *simInstrument) HeaderDiagnostics() []ParseDiagnostic {
+  return i.diagnostics
+}
+
 func (i *simInstrument) SetTimeout(timeout time.Duration) {
-	i.timeout = timeout
+	i.timeout.set(timeout)
+}
+
+func (i *simInstrument) QueryError(opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return i.QueryErrorContext(context.Background(), opts)
 }
 
-func (i *simInstrument) QueryError(errors []string) ([]string, error) {
-	return errors, nil
+func (i *simInstrument) QueryErrorContext(ctx context.Context, opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return queryErrorQueue(ctx, i.QueryContext, opts)
 }
 
 func (i *simInstrument) Close() error {
@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a socket instrument that answers every line with the next canned response, written in small pieces
+func newFakeSocketServer(t *testing.T, responses ...[]byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for _, response := range responses {
+			if !scanner.Scan() {
+				return
+			}
+			for len(response) > 0 {
+				n := min(1000, len(response))
+				if _, err := conn.Write(response[:n]); err != nil {
+					return
+				}
+				response = response[n:]
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestScpiQueryBytesBlock(t *testing.T) {
+	payload := bytes.Repeat([]byte("\x00\x01\n#"), 3000)
+	block := []byte(fmt.Sprintf("#5%05d%s\n", len(payload), payload))
+	address := newFakeSocketServer(t, block, []byte("+0,\"No error\"\n"))
+
+	inst := NewScpiInstrument(Framing{}, time.Second, false)
+	if err := inst.Connect(address, nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	b, err := inst.QueryBytes(":HCOP:SDUM:DATA?")
+	if err != nil {
+		t.Fatalf("QueryBytes failed: %v", err)
+	}
+	if !bytes.Equal(b, payload) {
+		t.Errorf("expected %d byte payload, got %d bytes", len(payload), len(b))
+	}
+
+	res, err := inst.Query("SYST:ERR?")
+	if err != nil || res != "+0,\"No error\"\n" {
+		t.Errorf("expected response after block to be intact, got %q %v", res, err)
+	}
+}
+
+func TestScpiQueryContextFlushesInterruptedResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if scanner.Text() == "TRAC:DATA?" {
+				// Half a block now, the rest after the client has given up
+				conn.Write([]byte("#210abc"))
+				time.Sleep(30 * time.Millisecond)
+				conn.Write([]byte("de\nfghij\n"))
+			} else {
+				conn.Write([]byte(scanner.Text() + "\n"))
+			}
+		}
+	}()
+
+	inst := NewScpiInstrument(Framing{}, time.Second, false)
+	if err := inst.Connect(listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := inst.QueryContext(ctx, "TRAC:DATA?"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the query to give up at the ctx deadline, took %s", elapsed)
+	}
+
+	res, err := inst.Query("*IDN?")
+	if err != nil || res != "*IDN?\n" {
+		t.Errorf("expected the rest of the interrupted response to be discarded, got %q %v", res, err)
+	}
+}
+
+func TestScpiQueryContextCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Accepts the connection but never answers
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	inst := NewScpiInstrument(Framing{}, 10*time.Second, false)
+	if err := inst.Connect(listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := inst.QueryContext(ctx, "*OPC?"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled, got %v", err)
+	}
+}
+
+func TestScpiQueryResponseSplitAcrossReads(t *testing.T) {
+	// The fake server sends 1000 bytes at a time, so the response arrives in many segments
+	response := strings.Repeat("+1.23456789E+00,", 1000) + "+0\r\n"
+	inst := NewScpiInstrument(Framing{WriteTermination: "\r\n", ReadTermination: "\r\n"}, time.Second, false)
+	if err := inst.Connect(newFakeSocketServer(t, []byte(response)), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	res, err := inst.Query(":TRAC:DATA?")
+	if err != nil || res != strings.TrimSuffix(response, "\r\n")+"\n" {
+		t.Errorf("expected the whole %d byte response, got %d bytes %v", len(response), len(res), err)
+	}
+}
+
+func TestScpiConnectRequiresTerminations(t *testing.T) {
+	inst := NewScpiInstrument(Framing{ReadTermination: TerminationEoi}, time.Second, false)
+	if err := inst.Connect(newFakeSocketServer(t), nil); err == nil {
+		inst.Close()
+		t.Error("expected a raw socket to reject EOI framing")
+	}
+}
+
+func TestScpiConcurrentTransactions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Echoes each query after a pause, and reports three errors before the queue is empty
+		queue := []string{"-100,\"Command error\"", "-200,\"Execution error\"", "-300,\"Device-specific error\""}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			line := scanner.Text()
+			time.Sleep(100 * time.Microsecond)
+			if line == "SYST:ERR?" {
+				response := "+0,\"No error\""
+				if len(queue) > 0 {
+					response, queue = queue[0], queue[1:]
+				}
+				conn.Write([]byte(response + "\n"))
+			} else {
+				conn.Write([]byte(line + "\n"))
+			}
+		}
+	}()
+
+	inst := NewScpiInstrument(Framing{}, 5*time.Second, false)
+	if err := inst.Connect(listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	done := make(chan struct{})
+	for g := range 8 {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for n := range 25 {
+				query := fmt.Sprintf(":MEAS%d:VOLT%d?", g, n)
+				if res, err := inst.Query(query); err != nil || res != query+"\n" {
+					t.Errorf("expected %s to get its own response, got %q %v", query, res, err)
+					return
+				}
+			}
+		}()
+	}
+	// Changing the timeout mid-transaction must be safe too
+	inst.SetTimeout(4 * time.Second)
+	errs, err := inst.QueryError(ErrorQueueOptions{})
+	if err != nil || len(errs) != 3 || errs[2].Code != -300 {
+		t.Errorf("expected the whole error queue in one drain, got %+v %v", errs, err)
+	}
+	for range 8 {
+		<-done
+	}
+}
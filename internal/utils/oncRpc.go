@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Minimal ONC RPC (RFC 5531) client over TCP with XDR (RFC 4506) encoding, enough to speak to a portmapper and a VXI-11 core channel,
+// and the server side needed to receive VXI-11 interrupts and to serve simulated instruments.
+
+const (
+	rpcCall  = 0
+	rpcReply = 1
+
+	rpcVersion = 2
+
+	portmapperProgram   = 100000
+	portmapperVersion   = 2
+	portmapperGetPort   = 3
+	portmapperProtoTcp  = 6
+	portmapperPort      = 111
+	rpcLastFragmentFlag = 0x80000000
+	rpcMaxRecordSize    = 1 << 24
+)
+
+type rpcClient struct {
+	conn net.Conn
+	xid  uint32
+	mu   sync.Mutex
+}
+
+func dialRpc(address string, timeout time.Duration) (*rpcClient, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &rpcClient{conn: conn, xid: uint32(time.Now().UnixNano())}, nil
+}
+
+// The call gives up when ctx is done, or after timeout if ctx has no deadline
+func (c *rpcClient) call(ctx context.Context, program, version, procedure uint32, args []byte, timeout time.Duration) (*xdrReader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.xid++
+	w := &xdrWriter{}
+	w.uint32(c.xid)
+	w.uint32(rpcCall)
+	w.uint32(rpcVersion)
+	w.uint32(program)
+	w.uint32(version)
+	w.uint32(procedure)
+	w.uint32(0) // credentials: AUTH_NONE
+	w.uint32(0)
+	w.uint32(0) // verifier: AUTH_NONE
+	w.uint32(0)
+	w.buf.Write(args)
+
+	stop := bindContext(ctx, c.conn, timeout)
+	defer stop()
+	if err := writeRpcRecord(c.conn, w.bytes()); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	for {
+		record, err := readRpcRecord(c.conn)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+		r := newXdrReader(record)
+		xid := r.uint32()
+		if r.uint32() != rpcReply {
+			return nil, protocolError("rpc: expected reply message")
+		}
+		if xid != c.xid {
+			continue // stale reply to an earlier, abandoned call
+		}
+		if err := r.acceptedReply(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+}
+
+// Discards the remains of a reply that an interrupted call stopped reading halfway, which would otherwise break the record framing
+func (c *rpcClient) flush(limit time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return flushInput(c.conn, c.conn, limit)
+}
+
+func (c *rpcClient) close() error {
+	return c.conn.Close()
+}
+
+// Serves the RPC calls arriving on conn until it fails. Every call gets a successful reply carrying the results
+// returned by handle, which sees its program, procedure and arguments.
+func serveRpc(conn net.Conn, handle func(program, procedure uint32, args *xdrReader) []byte) error {
+	for {
+		record, err := readRpcRecord(conn)
+		if err != nil {
+			return err
+		}
+		r := newXdrReader(record)
+		xid := r.uint32()
+		if r.uint32() != rpcCall {
+			return protocolError("rpc: expected call message")
+		}
+		r.uint32() // rpc version
+		program := r.uint32()
+		r.uint32() // program version
+		procedure := r.uint32()
+		r.uint32() // credentials
+		r.opaque()
+		r.uint32() // verifier
+		r.opaque()
+		if r.err != nil {
+			return r.err
+		}
+		results := handle(program, procedure, r)
+
+		w := &xdrWriter{}
+		w.uint32(xid)
+		w.uint32(rpcReply)
+		w.uint32(0) // accepted
+		w.uint32(0) // verifier: AUTH_NONE
+		w.uint32(0)
+		w.uint32(0) // success
+		if err := writeRpcRecord(conn, append(w.bytes(), results...)); err != nil {
+			return err
+		}
+	}
+}
+
+// Parses the reply header following the xid and message type, leaving r positioned at the procedure results
+func (r *xdrReader) acceptedReply() error {
+	if stat := r.uint32(); stat != 0 {
+		return protocolError("rpc: call denied (reject status %d)", r.uint32())
+	}
+	r.uint32() // verifier flavor
+	r.opaque() // verifier body
+	switch stat := r.uint32(); stat {
+	case 0:
+		return r.err
+	case 1:
+		return protocolError("rpc: program unavailable")
+	case 2:
+		return protocolError("rpc: program version mismatch")
+	case 3:
+		return protocolError("rpc: procedure unavailable")
+	case 4:
+		return protocolError("rpc: garbage arguments")
+	default:
+		return protocolError("rpc: call failed with accept status %d", stat)
+	}
+}
+
+func getRpcPort(address string, program, version uint32, timeout time.Duration) (uint32, error) {
+	c, err := dialRpc(address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+
+	w := &xdrWriter{}
+	w.uint32(program)
+	w.uint32(version)
+	w.uint32(portmapperProtoTcp)
+	w.uint32(0)
+	r, err := c.call(context.Background(), portmapperProgram, portmapperVersion, portmapperGetPort, w.bytes(), timeout)
+	if err != nil {
+		return 0, fmt.Errorf("portmapper lookup failed: %w", err)
+	}
+	port := r.uint32()
+	if r.err != nil {
+		return 0, r.err
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("portmapper at %s has no TCP registration for program %d version %d", address, program, version)
+	}
+	return port, nil
+}
+
+func writeRpcRecord(w io.Writer, record []byte) error {
+	b := make([]byte, 4+len(record))
+	binary.BigEndian.PutUint32(b, rpcLastFragmentFlag|uint32(len(record)))
+	copy(b[4:], record)
+	_, err := w.Write(b)
+	return err
+}
+
+func readRpcRecord(r io.Reader) ([]byte, error) {
+	var record []byte
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		marker := binary.BigEndian.Uint32(header)
+		size := marker &^ rpcLastFragmentFlag
+		if uint64(len(record))+uint64(size) > rpcMaxRecordSize {
+			return nil, protocolError("rpc: record of at least %d bytes exceeds maximum of %d", uint64(len(record))+uint64(size), rpcMaxRecordSize)
+		}
+		fragment := make([]byte, size)
+		if _, err := io.ReadFull(r, fragment); err != nil {
+			return nil, err
+		}
+		record = append(record, fragment...)
+		if marker&rpcLastFragmentFlag != 0 {
+			return record, nil
+		}
+	}
+}
+
+type xdrWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *xdrWriter) uint32(v uint32) {
+	_ = binary.Write(&w.buf, binary.BigEndian, v)
+}
+
+func (w *xdrWriter) bool(v bool) {
+	if v {
+		w.uint32(1)
+	} else {
+		w.uint32(0)
+	}
+}
+
+func (w *xdrWriter) opaque(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf.Write(b)
+	if pad := (4 - len(b)%4) % 4; pad > 0 {
+		w.buf.Write(make([]byte, pad))
+	}
+}
+
+func (w *xdrWriter) string(s string) {
+	w.opaque([]byte(s))
+}
+
+func (w *xdrWriter) bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// Reads XDR values sequentially. The first decoding failure is kept in err and all later reads return zero values.
+type xdrReader struct {
+	data []byte
+	err  error
+}
+
+var errXdrShort = errors.New("xdr: message too short")
+
+func newXdrReader(data []byte) *xdrReader {
+	return &xdrReader{data: data}
+}
+
+func (r *xdrReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) < 4 {
+		r.err = errXdrShort
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *xdrReader) bool() bool {
+	return r.uint32() != 0
+}
+
+func (r *xdrReader) opaque() []byte {
+	n := int(r.uint32())
+	if r.err != nil {
+		return nil
+	}
+	padded := n + (4-n%4)%4
+	if n < 0 || len(r.data) < padded {
+		r.err = errXdrShort
+		return nil
+	}
+	v := r.data[:n]
+	r.data = r.data[padded:]
+	return v
+}
+
+func (r *xdrReader) string() string {
+	return string(r.opaque())
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ProgramUnit is one command or query of a program message (IEEE 488.2 section 7.3.3)
+type ProgramUnit struct {
+	// Text is the unit as it was written, without the separating semicolon
+	Text string `json:"text"`
+	// Header is the unit's header with any relative path resolved, e.g. :SOUR:POW for POW following :SOUR:FREQ 1GHz
+	Header string `json:"header"`
+	// Arguments is everything after the header, including the separating whitespace
+	Arguments string `json:"arguments,omitempty"`
+	Query     bool   `json:"query"`
+}
+
+// Absolute returns the unit with its resolved header, which the instrument interprets the same way on its own
+func (u ProgramUnit) Absolute() string {
+	return u.Header + u.Arguments
+}
+
+// ProgramMessage is a line of one or more program units separated by semicolons, e.g. :FREQ 1GHz;:POW -10;*OPC?
+type ProgramMessage struct {
+	Units []ProgramUnit
+}
+
+// Splits a program message on the semicolons outside of strings and block data, and resolves the headers following
+// SCPI-99 volume 1 section 6.2.4: a header starting with a colon is absolute, common commands such as *OPC leave the
+// current path alone, and any other header continues from the path of the previous header.
+func ParseProgramMessage(s string) (ProgramMessage, error) {
+	texts, err := splitProgramUnits(s)
+	if err != nil {
+		return ProgramMessage{}, err
+	}
+
+	var msg ProgramMessage
+	var path []string
+	for _, text := range texts {
+		header, arguments := splitHeader(text)
+		unit := ProgramUnit{Text: text, Arguments: arguments, Query: strings.HasSuffix(header, "?")}
+		if strings.HasPrefix(header, "*") {
+			unit.Header = header
+			msg.Units = append(msg.Units, unit)
+			continue
+		}
+
+		nodes := strings.Split(strings.TrimPrefix(header, ":"), ":")
+		if !strings.HasPrefix(header, ":") {
+			nodes = append(append([]string{}, path...), nodes...)
+		}
+		for _, node := range nodes {
+			if node == "" {
+				return ProgramMessage{}, fmt.Errorf("invalid header '%s' in program message", header)
+			}
+		}
+		unit.Header = ":" + strings.Join(nodes, ":")
+		path = nodes[:len(nodes)-1]
+		msg.Units = append(msg.Units, unit)
+	}
+	if len(msg.Units) == 0 {
+		return ProgramMessage{}, fmt.Errorf("empty program message")
+	}
+	return msg, nil
+}
+
+// Queries is the number of responses the message produces
+func (m ProgramMessage) Queries() int {
+	count := 0
+	for _, unit := range m.Units {
+		if unit.Query {
+			count++
+		}
+	}
+	return count
+}
+
+func splitHeader(unit string) (string, string) {
+	if idx := strings.IndexAny(unit, " \t"); idx >= 0 {
+		return unit[:idx], unit[idx:]
+	}
+	return unit, ""
+}
+
+// Returns the trimmed, non-empty units of s
+func splitProgramUnits(s string) ([]string, error) {
+	var units []string
+	start := 0
+	for idx := 0; idx < len(s); idx++ {
+		switch s[idx] {
+		case '"', '\'':
+			end, err := closingQuote(s, idx)
+			if err != nil {
+				return nil, err
+			}
+			idx = end
+		case '#':
+			skip, err := blockDataLength(s[idx:])
+			if err != nil {
+				return nil, err
+			}
+			idx += skip - 1
+		case ';':
+			units = appendUnit(units, s[start:idx])
+			start = idx + 1
+		}
+	}
+	return appendUnit(units, s[start:]), nil
+}
+
+// Returns the index of the quote that ends the string starting at s[start]. A doubled quote stands for a literal one.
+func closingQuote(s string, start int) (int, error) {
+	quote := s[start]
+	for idx := start + 1; idx < len(s); idx++ {
+		if s[idx] != quote {
+			continue
+		}
+		if idx+1 < len(s) && s[idx+1] == quote {
+			idx++
+			continue
+		}
+		return idx, nil
+	}
+	return 0, fmt.Errorf("unterminated string in program message")
+}
+
+func appendUnit(units []string, unit string) []string {
+	if unit = strings.TrimSpace(unit); unit != "" {
+		units = append(units, unit)
+	}
+	return units
+}
+
+// Returns the length of the block data (IEEE 488.2 section 7.7.6) at the start of s. Anything else starting with #,
+// such as the non-decimal number #H1F, is left to the instrument.
+func blockDataLength(s string) (int, error) {
+	if len(s) < 2 || s[1] < '0' || s[1] > '9' {
+		return 1, nil
+	}
+	numDigits := int(s[1] - '0')
+	if numDigits == 0 {
+		// Indefinite length block data runs to the end of the message
+		return len(s), nil
+	}
+	if len(s) < 2+numDigits {
+		return 0, fmt.Errorf("truncated block header in program message")
+	}
+	length, err := strconv.Atoi(s[2 : 2+numDigits])
+	if err != nil {
+		return 0, fmt.Errorf("invalid block length in program message")
+	}
+	if len(s) < 2+numDigits+length {
+		return 0, fmt.Errorf("block data shorter than its header announced in program message")
+	}
+	return 2 + numDigits + length, nil
+}
+
+// UnitResult is the outcome of one program unit
+type UnitResult struct {
+	ProgramUnit
+	// Response is the query response, ending in a newline
+	Response string `json:"response,omitempty"`
+	// Errors are the error queue entries read right after the unit
+	Errors []InstrumentError `json:"errors,omitempty"`
+}
+
+type ProgramOptions struct {
+	// CheckErrors drains the error queue after each unit, so every error is attributed to the unit that caused it
+	CheckErrors bool
+	ErrorQueue  ErrorQueueOptions
+	// Sync is how command units wait for completion
+	Sync SyncOptions
+}
+
+// Sends each unit of msg on its own with its resolved header, reading a response for each query. Stops at the first
+// failure to send a unit or read its response, returning the results so far including the failed unit. Errors reported
+// by the instrument do not stop the message.
+func ExecuteProgramMessage(ctx context.Context, inst Instrument, msg ProgramMessage, opts ProgramOptions) ([]UnitResult, error) {
+	results := make([]UnitResult, 0, len(msg.Units))
+	for _, unit := range msg.Units {
+		result := UnitResult{ProgramUnit: unit}
+		var err error
+		if unit.Query {
+			result.Response, err = inst.QueryContext(ctx, unit.Absolute())
+		} else {
+			err = CommandSync(ctx, inst, unit.Absolute(), opts.Sync)
+		}
+		if err == nil && opts.CheckErrors {
+			result.Errors, err = inst.QueryErrorContext(ctx, opts.ErrorQueue)
+		} else if opts.CheckErrors && ctx.Err() == nil && !errors.Is(err, ErrConnectionClosed) {
+			// The errors usually explain the failure, e.g. a query the instrument rejected instead of answering
+			result.Errors, _ = inst.QueryErrorContext(ctx, opts.ErrorQueue)
+		}
+		results = append(results, result)
+		if err != nil && len(msg.Units) > 1 {
+			return results, fmt.Errorf("%s: %w", unit.Text, err)
+		} else if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// Returns the first error the instrument reported for any unit, or nil
+func FirstInstrumentError(results []UnitResult) error {
+	for _, result := range results {
+		if len(result.Errors) > 0 {
+			return &result.Errors[0]
+		}
+	}
+	return nil
+}
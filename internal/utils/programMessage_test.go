@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseProgramMessage(t *testing.T) {
+	msg, err := ParseProgramMessage(`:SOUR:FREQ 1GHz;POW -10; *OPC?;:OUTP ON;STAT?;:DISP:TEXT "Ready?; go";:MMEM:DATA 'a.bin',#15ab;cd`)
+	if err != nil {
+		t.Fatalf("ParseProgramMessage failed: %v", err)
+	}
+	expected := []ProgramUnit{
+		{Text: ":SOUR:FREQ 1GHz", Header: ":SOUR:FREQ", Arguments: " 1GHz"},
+		{Text: "POW -10", Header: ":SOUR:POW", Arguments: " -10"},
+		{Text: "*OPC?", Header: "*OPC?", Query: true},
+		{Text: ":OUTP ON", Header: ":OUTP", Arguments: " ON"},
+		{Text: "STAT?", Header: ":STAT?", Query: true},
+		{Text: `:DISP:TEXT "Ready?; go"`, Header: ":DISP:TEXT", Arguments: ` "Ready?; go"`},
+		{Text: ":MMEM:DATA 'a.bin',#15ab;cd", Header: ":MMEM:DATA", Arguments: " 'a.bin',#15ab;cd"},
+	}
+	if len(msg.Units) != len(expected) {
+		t.Fatalf("expected %d units, got %+v", len(expected), msg.Units)
+	}
+	for idx, unit := range msg.Units {
+		if unit != expected[idx] {
+			t.Errorf("unit %d: expected %+v, got %+v", idx, expected[idx], unit)
+		}
+	}
+	if msg.Queries() != 2 {
+		t.Errorf("expected 2 queries, got %d", msg.Queries())
+	}
+}
+
+func TestParseProgramMessageRelativePaths(t *testing.T) {
+	msg, err := ParseProgramMessage("SENS:FREQ:STAR 1e9;STOP 2e9;*WAI;CENT?")
+	if err != nil {
+		t.Fatalf("ParseProgramMessage failed: %v", err)
+	}
+	var headers []string
+	for _, unit := range msg.Units {
+		headers = append(headers, unit.Header)
+	}
+	if len(headers) != 4 || headers[1] != ":SENS:FREQ:STOP" || headers[3] != ":SENS:FREQ:CENT?" {
+		t.Errorf("unexpected headers %q", headers)
+	}
+}
+
+func TestParseProgramMessageInvalid(t *testing.T) {
+	for _, s := range []string{"", " ; ", `:DISP:TEXT "Ready`, ":MMEM:DATA #15ab", ":SOUR::FREQ 1"} {
+		if msg, err := ParseProgramMessage(s); err == nil {
+			t.Errorf("expected %q to fail, got %+v", s, msg.Units)
+		}
+	}
+}
+
+func TestExecuteProgramMessage(t *testing.T) {
+	// :FREQ 1GHz and its empty error queue, POW? and its error, then *OPC? and its empty error queue
+	inst := connectFakeSocket(t,
+		[]byte{}, []byte("+0,\"No error\"\n"),
+		[]byte("-1.0E+01\n"), []byte("-221,\"Settings conflict\"\n"), []byte("+0,\"No error\"\n"),
+		[]byte("1\n"), []byte("+0,\"No error\"\n"),
+	)
+	msg, err := ParseProgramMessage(":FREQ 1GHz;POW?;*OPC?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := ExecuteProgramMessage(context.Background(), inst, msg, ProgramOptions{CheckErrors: true})
+	if err != nil {
+		t.Fatalf("ExecuteProgramMessage failed: %v", err)
+	}
+	if len(results) != 3 || results[1].Response != "-1.0E+01\n" || results[2].Response != "1\n" {
+		t.Fatalf("unexpected results %+v", results)
+	}
+	if len(results[0].Errors) != 0 || len(results[1].Errors) != 1 || results[1].Errors[0].Code != -221 {
+		t.Errorf("expected the error to be attributed to POW?, got %+v", results)
+	}
+	if err := FirstInstrumentError(results); err == nil || err.Error() != `-221,"Settings conflict"` {
+		t.Errorf("unexpected first instrument error %v", err)
+	}
+}
+
+func TestExecuteProgramMessageReadsErrorsAfterTimeout(t *testing.T) {
+	// The instrument rejects the query instead of answering it
+	inst := NewScpiInstrument(Framing{}, 50*time.Millisecond, false)
+	if err := inst.Connect(newFakeSocketServer(t, []byte{}, []byte("-113,\"Undefined header\"\n"), []byte("+0,\"No error\"\n")), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	msg, _ := ParseProgramMessage(":FOO?")
+	results, err := ExecuteProgramMessage(context.Background(), inst, msg, ProgramOptions{CheckErrors: true})
+	if KindOf(err) != ErrorKindTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if len(results) != 1 || len(results[0].Errors) != 1 || results[0].Errors[0].Code != -113 {
+		t.Errorf("expected the rejected query's error, got %+v", results)
+	}
+}
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ResourceKind int
+
+const (
+	ResourceSocket ResourceKind = iota + 1
+	ResourceVxi11
+	ResourceHislip
+	ResourceSerial
+	ResourceSim
+	ResourceReplay
+)
+
+const defaultSimProfile = "SCPI.txt"
+
+// Resource is a parsed VISA-style resource string, e.g. TCPIP0::192.168.1.5::5025::SOCKET
+type Resource struct {
+	Kind  ResourceKind
+	Board int
+	// Host is the network address for TCPIP resources
+	Host string
+	// Port is the socket port for SOCKET resources and the optional HiSLIP port for hislip INSTR resources
+	Port int
+	// Device is the VXI-11 device or HiSLIP sub-address for INSTR resources
+	Device string
+	// SerialPort is the device path or COM port name for ASRL resources
+	SerialPort string
+	// Profile is the simulation file for SIM resources
+	Profile string
+	// Session is the recorded session file for REPLAY resources
+	Session string
+}
+
+type InstrumentOptions struct {
+	Timeout     time.Duration
+	Interactive bool
+	HislipMode  HislipMode
+	Serial      SerialConfig
+	// Framing sets the terminations and the maximum response size of every transport. The simulator ignores it.
+	Framing
+	// ErrorQueue is how callers drain the error queue with QueryError. Instruments do not read it themselves.
+	ErrorQueue ErrorQueueOptions
+	// Sync is how callers wait for commands with CommandSync. Instruments do not read it themselves.
+	Sync SyncOptions
+	// KeepAlive is how long a network connection stays idle before TCP keepalive probes start, and the time between
+	// probes. A peer that misses keepAliveProbes of them is considered gone. Zero keeps the system default and a
+	// negative value disables the probes.
+	KeepAlive time.Duration
+	// Middleware wraps the connected instrument in order, so the last one is outermost
+	Middleware []Middleware
+	// ReplayTiming makes REPLAY resources take as long to answer each call as the recorded instrument did
+	ReplayTiming bool
+}
+
+const keepAliveProbes = 3
+
+// Implemented by instruments on network connections, so OpenResource can apply the keepalive settings
+type networkInstrument interface {
+	conns() []net.Conn
+}
+
+// Parses VISA-style resource strings. Supported forms:
+//
+//	TCPIP[board]::host::port::SOCKET
+//	TCPIP[board]::host[::inst0]::INSTR   (VXI-11)
+//	TCPIP[board]::host::hislip0[,port]::INSTR
+//	ASRL/dev/ttyUSB0::INSTR or ASRL1::INSTR
+//	SIM[::profile]
+//	REPLAY::session
+func ParseResource(s string) (Resource, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, "::")
+	prefix := strings.ToUpper(parts[0])
+
+	switch {
+	case prefix == "SIM":
+		profile := strings.Join(parts[1:], "::")
+		if profile == "" {
+			profile = defaultSimProfile
+		}
+		return Resource{Kind: ResourceSim, Profile: profile}, nil
+	case prefix == "REPLAY":
+		session := strings.Join(parts[1:], "::")
+		if session == "" {
+			return Resource{}, fmt.Errorf("invalid resource '%s': missing session file", s)
+		}
+		return Resource{Kind: ResourceReplay, Session: session}, nil
+	case strings.HasPrefix(prefix, "TCPIP"):
+		board, err := parseBoard(prefix, "TCPIP")
+		if err != nil {
+			return Resource{}, fmt.Errorf("invalid resource '%s': %w", s, err)
+		}
+		return parseTcpipResource(s, board, parts[1:])
+	case strings.HasPrefix(prefix, "ASRL"):
+		return parseSerialResource(s, parts)
+	default:
+		return Resource{}, fmt.Errorf("invalid resource '%s': unsupported interface type '%s'", s, parts[0])
+	}
+}
+
+func parseBoard(prefix string, interfaceType string) (int, error) {
+	boardString := strings.TrimPrefix(prefix, interfaceType)
+	if boardString == "" {
+		return 0, nil
+	}
+	board, err := strconv.Atoi(boardString)
+	if err != nil || board < 0 {
+		return 0, fmt.Errorf("invalid board number '%s'", boardString)
+	}
+	return board, nil
+}
+
+func parseTcpipResource(s string, board int, parts []string) (Resource, error) {
+	if len(parts) == 0 || parts[0] == "" {
+		return Resource{}, fmt.Errorf("invalid resource '%s': missing host", s)
+	}
+	r := Resource{Board: board, Host: parts[0]}
+	suffix := "INSTR"
+	if last := len(parts) - 1; last > 0 && isResourceClass(parts[last]) {
+		suffix = strings.ToUpper(parts[last])
+		parts = parts[:last]
+	}
+
+	switch suffix {
+	case "SOCKET":
+		if len(parts) != 2 {
+			return Resource{}, fmt.Errorf("invalid resource '%s': SOCKET resources require a port", s)
+		}
+		port, err := parsePort(parts[1])
+		if err != nil {
+			return Resource{}, fmt.Errorf("invalid resource '%s': %w", s, err)
+		}
+		r.Kind = ResourceSocket
+		r.Port = port
+	case "INSTR":
+		if len(parts) > 2 {
+			return Resource{}, fmt.Errorf("invalid resource '%s': too many fields", s)
+		}
+		r.Kind = ResourceVxi11
+		r.Device = "inst0"
+		if len(parts) == 2 {
+			r.Device = parts[1]
+		}
+		if strings.HasPrefix(strings.ToLower(r.Device), "hislip") {
+			r.Kind = ResourceHislip
+			if device, portString, found := strings.Cut(r.Device, ","); found {
+				port, err := parsePort(portString)
+				if err != nil {
+					return Resource{}, fmt.Errorf("invalid resource '%s': %w", s, err)
+				}
+				r.Device = device
+				r.Port = port
+			}
+		}
+	}
+	return r, nil
+}
+
+func parseSerialResource(s string, parts []string) (Resource, error) {
+	if len(parts) > 2 || (len(parts) == 2 && !strings.EqualFold(parts[1], "INSTR")) {
+		return Resource{}, fmt.Errorf("invalid resource '%s': serial resources must end in ::INSTR", s)
+	}
+	port := parts[0][len("ASRL"):]
+	if port == "" {
+		return Resource{}, fmt.Errorf("invalid resource '%s': missing serial port", s)
+	}
+	if n, err := strconv.Atoi(port); err == nil {
+		port = "COM" + strconv.Itoa(n)
+	}
+	return Resource{Kind: ResourceSerial, SerialPort: port}, nil
+}
+
+func isResourceClass(s string) bool {
+	s = strings.ToUpper(s)
+	return s == "SOCKET" || s == "INSTR"
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port must be a number between 1 and 65535, got '%s'", s)
+	}
+	return port, nil
+}
+
+// IsResourceString reports whether s looks like a resource string rather than a bare hostname
+func IsResourceString(s string) bool {
+	prefix := strings.ToUpper(strings.SplitN(strings.TrimSpace(s), "::", 2)[0])
+	return strings.Contains(s, "::") || prefix == "SIM" || prefix == "REPLAY" || strings.HasPrefix(prefix, "ASRL")
+}
+
+// Resolves the legacy address and port pair into a Resource. Resource strings are parsed as-is and ignore port,
+// "simulated" selects the default simulation profile, and anything else is treated as a socket host.
+func ResolveAddress(address string, port int) (Resource, error) {
+	if address == "simulated" {
+		return Resource{Kind: ResourceSim, Profile: defaultSimProfile}, nil
+	}
+	if IsResourceString(address) {
+		return ParseResource(address)
+	}
+	if address == "" {
+		return Resource{}, fmt.Errorf("address cannot be empty")
+	}
+	if port < 1 || port > 65535 {
+		return Resource{}, fmt.Errorf("port must be between 1 and 65535")
+	}
+	return Resource{Kind: ResourceSocket, Host: address, Port: port}, nil
+}
+
+// Returns the canonical resource string
+func (r Resource) String() string {
+	board := ""
+	if r.Board > 0 {
+		board = strconv.Itoa(r.Board)
+	}
+	switch r.Kind {
+	case ResourceSocket:
+		return fmt.Sprintf("TCPIP%s::%s::%d::SOCKET", board, r.Host, r.Port)
+	case ResourceVxi11:
+		return fmt.Sprintf("TCPIP%s::%s::%s::INSTR", board, r.Host, r.Device)
+	case ResourceHislip:
+		if r.Port != 0 {
+			return fmt.Sprintf("TCPIP%s::%s::%s,%d::INSTR", board, r.Host, r.Device, r.Port)
+		}
+		return fmt.Sprintf("TCPIP%s::%s::%s::INSTR", board, r.Host, r.Device)
+	case ResourceSerial:
+		return "ASRL" + r.SerialPort + "::INSTR"
+	case ResourceSim:
+		return "SIM::" + r.Profile
+	case ResourceReplay:
+		return "REPLAY::" + r.Session
+	}
+	return ""
+}
+
+// Creates the Instrument matching the resource type and connects to it
+func OpenResource(r Resource, opts InstrumentOptions, progress func(int)) (Instrument, error) {
+	var inst Instrument
+	var address string
+	switch r.Kind {
+	case ResourceSocket:
+		inst = NewScpiInstrument(opts.Framing, opts.Timeout, opts.Interactive)
+		address = net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+	case ResourceVxi11:
+		inst = NewVxi11Instrument(r.Device, opts.Framing, opts.Timeout, opts.Interactive)
+		address = r.Host
+	case ResourceHislip:
+		inst = NewHislipInstrument(r.Device, opts.HislipMode, opts.Framing, opts.Timeout, opts.Interactive)
+		address = r.Host
+		if r.Port != 0 {
+			address = net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+		}
+	case ResourceSim:
+		inst = NewSimInstrument(r.Profile, opts.Timeout, opts.Interactive)
+	case ResourceSerial:
+		inst = NewSerialInstrument(opts.Serial, opts.Framing, opts.Timeout, opts.Interactive)
+		address = r.SerialPort
+	case ResourceReplay:
+		inst = NewReplayInstrument(opts.Timeout, opts.ReplayTiming)
+		address = r.Session
+	default:
+		return nil, fmt.Errorf("unknown resource type")
+	}
+
+	if err := inst.Connect(address, progress); err != nil {
+		return nil, err
+	}
+	if n, ok := inst.(networkInstrument); ok && opts.KeepAlive != 0 {
+		for _, conn := range n.conns() {
+			if err := setKeepAlive(conn, opts.KeepAlive); err != nil {
+				inst.Close()
+				return nil, fmt.Errorf("failed to configure keepalive: %w", err)
+			}
+		}
+	}
+	for _, middleware := range opts.Middleware {
+		inst = middleware(inst)
+	}
+	return inst, nil
+}
+
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period < 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	return tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: period, Interval: period, Count: keepAliveProbes})
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestParseResource(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Resource
+	}{
+		{"TCPIP0::192.168.1.5::5025::SOCKET", Resource{Kind: ResourceSocket, Host: "192.168.1.5", Port: 5025}},
+		{"tcpip1::myinst::5025::socket", Resource{Kind: ResourceSocket, Board: 1, Host: "myinst", Port: 5025}},
+		{"TCPIP0::192.168.1.5::inst0::INSTR", Resource{Kind: ResourceVxi11, Host: "192.168.1.5", Device: "inst0"}},
+		{"TCPIP::192.168.1.5", Resource{Kind: ResourceVxi11, Host: "192.168.1.5", Device: "inst0"}},
+		{"TCPIP0::192.168.1.5::gpib0,7::INSTR", Resource{Kind: ResourceVxi11, Host: "192.168.1.5", Device: "gpib0,7"}},
+		{"TCPIP0::192.168.1.5::hislip0::INSTR", Resource{Kind: ResourceHislip, Host: "192.168.1.5", Device: "hislip0"}},
+		{"TCPIP0::192.168.1.5::hislip1,4881::INSTR", Resource{Kind: ResourceHislip, Host: "192.168.1.5", Device: "hislip1", Port: 4881}},
+		{"ASRL/dev/ttyUSB0::INSTR", Resource{Kind: ResourceSerial, SerialPort: "/dev/ttyUSB0"}},
+		{"ASRL3::INSTR", Resource{Kind: ResourceSerial, SerialPort: "COM3"}},
+		{"SIM::profiles/mxg.txt", Resource{Kind: ResourceSim, Profile: "profiles/mxg.txt"}},
+		{"SIM", Resource{Kind: ResourceSim, Profile: "SCPI.txt"}},
+		{"REPLAY::sessions/bug-1234.jsonl", Resource{Kind: ResourceReplay, Session: "sessions/bug-1234.jsonl"}},
+	}
+	for _, test := range tests {
+		r, err := ParseResource(test.input)
+		if err != nil {
+			t.Errorf("ParseResource(%q) failed: %v", test.input, err)
+			continue
+		}
+		if r != test.expected {
+			t.Errorf("ParseResource(%q) = %+v, expected %+v", test.input, r, test.expected)
+		}
+	}
+}
+
+func TestParseResourceInvalid(t *testing.T) {
+	for _, input := range []string{
+		"GPIB0::7::INSTR",
+		"TCPIP0::::5025::SOCKET",
+		"TCPIP0::host::SOCKET",
+		"TCPIP0::host::99999::SOCKET",
+		"TCPIPx::host::INSTR",
+		"ASRL::INSTR",
+		"ASRL1::SOCKET",
+		"REPLAY",
+	} {
+		if r, err := ParseResource(input); err == nil {
+			t.Errorf("expected ParseResource(%q) to fail, got %+v", input, r)
+		}
+	}
+}
+
+func TestResourceStringRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		"TCPIP::192.168.1.5::5025::SOCKET",
+		"TCPIP2::192.168.1.5::inst0::INSTR",
+		"TCPIP::192.168.1.5::hislip0,4881::INSTR",
+		"ASRL/dev/ttyUSB0::INSTR",
+		"SIM::SCPI.txt",
+		"REPLAY::session.jsonl",
+	} {
+		r, err := ParseResource(input)
+		if err != nil {
+			t.Fatalf("ParseResource(%q) failed: %v", input, err)
+		}
+		if r.String() != input {
+			t.Errorf("expected %q to round trip, got %q", input, r.String())
+		}
+	}
+}
+
+func TestResolveAddress(t *testing.T) {
+	r, err := ResolveAddress("192.168.1.5", 5025)
+	if err != nil || r != (Resource{Kind: ResourceSocket, Host: "192.168.1.5", Port: 5025}) {
+		t.Errorf("expected bare host to resolve to a socket resource, got %+v %v", r, err)
+	}
+	r, err = ResolveAddress("simulated", 0)
+	if err != nil || r.Kind != ResourceSim {
+		t.Errorf("expected simulated to resolve to a sim resource, got %+v %v", r, err)
+	}
+	r, err = ResolveAddress("TCPIP0::192.168.1.5::hislip0::INSTR", 5025)
+	if err != nil || r.Kind != ResourceHislip || r.Port != 0 {
+		t.Errorf("expected resource string to ignore port, got %+v %v", r, err)
+	}
+	if _, err := ResolveAddress("192.168.1.5", 0); err == nil {
+		t.Error("expected bare host without port to fail")
+	}
+}
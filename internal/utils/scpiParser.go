@@ -1,11 +1,12 @@
 package utils
 
 import (
-	"log"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"slices"
+	"unicode"
 )
 
 type ScpiNode struct {
@@ -20,15 +21,44 @@ type nodeInfo struct {
   Suffixed bool `json:"suffixed"`
 }
 
-func parseScpi(lines []string) ScpiNode {
+// ParseDiagnostic reports a :SYSTem:HELP:HEADers? line that could not be parsed and was left out of the tree
+type ParseDiagnostic struct {
+	// Line counts from 1
+	Line   int    `json:"line"`
+	Text   string `json:"text"`
+	Reason string `json:"reason"`
+}
+
+func (d ParseDiagnostic) String() string {
+	return fmt.Sprintf("line %d: %s: %s", d.Line, d.Reason, d.Text)
+}
+
+func parseScpi(lines []string) (ScpiNode, []ParseDiagnostic) {
 	head := ScpiNode{}
-	commands := splitScpiCommands(lines)
+	commands, diagnostics := splitScpiCommands(lines)
 
 	for _, command := range commands {
 		createScpiTreeBranch(command, &head)
 	}
 
-	return head
+	return head, diagnostics
+}
+
+// Parses a :SYSTem:HELP:HEADers? response into the trees of its common commands, such as *RST, and its other commands.
+// The diagnostics number the lines of the whole response.
+func parseHeaders(lines []string) (ScpiNode, ScpiNode, []ParseDiagnostic) {
+	starTree, colonTree := ScpiNode{}, ScpiNode{}
+	commands, diagnostics := splitScpiCommands(lines)
+
+	for _, command := range commands {
+		if strings.HasPrefix(command[0].Text, "*") {
+			createScpiTreeBranch(command, &starTree)
+		} else {
+			createScpiTreeBranch(command, &colonTree)
+		}
+	}
+
+	return starTree, colonTree, diagnostics
 }
 
 func createScpiTreeBranch(command []nodeInfo, head *ScpiNode) {
@@ -76,24 +106,94 @@ func scpiNodeExists(nodes []ScpiNode, info nodeInfo) (bool, int) {
 
 // Converts :SYSTem:HELP:HEADers?-style SCPI definitions into a complete list of possible SCPI commands/queries.
 // NodeInfo objects contain command "suffix" information, e.g. RADio{1:16}
-func splitScpiCommands(lines []string) [][]nodeInfo {
+// Lines that cannot be parsed are skipped and reported, so one odd header does not lose the others.
+func splitScpiCommands(lines []string) ([][]nodeInfo, []ParseDiagnostic) {
 	var commands [][]nodeInfo
-	for _, line := range lines {
-		s := strings.Replace(line, "[", "", -1)
-		s = strings.TrimLeft(s, ":")
-		//TODO: Suffixed items are also accessible without suffix (default value)
-		s = reformatSuffixes(s)
-		s = reformatIrregularSuffixes(s)
-		//TODO: Convert all methods up to finishSuffixes to use strings instead of slices, will enable speeding up finishSuffixes by switching it from loops to recursion.
-		ss := strings.Split(s, ":")
-		sss := handleOptionals(removeSquareBraces(ss), getOptionalIndexes(ss))
-		sss = handleQueries(sss)
-		sss = handleBars(sss)
-		nodeInfos := finishSuffixes(sss)
+	var diagnostics []ParseDiagnostic
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		nodeInfos, err := splitScpiCommand(line)
+		if err != nil {
+			diagnostics = append(diagnostics, ParseDiagnostic{Line: i + 1, Text: line, Reason: err.Error()})
+			continue
+		}
 
 		commands = append(commands, nodeInfos...)
 	}
-	return commands
+	return commands, diagnostics
+}
+
+func splitScpiCommand(line string) ([][]nodeInfo, error) {
+	if err := checkHeaderLine(line); err != nil {
+		return nil, err
+	}
+	s := strings.Replace(line, "[", "", -1)
+	s = strings.TrimLeft(s, ":")
+	//TODO: Suffixed items are also accessible without suffix (default value)
+	s = reformatSuffixes(s)
+	s = reformatIrregularSuffixes(s)
+	if strings.ContainsAny(s, "{}") {
+		return nil, fmt.Errorf("unsupported suffix, expected {N} or {N:M} with N of one digit and M of up to two")
+	}
+	//TODO: Convert all methods up to finishSuffixes to use strings instead of slices, will enable speeding up finishSuffixes by switching it from loops to recursion.
+	ss := strings.Split(s, ":")
+	optionalIndexes := getOptionalIndexes(ss)
+	if len(optionalIndexes) == len(ss) {
+		return nil, fmt.Errorf("every node is optional")
+	}
+	sss := handleOptionals(removeSquareBraces(ss), optionalIndexes)
+	sss = handleQueries(sss)
+	sss = handleBars(sss)
+	nodeInfos, err := finishSuffixes(sss)
+	if err != nil {
+		return nil, err
+	}
+	for _, command := range nodeInfos {
+		for _, node := range command {
+			if strings.TrimSuffix(node.Text, "?") == "" {
+				return nil, fmt.Errorf("empty node")
+			}
+		}
+	}
+	return nodeInfos, nil
+}
+
+// Checks the characters and square brackets of a header, which the other steps assume are well formed
+func checkHeaderLine(line string) error {
+	s := strings.TrimSuffix(strings.TrimSuffix(line, "/nquery/"), "/qonly/")
+	depth := 0
+	for _, r := range s {
+		switch {
+		case r == '[':
+			depth++
+			if depth > 1 {
+				return fmt.Errorf("nested square brackets")
+			}
+		case r == ']':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced square brackets")
+			}
+		case unicode.IsSpace(r):
+			return fmt.Errorf("unexpected whitespace")
+		case !isHeaderRune(r):
+			return fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced square brackets")
+	}
+	if strings.HasSuffix(line, "/qonly/") && !strings.HasSuffix(line, "?/qonly/") {
+		return fmt.Errorf("/qonly/ must follow a ?")
+	}
+	return nil
+}
+
+func isHeaderRune(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("*?_:{}|", r))
 }
 
 // Rewrites any discovered suffixes into an easier to parse format that most importantly doesnt have any ':' characters
@@ -140,43 +240,56 @@ func reformatIrregularSuffixes(s string) string {
 }
 
 // Finds the temporarily adjusted suffix information and moves it into nodeInfo fields
-func finishSuffixes(commands [][]string) [][]nodeInfo {
+func finishSuffixes(commands [][]string) ([][]nodeInfo, error) {
 	//TODO: Need to speed this up
 	var result [][]nodeInfo
 	for _, command := range commands {
 		var commandInfo []nodeInfo
 		for _, subcommand := range command {
-			commandInfo = append(commandInfo, finishSuffix(subcommand))
+			info, err := finishSuffix(subcommand)
+			if err != nil {
+				return nil, err
+			}
+			commandInfo = append(commandInfo, info)
 		}
 		result = append(result, commandInfo)
 	}
-	return result
+	return result, nil
 }
 
-func finishSuffix(subcommand string) nodeInfo {
+func finishSuffix(subcommand string) (nodeInfo, error) {
 	r, _ := regexp.Compile(`@(\d{1,2})#(\d{1,2})`)
 	match := r.FindStringSubmatchIndex(subcommand)
 	if match == nil {
-		return nodeInfo{Text: subcommand, Suffixed: false}
+		return nodeInfo{Text: subcommand, Suffixed: false}, nil
 	}
 
-	start := tryConvertAtoi(calculateSuffix(subcommand, match[2], match[3]))
-	stop := tryConvertAtoi(calculateSuffix(subcommand, match[4], match[5]))
+	start, err := tryConvertAtoi(calculateSuffix(subcommand, match[2], match[3]))
+	if err != nil {
+		return nodeInfo{}, err
+	}
+	stop, err := tryConvertAtoi(calculateSuffix(subcommand, match[4], match[5]))
+	if err != nil {
+		return nodeInfo{}, err
+	}
+	if start > stop {
+		return nodeInfo{}, fmt.Errorf("suffix range {%d:%d} ends before it starts", start, stop)
+	}
 
 	startCut := match[0]
 	text := subcommand[:startCut]
 	if strings.HasSuffix(subcommand, "?") {
 		text += "?"
 	}
-	return nodeInfo{Text: text, Suffixed: true, Start: start, Stop: stop}
+	return nodeInfo{Text: text, Suffixed: true, Start: start, Stop: stop}, nil
 }
 
-func tryConvertAtoi(character string) int {
+func tryConvertAtoi(character string) (int, error) {
 	result, err := strconv.Atoi(character)
 	if err != nil {
-		log.Fatal("Failed to parse suffix from SCPI command: ")
+		return 0, fmt.Errorf("failed to parse suffix '%s'", character)
 	}
-	return result
+	return result, nil
 }
 
 //Determines whether the value is double digit or not, then generates the correct value string
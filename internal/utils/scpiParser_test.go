@@ -10,7 +10,7 @@ func BenchmarkVxgScpi(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		head := ScpiNode{}
 		lines, _ := ReadLinesFromPath("benchmark_SCPI.txt")
-		commands := splitScpiCommands(lines)
+		commands, _ := splitScpiCommands(lines)
 
 		for _, command := range commands {
 			createScpiTreeBranch(command, &head)
@@ -20,7 +20,7 @@ func BenchmarkVxgScpi(b *testing.B) {
 
 func TestScpiParserTwoOptionals(t *testing.T) {
 	lines := []string{":DIAGnostic[:CPU]:BLOCk:ABUS:LIST[:SINGle]"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 8 {
 		t.Error(":DIAGnostic[:CPU]:BLOCk:ABUS:LIST[:SINGle] not parsed properly:", commands)
 		return
@@ -29,7 +29,7 @@ func TestScpiParserTwoOptionals(t *testing.T) {
 
 func TestScpiParserThreeOptionals(t *testing.T) {
 	lines := []string{"[:SOURce]:AMPLitude[:LEVel]:STEP[:INCRement]"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 16 {
 		t.Error("[:SOURce]:AMPLitude[:LEVel]:STEP[:INCRement] not parsed properly:", commands)
 		return
@@ -38,7 +38,7 @@ func TestScpiParserThreeOptionals(t *testing.T) {
 
 func TestScpiParserFourOptionals(t *testing.T) {
 	lines := []string{"[:SOURce]:FREQuency[:CW][:FIXed][:FIXed]"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 32 {
 		t.Error("[:SOURce]:FREQuency[:CW][:FIXed][:FIXed] not parsed properly:", commands)
 		return
@@ -47,7 +47,7 @@ func TestScpiParserFourOptionals(t *testing.T) {
 
 func TestScpiParserFirstOptional(t *testing.T) {
 	lines := []string{"[:SOURce]:FREQuency:SPAN"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 4 {
 		t.Error("[:SOURce]:FREQuency:SPAN not parsed properly:", commands)
 		return
@@ -57,7 +57,7 @@ func TestScpiParserFirstOptional(t *testing.T) {
 func TestScpiParserNoQuery(t *testing.T) {
 
 	lines := []string{":ABORt/nquery/"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 1 {
 		t.Error(":ABORt/nquery/ not parsed properly:", commands[0])
 		return
@@ -69,7 +69,7 @@ func TestScpiParserNoQuery(t *testing.T) {
 
 func TestScpiParserOptionalsNoQuery(t *testing.T) {
 	lines := []string{":ABORt[:SWEep]/nquery/"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 2 {
 		t.Error(":ABORt[:SWEep]/nquery/ not parsed properly:", commands)
 		return
@@ -84,7 +84,7 @@ func TestScpiParserOptionalsNoQuery(t *testing.T) {
 
 func TestScpiParserOptionals(t *testing.T) {
 	lines := []string{":ABORt[:SWEep]"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 4 {
 		t.Error(":ABORt[:SWEep] not parsed properly:", commands)
 		return
@@ -99,7 +99,7 @@ func TestScpiParserOptionals(t *testing.T) {
 
 func TestScpiParserBasic(t *testing.T) {
 	lines := []string{":CALibration:BBG:CHANnel:OFFSet"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 2 {
 		t.Error(":CALibration:BBG:CHANnel:OFFSet not parsed properly:", commands)
 		return
@@ -114,7 +114,7 @@ func TestScpiParserBasic(t *testing.T) {
 
 func TestScpiParserOneBar(t *testing.T) {
 	lines := []string{"Hello|Goodbye:My:Friend/nquery/"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 2 {
 		t.Error(":Hello|Goodbye:My:Friend/nquery not parsed properly")
 	}
@@ -125,7 +125,7 @@ func TestScpiParserOneBar(t *testing.T) {
 
 func TestScpiParserMultipleBarsNoQuery(t *testing.T) {
 	lines := []string{"Hello|Goodbye:My:Friend|Love/nquery/"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 4 {
 		t.Error(":Hello|Goodbye:My:Friend|Love/nquery not parsed properly")
 	}
@@ -136,7 +136,7 @@ func TestScpiParserMultipleBarsNoQuery(t *testing.T) {
 
 func TestScpiParserMultipleBarsCommandAndQuery(t *testing.T) {
 	lines := []string{"Hello|Goodbye:My:Friend|Love"}
-	commands := splitScpiCommands(lines)
+	commands, _ := splitScpiCommands(lines)
 	if len(commands) != 8 {
 		t.Error(":Hello|Goodbye:My:Friend|Love not parsed properly")
 	}
@@ -166,6 +166,40 @@ func TestScpiParserIrregularSuffix(t *testing.T) {
 	}
 }
 
+func TestScpiParserDiagnostics(t *testing.T) {
+	lines := []string{
+		":SOURce:FREQuency",
+		":SOURce:POWer {dBm}",
+		"[:ABORt]/nquery/",
+		":OUTPut{10:20}:STATe",
+		"",
+		":TRIGger{2:1}",
+		":DIAGnostic[:CPU",
+		":SYSTem::ERRor?/qonly/",
+		":MEASure:VOLTage?/qonly/\r",
+	}
+	commands, diagnostics := splitScpiCommands(lines)
+	if len(commands) != 3 {
+		t.Error("expected the valid lines to still be parsed:", commands)
+	}
+	expected := map[int]string{
+		2: "unexpected whitespace",
+		3: "every node is optional",
+		4: "unsupported suffix",
+		6: "ends before it starts",
+		7: "unbalanced square brackets",
+		8: "empty node",
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatal("expected a diagnostic per invalid line, got", diagnostics)
+	}
+	for _, d := range diagnostics {
+		if reason, ok := expected[d.Line]; !ok || !strings.Contains(d.Reason, reason) || d.Text != strings.TrimSpace(lines[d.Line-1]) {
+			t.Errorf("line %d: expected %q, got %s", d.Line, reason, d)
+		}
+	}
+}
+
 func TestGenerateTree(t *testing.T) {
 	lines, _ := ReadLinesFromPath("SCPI.txt")
 	parseScpi(lines) //TODO: Generate real tests
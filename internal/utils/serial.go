@@ -0,0 +1,248 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Parity int
+
+const (
+	ParityNone Parity = iota
+	ParityOdd
+	ParityEven
+	ParityMark
+	ParitySpace
+)
+
+type FlowControl int
+
+const (
+	FlowControlNone FlowControl = iota
+	FlowControlXonXoff
+	FlowControlRtsCts
+)
+
+// SerialConfig describes the line settings of a serial port. The zero value is replaced by 9600 baud 8N1 without flow control.
+type SerialConfig struct {
+	BaudRate    int
+	DataBits    int
+	Parity      Parity
+	StopBits    int
+	FlowControl FlowControl
+}
+
+func (c SerialConfig) withDefaults() SerialConfig {
+	if c.BaudRate == 0 {
+		c.BaudRate = 9600
+	}
+	if c.DataBits == 0 {
+		c.DataBits = 8
+	}
+	if c.StopBits == 0 {
+		c.StopBits = 1
+	}
+	return c
+}
+
+func ParseParity(s string) (Parity, error) {
+	switch strings.ToLower(s) {
+	case "", "none", "n":
+		return ParityNone, nil
+	case "odd", "o":
+		return ParityOdd, nil
+	case "even", "e":
+		return ParityEven, nil
+	case "mark", "m":
+		return ParityMark, nil
+	case "space", "s":
+		return ParitySpace, nil
+	}
+	return ParityNone, fmt.Errorf("unknown parity '%s', expected none, odd, even, mark or space", s)
+}
+
+func ParseFlowControl(s string) (FlowControl, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return FlowControlNone, nil
+	case "xonxoff", "software":
+		return FlowControlXonXoff, nil
+	case "rtscts", "hardware":
+		return FlowControlRtsCts, nil
+	}
+	return FlowControlNone, fmt.Errorf("unknown flow control '%s', expected none, xonxoff or rtscts", s)
+}
+
+type serialInstrument struct {
+	config      SerialConfig
+	framing     Framing
+	port        *os.File
+	reader      *bufio.Reader
+	mu          sync.Mutex
+	timeout     timeoutSetting
+	interrupted bool
+	interactive bool
+	headersHash uint32
+	starTree    ScpiNode
+	colonTree   ScpiNode
+	diagnostics []ParseDiagnostic
+}
+
+// Serial ports have no end-of-message signal, so framing cannot use TerminationEoi
+func NewSerialInstrument(config SerialConfig, framing Framing, timeout time.Duration, interactive bool) Instrument {
+	i := &serialInstrument{
+		config:      config.withDefaults(),
+		framing:     framing,
+		interactive: interactive,
+	}
+	i.timeout.set(timeout)
+	return i
+}
+
+// Address is the serial device path, e.g. /dev/ttyUSB0
+func (i *serialInstrument) Connect(address string, progress func(int)) error {
+	if err := i.framing.requireTerminations("a serial port"); err != nil {
+		return err
+	}
+	port, err := openSerialPort(address, i.config)
+	if err != nil {
+		return fmt.Errorf("failed to open serial port %s: %w", address, err)
+	}
+	if progress != nil {
+		progress(40)
+	}
+	i.port = port
+	i.reader = bufio.NewReader(port)
+	return nil
+}
+
+func (i *serialInstrument) Command(command string) error {
+	return i.CommandContext(context.Background(), command)
+}
+
+func (i *serialInstrument) CommandContext(ctx context.Context, command string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.write(ctx, command); err != nil {
+		return fmt.Errorf("failed to execute the command '%s': %w", command, err)
+	}
+	return nil
+}
+
+func (i *serialInstrument) write(ctx context.Context, cmd string) error {
+	if i.interrupted {
+		if err := flushInput(i.reader, i.port, i.timeout.get()); err != nil {
+			return i.wrapError(ctx, err)
+		}
+		i.interrupted = false
+	}
+
+	stop := bindContext(ctx, i.port, i.timeout.get())
+	defer stop()
+	if _, err := i.port.Write([]byte(cmd + i.framing.writeTermination())); err != nil {
+		return i.wrapError(ctx, err)
+	}
+	return nil
+}
+
+func (i *serialInstrument) read(ctx context.Context) ([]byte, error) {
+	stop := bindContext(ctx, i.port, i.timeout.get())
+	defer stop()
+	b, err := readResponse(i.reader, i.framing.readTermination(), i.framing.maxResponseSize())
+	if err != nil {
+		return nil, i.wrapError(ctx, err)
+	}
+	return b, nil
+}
+
+func (i *serialInstrument) wrapError(ctx context.Context, err error) error {
+	if err = transportError(err); errors.Is(err, ErrConnectionClosed) {
+		return err
+	}
+	i.interrupted = true
+	return contextError(ctx, err)
+}
+
+func (i *serialInstrument) Query(cmd string) (string, error) {
+	return i.QueryContext(context.Background(), cmd)
+}
+
+func (i *serialInstrument) QueryContext(ctx context.Context, cmd string) (string, error) {
+	b, err := i.QueryBytesContext(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return responseString(b), nil
+}
+
+func (i *serialInstrument) QueryBytes(cmd string) ([]byte, error) {
+	return i.QueryBytesContext(context.Background(), cmd)
+}
+
+func (i *serialInstrument) QueryBytesContext(ctx context.Context, cmd string) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.query(ctx, cmd)
+}
+
+// Must be called with mu held
+func (i *serialInstrument) query(ctx context.Context, cmd string) ([]byte, error) {
+	if err := i.write(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	finish := trackQueryProgress(callTimeout(ctx, i.timeout.get()), i.interactive)
+	b, err := i.read(ctx)
+	finish(err == nil)
+	return b, err
+}
+
+func (i *serialInstrument) QueryError(opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return i.QueryErrorContext(context.Background(), opts)
+}
+
+// The queue is drained holding mu, so no other call runs between its queries
+func (i *serialInstrument) QueryErrorContext(ctx context.Context, opts ErrorQueueOptions) ([]InstrumentError, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return queryErrorQueue(ctx, func(ctx context.Context, cmd string) (string, error) {
+		b, err := i.query(ctx, cmd)
+		if err != nil {
+			return "", err
+		}
+		return responseString(b), nil
+	}, opts)
+}
+
+func (i *serialInstrument) GetSupportedCommandsTree() (ScpiNode, ScpiNode, error) {
+	r, err := i.Query(":SYST:HELP:HEAD?")
+	if err != nil {
+		return ScpiNode{}, ScpiNode{}, err
+	}
+	if hash := hash(r); hash != i.headersHash {
+		i.starTree, i.colonTree, i.diagnostics = parseHeaders(strings.Split(r, "\n"))
+		i.headersHash = hash
+	}
+	return i.starTree, i.colonTree, nil
+}
+
+func (i *serialInstrument) HeaderDiagnostics() []ParseDiagnostic {
+	return i.diagnostics
+}
+
+func (i *serialInstrument) SetTimeout(timeout time.Duration) {
+	i.timeout.set(timeout)
+}
+
+func (i *serialInstrument) Close() error {
+	if i.port == nil {
+		return nil
+	}
+	return i.port.Close()
+}
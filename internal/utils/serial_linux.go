@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var baudRates = map[int]uint32{
+	1200:   unix.B1200,
+	2400:   unix.B2400,
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	921600: unix.B921600,
+}
+
+var dataBits = map[int]uint32{
+	5: unix.CS5,
+	6: unix.CS6,
+	7: unix.CS7,
+	8: unix.CS8,
+}
+
+func openSerialPort(path string, config SerialConfig) (*os.File, error) {
+	baud, ok := baudRates[config.BaudRate]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", config.BaudRate)
+	}
+	size, ok := dataBits[config.DataBits]
+	if !ok {
+		return nil, fmt.Errorf("unsupported number of data bits %d", config.DataBits)
+	}
+	if config.StopBits != 1 && config.StopBits != 2 {
+		return nil, fmt.Errorf("unsupported number of stop bits %d", config.StopBits)
+	}
+
+	// Non-blocking mode lets the runtime poller implement read and write deadlines
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// Raw mode, equivalent to cfmakeraw
+	t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY
+	t.Oflag &^= unix.OPOST
+	t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CMSPAR | unix.CSTOPB | unix.CRTSCTS | unix.CBAUD
+	t.Cflag |= unix.CLOCAL | unix.CREAD | size | baud
+	t.Ispeed = baud
+	t.Ospeed = baud
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+
+	switch config.Parity {
+	case ParityOdd:
+		t.Cflag |= unix.PARENB | unix.PARODD
+	case ParityEven:
+		t.Cflag |= unix.PARENB
+	case ParityMark:
+		t.Cflag |= unix.PARENB | unix.PARODD | unix.CMSPAR
+	case ParitySpace:
+		t.Cflag |= unix.PARENB | unix.CMSPAR
+	}
+	if config.Parity != ParityNone {
+		t.Iflag |= unix.INPCK
+	}
+	if config.StopBits == 2 {
+		t.Cflag |= unix.CSTOPB
+	}
+	switch config.FlowControl {
+	case FlowControlXonXoff:
+		t.Iflag |= unix.IXON | unix.IXOFF
+	case FlowControlRtsCts:
+		t.Cflag |= unix.CRTSCTS
+	}
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, t); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	_ = unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIOFLUSH)
+
+	return os.NewFile(uintptr(fd), path), nil
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Opens a pseudo-terminal pair and answers each line written to the slave side using the simulated instrument
+func openSimulatedPty(t *testing.T, termination string) string {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals unavailable: %v", err)
+	}
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(fd)
+		t.Fatal(err)
+	}
+	master := os.NewFile(uintptr(fd), "ptmx")
+	t.Cleanup(func() { master.Close() })
+
+	sim := NewSimInstrument("", time.Second, false)
+	go func() {
+		scanner := bufio.NewScanner(master)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if !strings.Contains(line, "?") {
+				sim.Command(line)
+				continue
+			}
+			response, _ := sim.Query(line)
+			response = strings.TrimSuffix(response, "\n") + termination
+			if _, err := master.Write([]byte(response)); err != nil {
+				return
+			}
+		}
+	}()
+
+	return fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestSerialQuery(t *testing.T) {
+	path := openSimulatedPty(t, "\n")
+	inst := NewSerialInstrument(SerialConfig{BaudRate: 115200}, Framing{}, time.Second, false)
+	if err := inst.Connect(path, nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	if err := inst.Command(":FREQ 1000"); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	res, err := inst.Query(":FREQ?")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if res != "1000\n" {
+		t.Errorf("unexpected response %q", res)
+	}
+	errors, err := inst.QueryError(ErrorQueueOptions{})
+	if err != nil || len(errors) != 0 {
+		t.Errorf("expected empty error queue, got %v %v", errors, err)
+	}
+}
+
+func TestSerialQueryCrLfTermination(t *testing.T) {
+	path := openSimulatedPty(t, "\r\n")
+	config := SerialConfig{BaudRate: 9600, DataBits: 7, Parity: ParityEven, StopBits: 2, FlowControl: FlowControlXonXoff}
+	inst := NewSerialInstrument(config, Framing{WriteTermination: "\r\n", ReadTermination: "\r\n"}, time.Second, false)
+	if err := inst.Connect(path, nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	res, err := inst.Query("*IDN?")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if res != simIdentity+"\n" {
+		t.Errorf("expected CRLF termination to be normalized, got %q", res)
+	}
+}
+
+func TestSerialQueryTimeout(t *testing.T) {
+	path := openSimulatedPty(t, "\n")
+	inst := NewSerialInstrument(SerialConfig{}, Framing{}, 200*time.Millisecond, false)
+	if err := inst.Connect(path, nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	// The simulated pty only answers queries, so reading a response to a command times out
+	if _, err := inst.(*serialInstrument).read(context.Background()); err == nil {
+		t.Error("expected read without response to time out")
+	}
+}
+
+func TestSerialUnsupportedBaudRate(t *testing.T) {
+	path := openSimulatedPty(t, "\n")
+	inst := NewSerialInstrument(SerialConfig{BaudRate: 12345}, Framing{}, time.Second, false)
+	if err := inst.Connect(path, nil); err == nil {
+		inst.Close()
+		t.Error("expected unsupported baud rate to fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package utils
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func openSerialPort(path string, config SerialConfig) (*os.File, error) {
+	return nil, fmt.Errorf("serial instruments are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A recorded session is a JSON lines file holding a SessionHeader followed by a SessionEntry for each call on the instrument
+const sessionVersion = 1
+
+// The ops of session entries, matching the names of the calls in the middleware package
+const (
+	sessionCommand    = "command"
+	sessionQuery      = "query"
+	sessionQueryBytes = "queryBytes"
+	sessionQueryError = "queryError"
+	sessionCommands   = "commands"
+)
+
+// A replayed session was sent a different call than the one recorded next
+var ErrReplayDiverged = errors.New("replay diverged")
+
+type SessionHeader struct {
+	Version  int       `json:"version"`
+	Resource string    `json:"resource,omitempty"`
+	Started  time.Time `json:"started"`
+}
+
+// SessionEntry is a single recorded call and its outcome
+type SessionEntry struct {
+	// Offset is the time from the start of the session to the call, and Elapsed how long the call took
+	Offset  time.Duration `json:"offset"`
+	Elapsed time.Duration `json:"elapsed"`
+	Op      string        `json:"op"`
+	// Input holds the command or query sent. InputBlock holds one that is not valid UTF-8, such as a command with a
+	// binary block.
+	Input      string `json:"input,omitempty"`
+	InputBlock []byte `json:"inputBlock,omitempty"`
+	// Response holds a text response. Block holds a response that is not valid UTF-8, such as a binary block.
+	Response string            `json:"response,omitempty"`
+	Block    []byte            `json:"block,omitempty"`
+	Errors   []InstrumentError `json:"errors,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Kind     ErrorKind         `json:"errorKind,omitempty"`
+	// The command trees of a commands entry
+	StarTree  *ScpiNode `json:"starTree,omitempty"`
+	ColonTree *ScpiNode `json:"colonTree,omitempty"`
+}
+
+// Sets the command or query of the entry, choosing Input or InputBlock by its content
+func (e *SessionEntry) SetInput(input string) {
+	if utf8.ValidString(input) {
+		e.Input = input
+	} else {
+		e.InputBlock = []byte(input)
+	}
+}
+
+func (e *SessionEntry) input() string {
+	if e.InputBlock != nil {
+		return string(e.InputBlock)
+	}
+	return e.Input
+}
+
+// Sets the response of the entry, choosing Response or Block by its content
+func (e *SessionEntry) SetOutput(output []byte) {
+	if utf8.Valid(output) {
+		e.Response = string(output)
+	} else {
+		e.Block = output
+	}
+}
+
+func (e *SessionEntry) output() []byte {
+	if e.Block != nil {
+		return e.Block
+	}
+	return []byte(e.Response)
+}
+
+// Sets the error of the entry, keeping its kind so a replay fails the same way
+func (e *SessionEntry) SetError(err error) {
+	if err != nil {
+		e.Error = err.Error()
+		e.Kind = KindOf(err)
+	}
+}
+
+// Returns an error of the recorded kind, so callers react to a replayed failure as they did to the original
+func (e *SessionEntry) err() error {
+	if e.Error == "" {
+		return nil
+	}
+	switch e.Kind {
+	case ErrorKindTimeout:
+		return fmt.Errorf("%w: %s", ErrTimeout, e.Error)
+	case ErrorKindConnection:
+		return fmt.Errorf("%w: %s", ErrConnectionClosed, e.Error)
+	case ErrorKindProtocol:
+		return fmt.Errorf("%w: %s", ErrProtocol, e.Error)
+	case ErrorKindLocked:
+		return fmt.Errorf("%w: %s", ErrLocked, e.Error)
+	case ErrorKindCanceled:
+		return fmt.Errorf("%w: %s", context.Canceled, e.Error)
+	}
+	return errors.New(e.Error)
+}
+
+// SessionWriter records the calls on an instrument. It is safe for concurrent use.
+type SessionWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+	started time.Time
+}
+
+// Writes the session header for resource to w and returns a SessionWriter for the entries
+func NewSessionWriter(w io.Writer, resource string) (*SessionWriter, error) {
+	s := &SessionWriter{encoder: json.NewEncoder(w), started: time.Now()}
+	if err := s.encoder.Encode(SessionHeader{Version: sessionVersion, Resource: resource, Started: s.started}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Writes entry, made at start, to the session
+func (s *SessionWriter) Write(start time.Time, entry SessionEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.Offset = start.Sub(s.started)
+	return s.encoder.Encode(entry)
+}
+
+// Reads a session written by a SessionWriter
+func ReadSession(r io.Reader) (SessionHeader, []SessionEntry, error) {
+	var header SessionHeader
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	if err := decoder.Decode(&header); err != nil {
+		return SessionHeader{}, nil, fmt.Errorf("invalid session header: %w", err)
+	}
+	if header.Version != sessionVersion {
+		return SessionHeader{}, nil, fmt.Errorf("unsupported session version %d", header.Version)
+	}
+	var entries []SessionEntry
+	for {
+		var entry SessionEntry
+		if err := decoder.Decode(&entry); errors.Is(err, io.EOF) {
+			return header, entries, nil
+		} else if err != nil {
+			return SessionHeader{}, nil, fmt.Errorf("invalid session entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// replayInstrument answers each call with the next call of a recorded session, failing with ErrReplayDiverged when
+// the call differs from the recorded one. The command trees are answered whenever asked, as clients read them at
+// different times.
+type replayInstrument struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	// timing makes each call take as long as it did when recorded
+	timing    bool
+	resource  string
+	entries   []SessionEntry
+	next      int
+	starTree  ScpiNode
+	colonTree ScpiNode
+	hasTrees  bool
+}
+
+func NewReplayInstrument(timeout time.Duration, timing bool) Instrument {
+	return &replayInstrument{timeout: timeout, timing: timing}
+}
+
+// Address is the path of the session file
+func (i *replayInstrument) Connect(address string, progress func(int)) error {
+	file, err := os.Open(address)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, entries, err := ReadSession(file)
+	if err != nil {
+		return fmt.Errorf("failed to read session %s: %w", address, err)
+	}
+
+	i.resource = header.Resource
+	for _, entry := range entries {
+		if entry.Op != sessionCommands {
+			i.entries = append(i.entries, entry)
+		} else if !i.hasTrees && entry.StarTree != nil && entry.ColonTree != nil {
+			i.starTree, i.colonTree, i.hasTrees = *entry.StarTree, *entry.ColonTree, true
+		}
+	}
+	if progress != nil {
+		progress(40)
+	}
+	return nil
+}
+
+// Returns the next recorded entry if it matches op and input
+func (i *replayInstrument) replay(ctx context.Context, op string, input string) (SessionEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return SessionEntry{}, err
+	}
+
+	i.mu.Lock()
+	if i.next >= len(i.entries) {
+		i.mu.Unlock()
+		return SessionEntry{}, fmt.Errorf("%w: the session of %s ended, got %s %q", ErrReplayDiverged, i.resource, op, input)
+	}
+	entry := i.entries[i.next]
+	if entry.Op != op || strings.TrimSpace(entry.input()) != strings.TrimSpace(input) {
+		i.mu.Unlock()
+		return SessionEntry{}, fmt.Errorf("%w at call %d: expected %s %q, got %s %q", ErrReplayDiverged, i.next+1, entry.Op, entry.input(), op, input)
+	}
+	i.next++
+	i.mu.Unlock()
+
+	if i.timing && entry.Elapsed > 0 {
+		timer := time.NewTimer(entry.Elapsed)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return SessionEntry{}, contextError(ctx, ctx.Err())
+		}
+	}
+	return entry, entry.err()
+}
+
+func (i *replayInstrument) Command(command string) error {
+	return i.CommandContext(context.Background(), command)
+}
+
+func (i *replayInstrument) CommandContext(ctx context.Context, command string) error {
+	_, err := i.replay(ctx, sessionCommand, command)
+	return err
+}
+
+func (i *replayInstrument) Query(query string) (string, error) {
+	return i.QueryContext(context.Background(), query)
+}
+
+func (i *replayInstrument) QueryContext(ctx context.Context, query string) (string, error) {
+	entry, err := i.replay(ctx, sessionQuery, query)
+	return string(entry.output()), err
+}
+
+func (i *replayInstrument) QueryBytes(query string) ([]byte, error) {
+	return i.QueryBytesContext(context.Background(), query)
+}
+
+func (i *replayInstrument) QueryBytesContext(ctx context.Context, query string) ([]byte, error) {
+	entry, err := i.replay(ctx, sessionQueryBytes, query)
+	if entry.Op == "" {
+		return nil, err
+	}
+	return entry.output(), err
+}
+
+func (i *replayInstrument) QueryError(opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return i.QueryErrorContext(context.Background(), opts)
+}
+
+func (i *replayInstrument) QueryErrorContext(ctx context.Context, opts ErrorQueueOptions) ([]InstrumentError, error) {
+	entry, err := i.replay(ctx, sessionQueryError, opts.Query)
+	return entry.Errors, err
+}
+
+func (i *replayInstrument) GetSupportedCommandsTree() (ScpiNode, ScpiNode, error) {
+	if !i.hasTrees {
+		return ScpiNode{}, ScpiNode{}, fmt.Errorf("the session of %s has no command trees", i.resource)
+	}
+	return i.starTree, i.colonTree, nil
+}
+
+func (i *replayInstrument) SetTimeout(timeout time.Duration) {
+	i.timeout = timeout
+}
+
+func (i *replayInstrument) Close() error {
+	return nil
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSession(t *testing.T, entries ...SessionEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	session, err := NewSessionWriter(&buf, "TCPIP::dmm::5025::SOCKET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := session.Write(time.Now(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReplaySession(t *testing.T) {
+	block := SessionEntry{Op: sessionQueryBytes, Input: "TRAC:DATA?"}
+	block.SetOutput([]byte{0x00, 0xff, 0xfe, 0x80})
+	timeout := SessionEntry{Op: sessionQuery, Input: "MEAS:VOLT?"}
+	timeout.SetError(ErrTimeout)
+	star, colon, _ := parseHeaders([]string{"*IDN?", ":MEASure:VOLTage?"})
+	path := writeSession(t,
+		SessionEntry{Op: sessionCommands, StarTree: &star, ColonTree: &colon},
+		SessionEntry{Op: sessionCommand, Input: "*RST"},
+		SessionEntry{Op: sessionQuery, Input: "*IDN?", Response: "Keysight,34465A,MY1,A.03"},
+		block,
+		timeout,
+		SessionEntry{Op: sessionQueryError, Input: "SYST:ERR?", Errors: []InstrumentError{{Code: -113, Message: "Undefined header"}}},
+	)
+
+	inst, err := OpenResource(Resource{Kind: ResourceReplay, Session: path}, InstrumentOptions{Timeout: time.Second}, nil)
+	if err != nil {
+		t.Fatalf("failed to open the session: %v", err)
+	}
+	if starTree, colonTree, err := inst.GetSupportedCommandsTree(); err != nil || len(starTree.Children) == 0 || len(colonTree.Children) == 0 {
+		t.Errorf("expected the recorded command trees, got %+v %+v: %v", starTree, colonTree, err)
+	}
+
+	// A different call than the recorded one diverges without using up the recorded call
+	if err := inst.Command("*CLS"); !errors.Is(err, ErrReplayDiverged) {
+		t.Errorf("expected a divergence, got %v", err)
+	}
+	if err := inst.Command("*RST"); err != nil {
+		t.Errorf("expected the recorded command to succeed, got %v", err)
+	}
+	if res, err := inst.Query("*IDN?"); err != nil || res != "Keysight,34465A,MY1,A.03" {
+		t.Errorf("unexpected response %q: %v", res, err)
+	}
+	if res, err := inst.QueryBytes("TRAC:DATA?"); err != nil || !bytes.Equal(res, []byte{0x00, 0xff, 0xfe, 0x80}) {
+		t.Errorf("expected the recorded block, got %v: %v", res, err)
+	}
+	if _, err := inst.QueryContext(context.Background(), "MEAS:VOLT?"); KindOf(err) != ErrorKindTimeout {
+		t.Errorf("expected the recorded timeout, got %v", err)
+	}
+	if errs, err := inst.QueryError(ErrorQueueOptions{Query: "SYST:ERR?"}); err != nil || len(errs) != 1 || errs[0].Code != -113 {
+		t.Errorf("expected the recorded error queue, got %+v: %v", errs, err)
+	}
+	if _, err := inst.Query("*IDN?"); !errors.Is(err, ErrReplayDiverged) {
+		t.Errorf("expected the end of the session to diverge, got %v", err)
+	}
+}
+
+func TestReplaySessionTiming(t *testing.T) {
+	path := writeSession(t, SessionEntry{Op: sessionQuery, Input: "*OPC?", Response: "1", Elapsed: time.Second})
+
+	inst, err := OpenResource(Resource{Kind: ResourceReplay, Session: path}, InstrumentOptions{Timeout: time.Second, ReplayTiming: true}, nil)
+	if err != nil {
+		t.Fatalf("failed to open the session: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := inst.QueryContext(ctx, "*OPC?"); KindOf(err) != ErrorKindTimeout {
+		t.Errorf("expected the recorded duration to exceed the deadline, got %v", err)
+	}
+}
+
+func TestReadSessionInvalid(t *testing.T) {
+	for _, data := range []string{"", "not json", `{"version": 99}`, "{\"version\": 1}\n{\"op\": "} {
+		if _, _, err := ReadSession(bytes.NewBufferString(data)); err == nil {
+			t.Errorf("expected ReadSession(%q) to fail", data)
+		}
+	}
+}
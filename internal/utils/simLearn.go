@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// SimLearnOptions configures LearnSimProfile
+type SimLearnOptions struct {
+	// Headers is the :SYSTem:HELP:HEADers? file of the instrument. Headers it lists are learned under the line listing
+	// them, so every spelling of a header is learned as one, and the profile refers to the file. Other headers are
+	// learned as they were sent.
+	Headers string
+	// Timing learns the mean time the queries of a header took as its delay. Only recorded sessions have timings.
+	Timing bool
+	// Profile is where the profile is to be written. The profile refers to Headers relative to it, as LoadSimProfile
+	// expects. Empty refers to Headers as given.
+	Profile string
+}
+
+// LearnedSimProfile is a SimProfile mined from a transcript, in the form it is written
+type LearnedSimProfile struct {
+	Idn      string              `yaml:"idn,omitempty" json:"idn,omitempty"`
+	Headers  string              `yaml:"headers,omitempty" json:"headers,omitempty"`
+	Commands []LearnedSimCommand `yaml:"commands" json:"commands"`
+}
+
+type LearnedSimCommand struct {
+	Header   string `yaml:"header" json:"header"`
+	Default  string `yaml:"default,omitempty" json:"default,omitempty"`
+	Response string `yaml:"response,omitempty" json:"response,omitempty"`
+	Delay    string `yaml:"delay,omitempty" json:"delay,omitempty"`
+}
+
+// A program message of a transcript and its response
+type transcriptCall struct {
+	input    string
+	response string
+	elapsed  time.Duration
+	// Binary responses cannot be learned
+	binary bool
+}
+
+// What has been learned about a header
+type learnedHeader struct {
+	header  string
+	set     bool
+	queried bool
+	value   string
+	// The numeric responses to the query, while every response has been numeric
+	samples []float64
+	numeric bool
+	elapsed time.Duration
+	timed   int
+}
+
+// LearnSimProfile mines a transcript for the value last set or read with each header, so a simulated instrument
+// answers as the real one did. The transcript is either a session recorded with --record, or the text saved by the
+// -save_session action, where each program message follows a "> " and is followed by the responses of its queries.
+// Headers that were queried but never set and answered varying numbers are answered with noise around their mean.
+func LearnSimProfile(r io.Reader, opts SimLearnOptions) (*LearnedSimProfile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var calls []transcriptCall
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		calls, err = readRecordedCalls(data)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		calls = readTranscriptCalls(string(data))
+	}
+
+	var state *simState
+	lines := map[string]string{}
+	if opts.Headers != "" {
+		headers, err := readLinesFromPath(opts.Headers)
+		if err != nil {
+			return nil, err
+		}
+		state = newSimState(headers)
+		for _, line := range headers {
+			if key, ok := state.resolve(headerMnemonics(line)); ok && lines[key] == "" {
+				lines[key] = line
+			}
+		}
+	} else {
+		state = newSimState(nil)
+	}
+
+	profile := &LearnedSimProfile{Headers: opts.Headers}
+	if opts.Headers != "" && opts.Profile != "" {
+		if profile.Headers, err = pathFrom(opts.Profile, opts.Headers); err != nil {
+			return nil, err
+		}
+	}
+	learned := map[string]*learnedHeader{}
+	var order []string
+	learn := func(unit ProgramUnit) *learnedHeader {
+		// Resolved with any ?, as the headers lines were, since query-only headers only match as queries
+		header := strings.TrimSpace(unit.Header)
+		key, ok := state.resolve(header)
+		if !ok {
+			key = strings.ToUpper(strings.TrimSuffix(strings.TrimPrefix(header, ":"), "?"))
+		}
+		if l, ok := learned[key]; ok {
+			return l
+		}
+		l := &learnedHeader{header: lines[key], numeric: true}
+		if l.header == "" {
+			l.header = ":" + key
+			if strings.HasPrefix(key, "*") {
+				l.header = key
+			}
+		}
+		learned[key] = l
+		order = append(order, key)
+		return l
+	}
+
+	for _, call := range calls {
+		msg, err := ParseProgramMessage(call.input)
+		if err != nil {
+			continue
+		}
+		var queries []ProgramUnit
+		for _, unit := range msg.Units {
+			if unit.Query {
+				queries = append(queries, unit)
+			} else if !state.isBuiltin(unit.Header) {
+				l := learn(unit)
+				if value := strings.TrimSpace(unit.Arguments); value != "" {
+					l.set, l.value = true, value
+				}
+			}
+		}
+		responses := splitResponses(call.response, len(queries))
+		if call.binary || responses == nil {
+			continue
+		}
+		for i, unit := range queries {
+			response := responses[i]
+			if strings.EqualFold(unit.Header, "*IDN?") {
+				profile.Idn = response
+				continue
+			}
+			if state.isBuiltin(unit.Header) {
+				continue
+			}
+			l := learn(unit)
+			l.queried, l.value = true, response
+			if n, err := strconv.ParseFloat(response, 64); err == nil && l.numeric {
+				l.samples = append(l.samples, n)
+			} else {
+				l.numeric = false
+			}
+			if call.elapsed > 0 {
+				l.elapsed += call.elapsed / time.Duration(len(queries))
+				l.timed++
+			}
+		}
+	}
+
+	for _, key := range order {
+		l := learned[key]
+		c := LearnedSimCommand{Header: l.header, Default: l.value}
+		if l.queried && !l.set && lines[key] == "" {
+			c.Header += "?/qonly/"
+		}
+		if !l.set && l.numeric && len(l.samples) > 1 {
+			if mean, stddev := meanAndStddev(l.samples); stddev > 0 {
+				c.Default = ""
+				c.Response = fmt.Sprintf("{{add %s (noise %s)}}", strconv.FormatFloat(mean, 'g', -1, 64), strconv.FormatFloat(stddev, 'g', 6, 64))
+			}
+		}
+		if opts.Timing && l.timed > 0 {
+			if delay := (l.elapsed / time.Duration(l.timed)).Round(time.Millisecond); delay > 0 {
+				c.Delay = delay.String()
+			}
+		}
+		profile.Commands = append(profile.Commands, c)
+	}
+	return profile, nil
+}
+
+// Encodes the profile as yaml or json
+func (p *LearnedSimProfile) Encode(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(p)
+	case "yaml":
+		e := yaml.NewEncoder(w)
+		e.SetIndent(2)
+		if err := e.Encode(p); err != nil {
+			return err
+		}
+		return e.Close()
+	}
+	return fmt.Errorf("unknown profile format '%s', expected yaml or json", format)
+}
+
+// Returns path relative to the directory of file, or absolute if it has no relative path, e.g. on another volume
+func pathFrom(file string, path string) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		return rel, nil
+	}
+	return path, nil
+}
+
+func readRecordedCalls(data []byte) ([]transcriptCall, error) {
+	_, entries, err := ReadSession(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var calls []transcriptCall
+	for _, entry := range entries {
+		if entry.Error != "" {
+			continue
+		}
+		switch entry.Op {
+		case sessionCommand:
+			calls = append(calls, transcriptCall{input: entry.input()})
+		case sessionQuery, sessionQueryBytes:
+			calls = append(calls, transcriptCall{input: entry.input(), response: entry.Response, elapsed: entry.Elapsed, binary: entry.Block != nil})
+		}
+	}
+	return calls, nil
+}
+
+func readTranscriptCalls(transcript string) []transcriptCall {
+	var calls []transcriptCall
+	for _, line := range strings.Split(transcript, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if input, ok := strings.CutPrefix(line, "> "); ok {
+			calls = append(calls, transcriptCall{input: input})
+		} else if len(calls) > 0 {
+			calls[len(calls)-1].response += line + "\n"
+		}
+	}
+	return calls
+}
+
+// Splits the response of a program message into the responses of its n queries, which are on lines of their own or
+// separated by semicolons. Returns nil if the response cannot be split.
+func splitResponses(response string, n int) []string {
+	response = strings.TrimRight(response, "\r\n")
+	if n == 1 {
+		return []string{response}
+	}
+	for _, separator := range []string{"\n", ";"} {
+		if parts := strings.Split(response, separator); len(parts) == n {
+			for i := range parts {
+				parts[i] = strings.TrimSpace(parts[i])
+			}
+			return parts
+		}
+	}
+	return nil
+}
+
+func meanAndStddev(samples []float64) (float64, float64) {
+	var sum float64
+	for _, s := range samples {
+		sum += s
+	}
+	mean := sum / float64(len(samples))
+	var variance float64
+	for _, s := range samples {
+		variance += (s - mean) * (s - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(samples)))
+}
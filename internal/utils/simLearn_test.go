@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLearnSimProfileTranscript(t *testing.T) {
+	transcript := strings.Join([]string{
+		"> *IDN?",
+		"Acme,Signal Generator,42,2.0",
+		"> :SOUR:FREQ 1GHz;:SOUR:FREQ?;*OPC?",
+		"+1.00000000E+09",
+		"1",
+		"> :OUTP ON",
+		"> :MEAS:VOLT?",
+		"1.5",
+		"> :MEAS:VOLT?",
+		"2.5",
+		"> :SYST:ERR?",
+		`+0,"No error"`,
+		"> :OUTP:MODE?",
+		"EXT",
+		"",
+	}, "\n")
+	profile, err := LearnSimProfile(strings.NewReader(transcript), SimLearnOptions{})
+	if err != nil {
+		t.Fatalf("LearnSimProfile failed: %v", err)
+	}
+	expected := &LearnedSimProfile{
+		Idn: "Acme,Signal Generator,42,2.0",
+		Commands: []LearnedSimCommand{
+			{Header: ":SOUR:FREQ", Default: "+1.00000000E+09"},
+			{Header: ":OUTP", Default: "ON"},
+			{Header: ":MEAS:VOLT?/qonly/", Response: "{{add 2 (noise 0.5)}}"},
+			{Header: ":OUTP:MODE?/qonly/", Default: "EXT"},
+		},
+	}
+	if !reflect.DeepEqual(profile, expected) {
+		t.Errorf("expected %+v, got %+v", expected, profile)
+	}
+
+	// The learned profile answers as the instrument did
+	var buf bytes.Buffer
+	if err := profile.Encode(&buf, "yaml"); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "learned.yaml")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inst := NewSimInstrument(path, time.Second, false)
+	if err := inst.Connect("", nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if res, err := inst.Query("*IDN?;:SOUR:FREQ?;:OUTP:MODE?"); err != nil || res != "Acme,Signal Generator,42,2.0;+1.00000000E+09;EXT\n" {
+		t.Errorf("expected the learned answers, got %q %v", res, err)
+	}
+}
+
+func TestLearnSimProfileRecording(t *testing.T) {
+	headers := filepath.Join(t.TempDir(), "SCPI.txt")
+	if err := os.WriteFile(headers, []byte("[:SOURce]:FREQuency[:CW]\n:TRACe:DATA?/qonly/\n:MEASure:VOLTage?/qonly/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data := SessionEntry{Op: sessionQueryBytes, Input: ":TRAC:DATA?"}
+	data.SetOutput([]byte{0x00, 0xff, 0xfe, 0x80})
+	failed := SessionEntry{Op: sessionQuery, Input: ":FREQ?", Error: "timeout", Kind: ErrorKindTimeout}
+	path := writeSession(t,
+		SessionEntry{Op: sessionCommand, Input: "FREQ 2GHz"},
+		SessionEntry{Op: sessionQuery, Input: ":SOURCE:FREQUENCY:CW?", Response: "2000000000\n", Elapsed: 20 * time.Millisecond},
+		SessionEntry{Op: sessionQuery, Input: ":FREQ?", Response: "2000000000\n", Elapsed: 40 * time.Millisecond},
+		failed,
+		data,
+		SessionEntry{Op: sessionQuery, Input: ":MEAS:VOLT?", Response: "1.5\n"},
+	)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	profile, err := LearnSimProfile(file, SimLearnOptions{Headers: headers, Timing: true})
+	if err != nil {
+		t.Fatalf("LearnSimProfile failed: %v", err)
+	}
+	expected := &LearnedSimProfile{
+		Headers: headers,
+		Commands: []LearnedSimCommand{
+			{Header: "[:SOURce]:FREQuency[:CW]", Default: "2000000000", Delay: "30ms"},
+			{Header: ":MEASure:VOLTage?/qonly/", Default: "1.5"},
+		},
+	}
+	if !reflect.DeepEqual(profile, expected) {
+		t.Errorf("expected every spelling learned as the listed header, got %+v", profile)
+	}
+
+	// A profile written elsewhere refers to the headers file relative to itself
+	output := filepath.Join(t.TempDir(), "profiles", "learned.yaml")
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	profile, err = LearnSimProfile(file, SimLearnOptions{Headers: headers, Profile: output})
+	if err != nil {
+		t.Fatalf("LearnSimProfile failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := profile.Encode(&buf, "yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(output, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.IsAbs(profile.Headers) {
+		t.Errorf("expected a relative headers path, got %s", profile.Headers)
+	}
+	if _, err := LoadSimProfile(output); err != nil {
+		t.Errorf("expected the written profile to load: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// The points of a waveform that does not set them
+const simDefaultWaveformPoints = 100
+
+// SimProfile describes a simulated instrument in a YAML or JSON file, e.g.
+//
+//	idn: Acme,Signal Generator,0,1.0
+//	headers: SCPI.txt
+//	commands:
+//	  - header: :SOURce:FREQuency[:CW]
+//	    default: 1GHz
+//	    min: 9e3
+//	    max: 6e9
+//	    unit: Hz
+//	  - header: :TRACe:DATA?/qonly/
+//	    waveform: {shape: sine, points: 1001, amplitude: 2, noise: 0.01}
+//	    block: true
+type SimProfile struct {
+	// Idn is the *IDN? response, empty for the simulator's default
+	Idn string
+	// Headers is a :SYSTem:HELP:HEADers? style file listing further commands, relative to the profile
+	Headers string
+	// Delay is added to the handling of every program message
+	Delay    time.Duration
+	Commands []SimCommand
+
+	// The lines of Headers followed by the headers of Commands it does not list
+	headers []string
+}
+
+// SimCommand is the behaviour of one header of a simulated instrument. Headers without one store the value set by the
+// command and answer it to the query.
+type SimCommand struct {
+	// Header is in the :SYSTem:HELP:HEADers? format, e.g. :SOURce:FREQuency[:CW] or :TRACe:DATA?/qonly/
+	Header string
+	// Default answers the query until the command sets a value, and again after *RST
+	Default string
+	// Response is a text/template answering the query in place of the value, e.g. {{add (number .Value) (noise 0.1)}}.
+	// It is given the .Value and the .Count of queries so far, and the functions number, add, mul, random and noise.
+	Response string
+	// Values lists the accepted arguments, e.g. INTernal or EXTernal. The short form is stored, and anything else is
+	// refused with -224,"Illegal parameter value" unless it is a number within Min and Max.
+	Values []string
+	// Min and Max refuse numbers outside them with -222,"Data out of range" and anything else with -104,"Data type
+	// error". MIN, MAX and DEF set the bound or the default.
+	Min *float64
+	Max *float64
+	// Unit is the unit numbers may carry, e.g. Hz to accept 1.5GHz
+	Unit string
+	// Waveform generates the answer to the query
+	Waveform *SimWaveform
+	// Block answers the query as a definite length block, holding the waveform as big endian float32 values or the
+	// response as text
+	Block bool
+	// Delay is added to the handling of the header
+	Delay time.Duration
+	// Error is pushed onto the error queue whenever the header is used
+	Error *SimError
+
+	response *template.Template
+}
+
+// SimWaveform generates a trace for a data query
+type SimWaveform struct {
+	// Shape is sine, ramp or noise
+	Shape string
+	// Points defaults to 100
+	Points int
+	// Amplitude is the peak of a sine, the height of a ramp or the standard deviation of noise
+	Amplitude float64
+	Offset    float64
+	// Cycles is the number of periods of a sine or ramp across the points, defaulting to 1
+	Cycles float64
+	// Noise is the standard deviation of the noise added to every point
+	Noise float64
+}
+
+// SimError is an error injected by a simulated instrument
+type SimError struct {
+	Code    int
+	Message string
+	// Every pushes the error on every nth use of the header instead of every use
+	Every int
+}
+
+// IsSimProfile reports whether path names a YAML or JSON SimProfile rather than a :SYSTem:HELP:HEADers? file
+func IsSimProfile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+func LoadSimProfile(path string) (*SimProfile, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("error reading simulator profile: %w", err)
+	}
+	profile := &SimProfile{}
+	if err := v.Unmarshal(profile); err != nil {
+		return nil, fmt.Errorf("invalid simulator profile %s: %w", path, err)
+	}
+	if err := profile.validate(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("invalid simulator profile %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+// Checks the profile, compiles its responses and reads its headers file from dir
+func (p *SimProfile) validate(dir string) error {
+	if p.Delay < 0 {
+		return fmt.Errorf("delay cannot be negative")
+	}
+	p.headers = nil
+	if p.Headers != "" {
+		path := p.Headers
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		lines, err := readLinesFromPath(path)
+		if err != nil {
+			return err
+		}
+		p.headers = lines
+	}
+
+	listed := map[string]bool{}
+	for _, header := range p.headers {
+		listed[header] = true
+	}
+	for i := range p.Commands {
+		c := &p.Commands[i]
+		if err := c.validate(); err != nil {
+			return fmt.Errorf("command %s: %w", c.Header, err)
+		}
+		if !listed[c.Header] {
+			listed[c.Header] = true
+			p.headers = append(p.headers, c.Header)
+		}
+	}
+	return nil
+}
+
+func (c *SimCommand) validate() error {
+	if c.Header == "" {
+		return fmt.Errorf("header cannot be empty")
+	}
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		return fmt.Errorf("min cannot be greater than max")
+	}
+	if c.Delay < 0 {
+		return fmt.Errorf("delay cannot be negative")
+	}
+	if c.Response != "" && c.Waveform != nil {
+		return fmt.Errorf("response and waveform cannot both be set")
+	}
+	if c.Response != "" {
+		number := func(s string) float64 {
+			n, _ := parseSimNumber(s, c.Unit)
+			return n
+		}
+		response, err := template.New(c.Header).Funcs(simTemplateFuncs).Funcs(template.FuncMap{"number": number}).Parse(c.Response)
+		if err != nil {
+			return err
+		}
+		c.response = response
+	}
+	if w := c.Waveform; w != nil {
+		switch w.Shape {
+		case "sine", "ramp", "noise":
+		default:
+			return fmt.Errorf("unknown waveform shape '%s', expected sine, ramp or noise", w.Shape)
+		}
+		if w.Points < 0 || w.Noise < 0 || w.Cycles < 0 {
+			return fmt.Errorf("waveform points, cycles and noise cannot be negative")
+		}
+	}
+	if e := c.Error; e != nil {
+		if e.Code == 0 {
+			return fmt.Errorf("error code cannot be 0")
+		}
+		if e.Every < 0 {
+			return fmt.Errorf("error every cannot be negative")
+		}
+	}
+	return nil
+}
+
+// Removes the markup of a :SYSTem:HELP:HEADers? header, leaving the mnemonics of its first variant with all optional
+// nodes and the first suffix of each range, e.g. :SOURce:FREQuency:CW for [:SOURce]:FREQuency[:CW]
+func headerMnemonics(header string) string {
+	header = strings.NewReplacer("[", "", "]", "", "/qonly/", "", "/nquery/", "").Replace(header)
+	return suffixRange.ReplaceAllString(header, "$1")
+}
+
+var suffixRange = regexp.MustCompile(`{(\d+)(:\d+)?}`)
+
+// The key of the profile's behaviour for the value key, which leaves out suffixes so that every suffix shares it
+func commandKey(key string) string {
+	nodes := strings.Split(key, ":")
+	for i := range nodes {
+		nodes[i] = strings.TrimRight(nodes[i], "0123456789")
+	}
+	return strings.Join(nodes, ":")
+}
+
+// Checks the argument of a command, returning the value to store or the error to push
+func (c *SimCommand) accept(arg string) (string, *InstrumentError) {
+	for _, value := range c.Values {
+		long := strings.ToUpper(value)
+		short := shortForm(value)
+		if upper := strings.ToUpper(arg); upper == long || upper == short {
+			return short, nil
+		}
+	}
+	if c.Min == nil && c.Max == nil {
+		if len(c.Values) > 0 {
+			return "", &InstrumentError{Code: -224, Message: "Illegal parameter value"}
+		}
+		return arg, nil
+	}
+
+	switch strings.ToUpper(arg) {
+	case "MIN", "MINIMUM":
+		if c.Min != nil {
+			return strconv.FormatFloat(*c.Min, 'g', -1, 64), nil
+		}
+	case "MAX", "MAXIMUM":
+		if c.Max != nil {
+			return strconv.FormatFloat(*c.Max, 'g', -1, 64), nil
+		}
+	case "DEF", "DEFAULT":
+		return c.Default, nil
+	}
+	n, ok := parseSimNumber(arg, c.Unit)
+	if !ok {
+		return "", &InstrumentError{Code: -104, Message: "Data type error"}
+	}
+	if (c.Min != nil && n < *c.Min) || (c.Max != nil && n > *c.Max) {
+		return "", &InstrumentError{Code: -222, Message: "Data out of range"}
+	}
+	return arg, nil
+}
+
+// Reports whether the nth use of the header pushes the injected error
+func (c *SimCommand) fails(n int) bool {
+	return c.Error != nil && (c.Error.Every <= 1 || n%c.Error.Every == 0)
+}
+
+// Answers the query whose stored value is value, for the nth time
+func (c *SimCommand) answer(value string, n int) (string, error) {
+	if c.Waveform != nil {
+		points := c.Waveform.generate()
+		if c.Block {
+			payload := make([]byte, 4*len(points))
+			for i, p := range points {
+				binary.BigEndian.PutUint32(payload[4*i:], math.Float32bits(float32(p)))
+			}
+			return formatBlock(payload), nil
+		}
+		values := make([]string, len(points))
+		for i, p := range points {
+			values[i] = strconv.FormatFloat(p, 'g', 8, 64)
+		}
+		return strings.Join(values, ","), nil
+	}
+	if c.response != nil {
+		var b strings.Builder
+		if err := c.response.Execute(&b, struct {
+			Value string
+			Count int
+		}{value, n}); err != nil {
+			return "", err
+		}
+		value = b.String()
+	}
+	if c.Block {
+		return formatBlock([]byte(value)), nil
+	}
+	return value, nil
+}
+
+func (w *SimWaveform) generate() []float64 {
+	points := w.Points
+	if points == 0 {
+		points = simDefaultWaveformPoints
+	}
+	cycles := w.Cycles
+	if cycles == 0 {
+		cycles = 1
+	}
+	trace := make([]float64, points)
+	for i := range trace {
+		phase := cycles * float64(i) / float64(points)
+		switch w.Shape {
+		case "sine":
+			trace[i] = w.Amplitude * math.Sin(2*math.Pi*phase)
+		case "ramp":
+			trace[i] = w.Amplitude * (phase - math.Floor(phase))
+		case "noise":
+			trace[i] = w.Amplitude * rand.NormFloat64()
+		}
+		trace[i] += w.Offset + w.Noise*rand.NormFloat64()
+	}
+	return trace
+}
+
+var simTemplateFuncs = template.FuncMap{
+	"add":    func(a, b float64) float64 { return a + b },
+	"mul":    func(a, b float64) float64 { return a * b },
+	"random": func(min, max float64) float64 { return min + (max-min)*rand.Float64() },
+	"noise":  func(stddev float64) float64 { return stddev * rand.NormFloat64() },
+}
+
+// The SCPI suffix multipliers. M is milli, except in MHZ and MOHM.
+var simMultipliers = map[string]float64{
+	"EX": 1e18, "PE": 1e15, "T": 1e12, "G": 1e9, "MA": 1e6, "K": 1e3,
+	"M": 1e-3, "U": 1e-6, "N": 1e-9, "P": 1e-12, "F": 1e-15, "A": 1e-18,
+}
+
+var simNumber = regexp.MustCompile(`^([+-]?(?:\d+\.?\d*|\.\d+)(?:E[+-]?\d+)?)\s*([A-Z]*)$`)
+
+// Parses decimal numeric program data such as 1.5, 1e9, 1.5GHz or 10 MV, where unit is the unit it may carry
+func parseSimNumber(arg string, unit string) (float64, bool) {
+	match := simNumber.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(arg)))
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	unit = strings.ToUpper(unit)
+	suffix := match[2]
+	if unit != "" && strings.HasSuffix(suffix, unit) {
+		suffix = strings.TrimSuffix(suffix, unit)
+		if suffix == "M" && (unit == "HZ" || unit == "OHM") {
+			suffix = "MA"
+		}
+	}
+	if suffix == "" {
+		return n, true
+	}
+	multiplier, ok := simMultipliers[suffix]
+	return n * multiplier, ok
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSimProfile = `
+idn: Acme,Signal Generator,42,2.0
+headers: SCPI.txt
+commands:
+  - header: "[:SOURce]:FREQuency[:CW]"
+    default: 1GHz
+    min: 9e3
+    max: 6e9
+    unit: Hz
+  - header: ":OUTPut{1:2}:MODE"
+    default: INT
+    values: [INTernal, EXTernal]
+  - header: ":MEASure:POWer?/qonly/"
+    response: "{{.Count}},{{add (number \"1.5\") 1}}"
+  - header: ":TRACe:DATA?/qonly/"
+    waveform: {shape: ramp, points: 4, amplitude: 2, offset: 1}
+  - header: ":TRACe:BLOCk?/qonly/"
+    waveform: {shape: sine, points: 10, amplitude: 1, noise: 0.01}
+    block: true
+  - header: ":TRACe:RAMP?/qonly/"
+    waveform: {shape: ramp, points: 4, amplitude: 1}
+    block: true
+  - header: ":CALibration:ALL?/qonly/"
+    delay: 30ms
+    error: {code: -240, message: Hardware error, every: 2}
+`
+
+func newTestProfileSim(t *testing.T) Instrument {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "SCPI.txt"), []byte(":OUTPut{1:2}[:STATe]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	profile := filepath.Join(dir, "sim.yaml")
+	if err := os.WriteFile(profile, []byte(testSimProfile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inst := NewSimInstrument(profile, time.Second, false)
+	if err := inst.Connect("", nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	return inst
+}
+
+func TestSimProfile(t *testing.T) {
+	inst := newTestProfileSim(t)
+	steps := []struct {
+		scpi     string
+		expected string
+		code     int
+	}{
+		{"*IDN?", "Acme,Signal Generator,42,2.0", 0},
+		{"FREQ?", "1GHz", 0},
+		{"FREQ 2.5 GHZ", "", 0},
+		{"SOUR:FREQ:CW?", "2.5 GHZ", 0},
+		{"FREQ 7GHz", "", -222},
+		{"FREQ LOUD", "", -104},
+		{"FREQ MAX;FREQ?", "6e+09", 0},
+		{"FREQ DEF;FREQ?", "1GHz", 0},
+		{"OUTP2:MODE?", "INT", 0},
+		{"OUTP2:MODE external;MODE?", "EXT", 0},
+		{"OUTP:MODE?", "INT", 0},
+		{"OUTP2:MODE BOTH", "", -224},
+		{"OUTP2 ON;OUTP2?", "ON", 0},
+		{"MEAS:POW?;POW?", "1,2.5;2,2.5", 0},
+		{"TRAC:DATA?", "1,1.5,2,2.5", 0},
+		{"CAL:ALL?", "0", 0},
+		{"CAL:ALL?", "0", -240},
+		{"*RST;FREQ?", "1GHz", 0},
+	}
+	for _, step := range steps {
+		var res string
+		var err error
+		if strings.Contains(step.scpi, "?") {
+			res, err = inst.Query(step.scpi)
+			res = strings.TrimSuffix(res, "\n")
+		} else {
+			err = inst.Command(step.scpi)
+		}
+		if err != nil || res != step.expected {
+			t.Errorf("%s: expected %q, got %q %v", step.scpi, step.expected, res, err)
+		}
+		errs, _ := inst.QueryError(ErrorQueueOptions{})
+		if (step.code == 0 && len(errs) != 0) || (step.code != 0 && (len(errs) != 1 || errs[0].Code != step.code)) {
+			t.Errorf("%s: expected error %d, got %+v", step.scpi, step.code, errs)
+		}
+	}
+
+	block, err := inst.QueryBytes(":TRAC:BLOC?")
+	if err != nil || len(block) != 40 {
+		t.Errorf("expected the payload of a block of 10 float32 values, got %q %v", block, err)
+	}
+	start := time.Now()
+	inst.Query("CAL:ALL?")
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected the query to be delayed, took %s", elapsed)
+	}
+	// CALibration, FREQuency, MEASure, OUTPut, SOURce and TRACe, and FREQuency and OUTPut as queries
+	_, colonTree, err := inst.GetSupportedCommandsTree()
+	if err != nil || len(colonTree.Children) != 8 {
+		t.Errorf("expected the headers file and the profile's commands, got %d nodes %v", len(colonTree.Children), err)
+	}
+}
+
+func TestSimDelayHonoursContext(t *testing.T) {
+	inst := newTestProfileSim(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := inst.QueryContext(ctx, "CAL:ALL?"); KindOf(err) != ErrorKindTimeout {
+		t.Errorf("expected the delayed query to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 30*time.Millisecond {
+		t.Errorf("expected the query to give up at its deadline, took %s", elapsed)
+	}
+}
+
+func TestSimBlockResponses(t *testing.T) {
+	inst := newTestProfileSim(t)
+	ramp, err := QueryBinary(context.Background(), inst, ":TRAC:RAMP?", Float32, binary.BigEndian)
+	if err != nil || !reflect.DeepEqual(ramp, []float32{0, 0.25, 0.5, 0.75}) {
+		t.Errorf("expected the decoded ramp, got %v %v", ramp, err)
+	}
+}
+
+func TestLoadSimProfileInvalid(t *testing.T) {
+	profiles := map[string]string{
+		"no header":       "commands: [{default: 1}]",
+		"min above max":   "commands: [{header: ':VOLT', min: 2, max: 1}]",
+		"bad template":    "commands: [{header: ':VOLT', response: '{{.Value'}]",
+		"bad shape":       "commands: [{header: ':VOLT', waveform: {shape: triangle}}]",
+		"no error code":   "commands: [{header: ':VOLT', error: {message: Oops}}]",
+		"missing headers": "headers: missing.txt",
+	}
+	for name, profile := range profiles {
+		path := filepath.Join(t.TempDir(), "sim.yaml")
+		if err := os.WriteFile(path, []byte(profile), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSimProfile(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseSimNumber(t *testing.T) {
+	tests := []struct {
+		arg      string
+		unit     string
+		expected float64
+		ok       bool
+	}{
+		{"1.5", "", 1.5, true},
+		{"-2e3", "", -2000, true},
+		{"1.5GHz", "Hz", 1.5e9, true},
+		{"10 MHZ", "Hz", 10e6, true},
+		{"10 mV", "V", 0.01, true},
+		{"5K", "", 5000, true},
+		{"5 Hz", "", 0, false},
+		{"ON", "", 0, false},
+	}
+	for _, test := range tests {
+		n, ok := parseSimNumber(test.arg, test.unit)
+		if ok != test.ok || (ok && n != test.expected) {
+			t.Errorf("%s %s: expected %v %v, got %v %v", test.arg, test.unit, test.expected, test.ok, n, ok)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest write a VXI-11 client may send the simulator in one call
+const simVxi11MaxRecvSize = 64 * 1024
+
+// SimServerOptions configures a simulated instrument served to other programs over the network
+type SimServerOptions struct {
+	// Profile is a SimProfile or a :SYSTem:HELP:HEADers? style file listing the simulated commands
+	Profile string
+	// Identity is the *IDN? response. Empty uses the profile's or the simulator's default.
+	Identity string
+	// Latency delays the handling of every program message
+	Latency time.Duration
+}
+
+// SimServer serves a simulated instrument over raw sockets, HiSLIP and VXI-11, each on its own listener. All clients
+// share the instrument's settings, error queue and lock, as they would on a real one. While the lock is held, other
+// VXI-11 links are refused and other raw socket and HiSLIP clients' messages wait for it to be released.
+type SimServer struct {
+	state   *simState
+	latency time.Duration
+
+	mu sync.Mutex
+	// The client holding the lock, empty if none
+	lockedBy string
+	// The last HiSLIP session or VXI-11 link ID handed out
+	lastId uint32
+}
+
+func NewSimServer(opts SimServerOptions) (*SimServer, error) {
+	state, err := loadSimState(opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Identity != "" {
+		state.identity = opts.Identity
+	}
+	return &SimServer{state: state, latency: opts.Latency}, nil
+}
+
+// Runs a program message, returning the newline terminated response if it had one
+func (s *SimServer) respond(message string) (string, bool) {
+	message = strings.TrimRight(message, "\r\n")
+	if strings.TrimSpace(message) == "" {
+		return "", false
+	}
+	time.Sleep(s.latency)
+	res, ok, _ := s.state.execute(context.Background(), message)
+	return res + "\n", ok
+}
+
+func (s *SimServer) nextId() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastId++
+	return s.lastId
+}
+
+// Takes the lock for owner, waiting up to timeout for another owner to release it
+func (s *SimServer) lock(owner string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.mu.Lock()
+		if s.lockedBy == "" || s.lockedBy == owner {
+			s.lockedBy = owner
+			s.mu.Unlock()
+			return true
+		}
+		s.mu.Unlock()
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Releases the lock if owner holds it
+func (s *SimServer) unlock(owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lockedBy != owner {
+		return false
+	}
+	s.lockedBy = ""
+	return true
+}
+
+func (s *SimServer) lockedByOther(owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lockedBy != "" && s.lockedBy != owner
+}
+
+// Holds the messages of owner until no other owner holds the lock
+func (s *SimServer) waitUnlocked(owner string) {
+	for s.lockedByOther(owner) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func serveConns(l net.Listener, handle func(net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(conn)
+	}
+}
+
+// ServeSocket serves newline terminated program messages, as on port 5025, until l is closed
+func (s *SimServer) ServeSocket(l net.Listener) error {
+	return serveConns(l, func(conn net.Conn) {
+		defer conn.Close()
+		// Raw sockets cannot take the lock, so this client never holds it
+		owner := fmt.Sprintf("socket client %s", conn.RemoteAddr())
+		r := bufio.NewReader(conn)
+		for {
+			message, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			s.waitUnlocked(owner)
+			if res, ok := s.respond(message); ok {
+				if _, err := io.WriteString(conn, res); err != nil {
+					return
+				}
+			}
+		}
+	})
+}
+
+// ServeHislip serves HiSLIP sessions, as on port 4880, until l is closed. Either mode is accepted, and locks, device
+// clears and status queries are answered on the async channel. Service requests are never sent.
+func (s *SimServer) ServeHislip(l net.Listener) error {
+	return serveConns(l, func(conn net.Conn) {
+		defer conn.Close()
+		msg, err := readHislipMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msg.messageType {
+		case hislipInitialize:
+			id := s.nextId() & 0xffff
+			if writeHislipMessage(conn, hislipMessage{messageType: hislipInitializeResponse, parameter: hislipProtocolVersion<<16 | id}) == nil {
+				// The async channel names the same session, so the lock taken there covers this channel
+				s.serveHislipSync(conn, fmt.Sprintf("hislip session %d", id))
+			}
+		case hislipAsyncInitialize:
+			owner := fmt.Sprintf("hislip session %d", msg.parameter)
+			defer s.unlock(owner)
+			if writeHislipMessage(conn, hislipMessage{messageType: hislipAsyncInitializeResponse, parameter: hislipVendorId}) == nil {
+				s.serveHislipAsync(conn, owner)
+			}
+		default:
+			writeHislipMessage(conn, hislipMessage{messageType: hislipFatalError, control: 3})
+		}
+	})
+}
+
+func (s *SimServer) serveHislipSync(conn net.Conn, owner string) {
+	var pending []byte
+	for {
+		msg, err := readHislipMessage(conn)
+		if err != nil {
+			return
+		}
+		var res hislipMessage
+		switch msg.messageType {
+		case hislipData:
+			pending = append(pending, msg.payload...)
+			continue
+		case hislipDataEnd:
+			message := string(append(pending, msg.payload...))
+			pending = nil
+			s.waitUnlocked(owner)
+			response, ok := s.respond(message)
+			if !ok {
+				continue
+			}
+			res = hislipMessage{messageType: hislipDataEnd, parameter: msg.parameter, payload: []byte(response)}
+		case hislipDeviceClearComplete:
+			pending = nil
+			res = hislipMessage{messageType: hislipDeviceClearAcknowledge, control: msg.control & hislipControlOverlapped}
+		default:
+			res = hislipMessage{messageType: hislipError, control: 1}
+		}
+		if err := writeHislipMessage(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+func (s *SimServer) serveHislipAsync(conn net.Conn, owner string) {
+	for {
+		msg, err := readHislipMessage(conn)
+		if err != nil {
+			return
+		}
+		var res hislipMessage
+		switch msg.messageType {
+		case hislipAsyncMaximumMessageSize:
+			payload := make([]byte, 8)
+			binary.BigEndian.PutUint64(payload, hislipMaxPayload)
+			res = hislipMessage{messageType: hislipAsyncMaximumMessageSizeResponse, payload: payload}
+		case hislipAsyncDeviceClear:
+			res = hislipMessage{messageType: hislipAsyncDeviceClearAcknowledge}
+		case hislipAsyncLock:
+			// Control 1 requests the lock, waiting parameter milliseconds, and 0 releases it
+			res = hislipMessage{messageType: hislipAsyncLockResponse}
+			switch {
+			case msg.control == 1 && s.lock(owner, time.Duration(msg.parameter)*time.Millisecond):
+				res.control = 1
+			case msg.control == 0 && s.unlock(owner):
+				res.control = 1
+			case msg.control == 0:
+				res.control = 3
+			}
+		case hislipAsyncStatusQuery:
+			res = hislipMessage{messageType: hislipAsyncStatusResponse, control: s.state.statusByte()}
+		default:
+			res = hislipMessage{messageType: hislipError, control: 1}
+		}
+		if err := writeHislipMessage(conn, res); err != nil {
+			return
+		}
+	}
+}
+
+// The write in progress and the unread response of a VXI-11 link
+type simVxi11Link struct {
+	written []byte
+	pending []byte
+}
+
+// ServeVxi11 serves the portmapper and the VXI-11 core channel on the same listener until l is closed. Clients look
+// the portmapper up on port 111, so l usually listens there. Service requests are never sent.
+func (s *SimServer) ServeVxi11(l net.Listener) error {
+	port := uint32(l.Addr().(*net.TCPAddr).Port)
+	return serveConns(l, func(conn net.Conn) {
+		defer conn.Close()
+		links := map[uint32]*simVxi11Link{}
+		defer func() {
+			for id := range links {
+				s.unlock(vxi11Owner(id))
+			}
+		}()
+		serveRpc(conn, func(program, procedure uint32, args *xdrReader) []byte {
+			w := &xdrWriter{}
+			switch {
+			case program == portmapperProgram && procedure == portmapperGetPort:
+				w.uint32(port)
+			case program != vxi11CoreProgram:
+				// Nothing else is served
+			case procedure == vxi11CreateLink:
+				id := s.nextId()
+				links[id] = &simVxi11Link{}
+				w.uint32(0)
+				w.uint32(id)
+				w.uint32(0) // abortPort
+				w.uint32(simVxi11MaxRecvSize)
+			case procedure == vxi11CreateIntrChan || procedure == vxi11DestroyIntrChan:
+				// Their arguments carry no link, and the simulator never calls the channel
+				w.uint32(0)
+			default:
+				id := args.uint32()
+				if link, ok := links[id]; ok {
+					s.vxi11Call(procedure, id, link, args, w)
+				} else {
+					w.uint32(4) // invalid link identifier
+				}
+				if procedure == vxi11DestroyLink {
+					delete(links, id)
+				}
+			}
+			return w.bytes()
+		})
+	})
+}
+
+func vxi11Owner(link uint32) string {
+	return fmt.Sprintf("vxi11 link %d", link)
+}
+
+// Answers a core channel call on link, whose ID has already been read from args
+func (s *SimServer) vxi11Call(procedure uint32, id uint32, link *simVxi11Link, args *xdrReader, w *xdrWriter) {
+	owner := vxi11Owner(id)
+	switch procedure {
+	case vxi11DeviceWrite:
+		args.uint32() // io_timeout
+		args.uint32() // lock_timeout
+		flags := args.uint32()
+		data := args.opaque()
+		if s.lockedByOther(owner) {
+			w.uint32(11)
+			return
+		}
+		link.written = append(link.written, data...)
+		if flags&vxi11FlagEnd != 0 {
+			response, ok := s.respond(string(link.written))
+			link.written = nil
+			if ok {
+				link.pending = []byte(response)
+			}
+		}
+		w.uint32(0)
+		w.uint32(uint32(len(data)))
+	case vxi11DeviceRead:
+		requestSize := args.uint32()
+		if s.lockedByOther(owner) {
+			w.uint32(11)
+			return
+		}
+		if len(link.pending) == 0 {
+			w.uint32(15) // I/O timeout, as there is nothing to read
+			return
+		}
+		chunk := link.pending[:min(len(link.pending), int(requestSize))]
+		link.pending = link.pending[len(chunk):]
+		var reason uint32
+		if len(link.pending) == 0 {
+			reason = vxi11ReasonEnd
+		}
+		w.uint32(0)
+		w.uint32(reason)
+		w.opaque(chunk)
+	case vxi11ReadStb:
+		w.uint32(0)
+		w.uint32(uint32(s.state.statusByte()))
+	case vxi11DeviceClear:
+		link.written, link.pending = nil, nil
+		w.uint32(0)
+	case vxi11DeviceLock:
+		flags := args.uint32()
+		var timeout time.Duration
+		if flags&vxi11FlagWaitLock != 0 {
+			timeout = time.Duration(args.uint32()) * time.Millisecond
+		}
+		if !s.lock(owner, timeout) {
+			w.uint32(11)
+			return
+		}
+		w.uint32(0)
+	case vxi11DeviceUnlock:
+		if !s.unlock(owner) {
+			w.uint32(12)
+			return
+		}
+		w.uint32(0)
+	case vxi11DestroyLink:
+		s.unlock(owner)
+		w.uint32(0)
+	case vxi11EnableSrq:
+		w.uint32(0)
+	default:
+		w.uint32(8) // operation not supported
+	}
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSimServer(t *testing.T, opts SimServerOptions) *SimServer {
+	t.Helper()
+	opts.Profile = filepath.Join(t.TempDir(), "SCPI.txt")
+	if err := os.WriteFile(opts.Profile, []byte("[:SOURce]:FREQuency[:CW]\n:OUTPut[:STATe]\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSimServer(opts)
+	if err != nil {
+		t.Fatalf("NewSimServer failed: %v", err)
+	}
+	return s
+}
+
+// Serves s with serve on a local listener and returns its address
+func listenSim(t *testing.T, serve func(net.Listener) error) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func TestSimServerTransports(t *testing.T) {
+	s := newTestSimServer(t, SimServerOptions{Identity: "Acme,Model 1,42,2.0"})
+	clients := map[string]Instrument{
+		"socket": NewScpiInstrument(Framing{}, time.Second, false),
+		"hislip": NewHislipInstrument("", HislipModeDefault, Framing{}, time.Second, false),
+		"vxi11":  NewVxi11Instrument("", Framing{}, time.Second, false),
+	}
+	addresses := map[string]string{
+		"socket": listenSim(t, s.ServeSocket),
+		"hislip": listenSim(t, s.ServeHislip),
+		"vxi11":  listenSim(t, s.ServeVxi11),
+	}
+	for name, inst := range clients {
+		if err := inst.Connect(addresses[name], nil); err != nil {
+			t.Fatalf("%s: Connect failed: %v", name, err)
+		}
+		defer inst.Close()
+	}
+
+	if err := clients["socket"].Command("FREQ 2GHz;FOO"); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	for name, inst := range clients {
+		if res, err := inst.Query("*IDN?"); err != nil || res != "Acme,Model 1,42,2.0\n" {
+			t.Errorf("%s: expected the configured identity, got %q %v", name, res, err)
+		}
+		if res, err := inst.Query(":SOUR:FREQ:CW?"); err != nil || res != "2GHz\n" {
+			t.Errorf("%s: expected the setting shared by all clients, got %q %v", name, res, err)
+		}
+	}
+	if errs, err := clients["hislip"].QueryError(ErrorQueueOptions{}); err != nil || len(errs) != 1 || errs[0].Code != -113 {
+		t.Errorf("expected the undefined header in the shared error queue, got %+v %v", errs, err)
+	}
+	// FREQuency, OUTPut and SOURce, and the first two as queries
+	_, colonTree, err := clients["vxi11"].GetSupportedCommandsTree()
+	if err != nil || len(colonTree.Children) != 5 {
+		t.Errorf("expected the profile's headers, got %+v %v", colonTree, err)
+	}
+}
+
+func TestSimServerLock(t *testing.T) {
+	s := newTestSimServer(t, SimServerOptions{})
+	address := listenSim(t, s.ServeVxi11)
+	var clients [2]Instrument
+	for i := range clients {
+		clients[i] = NewVxi11Instrument("", Framing{}, time.Second, false)
+		if err := clients[i].Connect(address, nil); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+		defer clients[i].Close()
+	}
+
+	if err := clients[0].(Locker).Lock(0); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := clients[1].(Locker).Lock(20 * time.Millisecond); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the second client to find the instrument locked, got %v", err)
+	}
+	if err := clients[1].Command("*CLS"); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the second client's writes to be refused, got %v", err)
+	}
+	if err := clients[0].(Locker).Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := clients[1].Command("*CLS"); err != nil {
+		t.Errorf("expected the instrument to be free once unlocked, got %v", err)
+	}
+}
+
+func TestSimServerLockHoldsOtherClients(t *testing.T) {
+	s := newTestSimServer(t, SimServerOptions{})
+	holder := NewHislipInstrument("", HislipModeDefault, Framing{}, time.Second, false)
+	others := map[string]Instrument{
+		"socket": NewScpiInstrument(Framing{}, time.Second, false),
+		"hislip": NewHislipInstrument("", HislipModeDefault, Framing{}, time.Second, false),
+	}
+	hislipAddress := listenSim(t, s.ServeHislip)
+	addresses := map[string]string{"socket": listenSim(t, s.ServeSocket), "hislip": hislipAddress}
+	if err := holder.Connect(hislipAddress, nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer holder.Close()
+	for name, inst := range others {
+		if err := inst.Connect(addresses[name], nil); err != nil {
+			t.Fatalf("%s: Connect failed: %v", name, err)
+		}
+		defer inst.Close()
+	}
+
+	if err := holder.(Locker).Lock(0); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if res, err := holder.Query("*OPC?"); err != nil || res != "1\n" {
+		t.Errorf("expected the holder's own session to be served, got %q %v", res, err)
+	}
+	done := make(chan string, len(others))
+	for name, inst := range others {
+		go func() {
+			if res, err := inst.Query("*OPC?"); err != nil || res != "1\n" {
+				t.Errorf("%s: expected the query to be answered once unlocked, got %q %v", name, res, err)
+			}
+			done <- name
+		}()
+	}
+	select {
+	case name := <-done:
+		t.Errorf("%s: expected the query to wait for the lock", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := holder.(Locker).Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	for range others {
+		<-done
+	}
+}
+
+func TestSimServerLatency(t *testing.T) {
+	s := newTestSimServer(t, SimServerOptions{Latency: 50 * time.Millisecond})
+	inst := NewScpiInstrument(Framing{}, time.Second, false)
+	if err := inst.Connect(listenSim(t, s.ServeSocket), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer inst.Close()
+
+	start := time.Now()
+	if _, err := inst.Query("*OPC?"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected the response to be delayed, took %s", elapsed)
+	}
+}
@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The *IDN? response of simulated instruments that have not been given another
+const simIdentity = "Sclipi,Simulated Instrument,0,1.0"
+
+// The error queue holds this many entries, the last of which is replaced by -350,"Queue overflow" when it fills up
+const simErrorQueueSize = 30
+
+// Headers every simulated instrument supports, whether or not its profile lists them: the IEEE 488.2 common commands,
+// the SCPI error queue and the list of supported headers
+var simBuiltinHeaders = []string{
+	"*CLS/nquery/",
+	"*ESE",
+	"*ESR?/qonly/",
+	"*IDN?/qonly/",
+	"*OPC",
+	"*RST/nquery/",
+	"*SRE",
+	"*STB?/qonly/",
+	"*TST?/qonly/",
+	"*WAI/nquery/",
+	":SYSTem:ERRor:ALL?/qonly/",
+	":SYSTem:ERRor:COUNt?/qonly/",
+	":SYSTem:ERRor[:NEXT]?/qonly/",
+	":SYSTem:HELP:HEADers?/qonly/",
+}
+
+// The answers of queries that have not been set. Any other query answers 0.
+var simDefaults = map[string]string{
+	"*OPC": "1",
+}
+
+// simState is the state of a simulated instrument: the last value set by each command and the error queue.
+//
+// Headers are resolved against the command tree of the profile, accepting the short and long form of each node and
+// any suffix within its range, and stored under a key built from the long forms. An omitted suffix is 1, and nodes
+// that are optional in the profile are left out of the key, so FREQ 1GHz sets the value read by :SOUR:FREQ:CW?. A
+// header the tree does not have pushes -113,"Undefined header". Without a profile every header is accepted.
+type simState struct {
+	mu       sync.Mutex
+	identity string
+	builtins ScpiNode
+	tree     *ScpiNode
+	// The profile, answered to :SYST:HELP:HEAD?
+	headers  []string
+	optional map[string]bool
+	values   map[string]string
+	errors   []InstrumentError
+	// The behaviour a SimProfile gives headers, keyed by commandKey
+	commands map[string]*SimCommand
+	// The uses of each header, keyed like values
+	uses  map[string]int
+	delay time.Duration
+}
+
+func newSimState(profile []string) *simState {
+	builtins, _ := parseScpi(simBuiltinHeaders)
+	s := &simState{
+		identity: simIdentity,
+		headers:  profile,
+		builtins: builtins,
+		optional: optionalNodes(simBuiltinHeaders),
+		values:   map[string]string{},
+		commands: map[string]*SimCommand{},
+		uses:     map[string]int{},
+	}
+	if profile != nil {
+		tree, _ := parseScpi(profile)
+		s.tree = &tree
+		for name := range optionalNodes(profile) {
+			s.optional[name] = true
+		}
+	}
+	return s
+}
+
+func newSimStateFromProfile(profile *SimProfile) (*simState, error) {
+	s := newSimState(profile.headers)
+	if s.tree == nil {
+		s.tree = &ScpiNode{}
+	}
+	if profile.Idn != "" {
+		s.identity = profile.Idn
+	}
+	s.delay = profile.Delay
+	for i := range profile.Commands {
+		c := &profile.Commands[i]
+		key, ok := s.resolve(headerMnemonics(c.Header))
+		if !ok {
+			return nil, fmt.Errorf("invalid header %s", c.Header)
+		}
+		s.commands[commandKey(key)] = c
+	}
+	return s, nil
+}
+
+// Loads the simulated instrument described by a SimProfile or a :SYSTem:HELP:HEADers? file
+func loadSimState(path string) (*simState, error) {
+	if !IsSimProfile(path) {
+		lines, err := readLinesFromPath(path)
+		if err != nil {
+			return nil, err
+		}
+		return newSimState(lines), nil
+	}
+	profile, err := LoadSimProfile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSimStateFromProfile(profile)
+}
+
+// Returns the optional nodes of the headers as the upper case long forms of the node and its parent, e.g. FREQUENCY:CW
+// for [:SOURce]:FREQuency[:CW], or :SOURCE for the first node
+func optionalNodes(headers []string) map[string]bool {
+	optional := map[string]bool{}
+	for _, header := range headers {
+		// The same steps splitScpiCommands takes, which leave a ] on each optional node
+		s := strings.TrimLeft(strings.ReplaceAll(header, "[", ""), ":")
+		parent := ""
+		for _, word := range strings.Split(reformatIrregularSuffixes(reformatSuffixes(s)), ":") {
+			name, _, _ := strings.Cut(word, "/")
+			name, _, _ = strings.Cut(name, "@")
+			name = strings.ToUpper(strings.TrimRight(name, "]?0123456789"))
+			if strings.Contains(word, "]") {
+				optional[parent+":"+name] = true
+			}
+			parent = name
+		}
+	}
+	return optional
+}
+
+// Runs the units of a program message, returning the responses of its queries separated by semicolons. There is no
+// response if the message had no queries, or only undefined ones. The delays of the profile are waited out after
+// releasing the state, giving up early if ctx is done.
+func (s *simState) execute(ctx context.Context, message string) (string, bool, error) {
+	res, ok, delay := s.run(message)
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return "", false, contextError(ctx, ctx.Err())
+		}
+	}
+	return res, ok, nil
+}
+
+// Runs the units of a program message, also returning how long the profile says they take
+func (s *simState) run(message string) (string, bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delay := s.delay
+	msg, err := ParseProgramMessage(message)
+	if err != nil {
+		s.pushError(-102, "Syntax error")
+		return "", false, delay
+	}
+	var responses []string
+	for _, unit := range msg.Units {
+		key, ok := s.resolve(unit.Header)
+		if !ok {
+			s.pushError(-113, "Undefined header")
+			continue
+		}
+		s.uses[key]++
+		if c := s.commands[commandKey(key)]; c != nil {
+			delay += c.Delay
+			if c.fails(s.uses[key]) {
+				s.pushError(c.Error.Code, c.Error.Message)
+			}
+		}
+		if unit.Query {
+			responses = append(responses, s.query(key))
+		} else {
+			s.command(key, strings.TrimSpace(unit.Arguments))
+		}
+	}
+	return strings.Join(responses, ";"), len(responses) > 0, delay
+}
+
+// Returns the status byte, whose error queue available bit is set while the error queue holds entries
+func (s *simState) statusByte() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stb()
+}
+
+func (s *simState) stb() byte {
+	if len(s.errors) > 0 {
+		return 4
+	}
+	return 0
+}
+
+func (s *simState) command(key string, value string) {
+	switch key {
+	case "*RST":
+		clear(s.values)
+	case "*CLS":
+		s.errors = nil
+	default:
+		if value == "" {
+			return
+		}
+		if c := s.commands[commandKey(key)]; c != nil {
+			accepted, err := c.accept(value)
+			if err != nil {
+				s.pushError(err.Code, err.Message)
+				return
+			}
+			value = accepted
+		}
+		if value == "" {
+			delete(s.values, key)
+		} else {
+			s.values[key] = value
+		}
+	}
+}
+
+func (s *simState) query(key string) string {
+	switch key {
+	case "SYSTEM:ERROR":
+		if len(s.errors) == 0 {
+			return `+0,"No error"`
+		}
+		next := s.errors[0]
+		s.errors = s.errors[1:]
+		return next.Error()
+	case "SYSTEM:ERROR:ALL":
+		if len(s.errors) == 0 {
+			return `+0,"No error"`
+		}
+		entries := make([]string, len(s.errors))
+		for i := range s.errors {
+			entries[i] = s.errors[i].Error()
+		}
+		s.errors = nil
+		return strings.Join(entries, ",")
+	case "SYSTEM:ERROR:COUNT":
+		return strconv.Itoa(len(s.errors))
+	case "SYSTEM:HELP:HEADERS":
+		// A block on the wire, decoded to its payload by simInstrument and the clients of the simulator server alike
+		return formatBlock([]byte(strings.Join(s.headers, "\n") + "\n"))
+	case "*IDN":
+		return s.identity
+	case "*STB":
+		return strconv.Itoa(int(s.stb()))
+	}
+	c := s.commands[commandKey(key)]
+	value, ok := s.values[key]
+	if !ok && c != nil && c.Default != "" {
+		value, ok = c.Default, true
+	}
+	if !ok {
+		value, ok = simDefaults[key]
+	}
+	if !ok {
+		value = "0"
+	}
+	if c == nil {
+		return value
+	}
+	res, err := c.answer(value, s.uses[key])
+	if err != nil {
+		s.pushError(-300, "Device-specific error")
+	}
+	return res
+}
+
+func (s *simState) pushError(code int, message string) {
+	if len(s.errors) == simErrorQueueSize {
+		return
+	}
+	if len(s.errors) == simErrorQueueSize-1 {
+		code, message = -350, "Queue overflow"
+	}
+	s.errors = append(s.errors, InstrumentError{Code: code, Message: message})
+}
+
+// Returns the key the value of header is stored under, or false if the instrument does not support header
+func (s *simState) resolve(header string) (string, bool) {
+	header, query := strings.CutSuffix(strings.TrimSpace(header), "?")
+	mnemonics := strings.Split(strings.TrimPrefix(header, ":"), ":")
+
+	path, ok := resolvePath(s.builtins.Children, mnemonics, query)
+	if !ok && s.tree != nil {
+		path, ok = resolvePath(s.tree.Children, mnemonics, query)
+	} else if !ok {
+		path, ok = mnemonics, true
+		for i := range path {
+			path[i] = strings.ToUpper(path[i])
+		}
+	}
+	if !ok {
+		return "", false
+	}
+
+	var key []string
+	parent := ""
+	for _, name := range path {
+		if !s.optional[parent+":"+name] {
+			key = append(key, name)
+		}
+		parent = strings.TrimRight(name, "0123456789")
+	}
+	return strings.Join(key, ":"), true
+}
+
+// Reports whether header is one every simulated instrument supports, see simBuiltinHeaders
+func (s *simState) isBuiltin(header string) bool {
+	header, query := strings.CutSuffix(strings.TrimSpace(header), "?")
+	_, ok := resolvePath(s.builtins.Children, strings.Split(strings.TrimPrefix(header, ":"), ":"), query)
+	return ok
+}
+
+// Walks the tree along mnemonics, returning the long form of each node on the way
+func resolvePath(nodes []ScpiNode, mnemonics []string, query bool) ([]string, bool) {
+	last := len(mnemonics) == 1
+	for _, node := range nodes {
+		name, ok := matchMnemonic(node.Content, mnemonics[0], last && query)
+		if !ok {
+			continue
+		}
+		if last {
+			return []string{name}, true
+		}
+		if rest, ok := resolvePath(node.Children, mnemonics[1:], query); ok {
+			return append([]string{name}, rest...), true
+		}
+	}
+	return nil, false
+}
+
+// Matches mnemonic, e.g. RAD2, against the short and long form of the node, e.g. RADio{1:16}, returning the upper
+// case long form with any suffix other than 1, e.g. RADIO2
+func matchMnemonic(info nodeInfo, mnemonic string, query bool) (string, bool) {
+	text, isQuery := strings.CutSuffix(info.Text, "?")
+	if isQuery != query {
+		return "", false
+	}
+	long := strings.ToUpper(text)
+	short := shortForm(text)
+	mnemonic = strings.ToUpper(mnemonic)
+	if !info.Suffixed {
+		return long, mnemonic == long || mnemonic == short
+	}
+
+	name := strings.TrimRight(mnemonic, "0123456789")
+	if name != long && name != short {
+		return "", false
+	}
+	suffix := 1
+	if digits := mnemonic[len(name):]; digits != "" {
+		n, err := strconv.Atoi(digits)
+		if err != nil || n < info.Start || n > info.Stop {
+			return "", false
+		}
+		suffix = n
+	}
+	if suffix == 1 {
+		return long, true
+	}
+	return fmt.Sprintf("%s%d", long, suffix), true
+}
+
+// Returns the short form of a mnemonic or character data, its characters before the first lower case letter, e.g.
+// FREQ for FREQuency. Text that does not start with an upper case letter is its own short form.
+func shortForm(text string) string {
+	short := text[:len(text)-len(strings.TrimLeftFunc(text, func(r rune) bool { return r < 'a' || r > 'z' }))]
+	if short == "" {
+		return strings.ToUpper(text)
+	}
+	return strings.ToUpper(short)
+}
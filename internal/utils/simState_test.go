@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSim(t *testing.T) Instrument {
+	t.Helper()
+	profile := filepath.Join(t.TempDir(), "SCPI.txt")
+	headers := []string{
+		"[:SOURce]:FREQuency[:CW]",
+		"[:SOURce]:RADio{1:16}:ARB[:STATe]",
+		":INITiate[:IMMediate][:ALL]/nquery/",
+		":MEASure:VOLTage?/qonly/",
+	}
+	if err := os.WriteFile(profile, []byte(strings.Join(headers, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	inst := NewSimInstrument(profile, time.Second, false)
+	if err := inst.Connect("", nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	return inst
+}
+
+func TestSimRemembersSettings(t *testing.T) {
+	inst := newTestSim(t)
+	steps := []struct {
+		scpi     string
+		expected string
+	}{
+		{"*IDN?", simIdentity},
+		{"SOUR:FREQ:CW?", "0"},
+		{"FREQ 1GHz", ""},
+		{":SOURce:FREQuency:CW?", "1GHz"},
+		{"freq?", "1GHz"},
+		{"RAD2:ARB ON", ""},
+		{"SOUR:RADIO2:ARB:STATE?", "ON"},
+		{"RAD:ARB?", "0"},
+		{"RAD1:ARB:STAT 1", ""},
+		{"RAD:ARB?", "1"},
+		{"FREQ 2GHz;FREQ?;:RAD:ARB?", "2GHz;1"},
+		{"*RST", ""},
+		{"FREQ?", "0"},
+	}
+	for _, step := range steps {
+		var res string
+		var err error
+		if strings.Contains(step.scpi, "?") {
+			res, err = inst.Query(step.scpi)
+		} else {
+			err = inst.Command(step.scpi)
+		}
+		if err != nil || strings.TrimSuffix(res, "\n") != step.expected {
+			t.Errorf("%s: expected %q, got %q %v", step.scpi, step.expected, res, err)
+		}
+	}
+}
+
+func TestSimHelpHeaders(t *testing.T) {
+	inst := newTestSim(t)
+	// Answered as a block, whose header the transports strip
+	headers, err := inst.Query(":SYST:HELP:HEAD?")
+	if err != nil || !strings.HasPrefix(headers, "[:SOURce]:FREQuency[:CW]\n") || !strings.HasSuffix(headers, ":MEASure:VOLTage?/qonly/\n") {
+		t.Errorf("expected the headers as a real instrument answers them, got %q %v", headers, err)
+	}
+}
+
+func TestSimErrorQueue(t *testing.T) {
+	inst := newTestSim(t)
+	for _, scpi := range []string{"FOO 1", "RAD17:ARB ON", "INIT?", "MEAS:VOLT 1"} {
+		inst.Command(scpi)
+	}
+	if res, _ := inst.Query("*STB?"); res != "4\n" {
+		t.Errorf("expected the error queue available bit, got %q", res)
+	}
+	errs, err := inst.QueryError(ErrorQueueOptions{})
+	expected := []InstrumentError{{Code: -113, Message: "Undefined header"}}
+	expected = append(expected, expected[0], expected[0], expected[0])
+	if err != nil || !reflect.DeepEqual(errs, expected) {
+		t.Errorf("expected 4 undefined headers, got %+v %v", errs, err)
+	}
+	if errs, err := inst.QueryError(ErrorQueueOptions{Query: "SYST:ERR:ALL?"}); err != nil || len(errs) != 0 {
+		t.Errorf("expected an empty error queue, got %+v %v", errs, err)
+	}
+
+	for range simErrorQueueSize + 5 {
+		inst.Command("FOO")
+	}
+	if res, _ := inst.Query("SYST:ERR:COUN?"); res != "30\n" {
+		t.Errorf("expected a full queue, got %q", res)
+	}
+	errs, _ = inst.QueryError(ErrorQueueOptions{Query: ":SYST:ERR:NEXT?"})
+	if len(errs) != simErrorQueueSize || errs[len(errs)-1].Code != -350 {
+		t.Errorf("expected the queue to end in an overflow, got %+v", errs)
+	}
+
+	inst.Command("FOO")
+	inst.Command("*CLS")
+	if errs, _ := inst.QueryError(ErrorQueueOptions{}); len(errs) != 0 {
+		t.Errorf("expected *CLS to clear the error queue, got %+v", errs)
+	}
+}
+
+func TestSimWithoutProfile(t *testing.T) {
+	inst := NewSimInstrument("", time.Second, false)
+	inst.Command(":ANY:THING 5")
+	if res, _ := inst.Query("any:thing?"); res != "5\n" {
+		t.Errorf("expected any header to be accepted, got %q", res)
+	}
+	if errs, _ := inst.QueryError(ErrorQueueOptions{}); len(errs) != 0 {
+		t.Errorf("expected no errors, got %+v", errs)
+	}
+}
@@ -0,0 +1,340 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// StatusBit names one bit of a status register
+type StatusBit struct {
+	Bit         int    `json:"bit"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// StatusRegister describes a status register (IEEE 488.2 section 11, SCPI volume 1 section 9) and how to read and enable it
+type StatusRegister struct {
+	Name string `json:"name"`
+	// Path is the SCPI node of a register tree such as :STATus:QUEStionable. When set it fills in any of the queries below
+	// that are empty, e.g. :STATus:QUEStionable:CONDition?.
+	Path string `json:"path,omitempty"`
+	// ConditionQuery reads the current state. Empty for registers that only latch events, e.g. the Standard Event Status Register.
+	ConditionQuery string `json:"conditionQuery,omitempty"`
+	// EventQuery reads and clears the latched events
+	EventQuery string `json:"eventQuery,omitempty"`
+	// EnableQuery and EnableCommand read and program the enable mask
+	EnableQuery   string      `json:"enableQuery,omitempty"`
+	EnableCommand string      `json:"enableCommand,omitempty"`
+	Bits          []StatusBit `json:"bits"`
+	// SummaryBit is the bit of the parent register that summarizes this one
+	SummaryBit int `json:"summaryBit,omitempty"`
+	// Children are the registers summarized into bits of this one, e.g. :STAT:QUES:POW into bit 3 of :STAT:QUES
+	Children []StatusRegister `json:"children,omitempty"`
+}
+
+// StatusModel is the set of status registers an instrument implements
+type StatusModel struct {
+	Registers []StatusRegister `json:"registers"`
+}
+
+var statusByteRegister = StatusRegister{
+	Name:           "Status Byte",
+	ConditionQuery: "*STB?",
+	EnableQuery:    "*SRE?",
+	EnableCommand:  "*SRE",
+	Bits: []StatusBit{
+		{Bit: 2, Name: "EAV", Description: "Error/Event Queue not empty"},
+		{Bit: 3, Name: "QUES", Description: "Questionable Status summary"},
+		{Bit: 4, Name: "MAV", Description: "Message Available"},
+		{Bit: 5, Name: "ESB", Description: "Standard Event Status summary"},
+		{Bit: 6, Name: "RQS", Description: "Request Service"},
+		{Bit: 7, Name: "OPER", Description: "Operation Status summary"},
+	},
+}
+
+var standardEventRegister = StatusRegister{
+	Name:          "Standard Event Status",
+	EventQuery:    "*ESR?",
+	EnableQuery:   "*ESE?",
+	EnableCommand: "*ESE",
+	Bits: []StatusBit{
+		{Bit: 0, Name: "OPC", Description: "Operation Complete"},
+		{Bit: 1, Name: "RQC", Description: "Request Control"},
+		{Bit: 2, Name: "QYE", Description: "Query Error"},
+		{Bit: 3, Name: "DDE", Description: "Device Dependent Error"},
+		{Bit: 4, Name: "EXE", Description: "Execution Error"},
+		{Bit: 5, Name: "CME", Description: "Command Error"},
+		{Bit: 6, Name: "URQ", Description: "User Request"},
+		{Bit: 7, Name: "PON", Description: "Power On"},
+	},
+}
+
+var operationRegister = StatusRegister{
+	Name: "Operation Status",
+	Path: ":STATus:OPERation",
+	Bits: []StatusBit{
+		{Bit: 0, Name: "CAL", Description: "Calibrating"},
+		{Bit: 1, Name: "SETT", Description: "Settling"},
+		{Bit: 2, Name: "RANG", Description: "Ranging"},
+		{Bit: 3, Name: "SWE", Description: "Sweeping"},
+		{Bit: 4, Name: "MEAS", Description: "Measuring"},
+		{Bit: 5, Name: "TRIG", Description: "Waiting for trigger"},
+		{Bit: 6, Name: "ARM", Description: "Waiting for arm"},
+		{Bit: 7, Name: "CORR", Description: "Correcting"},
+		{Bit: 13, Name: "INST", Description: "Instrument summary"},
+		{Bit: 14, Name: "PROG", Description: "Program running"},
+	},
+}
+
+var questionableRegister = StatusRegister{
+	Name: "Questionable Status",
+	Path: ":STATus:QUEStionable",
+	Bits: []StatusBit{
+		{Bit: 0, Name: "VOLT", Description: "Voltage"},
+		{Bit: 1, Name: "CURR", Description: "Current"},
+		{Bit: 2, Name: "TIME", Description: "Time"},
+		{Bit: 3, Name: "POW", Description: "Power"},
+		{Bit: 4, Name: "TEMP", Description: "Temperature"},
+		{Bit: 5, Name: "FREQ", Description: "Frequency"},
+		{Bit: 6, Name: "PHAS", Description: "Phase"},
+		{Bit: 7, Name: "MOD", Description: "Modulation"},
+		{Bit: 8, Name: "CAL", Description: "Calibration"},
+		{Bit: 13, Name: "INST", Description: "Instrument summary"},
+		{Bit: 14, Name: "WARN", Description: "Command warning"},
+	},
+}
+
+// Returns the IEEE 488.2 status byte and standard event registers and the SCPI operation and questionable registers
+func DefaultStatusModel() StatusModel {
+	return StatusModel{Registers: []StatusRegister{statusByteRegister, standardEventRegister, operationRegister, questionableRegister}}
+}
+
+// Reads a status model from a JSON file. Registers in the file replace the default register of the same name and
+// are added to the model otherwise, so a file only needs the instrument specific registers.
+func LoadStatusModel(path string) (StatusModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return StatusModel{}, err
+	}
+	var custom StatusModel
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return StatusModel{}, fmt.Errorf("invalid status model %s: %w", path, err)
+	}
+
+	model := DefaultStatusModel()
+	for _, reg := range custom.Registers {
+		if idx := model.indexOf(reg.Name); idx >= 0 {
+			model.Registers[idx] = reg
+		} else {
+			model.Registers = append(model.Registers, reg)
+		}
+	}
+	return model, nil
+}
+
+var statusRegisterAliases = map[string]string{
+	"stb":  statusByteRegister.Name,
+	"sre":  statusByteRegister.Name,
+	"esr":  standardEventRegister.Name,
+	"ese":  standardEventRegister.Name,
+	"oper": operationRegister.Name,
+	"ques": questionableRegister.Name,
+}
+
+// Finds a top level register or one of its children by name, path, or one of the aliases stb, esr, oper and ques
+func (m StatusModel) Find(name string) (StatusRegister, bool) {
+	if alias, ok := statusRegisterAliases[strings.ToLower(name)]; ok {
+		name = alias
+	}
+	return findStatusRegister(m.Registers, name)
+}
+
+func findStatusRegister(registers []StatusRegister, name string) (StatusRegister, bool) {
+	for _, reg := range registers {
+		if strings.EqualFold(reg.Name, name) || (reg.Path != "" && strings.EqualFold(reg.Path, name)) {
+			return reg, true
+		}
+		if child, ok := findStatusRegister(reg.Children, name); ok {
+			return child, true
+		}
+	}
+	return StatusRegister{}, false
+}
+
+func (m StatusModel) indexOf(name string) int {
+	for idx, reg := range m.Registers {
+		if strings.EqualFold(reg.Name, name) {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (r StatusRegister) conditionQuery() string {
+	if r.ConditionQuery == "" && r.Path != "" {
+		return r.Path + ":CONDition?"
+	}
+	return r.ConditionQuery
+}
+
+func (r StatusRegister) eventQuery() string {
+	if r.EventQuery == "" && r.Path != "" {
+		return r.Path + ":EVENt?"
+	}
+	return r.EventQuery
+}
+
+func (r StatusRegister) enableQuery() string {
+	if r.EnableQuery == "" && r.Path != "" {
+		return r.Path + ":ENABle?"
+	}
+	return r.EnableQuery
+}
+
+func (r StatusRegister) enableCommand() string {
+	if r.EnableCommand == "" && r.Path != "" {
+		return r.Path + ":ENABle"
+	}
+	return r.EnableCommand
+}
+
+// StatusFlag is one decoded bit of a register
+type StatusFlag struct {
+	Bit         int    `json:"bit"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Condition   bool   `json:"condition"`
+	Event       bool   `json:"event"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// RegisterStatus holds the values read from a register. Values the register does not have are nil.
+type RegisterStatus struct {
+	Name      string           `json:"name"`
+	Path      string           `json:"path,omitempty"`
+	Condition *int             `json:"condition,omitempty"`
+	Event     *int             `json:"event,omitempty"`
+	Enable    *int             `json:"enable,omitempty"`
+	Flags     []StatusFlag     `json:"flags"`
+	Children  []RegisterStatus `json:"children,omitempty"`
+}
+
+// Returns the names of the bits set in value. Set bits the register does not name are reported as bitN.
+func (r StatusRegister) Decode(value int) []string {
+	var names []string
+	for bit := 0; bit < 16; bit++ {
+		if value&(1<<bit) == 0 {
+			continue
+		}
+		if b, ok := r.bit(bit); ok {
+			names = append(names, b.Name)
+		} else {
+			names = append(names, fmt.Sprintf("bit%d", bit))
+		}
+	}
+	return names
+}
+
+func (r StatusRegister) bit(bit int) (StatusBit, bool) {
+	for _, b := range r.Bits {
+		if b.Bit == bit {
+			return b, true
+		}
+	}
+	return StatusBit{}, false
+}
+
+// Reads every register of the model and its children. Note that reading an event register clears it.
+func ReadStatus(ctx context.Context, inst Instrument, model StatusModel) ([]RegisterStatus, error) {
+	return readStatusRegisters(ctx, inst, model.Registers)
+}
+
+func readStatusRegisters(ctx context.Context, inst Instrument, registers []StatusRegister) ([]RegisterStatus, error) {
+	statuses := make([]RegisterStatus, 0, len(registers))
+	for _, reg := range registers {
+		status, err := ReadRegister(ctx, inst, reg)
+		if err != nil {
+			return statuses, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Reads the condition, event and enable values of a register and its children and decodes them
+func ReadRegister(ctx context.Context, inst Instrument, reg StatusRegister) (RegisterStatus, error) {
+	status := RegisterStatus{Name: reg.Name, Path: reg.Path}
+	var err error
+	if status.Condition, err = queryRegister(ctx, inst, reg.conditionQuery()); err != nil {
+		return status, err
+	}
+	if status.Event, err = queryRegister(ctx, inst, reg.eventQuery()); err != nil {
+		return status, err
+	}
+	if status.Enable, err = queryRegister(ctx, inst, reg.enableQuery()); err != nil {
+		return status, err
+	}
+	status.Flags = reg.decodeFlags(status)
+	if status.Children, err = readStatusRegisters(ctx, inst, reg.Children); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+// Returns nil without querying when query is empty
+func queryRegister(ctx context.Context, inst Instrument, query string) (*int, error) {
+	if query == "" {
+		return nil, nil
+	}
+	res, err := inst.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	value, err := parseRegister(res)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", query, err)
+	}
+	return &value, nil
+}
+
+// Lists the named bits, followed by any unnamed bit that is set
+func (r StatusRegister) decodeFlags(status RegisterStatus) []StatusFlag {
+	isSet := func(value *int, bit int) bool {
+		return value != nil && *value&(1<<bit) != 0
+	}
+	flags := make([]StatusFlag, 0, len(r.Bits))
+	for bit := 0; bit < 16; bit++ {
+		b, named := r.bit(bit)
+		flag := StatusFlag{
+			Bit:         bit,
+			Name:        b.Name,
+			Description: b.Description,
+			Condition:   isSet(status.Condition, bit),
+			Event:       isSet(status.Event, bit),
+			Enabled:     isSet(status.Enable, bit),
+		}
+		if !named {
+			if !flag.Condition && !flag.Event && !flag.Enabled {
+				continue
+			}
+			flag.Name = fmt.Sprintf("bit%d", bit)
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// Programs the enable mask of a register, e.g. *SRE 32 or :STATus:OPERation:ENABle 16
+func SetStatusEnable(ctx context.Context, inst Instrument, reg StatusRegister, mask int) error {
+	cmd := reg.enableCommand()
+	if cmd == "" {
+		return fmt.Errorf("status register %s has no enable mask", reg.Name)
+	}
+	if mask < 0 || mask > 0xFFFF {
+		return fmt.Errorf("enable mask %d is out of range 0 to 65535", mask)
+	}
+	return inst.CommandContext(ctx, fmt.Sprintf("%s %d", cmd, mask))
+}
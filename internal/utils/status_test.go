@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestStatusRegisterDecode(t *testing.T) {
+	names := standardEventRegister.Decode(0x24)
+	if !slices.Equal(names, []string{"QYE", "CME"}) {
+		t.Errorf("expected QYE and CME, got %v", names)
+	}
+	names = operationRegister.Decode(1<<4 | 1<<9)
+	if !slices.Equal(names, []string{"MEAS", "bit9"}) {
+		t.Errorf("expected MEAS and bit9, got %v", names)
+	}
+}
+
+func TestReadStatus(t *testing.T) {
+	// *STB?, *SRE?, *ESR?, *ESE?, then condition, event and enable of :STAT:OPER and :STAT:QUES
+	inst := connectFakeSocket(t,
+		[]byte("+68\n"), []byte("+32\n"),
+		[]byte("+36\n"), []byte("+60\n"),
+		[]byte("+16\n"), []byte("+0\n"), []byte("+0\n"),
+		[]byte("+0\n"), []byte("+512\n"), []byte("+0\n"),
+	)
+	statuses, err := ReadStatus(context.Background(), inst, DefaultStatusModel())
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %v", err)
+	}
+	if len(statuses) != 4 {
+		t.Fatalf("expected 4 registers, got %d", len(statuses))
+	}
+
+	stb := statuses[0]
+	if stb.Condition == nil || *stb.Condition != 68 || stb.Event != nil || stb.Enable == nil || *stb.Enable != 32 {
+		t.Errorf("unexpected status byte values %+v", stb)
+	}
+	for _, flag := range stb.Flags {
+		if flag.Name == "RQS" && !flag.Condition {
+			t.Error("expected RQS to be set")
+		}
+		if flag.Name == "ESB" && (flag.Condition || !flag.Enabled) {
+			t.Errorf("expected ESB to be clear and enabled, got %+v", flag)
+		}
+	}
+
+	esr := statuses[1]
+	if esr.Condition != nil || esr.Event == nil || *esr.Event != 36 {
+		t.Errorf("unexpected standard event values %+v", esr)
+	}
+
+	ques := statuses[3]
+	if ques.Path != ":STATus:QUEStionable" || len(ques.Flags) != len(questionableRegister.Bits)+1 {
+		t.Errorf("expected the unnamed set bit 9 to be listed, got %+v", ques.Flags)
+	}
+}
+
+func TestSetStatusEnable(t *testing.T) {
+	inst := connectFakeSocket(t)
+	model := DefaultStatusModel()
+	reg, ok := model.Find("oper")
+	if !ok {
+		t.Fatal("expected to find the operation register")
+	}
+	if err := SetStatusEnable(context.Background(), inst, reg, 1<<4); err != nil {
+		t.Errorf("SetStatusEnable failed: %v", err)
+	}
+	if err := SetStatusEnable(context.Background(), inst, reg, 1<<16); err == nil {
+		t.Error("expected out of range mask to fail")
+	}
+}
+
+func TestLoadStatusModel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.json")
+	data := `{"registers": [{"name": "Questionable Status", "path": ":STAT:QUES", "bits": [{"bit": 3, "name": "POW"}],
+		"children": [{"name": "Questionable Power", "path": ":STAT:QUES:POW", "summaryBit": 3, "bits": [{"bit": 0, "name": "OVLD"}]}]}]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	model, err := LoadStatusModel(path)
+	if err != nil {
+		t.Fatalf("LoadStatusModel failed: %v", err)
+	}
+	if len(model.Registers) != 4 {
+		t.Errorf("expected the questionable register to be replaced, got %d registers", len(model.Registers))
+	}
+	child, ok := model.Find(":stat:ques:pow")
+	if !ok || child.SummaryBit != 3 || child.conditionQuery() != ":STAT:QUES:POW:CONDition?" {
+		t.Errorf("unexpected child register %+v", child)
+	}
+}
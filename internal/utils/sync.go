@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyncMode selects how CommandSync waits for an overlapped command, e.g. :INIT:IMM, to finish
+type SyncMode int
+
+const (
+	SyncNone SyncMode = iota
+	// SyncOpc appends *OPC? to the command and waits for its response
+	SyncOpc
+	// SyncEsr appends *OPC to the command and polls *ESR? until the Operation Complete bit is set
+	SyncEsr
+	// SyncOperCond polls :STAT:OPER:COND? until no operation is running
+	SyncOperCond
+)
+
+var syncModeNames = map[string]SyncMode{
+	"":     SyncNone,
+	"none": SyncNone,
+	"opc":  SyncOpc,
+	"esr":  SyncEsr,
+	"oper": SyncOperCond,
+}
+
+func ParseSyncMode(s string) (SyncMode, error) {
+	if mode, ok := syncModeNames[strings.ToLower(s)]; ok {
+		return mode, nil
+	}
+	return SyncNone, fmt.Errorf("unknown sync mode '%s', expected none, opc, esr or oper", s)
+}
+
+func (m SyncMode) String() string {
+	switch m {
+	case SyncOpc:
+		return "opc"
+	case SyncEsr:
+		return "esr"
+	case SyncOperCond:
+		return "oper"
+	}
+	return "none"
+}
+
+const (
+	DefaultSyncTimeout      = 60 * time.Second
+	DefaultSyncPollInterval = 100 * time.Millisecond
+)
+
+// Operation Complete bit of the Standard Event Status Register
+const esrOperationComplete = 1 << 0
+
+type SyncOptions struct {
+	Mode SyncMode
+	// Timeout bounds the whole wait and replaces the instrument's default timeout for it. Zero means DefaultSyncTimeout.
+	Timeout time.Duration
+	// PollInterval is the delay between status queries of the polling modes. Zero means DefaultSyncPollInterval.
+	PollInterval time.Duration
+}
+
+// Sends a command and, unless opts.Mode is SyncNone, waits until the instrument reports that it has finished
+func CommandSync(ctx context.Context, inst Instrument, cmd string, opts SyncOptions) error {
+	cmd = strings.TrimSpace(cmd)
+	if opts.Mode == SyncNone {
+		return inst.CommandContext(ctx, cmd)
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSyncTimeout
+	}
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultSyncPollInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch opts.Mode {
+	case SyncOpc:
+		res, err := inst.QueryContext(ctx, cmd+";*OPC?")
+		if err != nil {
+			return err
+		}
+		if value, err := parseRegister(res); err != nil || value != 1 {
+			return protocolError("unexpected *OPC? response %q", strings.TrimSpace(res))
+		}
+		return nil
+	case SyncEsr:
+		if err := inst.CommandContext(ctx, cmd+";*OPC"); err != nil {
+			return err
+		}
+		return pollRegister(ctx, inst, "*ESR?", interval, func(value int) bool { return value&esrOperationComplete != 0 })
+	case SyncOperCond:
+		if err := inst.CommandContext(ctx, cmd); err != nil {
+			return err
+		}
+		return pollRegister(ctx, inst, ":STAT:OPER:COND?", interval, func(value int) bool { return value == 0 })
+	}
+	return fmt.Errorf("unknown sync mode %d", opts.Mode)
+}
+
+// Queries a status register every interval until done accepts its value
+func pollRegister(ctx context.Context, inst Instrument, query string, interval time.Duration, done func(int) bool) error {
+	for {
+		res, err := inst.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		value, err := parseRegister(res)
+		if err != nil {
+			return err
+		}
+		if done(value) {
+			return nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s still reports %d", ctx.Err(), query, value)
+		}
+	}
+}
+
+// Parses a register value, which instruments send as an integer such as +32 or occasionally as a real such as 3.2E+01
+func parseRegister(response string) (int, error) {
+	response = strings.TrimSpace(response)
+	if value, err := strconv.Atoi(response); err == nil {
+		return value, nil
+	}
+	value, err := strconv.ParseFloat(response, 64)
+	if err != nil {
+		return 0, protocolError("register value is not a number: %q", response)
+	}
+	return int(value), nil
+}
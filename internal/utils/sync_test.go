@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func connectFakeSocket(t *testing.T, responses ...[]byte) Instrument {
+	inst := NewScpiInstrument(Framing{}, time.Second, false)
+	if err := inst.Connect(newFakeSocketServer(t, responses...), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { inst.Close() })
+	return inst
+}
+
+func TestCommandSyncOpc(t *testing.T) {
+	inst := connectFakeSocket(t, []byte("1\n"))
+	if err := CommandSync(context.Background(), inst, ":CAL:ALL", SyncOptions{Mode: SyncOpc}); err != nil {
+		t.Errorf("CommandSync failed: %v", err)
+	}
+
+	inst = connectFakeSocket(t, []byte("0\n"))
+	if err := CommandSync(context.Background(), inst, ":CAL:ALL", SyncOptions{Mode: SyncOpc}); !errors.Is(err, ErrProtocol) {
+		t.Errorf("expected unexpected *OPC? response to fail, got %v", err)
+	}
+}
+
+func TestCommandSyncEsr(t *testing.T) {
+	// No response to the command itself, then *ESR? reports a query error before Operation Complete
+	inst := connectFakeSocket(t, []byte{}, []byte("+0\n"), []byte("+4\n"), []byte("+1\n"))
+	if err := CommandSync(context.Background(), inst, ":INIT:IMM", SyncOptions{Mode: SyncEsr, PollInterval: time.Millisecond}); err != nil {
+		t.Errorf("CommandSync failed: %v", err)
+	}
+}
+
+func TestCommandSyncOperCondTimeout(t *testing.T) {
+	responses := [][]byte{{}}
+	for range 100 {
+		responses = append(responses, []byte("+16\n"))
+	}
+	inst := connectFakeSocket(t, responses...)
+	start := time.Now()
+	err := CommandSync(context.Background(), inst, ":INIT:IMM", SyncOptions{Mode: SyncOperCond, Timeout: 50 * time.Millisecond, PollInterval: 5 * time.Millisecond})
+	if KindOf(err) != ErrorKindTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the wait to end at the sync timeout, took %s", elapsed)
+	}
+}
+
+func TestParseSyncMode(t *testing.T) {
+	if mode, err := ParseSyncMode("ESR"); err != nil || mode != SyncEsr {
+		t.Errorf("expected esr mode, got %v %v", mode, err)
+	}
+	if _, err := ParseSyncMode("wait"); err == nil {
+		t.Error("expected unknown sync mode to fail")
+	}
+}
@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vxi11CoreProgram = 0x0607AF
+	vxi11CoreVersion = 1
+
+	vxi11CreateLink      = 10
+	vxi11DeviceWrite     = 11
+	vxi11DeviceRead      = 12
+	vxi11ReadStb         = 13
+	vxi11DeviceClear     = 15
+	vxi11DeviceLock      = 18
+	vxi11DeviceUnlock    = 19
+	vxi11EnableSrq       = 20
+	vxi11DestroyLink     = 23
+	vxi11CreateIntrChan  = 25
+	vxi11DestroyIntrChan = 26
+
+	vxi11IntrProgram = 0x0607B1
+	vxi11IntrVersion = 1
+	vxi11IntrSrq     = 30
+
+	vxi11FlagWaitLock = 0x01
+	vxi11FlagEnd      = 0x08
+
+	vxi11ReasonEnd = 0x04
+
+	vxi11MaxReadSize = 1024 * 1024
+)
+
+var vxi11ErrorMessages = map[uint32]string{
+	1:  "syntax error",
+	3:  "device not accessible",
+	4:  "invalid link identifier",
+	5:  "parameter error",
+	6:  "channel not established",
+	8:  "operation not supported",
+	9:  "out of resources",
+	11: "device locked by another link",
+	12: "no lock held by this link",
+	15: "I/O timeout",
+	17: "I/O error",
+	21: "invalid address",
+	23: "abort",
+	29: "channel already established",
+}
+
+type vxi11Error uint32
+
+func (e vxi11Error) Error() string {
+	if msg, ok := vxi11ErrorMessages[uint32(e)]; ok {
+		return "vxi11: " + msg
+	}
+	return fmt.Sprintf("vxi11: device error %d", uint32(e))
+}
+
+// The instrument's own I/O timeout and lock errors are reported like those of any other transport
+func (e vxi11Error) Is(target error) bool {
+	return (target == ErrTimeout && e == 15) || (target == ErrLocked && e == 11)
+}
+
+type vxi11Instrument struct {
+	device      string
+	framing     Framing
+	client      *rpcClient
+	link        uint32
+	maxRecvSize uint32
+	// Held for the whole of a command or query, so concurrent calls cannot take each other's responses
+	mu          sync.Mutex
+	timeout     timeoutSetting
+	interrupted bool
+	interactive bool
+	headersHash uint32
+	starTree    ScpiNode
+	colonTree   ScpiNode
+	diagnostics []ParseDiagnostic
+}
+
+// Device is the VXI-11 logical device name, e.g. inst0 or gpib0,5. An empty device uses inst0.
+func NewVxi11Instrument(device string, framing Framing, timeout time.Duration, interactive bool) Instrument {
+	if device == "" {
+		device = "inst0"
+	}
+	i := &vxi11Instrument{device: device, framing: framing, interactive: interactive}
+	i.timeout.set(timeout)
+	return i
+}
+
+// Address is the instrument host, optionally followed by the portmapper port (default 111)
+func (i *vxi11Instrument) Connect(address string, progress func(int)) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, strconv.Itoa(portmapperPort)
+	}
+
+	corePort, err := getRpcPort(net.JoinHostPort(host, port), vxi11CoreProgram, vxi11CoreVersion, i.timeout.get())
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(20)
+	}
+
+	client, err := dialRpc(net.JoinHostPort(host, strconv.Itoa(int(corePort))), i.timeout.get())
+	if err != nil {
+		return err
+	}
+
+	w := &xdrWriter{}
+	w.uint32(uint32(time.Now().Unix())) // clientId, only used for diagnostics by the instrument
+	w.bool(false)                       // lockDevice
+	w.uint32(0)                         // lock_timeout
+	w.string(i.device)
+	r, err := client.call(context.Background(), vxi11CoreProgram, vxi11CoreVersion, vxi11CreateLink, w.bytes(), i.rpcTimeout(i.timeout.get()))
+	if err != nil {
+		client.close()
+		return err
+	}
+	if code := r.uint32(); code != 0 {
+		client.close()
+		return fmt.Errorf("failed to create link to %s: %w", i.device, vxi11Error(code))
+	}
+	i.link = r.uint32()
+	r.uint32() // abortPort
+	i.maxRecvSize = r.uint32()
+	if r.err != nil {
+		client.close()
+		return r.err
+	}
+	if i.maxRecvSize == 0 {
+		i.maxRecvSize = 1024
+	}
+	if progress != nil {
+		progress(20)
+	}
+
+	i.client = client
+	return nil
+}
+
+// The RPC deadline must outlast the io_timeout handed to the instrument so the device can report its own timeout
+func (i *vxi11Instrument) rpcTimeout(ioTimeout time.Duration) time.Duration {
+	return ioTimeout + 2*time.Second
+}
+
+// The io_timeout handed to the instrument, which is whatever remains of the call
+func (i *vxi11Instrument) ioTimeout(ctx context.Context) time.Duration {
+	return max(callTimeout(ctx, i.timeout.get()), 0)
+}
+
+func (i *vxi11Instrument) Command(command string) error {
+	return i.CommandContext(context.Background(), command)
+}
+
+func (i *vxi11Instrument) CommandContext(ctx context.Context, command string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if err := i.write(ctx, command+i.framing.writeTermination()); err != nil {
+		return fmt.Errorf("failed to execute the command '%s': %w", command, err)
+	}
+	return nil
+}
+
+// An interrupted call may leave part of a reply in the connection and a response in the instrument, both are discarded
+func (i *vxi11Instrument) resync() error {
+	if !i.interrupted {
+		return nil
+	}
+	if err := i.client.flush(i.timeout.get()); err != nil {
+		return i.wrapRpcError(err)
+	}
+	i.interrupted = false
+	return i.Clear()
+}
+
+func (i *vxi11Instrument) write(ctx context.Context, data string) error {
+	if err := i.resync(); err != nil {
+		return err
+	}
+	b := []byte(data)
+	for len(b) > 0 {
+		chunk := b
+		flags := uint32(vxi11FlagEnd)
+		if uint32(len(chunk)) > i.maxRecvSize {
+			chunk = chunk[:i.maxRecvSize]
+			flags = 0
+		}
+
+		ioTimeout := i.ioTimeout(ctx)
+		w := &xdrWriter{}
+		w.uint32(i.link)
+		w.uint32(uint32(ioTimeout.Milliseconds())) // io_timeout
+		w.uint32(0)                                // lock_timeout
+		w.uint32(flags)
+		w.opaque(chunk)
+		r, err := i.client.call(ctx, vxi11CoreProgram, vxi11CoreVersion, vxi11DeviceWrite, w.bytes(), i.rpcTimeout(ioTimeout))
+		if err != nil {
+			return i.wrapRpcError(err)
+		}
+		if code := r.uint32(); code != 0 {
+			return vxi11Error(code)
+		}
+		size := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if size == 0 || size > uint32(len(chunk)) {
+			return protocolError("device accepted %d bytes of a %d byte write", size, len(chunk))
+		}
+		b = b[size:]
+	}
+	return nil
+}
+
+func (i *vxi11Instrument) read(ctx context.Context) ([]byte, error) {
+	var result []byte
+	for {
+		ioTimeout := i.ioTimeout(ctx)
+		w := &xdrWriter{}
+		w.uint32(i.link)
+		w.uint32(vxi11MaxReadSize)
+		w.uint32(uint32(ioTimeout.Milliseconds())) // io_timeout
+		w.uint32(0)                                // lock_timeout
+		w.uint32(0)                                // flags
+		w.uint32(0)                                // termChar
+		r, err := i.client.call(ctx, vxi11CoreProgram, vxi11CoreVersion, vxi11DeviceRead, w.bytes(), i.rpcTimeout(ioTimeout))
+		if err != nil {
+			return nil, i.wrapRpcError(err)
+		}
+		if code := r.uint32(); code != 0 {
+			return nil, vxi11Error(code)
+		}
+		reason := r.uint32()
+		result = append(result, r.opaque()...)
+		if r.err != nil {
+			return nil, r.err
+		}
+		if maxSize := i.framing.maxResponseSize(); len(result) > maxSize {
+			// The rest of the response is discarded by the device clear before the next call
+			i.interrupted = true
+			return nil, responseTooLarge(maxSize)
+		}
+		if reason&vxi11ReasonEnd != 0 {
+			return result, nil
+		}
+	}
+}
+
+func (i *vxi11Instrument) Clear() error {
+	w := &xdrWriter{}
+	w.uint32(i.link)
+	w.uint32(0)                                      // flags
+	w.uint32(0)                                      // lock_timeout
+	w.uint32(uint32(i.timeout.get().Milliseconds())) // io_timeout
+	r, err := i.client.call(context.Background(), vxi11CoreProgram, vxi11CoreVersion, vxi11DeviceClear, w.bytes(), i.rpcTimeout(i.timeout.get()))
+	if err != nil {
+		return i.wrapRpcError(err)
+	}
+	if code := r.uint32(); code != 0 {
+		return vxi11Error(code)
+	}
+	return r.err
+}
+
+// Lock takes the device lock of the link with device_lock, waiting up to timeout for another link to release it
+func (i *vxi11Instrument) Lock(timeout time.Duration) error {
+	w := &xdrWriter{}
+	w.uint32(i.link)
+	w.uint32(vxi11FlagWaitLock)
+	w.uint32(uint32(timeout.Milliseconds())) // lock_timeout
+	r, err := i.client.call(context.Background(), vxi11CoreProgram, vxi11CoreVersion, vxi11DeviceLock, w.bytes(), i.rpcTimeout(timeout))
+	if err != nil {
+		return transportError(err)
+	}
+	if code := r.uint32(); code != 0 {
+		return fmt.Errorf("failed to lock %s: %w", i.device, vxi11Error(code))
+	}
+	return r.err
+}
+
+func (i *vxi11Instrument) Unlock() error {
+	w := &xdrWriter{}
+	w.uint32(i.link)
+	if err := i.deviceCall(vxi11DeviceUnlock, w.bytes()); err != nil {
+		return fmt.Errorf("failed to unlock %s: %w", i.device, err)
+	}
+	return nil
+}
+
+// Events opens a VXI-11 interrupt channel. The instrument connects back to a listener on the address this host uses for
+// the core channel and calls device_intr_srq, after which the status byte is read with device_readstb.
+func (i *vxi11Instrument) Events(ctx context.Context) (<-chan StatusEvent, error) {
+	local, ok := i.client.conn.LocalAddr().(*net.TCPAddr)
+	if !ok || local.IP.To4() == nil {
+		return nil, errors.New("vxi11: the interrupt channel requires an IPv4 connection")
+	}
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+
+	w := &xdrWriter{}
+	w.uint32(binary.BigEndian.Uint32(local.IP.To4()))
+	w.uint32(uint32(listener.Addr().(*net.TCPAddr).Port))
+	w.uint32(vxi11IntrProgram)
+	w.uint32(vxi11IntrVersion)
+	w.uint32(0) // progFamily: DEVICE_TCP
+	if err := i.deviceCall(vxi11CreateIntrChan, w.bytes()); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to create interrupt channel: %w", err)
+	}
+	if err := i.enableSrq(true); err != nil {
+		_ = i.deviceCall(vxi11DestroyIntrChan, nil)
+		listener.Close()
+		return nil, fmt.Errorf("failed to enable service requests: %w", err)
+	}
+
+	requests := make(chan struct{}, 1)
+	var connsMu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			connsMu.Lock()
+			conns = append(conns, conn)
+			connsMu.Unlock()
+			go serveRpc(conn, func(program, procedure uint32, args *xdrReader) []byte {
+				if program == vxi11IntrProgram && procedure == vxi11IntrSrq {
+					select {
+					case requests <- struct{}{}:
+					default: // a status read is already pending
+					}
+				}
+				return nil
+			})
+		}
+	}()
+
+	events := make(chan StatusEvent, 16)
+	go func() {
+		defer close(events)
+		defer func() {
+			_ = i.enableSrq(false)
+			_ = i.deviceCall(vxi11DestroyIntrChan, nil)
+			listener.Close()
+			connsMu.Lock()
+			for _, conn := range conns {
+				conn.Close()
+			}
+			connsMu.Unlock()
+		}()
+		for {
+			select {
+			case <-requests:
+			case <-ctx.Done():
+				return
+			}
+			stb, err := i.readStb(ctx)
+			if errors.Is(err, ErrConnectionClosed) || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			select {
+			case events <- StatusEvent{Time: time.Now(), StatusByte: stb, ServiceRequest: true}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+func (i *vxi11Instrument) enableSrq(enable bool) error {
+	w := &xdrWriter{}
+	w.uint32(i.link)
+	w.bool(enable)
+	w.opaque([]byte("sclipi")) // handle, passed back in device_intr_srq
+	return i.deviceCall(vxi11EnableSrq, w.bytes())
+}
+
+// Reads the status byte without touching the interrupted state, so it is safe alongside other calls
+func (i *vxi11Instrument) readStb(ctx context.Context) (byte, error) {
+	ioTimeout := i.ioTimeout(ctx)
+	w := &xdrWriter{}
+	w.uint32(i.link)
+	w.uint32(0)                                // flags
+	w.uint32(0)                                // lock_timeout
+	w.uint32(uint32(ioTimeout.Milliseconds())) // io_timeout
+	r, err := i.client.call(ctx, vxi11CoreProgram, vxi11CoreVersion, vxi11ReadStb, w.bytes(), i.rpcTimeout(ioTimeout))
+	if err != nil {
+		return 0, transportError(err)
+	}
+	if code := r.uint32(); code != 0 {
+		return 0, vxi11Error(code)
+	}
+	stb := r.uint32()
+	return byte(stb), r.err
+}
+
+// Makes a core channel call whose only result is a device error code
+func (i *vxi11Instrument) deviceCall(procedure uint32, args []byte) error {
+	r, err := i.client.call(context.Background(), vxi11CoreProgram, vxi11CoreVersion, procedure, args, i.rpcTimeout(i.timeout.get()))
+	if err != nil {
+		return transportError(err)
+	}
+	if code := r.uint32(); code != 0 {
+		return vxi11Error(code)
+	}
+	return r.err
+}
+
+func (i *vxi11Instrument) wrapRpcError(err error) error {
+	if err = transportError(err); errors.Is(err, ErrConnectionClosed) {
+		return err
+	}
+	i.interrupted = true
+	return err
+}
+
+func (i *vxi11Instrument) Query(cmd string) (string, error) {
+	return i.QueryContext(context.Background(), cmd)
+}
+
+func (i *vxi11Instrument) QueryContext(ctx context.Context, cmd string) (string, error) {
+	b, err := i.QueryBytesContext(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return responseString(b), nil
+}
+
+func (i *vxi11Instrument) QueryBytes(cmd string) ([]byte, error) {
+	return i.QueryBytesContext(context.Background(), cmd)
+}
+
+func (i *vxi11Instrument) QueryBytesContext(ctx context.Context, cmd string) ([]byte, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.query(ctx, cmd)
+}
+
+// Must be called with mu held
+func (i *vxi11Instrument) query(ctx context.Context, cmd string) ([]byte, error) {
+	if err := i.write(ctx, cmd+i.framing.writeTermination()); err != nil {
+		return nil, err
+	}
+
+	finish := trackQueryProgress(callTimeout(ctx, i.timeout.get()), i.interactive)
+	b, err := i.read(ctx)
+	finish(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(b, i.framing.readTermination())
+}
+
+func (i *vxi11Instrument) QueryError(opts ErrorQueueOptions) ([]InstrumentError, error) {
+	return i.QueryErrorContext(context.Background(), opts)
+}
+
+// The queue is drained holding mu, so no other call runs between its queries
+func (i *vxi11Instrument) QueryErrorContext(ctx context.Context, opts ErrorQueueOptions) ([]InstrumentError, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return queryErrorQueue(ctx, func(ctx context.Context, cmd string) (string, error) {
+		b, err := i.query(ctx, cmd)
+		if err != nil {
+			return "", err
+		}
+		return responseString(b), nil
+	}, opts)
+}
+
+func (i *vxi11Instrument) GetSupportedCommandsTree() (ScpiNode, ScpiNode, error) {
+	r, err := i.Query(":SYST:HELP:HEAD?")
+	if err != nil {
+		return ScpiNode{}, ScpiNode{}, err
+	}
+	if hash := hash(r); hash != i.headersHash {
+		i.starTree, i.colonTree, i.diagnostics = parseHeaders(strings.Split(r, "\n"))
+		i.headersHash = hash
+	}
+	return i.starTree, i.colonTree, nil
+}
+
+func (i *vxi11Instrument) HeaderDiagnostics() []ParseDiagnostic {
+	return i.diagnostics
+}
+
+func (i *vxi11Instrument) SetTimeout(timeout time.Duration) {
+	i.timeout.set(timeout)
+}
+
+func (i *vxi11Instrument) conns() []net.Conn {
+	return []net.Conn{i.client.conn}
+}
+
+func (i *vxi11Instrument) Close() error {
+	if i.client == nil {
+		return nil
+	}
+	w := &xdrWriter{}
+	w.uint32(i.link)
+	_, destroyErr := i.client.call(context.Background(), vxi11CoreProgram, vxi11CoreVersion, vxi11DestroyLink, w.bytes(), i.rpcTimeout(i.timeout.get()))
+	return errors.Join(destroyErr, i.client.close())
+}
@@ -0,0 +1,392 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVxi11Server answers portmapper and VXI-11 core calls on a single listener
+type fakeVxi11Server struct {
+	listener    net.Listener
+	maxRecvSize uint32
+	readChunk   int
+	mu          sync.Mutex
+	received    []string
+	links       int
+	statusByte  byte
+	intrAddress string
+	srqEnabled  bool
+	// The link holding the device lock, zero if none
+	lockedBy uint32
+	// Overrides the size device_write reports accepting, given the size sent
+	writeSize func(int) uint32
+}
+
+func newFakeVxi11Server(t *testing.T) *fakeVxi11Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeVxi11Server{listener: listener, maxRecvSize: 16, readChunk: 8}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *fakeVxi11Server) port() uint32 {
+	return uint32(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *fakeVxi11Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeVxi11Server) handle(conn net.Conn) {
+	defer conn.Close()
+	var pending string
+	var written string
+	for {
+		record, err := readRpcRecord(conn)
+		if err != nil {
+			return
+		}
+		r := newXdrReader(record)
+		xid := r.uint32()
+		r.uint32() // message type
+		r.uint32() // rpc version
+		program := r.uint32()
+		r.uint32() // program version
+		procedure := r.uint32()
+		r.uint32()
+		r.opaque()
+		r.uint32()
+		r.opaque()
+
+		w := &xdrWriter{}
+		w.uint32(xid)
+		w.uint32(rpcReply)
+		w.uint32(0)
+		w.uint32(0)
+		w.uint32(0)
+		w.uint32(0)
+
+		switch {
+		case program == portmapperProgram && procedure == portmapperGetPort:
+			w.uint32(s.port())
+		case program == vxi11CoreProgram && procedure == vxi11CreateLink:
+			s.links++
+			w.uint32(0)
+			w.uint32(uint32(s.links))
+			w.uint32(0)
+			w.uint32(s.maxRecvSize)
+		case program == vxi11CoreProgram && procedure == vxi11DeviceWrite:
+			r.uint32() // link
+			r.uint32() // io_timeout
+			r.uint32() // lock_timeout
+			flags := r.uint32()
+			data := r.opaque()
+			written += string(data)
+			if flags&vxi11FlagEnd != 0 {
+				s.mu.Lock()
+				s.received = append(s.received, written)
+				s.mu.Unlock()
+				pending = s.respond(strings.TrimSuffix(written, "\n"))
+				written = ""
+			}
+			size := uint32(len(data))
+			s.mu.Lock()
+			if s.writeSize != nil {
+				size = s.writeSize(len(data))
+			}
+			s.mu.Unlock()
+			w.uint32(0)
+			w.uint32(size)
+		case program == vxi11CoreProgram && procedure == vxi11DeviceRead:
+			chunk := pending
+			reason := uint32(vxi11ReasonEnd)
+			if len(chunk) > s.readChunk {
+				chunk = chunk[:s.readChunk]
+				reason = 0
+			}
+			pending = pending[len(chunk):]
+			w.uint32(0)
+			w.uint32(reason)
+			w.string(chunk)
+		case program == vxi11CoreProgram && procedure == vxi11DeviceLock:
+			link := r.uint32()
+			s.mu.Lock()
+			if s.lockedBy != 0 && s.lockedBy != link {
+				w.uint32(11)
+			} else {
+				s.lockedBy = link
+				w.uint32(0)
+			}
+			s.mu.Unlock()
+		case program == vxi11CoreProgram && procedure == vxi11DeviceUnlock:
+			link := r.uint32()
+			s.mu.Lock()
+			if s.lockedBy != link {
+				w.uint32(12)
+			} else {
+				s.lockedBy = 0
+				w.uint32(0)
+			}
+			s.mu.Unlock()
+		case program == vxi11CoreProgram && procedure == vxi11DestroyLink:
+			w.uint32(0)
+		case program == vxi11CoreProgram && procedure == vxi11CreateIntrChan:
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, r.uint32())
+			port := r.uint32()
+			s.mu.Lock()
+			s.intrAddress = net.JoinHostPort(ip.String(), fmt.Sprint(port))
+			s.mu.Unlock()
+			w.uint32(0)
+		case program == vxi11CoreProgram && procedure == vxi11DestroyIntrChan:
+			s.mu.Lock()
+			s.intrAddress = ""
+			s.mu.Unlock()
+			w.uint32(0)
+		case program == vxi11CoreProgram && procedure == vxi11EnableSrq:
+			r.uint32() // link
+			s.mu.Lock()
+			s.srqEnabled = r.bool()
+			s.mu.Unlock()
+			w.uint32(0)
+		case program == vxi11CoreProgram && procedure == vxi11ReadStb:
+			s.mu.Lock()
+			w.uint32(0)
+			w.uint32(uint32(s.statusByte))
+			s.mu.Unlock()
+		default:
+			w = &xdrWriter{}
+			w.uint32(xid)
+			w.uint32(rpcReply)
+			w.uint32(0)
+			w.uint32(0)
+			w.uint32(0)
+			w.uint32(3) // procedure unavailable
+		}
+		if err := writeRpcRecord(conn, w.bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeVxi11Server) respond(message string) string {
+	if strings.HasPrefix(message, ":ECHO") {
+		return message + "\n"
+	}
+	switch message {
+	case "*IDN?":
+		return "Fake,VXI-11 Instrument,0001,1.0\n"
+	case "SYST:ERR?":
+		return "+0,\"No error\"\n"
+	case ":SYST:HELP:HEAD?":
+		return "#245*IDN?/qonly/\n:FREQuency[:CW]\n:OUTPut[:STATe]\n"
+	}
+	return ""
+}
+
+// Sets the status byte and calls device_intr_srq on the client's interrupt channel
+func (s *fakeVxi11Server) requestService(statusByte byte) error {
+	s.mu.Lock()
+	s.statusByte = statusByte
+	address := s.intrAddress
+	s.mu.Unlock()
+	c, err := dialRpc(address, time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	w := &xdrWriter{}
+	w.opaque([]byte("sclipi"))
+	_, err = c.call(context.Background(), vxi11IntrProgram, vxi11IntrVersion, vxi11IntrSrq, w.bytes(), time.Second)
+	return err
+}
+
+func connectFakeVxi11(t *testing.T) (*fakeVxi11Server, Instrument) {
+	s := newFakeVxi11Server(t)
+	inst := NewVxi11Instrument("", Framing{}, time.Second, false)
+	if err := inst.Connect(s.listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() { inst.Close() })
+	return s, inst
+}
+
+func TestVxi11Query(t *testing.T) {
+	_, inst := connectFakeVxi11(t)
+	res, err := inst.Query("*IDN?")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if res != "Fake,VXI-11 Instrument,0001,1.0\n" {
+		t.Errorf("unexpected *IDN? response %q", res)
+	}
+}
+
+func TestVxi11CommandSplitsLargeWrites(t *testing.T) {
+	s, inst := connectFakeVxi11(t)
+	command := ":DISPlay:WINDow:TEXT:DATA \"a message longer than the max receive size\""
+	if err := inst.Command(command); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.received) != 1 || s.received[0] != command+"\n" {
+		t.Errorf("expected server to reassemble %q, got %q", command, s.received)
+	}
+}
+
+func TestVxi11CommandRejectsBadWriteSize(t *testing.T) {
+	for _, writeSize := range []func(int) uint32{
+		func(int) uint32 { return 0 },
+		func(n int) uint32 { return uint32(n + 1) },
+	} {
+		s, inst := connectFakeVxi11(t)
+		s.mu.Lock()
+		s.writeSize = writeSize
+		s.mu.Unlock()
+		if err := inst.Command("*RST"); KindOf(err) != ErrorKindProtocol {
+			t.Errorf("expected a protocol error, got %v", err)
+		}
+	}
+}
+
+func TestVxi11ConcurrentQueries(t *testing.T) {
+	_, inst := connectFakeVxi11(t)
+	var wg sync.WaitGroup
+	for g := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 10 {
+				query := fmt.Sprintf(":ECHO%d:VALue%d?", g, n)
+				if res, err := inst.Query(query); err != nil || res != query+"\n" {
+					t.Errorf("expected %s to get its own response, got %q %v", query, res, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReadRpcRecordRejectsOversizedRecords(t *testing.T) {
+	// Two fragments that are each allowed but together exceed the maximum
+	var b bytes.Buffer
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, rpcMaxRecordSize)
+	b.Write(header)
+	b.Write(make([]byte, rpcMaxRecordSize))
+	binary.BigEndian.PutUint32(header, rpcLastFragmentFlag|1)
+	b.Write(header)
+	b.WriteByte(0)
+	if _, err := readRpcRecord(&b); KindOf(err) != ErrorKindProtocol {
+		t.Errorf("expected a protocol error, got %v", err)
+	}
+
+	binary.BigEndian.PutUint32(header, rpcLastFragmentFlag|0x7fffffff)
+	if _, err := readRpcRecord(bytes.NewReader(header)); KindOf(err) != ErrorKindProtocol {
+		t.Errorf("expected a protocol error without allocating the claimed size, got %v", err)
+	}
+}
+
+func TestVxi11QueryError(t *testing.T) {
+	_, inst := connectFakeVxi11(t)
+	errors, err := inst.QueryError(ErrorQueueOptions{})
+	if err != nil {
+		t.Fatalf("QueryError failed: %v", err)
+	}
+	if len(errors) != 0 {
+		t.Errorf("expected no errors, got %v", errors)
+	}
+}
+
+func TestVxi11GetSupportedCommandsTree(t *testing.T) {
+	_, inst := connectFakeVxi11(t)
+	starTree, colonTree, err := inst.GetSupportedCommandsTree()
+	if err != nil {
+		t.Fatalf("GetSupportedCommandsTree failed: %v", err)
+	}
+	if len(starTree.Children) != 1 || starTree.Children[0].Content.Text != "*IDN?" {
+		t.Errorf("unexpected star tree %v", starTree)
+	}
+	if len(colonTree.Children) != 4 {
+		t.Errorf("unexpected colon tree %v", colonTree)
+	}
+}
+
+func TestVxi11Events(t *testing.T) {
+	s, inst := connectFakeVxi11(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := inst.(EventSource).Events(ctx)
+	if err != nil {
+		t.Fatalf("Events failed: %v", err)
+	}
+	s.mu.Lock()
+	if !s.srqEnabled || s.intrAddress == "" {
+		t.Errorf("expected an interrupt channel with SRQ enabled, got %q %v", s.intrAddress, s.srqEnabled)
+	}
+	s.mu.Unlock()
+
+	if err := s.requestService(0x50); err != nil {
+		t.Fatalf("requestService failed: %v", err)
+	}
+	select {
+	case event := <-events:
+		if event.StatusByte != 0x50 || !event.ServiceRequest {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an event for the service request")
+	}
+
+	cancel()
+	for range events {
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srqEnabled || s.intrAddress != "" {
+		t.Errorf("expected the interrupt channel to be torn down, got %q %v", s.intrAddress, s.srqEnabled)
+	}
+}
+
+func TestVxi11Lock(t *testing.T) {
+	s, inst := connectFakeVxi11(t)
+	other := NewVxi11Instrument("", Framing{}, time.Second, false)
+	if err := other.Connect(s.listener.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer other.Close()
+
+	if err := inst.(Locker).Lock(time.Second); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+	if err := other.(Locker).Lock(time.Second); !errors.Is(err, ErrLocked) {
+		t.Errorf("expected the second link to find the device locked, got %v", err)
+	}
+	if err := inst.(Locker).Unlock(); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := other.(Locker).Lock(time.Second); err != nil {
+		t.Errorf("expected the released lock to be available, got %v", err)
+	}
+	if err := inst.(Locker).Unlock(); err == nil {
+		t.Error("expected unlocking without holding the lock to fail")
+	}
+}
@@ -49,6 +49,7 @@ import {
 import { MatProgressBarModule } from '@angular/material/progress-bar';
 import { SyntaxHighlightPipe } from './syntax-highlight/syntax-highlight.pipe';
 import { ConnectionService } from '../services/connection.service';
+import { LockService } from '../services/lock.service';
 
 @Component({
   selector: 'app-root',
@@ -78,6 +79,7 @@ import { ConnectionService } from '../services/connection.service';
 })
 export class App {
   public connection = inject(ConnectionService);
+  public lock = inject(LockService);
 
   public inputText = signal('');
   public scriptedLog: WritableSignal<LogEntry[]> = signal([]);
@@ -338,6 +340,7 @@ export class App {
       params: {
         port: this.preferences.port(),
         address: this.preferences.address(),
+        lockToken: this.lock.token(),
       },
     };
   });
@@ -564,35 +567,47 @@ export class App {
       timeoutSeconds: this.preferences.timeoutSeconds(),
       port: this.preferences.port(),
       address: this.preferences.address(),
+      lockToken: this.lock.token(),
       scriptSource: this.scriptRunning() && this.scriptSource() === 'file' ? this.scriptFileName() : this.scriptRunning() ? 'clipboard' : '',
     };
 
     return new Promise<void>((resolve) => {
+      const logResponse = (x: ScpiResponse) => {
+        const response = type === 'query' ? x.response : undefined;
+        this.log.update((log) => {
+          const clone = structuredClone(log); // Can't modify existing log, have to write a new one, otherwise signals don't work
+          const lastElement = clone[clone.length - 1];
+          lastElement.response = (response ? response : x.serverError).trim();
+          lastElement.isServerError = !response;
+          lastElement.elapsed = Date.now() - time;
+          for (const error of x.errors ?? []) {
+            clone.push({
+              type: 'query',
+              scpi: ':SYST:ERR?',
+              response: `${error.code},"${error.message}${error.info ? `;${error.info}` : ''}"`,
+              uniqueId: crypto.randomUUID(),
+              time,
+              hideTime: true,
+              isServerError: false,
+            });
+          }
+          return clone;
+        });
+      };
+
       this.http.post<ScpiResponse>('/api/scpi', scpi, { params, responseType: 'json' }).subscribe({
         next: (x) => {
-          const response = type === 'query' ? x.response : undefined;
-          this.log.update((log) => {
-            const clone = structuredClone(log); // Can't modify existing log, have to write a new one, otherwise signals don't work
-            const lastElement = clone[clone.length - 1];
-            lastElement.response = (response ? response : x.serverError).trim();
-            lastElement.isServerError = !response;
-            lastElement.elapsed = Date.now() - time;
-            for (const error of x.errors ?? []) {
-              clone.push({
-                type: 'query',
-                scpi: ':SYST:ERR?',
-                response: error,
-                uniqueId: crypto.randomUUID(),
-                time,
-                hideTime: true,
-                isServerError: false,
-              });
-            }
-            return clone;
-          });
+          logResponse(x);
           resolve();
         },
         error: (x) => {
+          // Instrument failures still carry a ScpiResponse, with an HTTP status matching its errorKind
+          if (x.error?.errorKind) {
+            logResponse(x.error);
+            this.snackBar.open(x.error.serverError, 'Close', { duration: 5000 });
+            resolve();
+            return;
+          }
           this.log.update((log) => {
             const clone = structuredClone(log); // Can't modify existing log, have to write a new one, otherwise signals don't work
             const lastElement = clone[clone.length - 1];
@@ -679,6 +694,19 @@ export class App {
     }
   }
 
+  public async toggleLock() {
+    try {
+      if (this.lock.heldByMe()) {
+        await this.lock.release();
+      } else {
+        await this.lock.acquire();
+      }
+    } catch (x: any) {
+      const message = x.error?.owner ? `Instrument is locked by ${x.error.owner}` : x.error ?? x.message;
+      this.snackBar.open(message, 'Close', { duration: 5000 });
+    }
+  }
+
   public async systErr() {
     await this.sendInteractiveInternal(':SYST:ERR?');
   }
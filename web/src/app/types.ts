@@ -10,10 +10,27 @@ export interface LogEntry {
   minimized?: boolean;
 }
 
+export interface ScpiError {
+  code: number;
+  message: string;
+  info?: string;
+}
+
 export interface ScpiResponse {
   response: string;
-  errors: string[];
+  data?: number[];
+  errors: ScpiError[];
   serverError: string;
+  errorKind?: 'timeout' | 'connectionLost' | 'protocol' | 'instrument' | 'canceled' | 'locked' | 'other';
+}
+
+export interface InstrumentLock {
+  locked: boolean;
+  owner?: string;
+  token?: string;
+  acquired?: string;
+  expires?: string;
+  native?: boolean;
 }
 
 export type ConnectionMode = 'server-default' | 'per-client';
@@ -22,6 +39,19 @@ export interface HealthResponse {
   healthy: boolean;
   version: string;
   connectionMode: ConnectionMode;
+  connections: ConnectionStatus[];
+}
+
+export type ConnectionState = 'disconnected' | 'connected' | 'reconnecting' | 'down';
+
+export interface ConnectionStatus {
+  resource: string;
+  connected: boolean;
+  state: ConnectionState;
+  since?: string;
+  lastError?: string;
+  failures?: number;
+  nextAttempt?: string;
 }
 
 export interface IDN {
@@ -1,8 +1,9 @@
 import { computed, effect, Injectable, signal } from '@angular/core';
 import { LocalStorageService } from './localStorage.service';
-import { httpResource } from '@angular/common/http';
+import { HttpClient, httpResource } from '@angular/common/http';
 import { PreferencesService } from './preferences.service';
 import { toObservable } from '@angular/core/rxjs-interop';
+import { ConnectionStatus } from '../app/types';
 
 @Injectable({
   providedIn: 'root'
@@ -12,10 +13,18 @@ export class ConnectionService {
   public desiredPerClientConnected$ = toObservable(this.desiredPerClientConnected);
 
   public perClientConnected = computed(() => {
-    return this.desiredPerClientConnected() && this.backendConfirmsConnected.hasValue() && this.backendConfirmsConnected.value();
+    return this.desiredPerClientConnected() && this.backendConfirmsConnected.hasValue() && this.backendConfirmsConnected.value().connected;
   });
 
-  public backendConfirmsConnected = httpResource<boolean>(() => {
+  // Reconnecting or down, as tracked by the server, while the client wants to be connected
+  public perClientStatus = computed(() => {
+    if (!this.desiredPerClientConnected() || !this.backendConfirmsConnected.hasValue()) {
+      return undefined;
+    }
+    return this.backendConfirmsConnected.value();
+  });
+
+  public backendConfirmsConnected = httpResource<ConnectionStatus>(() => {
     if (!this.desiredPerClientConnected() || this.preferences.perClientPort() === 0 || this.preferences.perClientAddress() === '') {
       return undefined;
     }
@@ -27,16 +36,24 @@ export class ConnectionService {
         port: this.preferences.perClientPort(),
         address: this.preferences.perClientAddress(),
         timeoutSeconds: this.preferences.timeoutSeconds(),
+        detail: true,
       },
     };
   });
 
   constructor(
     localStorageService: LocalStorageService,
-    private preferences: PreferencesService
+    private preferences: PreferencesService,
+    private http: HttpClient,
   ) {
     localStorageService.setFromStorage('desiredPerClientConnected', this.desiredPerClientConnected);
     effect(() => localStorageService.setItem('desiredPerClientConnected', this.desiredPerClientConnected()));
+    // The server tracks the connection state, so polling it does not send anything to the instrument
+    setInterval(() => {
+      if (this.desiredPerClientConnected()) {
+        this.backendConfirmsConnected.reload();
+      }
+    }, 5000);
   }
 
   public perClientConnect() {
@@ -47,5 +64,15 @@ export class ConnectionService {
 
   public perClientDisconnect() {
     this.desiredPerClientConnected.set(false);
+    // Close the server's connection too, as many instruments accept a single socket client. A locked or already
+    // closed connection is left as it is.
+    this.http.post('/api/disconnect', null, {
+      params: {
+        simulated: this.preferences.simulated(),
+        port: this.preferences.perClientPort(),
+        address: this.preferences.perClientAddress(),
+      },
+      responseType: 'text',
+    }).subscribe({ error: () => {} });
   }
 }
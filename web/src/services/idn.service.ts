@@ -3,6 +3,7 @@ import { computed, Injectable, Signal } from '@angular/core';
 import { IDN, ScpiResponse } from '../app/types';
 import { PreferencesService } from './preferences.service';
 import { ConnectionService } from './connection.service';
+import { LockService } from './lock.service';
 
 @Injectable({providedIn: 'root'})
 export class IdnService {
@@ -19,7 +20,8 @@ export class IdnService {
         port: this.preferences.port(),
         address: this.preferences.address(),
         timeoutSeconds: this.preferences.timeoutSeconds(),
-        autoSystErr: false
+        autoSystErr: false,
+        lockToken: this.lock.token(),
       },
     };
   });
@@ -55,6 +57,7 @@ export class IdnService {
   constructor(
     private preferences: PreferencesService,
     private connection: ConnectionService,
+    private lock: LockService,
   ){
     setInterval(() => {
       if (!this.idn.hasValue() || this.idn.value().response === "") {
@@ -0,0 +1,96 @@
+import { HttpClient, httpResource } from '@angular/common/http';
+import { computed, effect, Injectable, signal } from '@angular/core';
+import { firstValueFrom } from 'rxjs';
+import { InstrumentLock } from '../app/types';
+import { ConnectionService } from './connection.service';
+import { LocalStorageService } from './localStorage.service';
+import { PreferencesService } from './preferences.service';
+
+const leaseSeconds = 60;
+
+@Injectable({ providedIn: 'root' })
+export class LockService {
+  // Token of the lock held by this client, kept across reloads so the lock is not orphaned until its lease runs out
+  public token = signal('');
+
+  public lock = httpResource<InstrumentLock>(() => {
+    if (!this.connection.perClientConnected() || this.preferences.port() === 0 || this.preferences.address() === '') {
+      return undefined;
+    }
+    return {
+      url: '/api/lock',
+      method: 'GET',
+      params: this.instrumentParams(),
+    };
+  });
+
+  public locked = computed(() => this.lock.hasValue() && this.lock.value().locked);
+  public heldByMe = computed(() => this.locked() && this.token() !== '');
+  public heldByOther = computed(() => this.locked() && this.token() === '');
+
+  constructor(
+    private http: HttpClient,
+    private preferences: PreferencesService,
+    private connection: ConnectionService,
+    localStorageService: LocalStorageService,
+  ) {
+    localStorageService.setFromStorage('lockToken', this.token);
+    effect(() => localStorageService.setItem('lockToken', this.token()));
+
+    effect(() => {
+      // The lease ran out or someone released the lock on our behalf
+      if (this.lock.hasValue() && !this.lock.value().locked) {
+        this.token.set('');
+      }
+    });
+
+    setInterval(() => this.lock.reload(), 5000);
+    setInterval(() => {
+      if (this.token() !== '') {
+        this.renew();
+      }
+    }, (leaseSeconds * 1000) / 3);
+  }
+
+  private instrumentParams() {
+    return {
+      simulated: this.preferences.simulated(),
+      port: this.preferences.port(),
+      address: this.preferences.address(),
+    };
+  }
+
+  public async acquire() {
+    try {
+      const lock = await firstValueFrom(
+        this.http.post<InstrumentLock>('/api/lock', null, { params: { ...this.instrumentParams(), leaseSeconds } })
+      );
+      this.token.set(lock.token ?? '');
+    } finally {
+      this.lock.reload();
+    }
+  }
+
+  public async release() {
+    try {
+      await firstValueFrom(
+        this.http.delete('/api/lock', { params: { ...this.instrumentParams(), token: this.token() }, responseType: 'text' })
+      );
+    } finally {
+      this.token.set('');
+      this.lock.reload();
+    }
+  }
+
+  private async renew() {
+    try {
+      await firstValueFrom(
+        this.http.post<InstrumentLock>('/api/lock', null, { params: { ...this.instrumentParams(), leaseSeconds, token: this.token() } })
+      );
+    } catch {
+      // 409: the lock expired before it was renewed
+      this.token.set('');
+      this.lock.reload();
+    }
+  }
+}